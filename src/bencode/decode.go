@@ -17,6 +17,15 @@ func (de *DecoderError) Error() string {
 // Public =====================================================================
 
 func Decode(data []byte) (ret interface{}, err error) {
+	ret, _, err = DecodePrefix(data)
+	return ret, err
+}
+
+// DecodePrefix decodes the bencoded value at the start of data, and also
+// returns the number of bytes it took up. Anything after the value is left
+// alone, which is needed for messages that append raw data to a bencoded
+// dictionary (e.g. BEP_0009 metadata pieces).
+func DecodePrefix(data []byte) (ret interface{}, n int, err error) {
 
 	dc := decoder{data: data, curs: 0}
 
@@ -29,6 +38,7 @@ func Decode(data []byte) (ret interface{}, err error) {
 				err = &DecoderError{"caught panic"}
 			}
 			ret = nil
+			n = 0
 		}
 	}()
 
@@ -45,7 +55,7 @@ func Decode(data []byte) (ret interface{}, err error) {
 		ret, err = dc.decodeString()
 	}
 
-	return ret, err
+	return ret, int(dc.curs), err
 }
 
 // ============================================================================
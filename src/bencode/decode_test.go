@@ -23,6 +23,29 @@ func TestDecode(t *testing.T) {
 
 }
 
+func TestDecodePrefix(t *testing.T) {
+	tests := []struct {
+		data string
+		n    int
+	}{
+		{"d8:msg_typei1e5:piecei0eeRAW DATA", 25},
+		{"i42e", 4},
+		{"4:spamXX", 6},
+		{"l1:ae", 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.data, func(t *testing.T) {
+			_, n, err := DecodePrefix([]byte(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.n {
+				t.Errorf("read %v bytes, expected %v", n, tt.n)
+			}
+		})
+	}
+}
+
 func TestDecodeString(t *testing.T) {
 	// Test good strings
 	words := []string{
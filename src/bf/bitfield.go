@@ -2,6 +2,7 @@ package bf
 
 import (
 	"fmt"
+	"sync"
 )
 
 // Bitfield is fairly self-explanatory, aside from the data5 field. Rather than
@@ -9,12 +10,17 @@ import (
 // (4 bytes) and id (1 byte) of a bitfield message. This is so we are not
 // wasting time prepending 5 bytes to a potentially long slice every time we need
 // to send a bitfield message.
+//
+// Bits may be read and set from many goroutines at once. The slices returned
+// by Data and Data5 are not guarded, so bitfields that are still being set
+// should be cloned first.
 type Bitfield struct {
 	data5  []byte // Holds the first 5 bytes + bitfield data
 	data   []byte // Holds only the bitfield data
 	nbytes int64
 	nbits  int64
 	nset   int64
+	mutex  sync.RWMutex // Guards data5, data, nbits and nset
 }
 
 func NewBitfield(nbits int64) *Bitfield {
@@ -100,7 +106,25 @@ func (bf *Bitfield) calcNset() {
 	bf.nset = nset
 }
 
+// Clone returns a copy of the bitfield.
+func (bf *Bitfield) Clone() *Bitfield {
+	bf.mutex.RLock()
+	defer bf.mutex.RUnlock()
+
+	data5 := make([]byte, len(bf.data5))
+	copy(data5, bf.data5)
+	return &Bitfield{
+		data5:  data5,
+		data:   data5[5:],
+		nbits:  bf.nbits,
+		nbytes: bf.nbytes,
+		nset:   bf.nset,
+	}
+}
+
 func (bf *Bitfield) Fill() {
+	bf.mutex.Lock()
+	defer bf.mutex.Unlock()
 	for i, _ := range bf.data5 {
 		bf.data5[i] = 255
 	}
@@ -108,6 +132,9 @@ func (bf *Bitfield) Fill() {
 }
 
 func (bf *Bitfield) Get(idx int64) bool {
+	bf.mutex.RLock()
+	defer bf.mutex.RUnlock()
+
 	maj := idx / 8
 	min := idx % 8
 	mask := uint8(128) >> min
@@ -117,6 +144,9 @@ func (bf *Bitfield) Get(idx int64) bool {
 }
 
 func (bf *Bitfield) Set(idx int64, val bool) {
+	bf.mutex.Lock()
+	defer bf.mutex.Unlock()
+
 	maj := idx / 8
 	min := idx % 8
 	getMask := uint8(128) >> min
@@ -144,10 +174,14 @@ func (bf *Bitfield) Data() []byte {
 }
 
 func (bf *Bitfield) Complete() bool {
+	bf.mutex.RLock()
+	defer bf.mutex.RUnlock()
 	return bf.nset == bf.nbits
 }
 
 func (bf *Bitfield) Nbits() int64 {
+	bf.mutex.RLock()
+	defer bf.mutex.RUnlock()
 	return bf.nbits
 }
 
@@ -156,12 +190,17 @@ func (bf *Bitfield) Nbytes() int64 {
 }
 
 func (bf *Bitfield) Nset() int64 {
+	bf.mutex.RLock()
+	defer bf.mutex.RUnlock()
 	return bf.nset
 }
 
 // 00000000 00000000 00000xxx
 
 func (bf *Bitfield) SetNbits(nbits int64) {
+	bf.mutex.Lock()
+	defer bf.mutex.Unlock()
+
 	if nbits < (bf.nbytes-1)*8 || nbits > (bf.nbytes)*8 {
 		panic("cannot set nbits such that nbytes would change")
 	}
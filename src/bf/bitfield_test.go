@@ -1,6 +1,7 @@
 package bf
 
 import (
+	"sync"
 	"testing"
 )
 
@@ -112,3 +113,53 @@ func TestSet(t *testing.T) {
 		})
 	}
 }
+
+func TestConcurrent(t *testing.T) {
+	bf := NewBitfield(64)
+	done := make(chan struct{})
+
+	// Readers race the writers, the race detector complains if they aren't
+	// guarded
+	for r := 0; r < 4; r++ {
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					bf.Get(7)
+					bf.Complete()
+					bf.Clone()
+				}
+			}
+		}()
+	}
+
+	wg := sync.WaitGroup{}
+	for w := int64(0); w < 4; w++ {
+		wg.Add(1)
+		go func(w int64) {
+			defer wg.Done()
+			for i := w; i < 64; i += 4 {
+				bf.Set(i, true)
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(done)
+
+	if !bf.Complete() || bf.Nset() != 64 {
+		t.Errorf("expected every bit set, got %v", bf.Nset())
+	}
+}
+
+func TestClone(t *testing.T) {
+	bf := NewBitfield(10)
+	bf.Set(3, true)
+	clone := bf.Clone()
+	bf.Set(4, true)
+
+	if !clone.Get(3) || clone.Get(4) || clone.Nset() != 1 || clone.Nbits() != 10 {
+		t.Errorf("clone changed with the original, or lost bits")
+	}
+}
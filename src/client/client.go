@@ -0,0 +1,126 @@
+/* client.go ==================================================================
+Runs torrents from other Go programs. Unlike the command line, it never
+touches flags or exits the process: everything is set up through Config, and
+every failure is returned as an error. Every torrent of a Client shares one
+port, one rate limiter and one peer ID.
+
+	c, e := client.New(client.DefaultConfig())
+	t, e := c.Add(ctx, "file.torrent")
+	p := t.Progress()
+	e = c.Close(ctx)
+============================================================================ */
+
+package client
+
+import (
+	"context"
+	"time"
+
+	"gotor/swarm"
+)
+
+// loadStopTimeout is how long we wait for peers and trackers when dropping
+// a torrent that finished loading after Add gave up on it.
+const loadStopTimeout = 30 * time.Second
+
+// ============================================================================
+// STRUCTS ====================================================================
+
+// Client runs any number of torrents.
+type Client struct {
+	cfg     Config
+	session *swarm.Session
+}
+
+// ============================================================================
+// FUNK =======================================================================
+
+// New checks the config and starts listening for peers.
+func New(cfg Config) (*Client, error) {
+	e := cfg.Validate()
+	if e != nil {
+		return nil, e
+	}
+
+	session, e := swarm.NewSession(cfg.sessionConfig())
+	if e != nil {
+		return nil, e
+	}
+	return &Client{cfg: cfg, session: session}, nil
+}
+
+// Add loads a torrent from a .torrent file or magnet link and starts it.
+// Magnet links need the metadata from peers first, which may take a while.
+// If ctx is done first, Add returns ctx's error, and stops checking the
+// files or fetching the metadata right away.
+func (c *Client) Add(ctx context.Context, input string) (*Torrent, error) {
+	if e := ctx.Err(); e != nil {
+		return nil, e
+	}
+
+	type result struct {
+		s *swarm.Swarm
+		e error
+	}
+	chResult := make(chan result, 1)
+	go func() {
+		s, e := c.session.Add(ctx, input, c.cfg.DataDir)
+		chResult <- result{s, e}
+	}()
+
+	select {
+	case r := <-chResult:
+		if r.e != nil {
+			return nil, r.e
+		}
+		return &Torrent{c: c, s: r.s}, nil
+	case <-ctx.Done():
+		go func() {
+			r := <-chResult
+			if r.e != nil {
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), loadStopTimeout)
+			defer cancel()
+			_ = c.session.Remove(ctx, r.s.Tor.Infohash())
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// Torrent returns the torrent with the given infohash, or nil if the client
+// doesn't have it.
+func (c *Client) Torrent(infohash string) *Torrent {
+	s := c.session.Swarm(infohash)
+	if s == nil {
+		return nil
+	}
+	return &Torrent{c: c, s: s}
+}
+
+// Torrents returns every torrent of the client.
+func (c *Client) Torrents() []*Torrent {
+	swarms := c.session.Swarms()
+	torrents := make([]*Torrent, 0, len(swarms))
+	for _, s := range swarms {
+		torrents = append(torrents, &Torrent{c: c, s: s})
+	}
+	return torrents
+}
+
+// Port returns the port we listen on.
+func (c *Client) Port() uint16 {
+	return c.session.Port
+}
+
+// PeerId returns the peer ID every torrent uses.
+func (c *Client) PeerId() string {
+	return c.session.Id
+}
+
+// Close stops every torrent, then stops listening. If ctx is done before
+// the peers and trackers are, Close stops waiting for them and returns
+// ctx's error, but files and sockets are closed regardless.
+func (c *Client) Close(ctx context.Context) error {
+	return c.session.Close(ctx)
+}
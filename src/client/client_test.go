@@ -0,0 +1,74 @@
+package client
+
+import (
+	"context"
+	"testing"
+
+	"gotor/utils/test"
+)
+
+// newTestClient makes a client on a free port without any peer sources.
+func newTestClient(t *testing.T) *Client {
+	cfg := DefaultConfig()
+	cfg.Port = 0
+	cfg.UTP = false
+	cfg.DHTStatePath = ""
+	cfg.ResumeDir = ""
+	c, e := New(cfg)
+	test.CheckFatal(t, e)
+	t.Cleanup(func() {
+		c.Close(context.Background())
+	})
+	return c
+}
+
+func TestNew(t *testing.T) {
+	c := newTestClient(t)
+	if c.Port() == 0 {
+		t.Error("expected a port to be picked")
+	}
+	if len(c.PeerId()) != 20 {
+		t.Errorf("bad peer id %q", c.PeerId())
+	}
+
+	cfg := DefaultConfig()
+	cfg.MaxConns = 0
+	if _, e := New(cfg); e == nil {
+		t.Error("expected an invalid config to be refused")
+	}
+}
+
+func TestClient_Add(t *testing.T) {
+	c := newTestClient(t)
+
+	if _, e := c.Add(context.Background(), "does-not-exist.torrent"); e == nil {
+		t.Error("expected an error for a missing torrent file")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, e := c.Add(ctx, "does-not-exist.torrent"); e != context.Canceled {
+		t.Errorf("expected a cancelled add to fail with %v, got %v", context.Canceled, e)
+	}
+
+	if len(c.Torrents()) != 0 || c.Torrent("unknown-infohash-000") != nil {
+		t.Error("expected no torrents")
+	}
+}
+
+func TestProgress(t *testing.T) {
+	tests := []struct {
+		p        Progress
+		fraction float64
+		complete bool
+	}{
+		{Progress{}, 0, false},
+		{Progress{Pieces: 4, PiecesDone: 1}, 0.25, false},
+		{Progress{Pieces: 4, PiecesDone: 4}, 1, true},
+	}
+	for _, tt := range tests {
+		if tt.p.Fraction() != tt.fraction || tt.p.Complete() != tt.complete {
+			t.Errorf("%+v: got %v and %v, want %v and %v", tt.p, tt.p.Fraction(), tt.p.Complete(), tt.fraction, tt.complete)
+		}
+	}
+}
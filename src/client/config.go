@@ -0,0 +1,97 @@
+package client
+
+import (
+	"fmt"
+
+	"gotor/io"
+	"gotor/mse"
+	"gotor/swarm"
+	"gotor/torrent/storage"
+)
+
+// Config is everything a Client needs to run. Start from DefaultConfig, the
+// zero value is not valid.
+type Config struct {
+	DataDir    string     // Where torrent data is stored, "" for the working directory
+	Port       uint16     // Listen port for TCP and uTP, 0 picks a free one
+	Encryption mse.Policy // Protocol encryption policy
+	MaxConns   int        // Connection limit across every torrent
+	MaxPeers   int        // Connection limit per torrent
+	UpLimit    int64      // Upload limit in bytes / sec, io.NoLimit for none
+	DnLimit    int64      // Download limit in bytes / sec, io.NoLimit for none
+	UTP        bool       // Connect to peers over uTP, falling back to TCP
+	DHT        bool       // Find peers through the DHT
+	LSD        bool       // Find peers on the local network
+
+	// DHTStatePath is where the DHT routing table is saved between runs, ""
+	// to not save it.
+	DHTStatePath string
+
+	// ResumeDir is where resume files are saved, "" to check every piece on
+	// every start.
+	ResumeDir string
+
+	// VerifyWorkers is how many pieces are hashed at once when checking
+	// files, < 1 for one per CPU.
+	VerifyWorkers int
+
+	// Storage makes the storage of every torrent, nil to store torrents in
+	// their files in DataDir.
+	Storage storage.Factory
+}
+
+// DefaultConfig returns the same defaults as the command line.
+func DefaultConfig() Config {
+	return Config{
+		Port:         60666,
+		Encryption:   mse.Prefer,
+		MaxConns:     swarm.DefaultMaxConns,
+		MaxPeers:     swarm.DefaultMaxPeers,
+		UpLimit:      io.NoLimit,
+		DnLimit:      io.NoLimit,
+		UTP:          true,
+		DHTStatePath: swarm.DefaultDHTStatePath(),
+		ResumeDir:    swarm.DefaultResumeDir(),
+	}
+}
+
+// Validate returns an error if the config can't be used.
+func (cfg *Config) Validate() error {
+	switch cfg.Encryption {
+	case mse.Disabled, mse.Prefer, mse.Require:
+	default:
+		return fmt.Errorf("invalid encryption policy %v", cfg.Encryption)
+	}
+	if cfg.MaxConns < 1 {
+		return fmt.Errorf("connection limit must be at least 1, got %v", cfg.MaxConns)
+	}
+	if cfg.MaxPeers < 1 {
+		return fmt.Errorf("per torrent connection limit must be at least 1, got %v", cfg.MaxPeers)
+	}
+	if cfg.UpLimit < io.NoLimit {
+		return fmt.Errorf("invalid upload limit %v", cfg.UpLimit)
+	}
+	if cfg.DnLimit < io.NoLimit {
+		return fmt.Errorf("invalid download limit %v", cfg.DnLimit)
+	}
+	return nil
+}
+
+// sessionConfig returns the part of the config the session needs.
+func (cfg *Config) sessionConfig() swarm.SessionConfig {
+	return swarm.SessionConfig{
+		Port:          cfg.Port,
+		Encryption:    cfg.Encryption,
+		MaxConns:      cfg.MaxConns,
+		MaxPeers:      cfg.MaxPeers,
+		UpLimit:       cfg.UpLimit,
+		DnLimit:       cfg.DnLimit,
+		UTP:           cfg.UTP,
+		DHT:           cfg.DHT,
+		LSD:           cfg.LSD,
+		DHTStatePath:  cfg.DHTStatePath,
+		ResumeDir:     cfg.ResumeDir,
+		VerifyWorkers: cfg.VerifyWorkers,
+		Storage:       cfg.Storage,
+	}
+}
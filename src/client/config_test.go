@@ -0,0 +1,38 @@
+package client
+
+import (
+	"testing"
+
+	"gotor/mse"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name  string
+		edit  func(cfg *Config)
+		valid bool
+	}{
+		{name: "Default", edit: func(cfg *Config) {}, valid: true},
+		{name: "Free port", edit: func(cfg *Config) { cfg.Port = 0 }, valid: true},
+		{name: "Encryption", edit: func(cfg *Config) { cfg.Encryption = mse.Policy(7) }},
+		{name: "MaxConns", edit: func(cfg *Config) { cfg.MaxConns = 0 }},
+		{name: "MaxPeers", edit: func(cfg *Config) { cfg.MaxPeers = -1 }},
+		{name: "Many peers", edit: func(cfg *Config) { cfg.MaxPeers = 1000 }, valid: true},
+		{name: "UpLimit", edit: func(cfg *Config) { cfg.UpLimit = -2 }},
+		{name: "DnLimit", edit: func(cfg *Config) { cfg.DnLimit = -2 }},
+		{name: "Zero value", edit: func(cfg *Config) { *cfg = Config{} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tt.edit(&cfg)
+			e := cfg.Validate()
+			if tt.valid && e != nil {
+				t.Errorf("expected valid config, got %v", e)
+			}
+			if !tt.valid && e == nil {
+				t.Errorf("expected invalid config")
+			}
+		})
+	}
+}
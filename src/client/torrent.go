@@ -0,0 +1,128 @@
+package client
+
+import (
+	"context"
+	"encoding/hex"
+
+	"gotor/swarm"
+)
+
+// State is what a torrent is doing.
+type State int
+
+const (
+	Running State = iota // Connected to peers
+	Paused               // Disconnected, but can be resumed
+	Removed              // Stopped and removed from the client
+)
+
+func (st State) String() string {
+	switch st {
+	case Running:
+		return "running"
+	case Paused:
+		return "paused"
+	case Removed:
+		return "removed"
+	}
+	return "unknown"
+}
+
+// ============================================================================
+// STRUCTS ====================================================================
+
+// Torrent is a torrent run by a Client.
+type Torrent struct {
+	c *Client
+	s *swarm.Swarm
+}
+
+// Progress is a snapshot of how far along a torrent is.
+type Progress struct {
+	State      State
+	Pieces     int64  // Pieces in the torrent
+	PiecesDone int64  // Pieces we have and have verified
+	Length     int64  // Bytes in the torrent
+	Left       uint64 // Bytes we still need
+	Downloaded uint64 // Bytes ever downloaded, kept across runs by the resume file
+	Uploaded   uint64 // Bytes ever uploaded, kept across runs by the resume file
+	Peers      int    // Connected peers
+}
+
+// ============================================================================
+// TORRENT ====================================================================
+
+// Name returns the torrent's name.
+func (t *Torrent) Name() string {
+	return t.s.Tor.Info().Name()
+}
+
+// Infohash returns the torrent's 20 byte infohash.
+func (t *Torrent) Infohash() string {
+	return t.s.Tor.Infohash()
+}
+
+// InfohashHex returns the torrent's infohash in hex, as shown in magnet
+// links.
+func (t *Torrent) InfohashHex() string {
+	return hex.EncodeToString([]byte(t.Infohash()))
+}
+
+// Progress returns the torrent's current progress.
+func (t *Torrent) Progress() Progress {
+	p := Progress{
+		State:      t.State(),
+		Length:     t.s.Tor.Info().Length(),
+		Left:       t.s.Stats.Left(),
+		Downloaded: t.s.Stats.Dnloaded(),
+		Uploaded:   t.s.Stats.Uploaded(),
+		Peers:      len(t.s.Handlers()),
+	}
+	p.PiecesDone, p.Pieces = t.s.Pieces()
+	return p
+}
+
+// State returns what the torrent is doing.
+func (t *Torrent) State() State {
+	if t.s.Stopped() {
+		return Removed
+	}
+	if t.s.Running() {
+		return Running
+	}
+	return Paused
+}
+
+// Pause disconnects the torrent from its peers until Resume is called. If
+// ctx is done before the peers and trackers are, Pause stops waiting for
+// them and returns ctx's error.
+func (t *Torrent) Pause(ctx context.Context) error {
+	return t.s.Pause(ctx)
+}
+
+// Resume starts a paused torrent again.
+func (t *Torrent) Resume() error {
+	return t.s.Start()
+}
+
+// Remove stops the torrent and removes it from the client. The downloaded
+// files are kept.
+func (t *Torrent) Remove(ctx context.Context) error {
+	return t.c.session.Remove(ctx, t.Infohash())
+}
+
+// ============================================================================
+// PROGRESS ===================================================================
+
+// Fraction returns how much of the torrent we have, from 0 to 1.
+func (p Progress) Fraction() float64 {
+	if p.Pieces == 0 {
+		return 0
+	}
+	return float64(p.PiecesDone) / float64(p.Pieces)
+}
+
+// Complete returns true if we have every piece.
+func (p Progress) Complete() bool {
+	return p.Pieces > 0 && p.PiecesDone == p.Pieces
+}
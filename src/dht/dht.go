@@ -0,0 +1,676 @@
+/* dht.go =====================================================================
+A mainline DHT node (BEP_0005). The node answers ping, find_node, get_peers
+and announce_peer queries from other nodes, and can look up and announce
+torrents itself. Lookups are iterative: the closest known nodes to the target
+are queried alpha at a time, and any closer nodes they return are queried in
+turn, until the K closest nodes have all been asked.
+============================================================================ */
+
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"gotor/bencode"
+	"gotor/peer"
+)
+
+const (
+	// alpha is the number of queries sent in parallel during a lookup
+	alpha = 3
+
+	// RefreshInterval is how often the node looks itself up to keep its
+	// routing table fresh.
+	RefreshInterval = 15 * time.Minute
+
+	// maxPacket is larger than any KRPC message we expect
+	maxPacket = 4096
+)
+
+// readRetry is how long serve waits after a failed read before trying again.
+const readRetry = 100 * time.Millisecond
+
+// queryTimeout is how long to wait for a response to a query. This is a
+// variable so that tests can shorten it.
+var queryTimeout = 5 * time.Second
+
+// DefaultBootstrap are well known nodes used to join the DHT.
+var DefaultBootstrap = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// ============================================================================
+// STRUCTS ====================================================================
+
+type DHT struct {
+	id        NodeID
+	conn      net.PacketConn
+	table     *table
+	tokens    *tokenManager
+	store     *peerStore
+	statePath string // Where the routing table is saved, "" to not save
+
+	pending map[string]pendingQuery // Outstanding queries by transaction ID
+	tid     uint16                  // Next transaction ID
+	pmutex  sync.Mutex              // Guards pending and tid
+
+	chDone    chan struct{}
+	closeOnce sync.Once
+	procs     sync.WaitGroup
+}
+
+type pendingQuery struct {
+	addr string
+	ch   chan *message
+}
+
+// lookupResult is everything learned during a lookup.
+type lookupResult struct {
+	peers  peer.List         // Peers returned by get_peers
+	nodes  []contact         // Closest nodes that responded, closest first
+	tokens map[NodeID]string // Tokens returned by get_peers, by node
+}
+
+// ============================================================================
+// FUNK =======================================================================
+
+// New starts a DHT node listening on the given UDP address. If statePath is
+// not empty and holds a routing table saved by an earlier node, the node ID
+// and contacts are restored from it, and the table is saved there again when
+// the node is closed.
+func New(addr string, statePath string) (*DHT, error) {
+	udpAddr, e := net.ResolveUDPAddr("udp4", addr)
+	if e != nil {
+		return nil, e
+	}
+	conn, e := net.ListenUDP("udp4", udpAddr)
+	if e != nil {
+		return nil, e
+	}
+	return NewWithConn(conn, statePath)
+}
+
+// NewWithConn is New on an existing IPv4 packet connection, e.g. one shared
+// with uTP. The node closes conn when it is closed.
+func NewWithConn(conn net.PacketConn, statePath string) (*DHT, error) {
+	id := RandomNodeID()
+	var saved []contact
+
+	if statePath != "" {
+		sid, contacts, e := loadState(statePath)
+		if e == nil {
+			id = sid
+			saved = contacts
+		} else if !os.IsNotExist(e) {
+			log.Printf("ignoring bad dht state [%v]: %v", statePath, e)
+		}
+	}
+
+	d := DHT{
+		id:        id,
+		conn:      conn,
+		table:     newTable(id),
+		tokens:    newTokenManager(),
+		store:     newPeerStore(),
+		statePath: statePath,
+		pending:   make(map[string]pendingQuery),
+		chDone:    make(chan struct{}),
+	}
+	for _, c := range saved {
+		d.table.insert(c.id, c.addr)
+	}
+
+	d.procs.Add(2)
+	go d.serve()
+	go d.refreshLoop()
+
+	return &d, nil
+}
+
+func (d *DHT) Id() NodeID {
+	return d.id
+}
+
+func (d *DHT) Addr() *net.UDPAddr {
+	return d.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// NumNodes returns the number of nodes in the routing table.
+func (d *DHT) NumNodes() int {
+	return d.table.len()
+}
+
+// Close stops the node, and saves the routing table if it has a state path.
+func (d *DHT) Close() error {
+	var e error
+	d.closeOnce.Do(func() {
+		close(d.chDone)
+		e = d.conn.Close()
+		d.procs.Wait()
+		if d.statePath != "" {
+			if se := d.Save(); se != nil {
+				e = se
+			}
+		}
+	})
+	return e
+}
+
+// Bootstrap joins the DHT through the given nodes, then looks up our own ID
+// to fill the routing table. Contacts restored from a saved table are used
+// as well. Returns an error if no node could be reached.
+func (d *DHT) Bootstrap(addrs []string) error {
+	target := bencode.Dict{"target": string(d.id[:])}
+	for _, addr := range addrs {
+		udpAddr, e := net.ResolveUDPAddr("udp4", addr)
+		if e != nil {
+			log.Printf("failed to resolve dht bootstrap node [%v]: %v", addr, e)
+			continue
+		}
+		// Responding nodes are added to the table by the serve loop
+		_, e = d.query(udpAddr, methodFindNode, target)
+		if e != nil {
+			log.Printf("dht bootstrap node [%v] failed: %v", addr, e)
+		}
+	}
+
+	d.lookup(d.id, "")
+
+	if d.table.len() == 0 {
+		return &Error{msg: "could not reach any bootstrap nodes"}
+	}
+	return nil
+}
+
+// Ping pings the node at the given address and returns its ID.
+func (d *DHT) Ping(addr string) (NodeID, error) {
+	udpAddr, e := net.ResolveUDPAddr("udp4", addr)
+	if e != nil {
+		return NodeID{}, e
+	}
+	ret, e := d.query(udpAddr, methodPing, bencode.Dict{})
+	if e != nil {
+		return NodeID{}, e
+	}
+	s, e := ret.GetString("id")
+	if e != nil {
+		return NodeID{}, e
+	}
+	return NodeIDFromString(s)
+}
+
+// GetPeers looks up the peers of the torrent with the given infohash.
+func (d *DHT) GetPeers(infohash string) (peer.List, error) {
+	target, e := NodeIDFromString(infohash)
+	if e != nil {
+		return nil, e
+	}
+	return d.lookup(target, infohash).peers, nil
+}
+
+// Announce looks up the torrent with the given infohash, then announces that
+// we are downloading it on the given port to the closest nodes. Returns the
+// peers found by the lookup.
+func (d *DHT) Announce(infohash string, port uint16) (peer.List, error) {
+	target, e := NodeIDFromString(infohash)
+	if e != nil {
+		return nil, e
+	}
+
+	res := d.lookup(target, infohash)
+
+	nannounced := 0
+	for _, c := range res.nodes {
+		token, ok := res.tokens[c.id]
+		if !ok {
+			continue
+		}
+		args := bencode.Dict{
+			"info_hash":    infohash,
+			"port":         int64(port),
+			"token":        token,
+			"implied_port": int64(0),
+		}
+		if _, e := d.query(c.addr, methodAnnouncePeer, args); e == nil {
+			nannounced++
+		}
+	}
+
+	if nannounced == 0 {
+		return res.peers, &Error{msg: "no nodes accepted the announce"}
+	}
+	return res.peers, nil
+}
+
+// ============================================================================
+// LOOKUP =====================================================================
+
+// lookup finds the nodes closest to the target. If infohash is not empty,
+// get_peers is used and any peers returned are collected, otherwise
+// find_node is used.
+func (d *DHT) lookup(target NodeID, infohash string) *lookupResult {
+	method := methodFindNode
+	args := bencode.Dict{"target": string(target[:])}
+	if infohash != "" {
+		method = methodGetPeers
+		args = bencode.Dict{"info_hash": infohash}
+	}
+
+	res := lookupResult{
+		peers:  make(peer.List, 0),
+		nodes:  make([]contact, 0, K),
+		tokens: make(map[NodeID]string),
+	}
+
+	shortlist := d.table.closest(target, K)
+	seen := make(map[NodeID]bool)
+	for _, c := range shortlist {
+		seen[c.id] = true
+	}
+	queried := make(map[NodeID]bool)
+	seenPeers := make(map[string]bool)
+
+	type reply struct {
+		c   contact
+		ret bencode.Dict
+		err error
+	}
+
+	for {
+		// Query the closest nodes we haven't asked yet. Once the K closest
+		// have all been asked, we are done.
+		batch := make([]contact, 0, alpha)
+		for i := 0; i < len(shortlist) && i < K && len(batch) < alpha; i++ {
+			if !queried[shortlist[i].id] {
+				queried[shortlist[i].id] = true
+				batch = append(batch, shortlist[i])
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		chReply := make(chan reply, len(batch))
+		for _, c := range batch {
+			go func(c contact) {
+				ret, e := d.query(c.addr, method, args)
+				chReply <- reply{c: c, ret: ret, err: e}
+			}(c)
+		}
+
+		failed := make(map[NodeID]bool)
+		for range batch {
+			r := <-chReply
+			if r.err != nil {
+				d.table.failed(r.c.id)
+				failed[r.c.id] = true
+				continue
+			}
+			res.nodes = append(res.nodes, r.c)
+
+			if token, e := r.ret.GetString("token"); e == nil {
+				res.tokens[r.c.id] = token
+			}
+
+			if values, e := r.ret.GetList("values"); e == nil {
+				for _, v := range values {
+					s, ok := v.(string)
+					if !ok {
+						continue
+					}
+					peers, e := peer.ParseCompact([]byte(s))
+					if e != nil {
+						continue
+					}
+					for _, p := range peers {
+						if !seenPeers[p.Addr()] {
+							seenPeers[p.Addr()] = true
+							res.peers = append(res.peers, p)
+						}
+					}
+				}
+			}
+
+			if nodes, e := r.ret.GetString("nodes"); e == nil {
+				contacts, e := decodeNodes(nodes)
+				if e != nil {
+					continue
+				}
+				for _, c := range contacts {
+					if c.id != d.id && !seen[c.id] {
+						seen[c.id] = true
+						shortlist = append(shortlist, c)
+					}
+				}
+			}
+		}
+
+		// Drop nodes that didn't answer, and re-sort
+		kept := shortlist[:0]
+		for _, c := range shortlist {
+			if !failed[c.id] {
+				kept = append(kept, c)
+			}
+		}
+		shortlist = kept
+		sort.Slice(shortlist, func(i, j int) bool {
+			return target.Closer(shortlist[i].id, shortlist[j].id)
+		})
+
+		select {
+		case <-d.chDone:
+			return &res
+		default:
+		}
+	}
+
+	sort.Slice(res.nodes, func(i, j int) bool {
+		return target.Closer(res.nodes[i].id, res.nodes[j].id)
+	})
+	if len(res.nodes) > K {
+		res.nodes = res.nodes[:K]
+	}
+	return &res
+}
+
+// refreshLoop periodically looks up our own ID, which keeps the routing
+// table populated with live nodes close to us, and drops expired peers.
+func (d *DHT) refreshLoop() {
+	defer d.procs.Done()
+
+	ticker := time.NewTicker(RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.chDone:
+			return
+		case <-ticker.C:
+			d.store.expire()
+			if d.table.len() > 0 {
+				d.lookup(d.id, "")
+			}
+		}
+	}
+}
+
+// ============================================================================
+// NETWORK ====================================================================
+
+// query sends a query to the node at addr and waits for its response. Our ID
+// is added to the arguments.
+func (d *DHT) query(addr *net.UDPAddr, method string, args bencode.Dict) (bencode.Dict, error) {
+	a := bencode.Dict{"id": string(d.id[:])}
+	for k, v := range args {
+		a[k] = v
+	}
+
+	ch := make(chan *message, 1)
+	d.pmutex.Lock()
+	d.tid++
+	tid := string([]byte{byte(d.tid >> 8), byte(d.tid)})
+	d.pending[tid] = pendingQuery{addr: addr.String(), ch: ch}
+	d.pmutex.Unlock()
+
+	defer func() {
+		d.pmutex.Lock()
+		delete(d.pending, tid)
+		d.pmutex.Unlock()
+	}()
+
+	e := d.send(&message{t: tid, y: typeQuery, q: method, args: a}, addr)
+	if e != nil {
+		return nil, e
+	}
+
+	timer := time.NewTimer(queryTimeout)
+	defer timer.Stop()
+
+	select {
+	case msg := <-ch:
+		if msg.y == typeError {
+			return nil, msg.err
+		}
+		return msg.ret, nil
+	case <-timer.C:
+		return nil, &Error{msg: fmt.Sprintf("%v query to [%v] timed out", method, addr)}
+	case <-d.chDone:
+		return nil, &Error{msg: "dht closed"}
+	}
+}
+
+func (d *DHT) send(msg *message, addr *net.UDPAddr) error {
+	data, e := msg.encode()
+	if e != nil {
+		return e
+	}
+	_, e = d.conn.WriteTo(data, addr)
+	return e
+}
+
+func (d *DHT) sendError(tid string, addr *net.UDPAddr, code int64, msg string) {
+	// Nothing to be done if the error doesn't make it
+	_ = d.send(&message{t: tid, y: typeError, err: &KrpcError{Code: code, Msg: msg}}, addr)
+}
+
+// serve reads incoming messages until the node or its connection is closed.
+// Other read errors are retried after a short wait.
+func (d *DHT) serve() {
+	defer d.procs.Done()
+
+	buf := make([]byte, maxPacket)
+	for {
+		n, from, e := d.conn.ReadFrom(buf)
+		if e != nil {
+			if errors.Is(e, net.ErrClosed) {
+				select {
+				case <-d.chDone:
+				default:
+					log.Printf("dht connection closed, no longer serving: %v", e)
+				}
+				return
+			}
+
+			select {
+			case <-d.chDone:
+				return
+			case <-time.After(readRetry):
+				continue
+			}
+		}
+		addr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		msg, e := decodeMessage(buf[:n])
+		if e != nil {
+			continue
+		}
+
+		if msg.y == typeQuery {
+			d.handleQuery(msg, addr)
+		} else {
+			d.handleReply(msg, addr)
+		}
+	}
+}
+
+// handleReply passes a response or error to the query waiting for it.
+func (d *DHT) handleReply(msg *message, addr *net.UDPAddr) {
+	d.pmutex.Lock()
+	pq, ok := d.pending[msg.t]
+	d.pmutex.Unlock()
+
+	if !ok || pq.addr != addr.String() {
+		return
+	}
+
+	if msg.y == typeResponse {
+		id, e := msg.senderId()
+		if e != nil {
+			return
+		}
+		d.table.insert(id, addr)
+	}
+
+	select {
+	case pq.ch <- msg:
+	default:
+	}
+}
+
+// handleQuery answers a query from another node.
+func (d *DHT) handleQuery(msg *message, addr *net.UDPAddr) {
+	id, e := msg.senderId()
+	if e != nil {
+		d.sendError(msg.t, addr, errProtocol, "missing or bad id")
+		return
+	}
+	d.table.insert(id, addr)
+
+	ret := bencode.Dict{"id": string(d.id[:])}
+
+	switch msg.q {
+	case methodPing:
+		// Just the ID
+
+	case methodFindNode:
+		s, e := msg.args.GetString("target")
+		target, e2 := NodeIDFromString(s)
+		if e != nil || e2 != nil {
+			d.sendError(msg.t, addr, errProtocol, "missing or bad target")
+			return
+		}
+		d.addNodes(ret, target)
+
+	case methodGetPeers:
+		infohash, e := msg.args.GetString("info_hash")
+		target, e2 := NodeIDFromString(infohash)
+		if e != nil || e2 != nil {
+			d.sendError(msg.t, addr, errProtocol, "missing or bad info_hash")
+			return
+		}
+		ret["token"] = d.tokens.token(addr.IP)
+		if peers := d.store.get(infohash); len(peers) > 0 {
+			values := make(bencode.List, 0, len(peers))
+			for _, p := range peers {
+				values = append(values, string(p.Compact()))
+			}
+			ret["values"] = values
+		}
+		d.addNodes(ret, target)
+
+	case methodAnnouncePeer:
+		infohash, e := msg.args.GetString("info_hash")
+		_, e2 := NodeIDFromString(infohash)
+		if e != nil || e2 != nil {
+			d.sendError(msg.t, addr, errProtocol, "missing or bad info_hash")
+			return
+		}
+		token, e := msg.args.GetString("token")
+		if e != nil || !d.tokens.valid(token, addr.IP) {
+			d.sendError(msg.t, addr, errProtocol, "bad token")
+			return
+		}
+
+		port := uint16(addr.Port)
+		implied, _ := msg.args.GetInt("implied_port")
+		if implied == 0 {
+			p, e := msg.args.GetUint("port")
+			if e != nil {
+				d.sendError(msg.t, addr, errProtocol, "missing port")
+				return
+			}
+			port = uint16(p)
+		}
+		d.store.add(infohash, peer.MakePeer("", addr.IP, port))
+
+	default:
+		d.sendError(msg.t, addr, errMethod, "method unknown")
+		return
+	}
+
+	// Nothing to be done if the response doesn't make it
+	_ = d.send(&message{t: msg.t, y: typeResponse, ret: ret}, addr)
+}
+
+// addNodes adds the closest nodes to the target to a response.
+func (d *DHT) addNodes(ret bencode.Dict, target NodeID) {
+	nodes := encodeNodes(d.table.closest(target, K))
+	// Empty strings can't be bencoded, leave the key out instead
+	if nodes != "" {
+		ret["nodes"] = nodes
+	}
+}
+
+// ============================================================================
+// PERSISTENCE ================================================================
+
+// Save writes our node ID and routing table to the state path, so that a
+// later node can rejoin the DHT without bootstrapping from scratch.
+func (d *DHT) Save() error {
+	if d.statePath == "" {
+		return &Error{msg: "no state path"}
+	}
+
+	state := bencode.Dict{"id": string(d.id[:])}
+	if nodes := encodeNodes(d.table.contacts()); nodes != "" {
+		state["nodes"] = nodes
+	}
+
+	data, e := bencode.Encode(state)
+	if e != nil {
+		return e
+	}
+	if e = os.MkdirAll(filepath.Dir(d.statePath), 0755); e != nil {
+		return e
+	}
+	return os.WriteFile(d.statePath, data, 0644)
+}
+
+func loadState(path string) (NodeID, []contact, error) {
+	data, e := os.ReadFile(path)
+	if e != nil {
+		return NodeID{}, nil, e
+	}
+
+	ben, e := bencode.Decode(data)
+	if e != nil {
+		return NodeID{}, nil, e
+	}
+	dict, ok := ben.(bencode.Dict)
+	if !ok {
+		return NodeID{}, nil, &Error{msg: "dht state is not a dictionary"}
+	}
+
+	s, e := dict.GetString("id")
+	if e != nil {
+		return NodeID{}, nil, e
+	}
+	id, e := NodeIDFromString(s)
+	if e != nil {
+		return NodeID{}, nil, e
+	}
+
+	nodes, e := dict.GetString("nodes")
+	if e != nil {
+		// A table with no nodes is still a valid state
+		return id, nil, nil
+	}
+	contacts, e := decodeNodes(nodes)
+	if e != nil {
+		return NodeID{}, nil, e
+	}
+	return id, contacts, nil
+}
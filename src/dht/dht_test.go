@@ -0,0 +1,184 @@
+package dht
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotor/bencode"
+	"gotor/utils/test"
+	"gotor/utp"
+)
+
+// newTestNetwork starts n DHT nodes on loopback, all bootstrapped from the
+// first node.
+func newTestNetwork(t *testing.T, n int) []*DHT {
+	nodes := make([]*DHT, 0, n)
+	for i := 0; i < n; i++ {
+		d, e := New("127.0.0.1:0", "")
+		test.CheckFatal(t, e)
+		t.Cleanup(func() { _ = d.Close() })
+		nodes = append(nodes, d)
+	}
+
+	first := []string{nodes[0].Addr().String()}
+	for _, d := range nodes[1:] {
+		test.CheckFatal(t, d.Bootstrap(first))
+	}
+	return nodes
+}
+
+func randomInfohash() string {
+	id := RandomNodeID()
+	return string(id[:])
+}
+
+func TestDHT_Ping(t *testing.T) {
+	nodes := newTestNetwork(t, 2)
+
+	id, e := nodes[0].Ping(nodes[1].Addr().String())
+	test.CheckFatal(t, e)
+	if id != nodes[1].Id() {
+		t.Errorf("ping returned id %v, want %v", id, nodes[1].Id())
+	}
+	if nodes[0].NumNodes() != 1 || nodes[1].NumNodes() != 1 {
+		t.Errorf("nodes know %v and %v nodes, want 1 and 1", nodes[0].NumNodes(), nodes[1].NumNodes())
+	}
+}
+
+func TestDHT_SharedWithUtp(t *testing.T) {
+	nodes := newTestNetwork(t, 1)
+
+	s, e := utp.Listen("udp4", "127.0.0.1:0")
+	test.CheckFatal(t, e)
+	defer s.Close()
+	d, e := NewWithConn(s.PacketConn(), "")
+	test.CheckFatal(t, e)
+	defer d.Close()
+
+	id, e := d.Ping(nodes[0].Addr().String())
+	test.CheckFatal(t, e)
+	if id != nodes[0].Id() {
+		t.Errorf("ping returned id %v, want %v", id, nodes[0].Id())
+	}
+}
+
+func TestDHT_ServeClosedConn(t *testing.T) {
+	conn, e := net.ListenPacket("udp4", "127.0.0.1:0")
+	test.CheckFatal(t, e)
+	d := &DHT{conn: conn, chDone: make(chan struct{})}
+	d.procs.Add(1)
+	go d.serve()
+
+	// A connection closed under the node stops serve instead of spinning
+	_ = conn.Close()
+	chServed := make(chan struct{})
+	go func() {
+		d.procs.Wait()
+		close(chServed)
+	}()
+	select {
+	case <-chServed:
+	case <-time.After(time.Second):
+		t.Fatal("serve did not return after its connection was closed")
+	}
+}
+
+func TestDHT_AnnounceGetPeers(t *testing.T) {
+	nodes := newTestNetwork(t, 12)
+	infohash := randomInfohash()
+
+	// Nobody has announced yet
+	peers, e := nodes[5].GetPeers(infohash)
+	test.CheckFatal(t, e)
+	if len(peers) != 0 {
+		t.Fatalf("got %v peers before announcing", len(peers))
+	}
+
+	_, e = nodes[3].Announce(infohash, 6881)
+	test.CheckFatal(t, e)
+	_, e = nodes[4].Announce(infohash, 6882)
+	test.CheckFatal(t, e)
+
+	for _, i := range []int{0, 7, 11} {
+		peers, e = nodes[i].GetPeers(infohash)
+		test.CheckFatal(t, e)
+
+		got := make(map[string]bool)
+		for _, p := range peers {
+			got[p.Addr()] = true
+		}
+		if !got["127.0.0.1:6881"] || !got["127.0.0.1:6882"] || len(got) != 2 {
+			t.Errorf("node %v got peers %v", i, peers)
+		}
+	}
+}
+
+func TestDHT_BadToken(t *testing.T) {
+	nodes := newTestNetwork(t, 2)
+	args := bencode.Dict{
+		"info_hash": randomInfohash(),
+		"port":      int64(6881),
+		"token":     "not a real token",
+	}
+	_, e := nodes[1].query(nodes[0].Addr(), methodAnnouncePeer, args)
+	ke, ok := e.(*KrpcError)
+	if !ok || ke.Code != errProtocol {
+		t.Errorf("expected protocol error, got %v", e)
+	}
+}
+
+func TestDHT_Persistence(t *testing.T) {
+	nodes := newTestNetwork(t, 4)
+	path := filepath.Join(t.TempDir(), "gotor", "dht.dat") // Made by Save
+
+	d, e := New("127.0.0.1:0", path)
+	test.CheckFatal(t, e)
+	test.CheckFatal(t, d.Bootstrap([]string{nodes[0].Addr().String()}))
+	id, nnodes := d.Id(), d.NumNodes()
+	test.CheckFatal(t, d.Close())
+
+	d, e = New("127.0.0.1:0", path)
+	test.CheckFatal(t, e)
+	defer d.Close()
+
+	if d.Id() != id {
+		t.Errorf("restored id %v, want %v", d.Id(), id)
+	}
+	if d.NumNodes() != nnodes {
+		t.Errorf("restored %v nodes, want %v", d.NumNodes(), nnodes)
+	}
+
+	// Restored contacts should be enough to rejoin without a bootstrap node
+	test.CheckFatal(t, d.Bootstrap(nil))
+}
+
+func TestTokenManager(t *testing.T) {
+	tm := newTokenManager()
+	ip := net.IPv4(10, 0, 0, 1)
+	other := net.IPv4(10, 0, 0, 2)
+
+	token := tm.token(ip)
+	if !tm.valid(token, ip) {
+		t.Error("fresh token not valid")
+	}
+	if tm.valid(token, other) {
+		t.Error("token valid for another ip")
+	}
+
+	// Still valid after one rotation, but not two
+	tm.mutex.Lock()
+	tm.rotate()
+	tm.mutex.Unlock()
+	if !tm.valid(token, ip) {
+		t.Error("token not valid after one rotation")
+	}
+
+	tm.mutex.Lock()
+	tm.rotate()
+	tm.mutex.Unlock()
+	if tm.valid(token, ip) {
+		t.Error("token valid after two rotations")
+	}
+}
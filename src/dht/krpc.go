@@ -0,0 +1,198 @@
+/* krpc.go ====================================================================
+The KRPC protocol from BEP_0005. Every message is a bencoded dictionary with a
+transaction ID "t" and a type "y", which is either a query ("q"), a response
+("r") or an error ("e"). Queries name their method in "q" and carry their
+arguments in "a", responses carry their return values in "r", and errors
+carry a [code, message] list in "e".
+============================================================================ */
+
+package dht
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"gotor/bencode"
+)
+
+const (
+	typeQuery    = "q"
+	typeResponse = "r"
+	typeError    = "e"
+
+	methodPing         = "ping"
+	methodFindNode     = "find_node"
+	methodGetPeers     = "get_peers"
+	methodAnnouncePeer = "announce_peer"
+
+	// KRPC error codes
+	errGeneric  = int64(201)
+	errServer   = int64(202)
+	errProtocol = int64(203)
+	errMethod   = int64(204)
+
+	// compactNodeLen is the length of a node in compact node info, a 20 byte
+	// ID followed by a compact IPv4 address
+	compactNodeLen = IdLen + 6
+)
+
+// ============================================================================
+// ERRORS =====================================================================
+
+type Error struct{ msg string }
+
+func (e *Error) Error() string {
+	return "dht error: " + e.msg
+}
+
+// KrpcError is an error message sent by a remote node.
+type KrpcError struct {
+	Code int64
+	Msg  string
+}
+
+func (e *KrpcError) Error() string {
+	return fmt.Sprintf("krpc error %v: %v", e.Code, e.Msg)
+}
+
+// ============================================================================
+// MESSAGE ====================================================================
+
+type message struct {
+	t    string       // Transaction ID
+	y    string       // Message type
+	q    string       // Query method, for queries
+	args bencode.Dict // Query arguments, for queries
+	ret  bencode.Dict // Return values, for responses
+	err  *KrpcError   // Error, for errors
+}
+
+func (m *message) encode() ([]byte, error) {
+	dict := bencode.Dict{
+		"t": m.t,
+		"y": m.y,
+	}
+
+	switch m.y {
+	case typeQuery:
+		dict["q"] = m.q
+		dict["a"] = m.args
+	case typeResponse:
+		dict["r"] = m.ret
+	case typeError:
+		dict["e"] = bencode.List{m.err.Code, m.err.Msg}
+	default:
+		return nil, &Error{msg: fmt.Sprintf("unknown message type [%v]", m.y)}
+	}
+
+	return bencode.Encode(dict)
+}
+
+func decodeMessage(data []byte) (*message, error) {
+	ben, e := bencode.Decode(data)
+	if e != nil {
+		return nil, e
+	}
+	dict, ok := ben.(bencode.Dict)
+	if !ok {
+		return nil, &Error{msg: "krpc message is not a dictionary"}
+	}
+
+	m := message{}
+	if m.t, e = dict.GetString("t"); e != nil {
+		return nil, e
+	}
+	if m.y, e = dict.GetString("y"); e != nil {
+		return nil, e
+	}
+
+	switch m.y {
+	case typeQuery:
+		if m.q, e = dict.GetString("q"); e != nil {
+			return nil, e
+		}
+		if m.args, e = dict.GetDict("a"); e != nil {
+			return nil, e
+		}
+	case typeResponse:
+		if m.ret, e = dict.GetDict("r"); e != nil {
+			return nil, e
+		}
+	case typeError:
+		list, e := dict.GetList("e")
+		if e != nil {
+			return nil, e
+		}
+		m.err = &KrpcError{Code: errGeneric}
+		if len(list) > 0 {
+			if code, ok := list[0].(int64); ok {
+				m.err.Code = code
+			}
+		}
+		if len(list) > 1 {
+			if msg, ok := list[1].(string); ok {
+				m.err.Msg = msg
+			}
+		}
+	default:
+		return nil, &Error{msg: fmt.Sprintf("unknown message type [%v]", m.y)}
+	}
+
+	return &m, nil
+}
+
+// senderId returns the ID of the node that sent the message, which is in
+// the arguments of queries and the return values of responses.
+func (m *message) senderId() (NodeID, error) {
+	dict := m.args
+	if m.y == typeResponse {
+		dict = m.ret
+	}
+	if dict == nil {
+		return NodeID{}, &Error{msg: "message has no sender id"}
+	}
+	s, e := dict.GetString("id")
+	if e != nil {
+		return NodeID{}, e
+	}
+	return NodeIDFromString(s)
+}
+
+// ============================================================================
+// COMPACT ENCODING ===========================================================
+
+// encodeNodes encodes contacts in compact node info format. Contacts without
+// an IPv4 address are skipped.
+func encodeNodes(contacts []contact) string {
+	buf := make([]byte, 0, len(contacts)*compactNodeLen)
+	for _, c := range contacts {
+		ip := c.addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+		buf = append(buf, c.id[:]...)
+		buf = append(buf, ip...)
+		buf = append(buf, byte(c.addr.Port>>8), byte(c.addr.Port))
+	}
+	return string(buf)
+}
+
+// decodeNodes decodes compact node info.
+func decodeNodes(s string) ([]contact, error) {
+	if len(s)%compactNodeLen != 0 {
+		return nil, &Error{msg: fmt.Sprintf("compact node info must be divisible by %v, length = [%v]", compactNodeLen, len(s))}
+	}
+
+	contacts := make([]contact, 0, len(s)/compactNodeLen)
+	for i := 0; i < len(s); i += compactNodeLen {
+		c := contact{}
+		copy(c.id[:], s[i:i+IdLen])
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, s[i+IdLen:i+IdLen+4])
+		port := binary.BigEndian.Uint16([]byte(s[i+IdLen+4 : i+compactNodeLen]))
+		c.addr = &net.UDPAddr{IP: ip, Port: int(port)}
+		contacts = append(contacts, c)
+	}
+	return contacts, nil
+}
@@ -0,0 +1,89 @@
+package dht
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"gotor/bencode"
+	"gotor/utils/test"
+)
+
+func TestMessage_Encode(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  message
+	}{
+		{
+			name: "query",
+			msg: message{t: "aa", y: typeQuery, q: methodGetPeers, args: bencode.Dict{
+				"id":        "abcdefghij0123456789",
+				"info_hash": "mnopqrstuvwxyz123456",
+			}},
+		},
+		{
+			name: "response",
+			msg:  message{t: "aa", y: typeResponse, ret: bencode.Dict{"id": "mnopqrstuvwxyz123456"}},
+		},
+		{
+			name: "error",
+			msg:  message{t: "aa", y: typeError, err: &KrpcError{Code: errGeneric, Msg: "A Generic Error Ocurred"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, e := tt.msg.encode()
+			test.CheckFatal(t, e)
+			got, e := decodeMessage(data)
+			test.CheckFatal(t, e)
+			if !reflect.DeepEqual(*got, tt.msg) {
+				t.Errorf("got %+v, want %+v", *got, tt.msg)
+			}
+		})
+	}
+}
+
+func TestDecodeMessage_BEP5(t *testing.T) {
+	// Example ping query from BEP_0005
+	raw := "d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"
+	msg, e := decodeMessage([]byte(raw))
+	test.CheckFatal(t, e)
+
+	if msg.t != "aa" || msg.y != typeQuery || msg.q != methodPing {
+		t.Errorf("bad message %+v", msg)
+	}
+	id, e := msg.senderId()
+	test.CheckFatal(t, e)
+	if string(id[:]) != "abcdefghij0123456789" {
+		t.Errorf("bad sender id %v", id)
+	}
+
+	_, e = decodeMessage([]byte("d1:t2:aa1:y1:xe"))
+	if e == nil {
+		t.Error("expected error for unknown message type")
+	}
+}
+
+func TestCompactNodes(t *testing.T) {
+	contacts := []contact{
+		{id: RandomNodeID(), addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 6881}},
+		{id: RandomNodeID(), addr: &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20).To4(), Port: 51413}},
+	}
+	ipv6 := contact{id: RandomNodeID(), addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6881}}
+
+	enc := encodeNodes(append(contacts, ipv6))
+	if len(enc) != 2*compactNodeLen {
+		t.Fatalf("encoded length %v, want %v", len(enc), 2*compactNodeLen)
+	}
+
+	got, e := decodeNodes(enc)
+	test.CheckFatal(t, e)
+	if !reflect.DeepEqual(got, contacts) {
+		t.Errorf("got %v, want %v", got, contacts)
+	}
+
+	_, e = decodeNodes(enc[1:])
+	if e == nil {
+		t.Error("expected error for bad length")
+	}
+}
@@ -0,0 +1,76 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+)
+
+// IdLen is the length of node IDs and infohashes, in bytes.
+const IdLen = 20
+
+// NodeID identifies a node in the DHT, and lives in the same 160 bit space
+// as infohashes.
+type NodeID [IdLen]byte
+
+// ============================================================================
+// FUNK =======================================================================
+
+// RandomNodeID makes a new random node ID.
+func RandomNodeID() NodeID {
+	id := NodeID{}
+	_, e := rand.Read(id[:])
+	if e != nil {
+		panic(e)
+	}
+	return id
+}
+
+// NodeIDFromString converts a raw 20 byte string (e.g. an infohash) into a
+// NodeID.
+func NodeIDFromString(s string) (NodeID, error) {
+	id := NodeID{}
+	if len(s) != IdLen {
+		return id, &Error{msg: fmt.Sprintf("node id must be %v bytes, got %v", IdLen, len(s))}
+	}
+	copy(id[:], s)
+	return id, nil
+}
+
+// Distance returns the XOR distance between the two IDs.
+func (id NodeID) Distance(other NodeID) NodeID {
+	d := NodeID{}
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// Closer returns true if a is closer to id than b is.
+func (id NodeID) Closer(a NodeID, b NodeID) bool {
+	for i := range id {
+		da := id[i] ^ a[i]
+		db := id[i] ^ b[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// prefixLen returns the number of leading bits that the IDs have in common,
+// which is IdLen*8 if they are equal.
+func (id NodeID) prefixLen(other NodeID) int {
+	for i := range id {
+		x := id[i] ^ other[i]
+		if x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return IdLen * 8
+}
+
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,111 @@
+package dht
+
+import (
+	"sync"
+	"time"
+
+	"gotor/peer"
+)
+
+const (
+	// peerExpiry is how long an announced peer is kept. Peers are expected
+	// to re-announce well before this.
+	peerExpiry = 30 * time.Minute
+
+	// maxValues is the maximum number of peers returned by get_peers, which
+	// keeps the response inside a single UDP packet.
+	maxValues = 50
+
+	// Caps on what other nodes can make us store. Announces for new
+	// infohashes are dropped once maxInfohashes are stored, and a new peer
+	// replaces the oldest one once an infohash has maxStoredPeers.
+	maxInfohashes  = 10000
+	maxStoredPeers = 200
+)
+
+// peerStore holds the peers that have announced to us, by infohash.
+type peerStore struct {
+	peers map[string]map[string]storedPeer // infohash -> address -> peer
+	mutex sync.Mutex
+}
+
+type storedPeer struct {
+	info peer.Info
+	at   time.Time
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{peers: make(map[string]map[string]storedPeer)}
+}
+
+// add stores the peer under the infohash, replacing an older entry for the
+// same address. Peers for new infohashes are dropped once the store is full.
+func (ps *peerStore) add(infohash string, p peer.Info) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	m, ok := ps.peers[infohash]
+	if !ok {
+		if len(ps.peers) >= maxInfohashes {
+			return
+		}
+		m = make(map[string]storedPeer)
+		ps.peers[infohash] = m
+	}
+
+	if _, ok = m[p.Addr()]; !ok && len(m) >= maxStoredPeers {
+		oldest := ""
+		for addr, sp := range m {
+			if oldest == "" || sp.at.Before(m[oldest].at) {
+				oldest = addr
+			}
+		}
+		delete(m, oldest)
+	}
+	m[p.Addr()] = storedPeer{info: p, at: time.Now()}
+}
+
+// expire drops every expired peer, and the infohashes left without peers.
+func (ps *peerStore) expire() {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	for infohash, m := range ps.peers {
+		for addr, sp := range m {
+			if time.Since(sp.at) > peerExpiry {
+				delete(m, addr)
+			}
+		}
+		if len(m) == 0 {
+			delete(ps.peers, infohash)
+		}
+	}
+}
+
+// get returns up to maxValues unexpired peers for the infohash. Expired peers
+// are dropped along the way.
+func (ps *peerStore) get(infohash string) peer.List {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	m, ok := ps.peers[infohash]
+	if !ok {
+		return nil
+	}
+
+	peers := make(peer.List, 0, len(m))
+	for addr, sp := range m {
+		if time.Since(sp.at) > peerExpiry {
+			delete(m, addr)
+			continue
+		}
+		if len(peers) < maxValues {
+			peers = append(peers, sp.info)
+		}
+	}
+
+	if len(m) == 0 {
+		delete(ps.peers, infohash)
+	}
+	return peers
+}
@@ -0,0 +1,51 @@
+package dht
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"gotor/peer"
+)
+
+func TestPeerStore_Limits(t *testing.T) {
+	ps := newPeerStore()
+
+	// New peers replace the oldest once an infohash is full
+	for i := 0; i < maxStoredPeers+10; i++ {
+		ps.add("a", peer.MakePeer("", net.IPv4(10, 0, byte(i>>8), byte(i)), 6881))
+	}
+	if n := len(ps.peers["a"]); n != maxStoredPeers {
+		t.Errorf("stored %v peers, want %v", n, maxStoredPeers)
+	}
+	if _, ok := ps.peers["a"]["10.0.0.0:6881"]; ok {
+		t.Errorf("oldest peer was kept")
+	}
+
+	// New infohashes are dropped once the store is full
+	for i := 0; i < maxInfohashes+10; i++ {
+		ps.add(fmt.Sprint(i), peer.MakePeer("", net.IPv4(10, 0, 0, 1), 6881))
+	}
+	if n := len(ps.peers); n != maxInfohashes {
+		t.Errorf("stored %v infohashes, want %v", n, maxInfohashes)
+	}
+}
+
+func TestPeerStore_expire(t *testing.T) {
+	ps := newPeerStore()
+	ps.add("old", peer.MakePeer("", net.IPv4(10, 0, 0, 1), 6881))
+	ps.add("new", peer.MakePeer("", net.IPv4(10, 0, 0, 2), 6881))
+	for addr, sp := range ps.peers["old"] {
+		sp.at = time.Now().Add(-2 * peerExpiry)
+		ps.peers["old"][addr] = sp
+	}
+
+	ps.expire()
+	if _, ok := ps.peers["old"]; ok {
+		t.Errorf("infohash with only expired peers was kept")
+	}
+	if len(ps.peers["new"]) != 1 {
+		t.Errorf("unexpired peer was dropped")
+	}
+}
@@ -0,0 +1,159 @@
+package dht
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// K is the maximum number of contacts in a bucket, and the number of
+	// closest nodes returned by find_node and get_peers.
+	K = 8
+
+	// maxFails is the number of unanswered queries after which a contact is
+	// considered bad, and may be replaced.
+	maxFails = 2
+)
+
+// ============================================================================
+// STRUCTS ====================================================================
+
+type contact struct {
+	id       NodeID
+	addr     *net.UDPAddr
+	lastSeen time.Time
+	fails    int // Queries in a row that went unanswered
+}
+
+// table is the Kademlia routing table. Contacts are put in the bucket given by
+// how many leading bits their ID shares with ours, so there is one bucket
+// for each possible shared prefix length. Each bucket is ordered from least
+// to most recently seen.
+type table struct {
+	self    NodeID
+	buckets [IdLen * 8][]*contact
+	mutex   sync.Mutex
+}
+
+// ============================================================================
+// FUNK =======================================================================
+
+func newTable(self NodeID) *table {
+	return &table{self: self}
+}
+
+// insert adds the node to the table, or marks it as seen if it is already
+// there. If the node's bucket is full, it replaces a bad contact if there is
+// one, and is dropped otherwise. Returns true if the node is in the table
+// afterwards.
+func (t *table) insert(id NodeID, addr *net.UDPAddr) bool {
+	if id == t.self {
+		return false
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	i := t.bucketIndex(id)
+	bucket := t.buckets[i]
+
+	for j, c := range bucket {
+		if c.id == id {
+			c.addr = addr
+			c.lastSeen = time.Now()
+			c.fails = 0
+			// Move to the back, most recently seen
+			t.buckets[i] = append(append(bucket[:j:j], bucket[j+1:]...), c)
+			return true
+		}
+	}
+
+	c := &contact{id: id, addr: addr, lastSeen: time.Now()}
+	if len(bucket) < K {
+		t.buckets[i] = append(bucket, c)
+		return true
+	}
+
+	for j, old := range bucket {
+		if old.fails >= maxFails {
+			t.buckets[i] = append(append(bucket[:j:j], bucket[j+1:]...), c)
+			return true
+		}
+	}
+
+	return false
+}
+
+// failed records that a query to the node went unanswered.
+func (t *table) failed(id NodeID) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, c := range t.buckets[t.bucketIndex(id)] {
+		if c.id == id {
+			c.fails++
+			return
+		}
+	}
+}
+
+// closest returns up to n good contacts closest to the target, closest
+// first.
+func (t *table) closest(target NodeID, n int) []contact {
+	t.mutex.Lock()
+	all := make([]contact, 0, 4*K)
+	for _, bucket := range t.buckets {
+		for _, c := range bucket {
+			if c.fails < maxFails {
+				all = append(all, *c)
+			}
+		}
+	}
+	t.mutex.Unlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		return target.Closer(all[i].id, all[j].id)
+	})
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+// contacts returns every contact in the table.
+func (t *table) contacts() []contact {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	all := make([]contact, 0, 4*K)
+	for _, bucket := range t.buckets {
+		for _, c := range bucket {
+			all = append(all, *c)
+		}
+	}
+	return all
+}
+
+// len returns the number of contacts in the table.
+func (t *table) len() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	n := 0
+	for _, bucket := range t.buckets {
+		n += len(bucket)
+	}
+	return n
+}
+
+// bucketIndex returns the index of the bucket that the ID belongs in. Must
+// not be called with our own ID.
+func (t *table) bucketIndex(id NodeID) int {
+	i := t.self.prefixLen(id)
+	if i >= len(t.buckets) {
+		i = len(t.buckets) - 1
+	}
+	return i
+}
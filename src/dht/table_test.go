@@ -0,0 +1,100 @@
+package dht
+
+import (
+	"net"
+	"testing"
+)
+
+// idWithPrefix returns a random ID that shares exactly n leading bits with
+// self.
+func idWithPrefix(self NodeID, n int) NodeID {
+	id := RandomNodeID()
+	for i := 0; i <= n; i++ {
+		mask := byte(0x80) >> (i % 8)
+		want := self[i/8] & mask
+		if i == n {
+			want ^= mask
+		}
+		id[i/8] = id[i/8]&^mask | want
+	}
+	return id
+}
+
+func TestTable_Insert(t *testing.T) {
+	self := RandomNodeID()
+	tbl := newTable(self)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+
+	if tbl.insert(self, addr) {
+		t.Error("inserted own id")
+	}
+
+	// Fill up the bucket for prefix length 3
+	ids := make([]NodeID, 0, K+1)
+	for i := 0; i < K+1; i++ {
+		id := idWithPrefix(self, 3)
+		if self.prefixLen(id) != 3 {
+			t.Fatalf("bad test id, prefix %v", self.prefixLen(id))
+		}
+		ids = append(ids, id)
+	}
+	for _, id := range ids[:K] {
+		if !tbl.insert(id, addr) {
+			t.Fatalf("failed to insert into non-full bucket")
+		}
+	}
+
+	if tbl.insert(ids[K], addr) {
+		t.Error("inserted into full bucket with no bad contacts")
+	}
+
+	// Once a contact goes bad, it can be replaced
+	for i := 0; i < maxFails; i++ {
+		tbl.failed(ids[2])
+	}
+	if !tbl.insert(ids[K], addr) {
+		t.Error("failed to replace bad contact")
+	}
+	if tbl.len() != K {
+		t.Errorf("table has %v contacts, want %v", tbl.len(), K)
+	}
+	for _, c := range tbl.contacts() {
+		if c.id == ids[2] {
+			t.Error("bad contact still in table")
+		}
+	}
+}
+
+func TestTable_Closest(t *testing.T) {
+	self := RandomNodeID()
+	tbl := newTable(self)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+
+	for i := 0; i < 40; i++ {
+		tbl.insert(RandomNodeID(), addr)
+	}
+
+	target := RandomNodeID()
+	closest := tbl.closest(target, K)
+	if len(closest) != K {
+		t.Fatalf("got %v contacts, want %v", len(closest), K)
+	}
+
+	for i := 1; i < len(closest); i++ {
+		if target.Closer(closest[i].id, closest[i-1].id) {
+			t.Errorf("contacts not sorted by distance at %v", i)
+		}
+	}
+
+	// Nothing left out of the result should be closer than the furthest
+	// contact in it
+	in := make(map[NodeID]bool)
+	for _, c := range closest {
+		in[c.id] = true
+	}
+	for _, c := range tbl.contacts() {
+		if !in[c.id] && target.Closer(c.id, closest[K-1].id) {
+			t.Errorf("contact %v is closer than the result", c.id)
+		}
+	}
+}
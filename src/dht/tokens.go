@@ -0,0 +1,85 @@
+package dht
+
+import (
+	"crypto/rand"
+	"net"
+	"sync"
+	"time"
+
+	"gotor/utils"
+)
+
+// tokenRotation is how often the token secret changes. Tokens made with the
+// previous secret are still accepted, so a token is valid for up to twice
+// this long, as suggested by BEP_0005.
+const tokenRotation = 5 * time.Minute
+
+// tokenManager hands out the tokens that get_peers responses carry, which
+// must be given back in announce_peer to prove that the announcing node owns
+// its IP. A token is the SHA1 of the node's IP and a secret.
+type tokenManager struct {
+	secret    []byte
+	prev      []byte
+	rotatedAt time.Time
+	mutex     sync.Mutex
+}
+
+func newTokenManager() *tokenManager {
+	tm := tokenManager{}
+	tm.secret = newSecret()
+	tm.prev = tm.secret
+	tm.rotatedAt = time.Now()
+	return &tm
+}
+
+// token returns the token for the given IP.
+func (tm *tokenManager) token(ip net.IP) string {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	tm.maybeRotate()
+	return makeToken(tm.secret, ip)
+}
+
+// valid returns true if the token was handed out to the IP recently.
+func (tm *tokenManager) valid(token string, ip net.IP) bool {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	tm.maybeRotate()
+	return token == makeToken(tm.secret, ip) || token == makeToken(tm.prev, ip)
+}
+
+// rotate replaces the secret. Must be called with the lock held.
+func (tm *tokenManager) rotate() {
+	tm.prev = tm.secret
+	tm.secret = newSecret()
+	tm.rotatedAt = time.Now()
+}
+
+// maybeRotate rotates the secret if it is due. Must be called with the lock
+// held.
+func (tm *tokenManager) maybeRotate() {
+	if time.Since(tm.rotatedAt) >= tokenRotation {
+		tm.rotate()
+	}
+}
+
+func makeToken(secret []byte, ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	buf := make([]byte, 0, len(ip)+len(secret))
+	buf = append(buf, ip...)
+	buf = append(buf, secret...)
+	return utils.SHA1(buf)
+}
+
+func newSecret() []byte {
+	secret := make([]byte, 16)
+	_, e := rand.Read(secret)
+	if e != nil {
+		panic(e)
+	}
+	return secret
+}
@@ -3,6 +3,7 @@ package io
 import (
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -17,6 +18,7 @@ type ReadLoop struct {
 	chReady chan struct{} // Once data in chBuf is processed, this signals user is ready to read again
 	chErr   chan error    // Errors encountered when reading
 	chDone  chan struct{} // Once user is done, Run() will exit
+	once    sync.Once     // Closes chDone
 
 	conn    net.Conn
 	timeout time.Duration
@@ -27,7 +29,7 @@ func NewReadLoop(bufSize int64, conn net.Conn, timeout time.Duration) *ReadLoop
 		buf:     make([]byte, bufSize, bufSize),
 		chBuf:   make(chan []byte, 1),
 		chReady: make(chan struct{}, 1),
-		chErr:   make(chan error),
+		chErr:   make(chan error, 1),
 		chDone:  make(chan struct{}),
 		conn:    conn,
 		timeout: timeout,
@@ -51,8 +53,11 @@ func (rl *ReadLoop) ReadError() <-chan error {
 }
 
 // Finish cancels the current conn.Read() call and terminates the call to Run().
+// Never blocks, even if Run has already exited.
 func (rl *ReadLoop) Finish() {
-	rl.chDone <- struct{}{}
+	rl.once.Do(func() {
+		close(rl.chDone)
+	})
 	// Set the cancel time to now. Rather than using time.Now() which involves
 	// a syscall, use Unix(1,0)
 	_ = rl.conn.SetReadDeadline(time.Unix(1, 0))
@@ -68,6 +73,13 @@ func (rl *ReadLoop) Run() {
 
 	done := false
 	for !done {
+		// Finish may have been called while we weren't reading
+		select {
+		case <-rl.chDone:
+			return
+		default:
+		}
+
 		e := rl.conn.SetReadDeadline(time.Now().Add(rl.timeout))
 		if e != nil {
 			rl.chErr <- e
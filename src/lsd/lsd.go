@@ -0,0 +1,390 @@
+/* lsd.go =====================================================================
+Local Service Discovery (BEP_0014). Peers on the same network find each other
+by multicasting BT-SEARCH announces for the torrents they are active in to a
+well known group, and listening for the announces of others. Multicast
+packets are looped back to the sending host, so processes on the same machine
+find each other too.
+============================================================================ */
+
+package lsd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gotor/peer"
+)
+
+const (
+	// Group4 and Group6 are the multicast groups from BEP_0014
+	Group4 = "239.192.152.143:6771"
+	Group6 = "[ff15::efc0:988f]:6771"
+
+	// Interval is how often every infohash is announced
+	Interval = 5 * time.Minute
+
+	// checkInterval is how often we look for infohashes that are due for an
+	// announce. Each one is still only announced once per Interval.
+	checkInterval = time.Minute
+
+	// badLogInterval is the least time between two logs of bad announces,
+	// so that a host on the network can't flood the log.
+	badLogInterval = time.Minute
+
+	// maxPerAnnounce is the most infohashes put in a single announce, which
+	// keeps it inside one packet.
+	maxPerAnnounce = 16
+
+	// peersBufSize is how many discovered peers are buffered before new
+	// ones are dropped.
+	peersBufSize = 64
+
+	searchLine = "BT-SEARCH * HTTP/1.1"
+)
+
+// ============================================================================
+// ERRORS =====================================================================
+
+type Error struct{ msg string }
+
+func (e *Error) Error() string {
+	return "lsd error: " + e.msg
+}
+
+// ============================================================================
+// STRUCTS ====================================================================
+
+// Peer is a peer that announced an infohash on the local network.
+type Peer struct {
+	Infohash string
+	Peer     peer.Info
+}
+
+// LSD announces infohashes on the local network, and reports the peers that
+// announce the same infohashes.
+type LSD struct {
+	port   uint16
+	cookie string // Tells our own announces apart when they are looped back
+	groups []*group
+
+	infohashes map[string]time.Time // Infohash -> last announced
+	mutex      sync.Mutex           // Guards infohashes
+
+	chPeers    chan Peer
+	chAnnounce chan struct{} // Triggers an early announce
+	chDone     chan struct{}
+	closeOnce  sync.Once
+	wg         sync.WaitGroup
+}
+
+// group is a joined multicast group.
+type group struct {
+	addr   *net.UDPAddr
+	listen *net.UDPConn
+	send   *net.UDPConn
+}
+
+// announce is a parsed BT-SEARCH message.
+type announce struct {
+	host       string
+	port       uint16
+	infohashes []string // Raw 20 byte infohashes
+	cookie     string
+}
+
+// ============================================================================
+// FUNK =======================================================================
+
+// New joins the multicast groups, or Group4 and Group6 if none are given,
+// and starts listening. Our peers are announced as listening on port. Groups
+// that can't be joined are skipped, e.g. on hosts without IPv6, but at least
+// one must work.
+func New(port uint16, groups ...string) (*LSD, error) {
+	if len(groups) == 0 {
+		groups = []string{Group4, Group6}
+	}
+
+	l := LSD{
+		port:       port,
+		cookie:     newCookie(),
+		infohashes: make(map[string]time.Time),
+		chPeers:    make(chan Peer, peersBufSize),
+		chAnnounce: make(chan struct{}, 1),
+		chDone:     make(chan struct{}),
+	}
+
+	for _, addr := range groups {
+		g, e := joinGroup(addr)
+		if e != nil {
+			log.Printf("lsd: failed to join %v: %v", addr, e)
+			continue
+		}
+		l.groups = append(l.groups, g)
+	}
+	if len(l.groups) == 0 {
+		return nil, &Error{msg: "could not join any multicast group"}
+	}
+
+	for _, g := range l.groups {
+		l.wg.Add(1)
+		go l.listen(g)
+	}
+	l.wg.Add(1)
+	go l.announceLoop()
+
+	return &l, nil
+}
+
+func joinGroup(addr string) (*group, error) {
+	gaddr, e := net.ResolveUDPAddr("udp", addr)
+	if e != nil {
+		return nil, e
+	}
+	network := "udp4"
+	if gaddr.IP.To4() == nil {
+		network = "udp6"
+	}
+
+	listen, e := net.ListenMulticastUDP(network, nil, gaddr)
+	if e != nil {
+		return nil, e
+	}
+	send, e := net.DialUDP(network, nil, gaddr)
+	if e != nil {
+		listen.Close()
+		return nil, e
+	}
+	return &group{addr: gaddr, listen: listen, send: send}, nil
+}
+
+// Peers returns the channel that discovered peers are sent on. Peers are
+// only reported for infohashes that have been added. The channel is closed
+// by Close.
+func (l *LSD) Peers() <-chan Peer {
+	return l.chPeers
+}
+
+// Add starts announcing the infohash. The first announce is sent right away.
+func (l *LSD) Add(infohash string) {
+	l.mutex.Lock()
+	if _, ok := l.infohashes[infohash]; !ok {
+		l.infohashes[infohash] = time.Time{}
+	}
+	l.mutex.Unlock()
+
+	select {
+	case l.chAnnounce <- struct{}{}:
+	default:
+	}
+}
+
+// Remove stops announcing the infohash, and reporting peers for it.
+func (l *LSD) Remove(infohash string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.infohashes, infohash)
+}
+
+// Close leaves the multicast groups and stops all goroutines.
+func (l *LSD) Close() {
+	l.closeOnce.Do(func() {
+		close(l.chDone)
+		for _, g := range l.groups {
+			g.listen.Close()
+			g.send.Close()
+		}
+		l.wg.Wait()
+		close(l.chPeers)
+	})
+}
+
+// announceLoop announces every infohash once per Interval, and new ones as
+// soon as they are added.
+func (l *LSD) announceLoop() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.chDone:
+			return
+		case <-l.chAnnounce:
+		case <-ticker.C:
+		}
+		l.announceDue()
+	}
+}
+
+// announceDue announces the infohashes that haven't been announced for
+// Interval, or ever.
+func (l *LSD) announceDue() {
+	now := time.Now()
+	due := make([]string, 0)
+
+	l.mutex.Lock()
+	for ih, last := range l.infohashes {
+		if now.Sub(last) >= Interval {
+			due = append(due, ih)
+			l.infohashes[ih] = now
+		}
+	}
+	l.mutex.Unlock()
+
+	for len(due) > 0 {
+		n := len(due)
+		if n > maxPerAnnounce {
+			n = maxPerAnnounce
+		}
+		for _, g := range l.groups {
+			msg := encodeAnnounce(g.addr.String(), l.port, due[:n], l.cookie)
+			_, e := g.send.Write(msg)
+			if e != nil {
+				log.Printf("lsd: failed to announce to %v: %v", g.addr, e)
+			}
+		}
+		due = due[n:]
+	}
+}
+
+// listen reads announces from the group until Close is called.
+func (l *LSD) listen(g *group) {
+	defer l.wg.Done()
+
+	var lastBad time.Time
+	numBad := 0
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, e := g.listen.ReadFromUDP(buf)
+		if e != nil {
+			select {
+			case <-l.chDone:
+			default:
+				log.Printf("lsd: stopped listening on %v: %v", g.addr, e)
+			}
+			return
+		}
+
+		a, e := parseAnnounce(buf[:n])
+		if e != nil {
+			numBad++
+			if time.Since(lastBad) >= badLogInterval {
+				log.Printf("lsd: %v bad announces, latest from %v: %v", numBad, from, e)
+				lastBad = time.Now()
+				numBad = 0
+			}
+			continue
+		}
+		if a.cookie == l.cookie {
+			continue
+		}
+		l.report(a, from.IP)
+	}
+}
+
+// report sends the announcing peer on the peers channel for every infohash
+// we are interested in. Peers are dropped if nobody is reading the channel.
+func (l *LSD) report(a *announce, ip net.IP) {
+	p := peer.MakePeer("", ip, a.port)
+	for _, ih := range a.infohashes {
+		l.mutex.Lock()
+		_, ok := l.infohashes[ih]
+		l.mutex.Unlock()
+		if !ok {
+			continue
+		}
+
+		select {
+		case l.chPeers <- Peer{Infohash: ih, Peer: p}:
+		default:
+		}
+	}
+}
+
+// ============================================================================
+// MESSAGES ===================================================================
+
+// encodeAnnounce makes a BT-SEARCH announce for the raw infohashes.
+func encodeAnnounce(host string, port uint16, infohashes []string, cookie string) []byte {
+	strb := strings.Builder{}
+	strb.WriteString(searchLine + "\r\n")
+	strb.WriteString(fmt.Sprintf("Host: %v\r\n", host))
+	strb.WriteString(fmt.Sprintf("Port: %v\r\n", port))
+	for _, ih := range infohashes {
+		strb.WriteString(fmt.Sprintf("Infohash: %v\r\n", hex.EncodeToString([]byte(ih))))
+	}
+	if cookie != "" {
+		strb.WriteString(fmt.Sprintf("cookie: %v\r\n", cookie))
+	}
+	strb.WriteString("\r\n\r\n")
+	return []byte(strb.String())
+}
+
+// parseAnnounce parses a BT-SEARCH announce. Header names are case
+// insensitive, and unknown headers are ignored.
+func parseAnnounce(data []byte) (*announce, error) {
+	lines := strings.Split(string(data), "\r\n")
+	if lines[0] != searchLine {
+		return nil, &Error{msg: "not a BT-SEARCH message"}
+	}
+
+	a := announce{}
+	hasPort := false
+	for _, line := range lines[1:] {
+		if line == "" {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, &Error{msg: fmt.Sprintf("bad header [%v]", line)}
+		}
+		name := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+
+		switch name {
+		case "host":
+			a.host = value
+		case "port":
+			port, e := strconv.ParseUint(value, 10, 16)
+			if e != nil || port == 0 {
+				return nil, &Error{msg: fmt.Sprintf("bad port [%v]", value)}
+			}
+			a.port = uint16(port)
+			hasPort = true
+		case "infohash":
+			ih, e := hex.DecodeString(value)
+			if e != nil || len(ih) != 20 {
+				return nil, &Error{msg: fmt.Sprintf("bad infohash [%v]", value)}
+			}
+			a.infohashes = append(a.infohashes, string(ih))
+		case "cookie":
+			a.cookie = value
+		}
+	}
+
+	if !hasPort {
+		return nil, &Error{msg: "missing port"}
+	}
+	if len(a.infohashes) == 0 {
+		return nil, &Error{msg: "missing infohash"}
+	}
+	return &a, nil
+}
+
+func newCookie() string {
+	buf := make([]byte, 8)
+	_, e := rand.Read(buf)
+	if e != nil {
+		panic(e)
+	}
+	return hex.EncodeToString(buf)
+}
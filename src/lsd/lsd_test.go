@@ -0,0 +1,91 @@
+package lsd
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gotor/utils"
+	"gotor/utils/test"
+)
+
+func TestParseAnnounce(t *testing.T) {
+	ih := utils.SHA1([]byte("torrent"))
+	tests := []struct {
+		name   string
+		data   string
+		port   uint16
+		nih    int
+		cookie string
+		err    bool
+	}{
+		{
+			name: "Encoded",
+			data: string(encodeAnnounce(Group4, 6881, []string{ih, ih}, "abc")),
+			port: 6881, nih: 2, cookie: "abc",
+		},
+		{
+			name: "Lowercase headers",
+			data: "BT-SEARCH * HTTP/1.1\r\nhost: " + Group4 + "\r\nport: 51413\r\ninfohash: " + strings.Repeat("AB", 20) + "\r\nx-other: 1\r\n\r\n\r\n",
+			port: 51413, nih: 1,
+		},
+		{name: "Not BT-SEARCH", data: "M-SEARCH * HTTP/1.1\r\n\r\n\r\n", err: true},
+		{name: "No port", data: "BT-SEARCH * HTTP/1.1\r\nInfohash: " + strings.Repeat("ab", 20) + "\r\n\r\n\r\n", err: true},
+		{name: "No infohash", data: "BT-SEARCH * HTTP/1.1\r\nPort: 1\r\n\r\n\r\n", err: true},
+		{name: "Short infohash", data: "BT-SEARCH * HTTP/1.1\r\nPort: 1\r\nInfohash: abab\r\n\r\n\r\n", err: true},
+		{name: "Bad port", data: "BT-SEARCH * HTTP/1.1\r\nPort: 70000\r\nInfohash: " + strings.Repeat("ab", 20) + "\r\n\r\n\r\n", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, e := parseAnnounce([]byte(tt.data))
+			if tt.err {
+				if e == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+			test.CheckFatal(t, e)
+			if a.port != tt.port || len(a.infohashes) != tt.nih || a.cookie != tt.cookie {
+				t.Errorf("got (%v, %v infohashes, %v), want (%v, %v, %v)", a.port, len(a.infohashes), a.cookie, tt.port, tt.nih, tt.cookie)
+			}
+		})
+	}
+}
+
+func TestLSD_Discover(t *testing.T) {
+	// Not the real port, so we don't talk to real clients
+	const group = "239.192.152.143:16771"
+	ih := utils.SHA1([]byte("shared"))
+
+	a, e := New(6881, group)
+	if e != nil {
+		t.Skipf("multicast unavailable: %v", e)
+	}
+	defer a.Close()
+	b, e := New(6882, group)
+	test.CheckFatal(t, e)
+	defer b.Close()
+
+	// Both must know the infohash before either announces it
+	for _, l := range []*LSD{a, b} {
+		l.mutex.Lock()
+		l.infohashes[ih] = time.Time{}
+		l.mutex.Unlock()
+	}
+	a.Add(ih)
+	b.Add(ih)
+
+	for _, tt := range []struct {
+		lsd  *LSD
+		port uint16
+	}{{a, 6882}, {b, 6881}} {
+		select {
+		case p := <-tt.lsd.Peers():
+			if p.Infohash != ih || p.Peer.Port() != tt.port {
+				t.Errorf("got peer %v for %x, want port %v", p.Peer.Addr(), p.Infohash, tt.port)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no peer found by the instance on %v", tt.port)
+		}
+	}
+}
@@ -1,14 +1,27 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"gotor/swarm"
+	"gotor/client"
 	"gotor/torrent"
+	"gotor/torrent/verify"
+	"gotor/tracker"
 	"gotor/utils"
 )
 
+// shutdownTimeout is how long we wait for peers and trackers when stopping.
+const shutdownTimeout = 30 * time.Second
+
+// scrapeTimeout is how long we wait for each tracker when scraping.
+const scrapeTimeout = 30 * time.Second
+
 func main() {
 
 	opts := utils.GetOpts()
@@ -20,6 +33,10 @@ func main() {
 		CmdSwarm(opts)
 	case utils.TorInfo:
 		CmdTorInfo(opts)
+	case utils.Scrape:
+		CmdScrape(opts)
+	case utils.Verify:
+		CmdVerify(opts)
 	default:
 		fmt.Printf("invalid command [%v]", opts.Cmd())
 	}
@@ -28,18 +45,57 @@ func main() {
 
 }
 
+// CmdSwarm runs every torrent given on the command line in one client, until
+// we get SIGINT or SIGTERM.
 func CmdSwarm(opts *utils.Opts) {
-	s, e := swarm.NewSwarm(opts)
+	cfg := client.DefaultConfig()
+	cfg.DataDir = opts.WorkingDir()
+	cfg.Port = opts.Port()
+	cfg.Encryption = opts.Encryption()
+	cfg.MaxConns = opts.MaxConns()
+	cfg.MaxPeers = opts.MaxPeers()
+	cfg.UpLimit = opts.UpLimit()
+	cfg.DnLimit = opts.DnLimit()
+	cfg.UTP = opts.UTP()
+	cfg.DHT = opts.DHT()
+	cfg.LSD = opts.LSD()
+	cfg.VerifyWorkers = opts.Workers()
+
+	c, e := client.New(cfg)
 	if e != nil {
 		log.Fatal(e)
 	}
 
-	fmt.Println("\n", s.String())
+	// Run until we are asked to stop, which also stops adding torrents
+	sigCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	s.Start()
+	for _, input := range opts.Inputs() {
+		t, e := c.Add(sigCtx, input)
+		if sigCtx.Err() != nil {
+			break
+		}
+		if e != nil {
+			log.Printf("failed to add [%v]: %v", input, e)
+			continue
+		}
+		p := t.Progress()
+		fmt.Printf("\n%v [%v]: have %v/%v pieces\n", t.Name(), t.InfohashHex(), p.PiecesDone, p.Pieces)
+	}
+	if sigCtx.Err() == nil && len(c.Torrents()) == 0 {
+		_ = c.Close(context.Background())
+		log.Fatal("no torrents to run")
+	}
 
-	for {
+	<-sigCtx.Done()
+	stop()
+	log.Printf("stopping")
 
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	e = c.Close(ctx)
+	if e != nil {
+		log.Printf("failed to stop cleanly: %v", e)
 	}
 }
 
@@ -50,3 +106,61 @@ func CmdTorInfo(opts *utils.Opts) {
 	}
 	fmt.Println(tor.String())
 }
+
+// CmdScrape scrapes every tracker of the torrent and prints one line per
+// tracker, so swarm health can be checked from scripts.
+func CmdScrape(opts *utils.Opts) {
+	tor, e := torrent.FromTorrentFile(opts.Input(), opts.WorkingDir())
+	if e != nil {
+		log.Fatal(e)
+	}
+
+	for _, tier := range tor.AnnounceList() {
+		for _, announceUrl := range tier {
+			ctx, cancel := context.WithTimeout(context.Background(), scrapeTimeout)
+			results, e := tracker.Scrape(ctx, announceUrl, []string{tor.Infohash()})
+			cancel()
+			if e != nil {
+				fmt.Printf("%v error %v\n", announceUrl, e)
+				continue
+			}
+			r := results[0]
+			fmt.Printf("%v seeders=%v leechers=%v downloaded=%v\n", announceUrl, r.Seeders, r.Leechers, r.Downloaded)
+		}
+	}
+}
+
+// CmdVerify checks which pieces of the torrent are in the working directory,
+// without creating or changing any file. Exits with status 1 if any piece is
+// missing, so downloads can be checked from scripts.
+func CmdVerify(opts *utils.Opts) {
+	tor, e := torrent.FromTorrentFile(opts.Input(), opts.WorkingDir())
+	if e != nil {
+		log.Fatal(e)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	v := verify.Verifier{
+		Workers: opts.Workers(),
+		OnProgress: func(p verify.Progress) {
+			fmt.Printf("\rchecked %v/%v pieces, have %v", p.Checked, p.Total, p.Have)
+		},
+	}
+	res, e := v.Verify(ctx, tor.Info())
+	fmt.Println()
+	if e != nil {
+		log.Fatal(e)
+	}
+
+	for _, fpath := range res.Missing {
+		fmt.Printf("missing file %v\n", fpath)
+	}
+	have := res.Have
+	pcent := 100 * float64(have.Nset()) / float64(have.Nbits())
+	fmt.Printf("%v [%x]: have %v/%v (%.1f%%) pieces\n", tor.Info().Name(), tor.Infohash(), have.Nset(), have.Nbits(), pcent)
+	if !have.Complete() {
+		os.Exit(1)
+	}
+}
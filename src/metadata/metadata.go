@@ -0,0 +1,232 @@
+/* metadata.go ================================================================
+The metadata extension (BEP_0009), which lets peers send each other the info
+dictionary of a torrent, so that a download can start from just a magnet
+link. The info dictionary is split into 16KiB pieces which are requested one
+at a time, and the whole thing is verified against the infohash once every
+piece has arrived.
+============================================================================ */
+
+package metadata
+
+import (
+	"fmt"
+
+	"gotor/bencode"
+	"gotor/utils"
+)
+
+const (
+	// ExtName is the name of the extension in the extended handshake
+	ExtName = "ut_metadata"
+
+	// PieceLen is the size of every metadata piece except the last
+	PieceLen = 16384
+
+	// MaxSize is the largest info dictionary we will accept. Real ones are
+	// usually well under a megabyte.
+	MaxSize = 16 * 1024 * 1024
+
+	TypeRequest = int64(0)
+	TypeData    = int64(1)
+	TypeReject  = int64(2)
+)
+
+// ============================================================================
+// ERRORS =====================================================================
+
+type Error struct{ msg string }
+
+func (e *Error) Error() string {
+	return "metadata error: " + e.msg
+}
+
+// ============================================================================
+// MESSAGE ====================================================================
+
+// Msg is a single ut_metadata message. Data is only set for data messages,
+// and TotalSize is only meaningful for data messages.
+type Msg struct {
+	Type      int64
+	Piece     int64
+	TotalSize int64
+	Data      []byte
+}
+
+func NewRequest(piece int64) *Msg {
+	return &Msg{Type: TypeRequest, Piece: piece}
+}
+
+func NewData(piece int64, totalSize int64, data []byte) *Msg {
+	return &Msg{Type: TypeData, Piece: piece, TotalSize: totalSize, Data: data}
+}
+
+func NewReject(piece int64) *Msg {
+	return &Msg{Type: TypeReject, Piece: piece}
+}
+
+// Encode encodes the message as the payload of an extended message. Data
+// messages have the piece appended after the bencoded dictionary.
+func (m *Msg) Encode() ([]byte, error) {
+	dict := bencode.Dict{
+		"msg_type": m.Type,
+		"piece":    m.Piece,
+	}
+	if m.Type == TypeData {
+		dict["total_size"] = m.TotalSize
+	}
+
+	enc, e := bencode.Encode(dict)
+	if e != nil {
+		return nil, e
+	}
+	return append(enc, m.Data...), nil
+}
+
+// DecodeMsg decodes the payload of an extended ut_metadata message.
+func DecodeMsg(payload []byte) (*Msg, error) {
+	ben, n, e := bencode.DecodePrefix(payload)
+	if e != nil {
+		return nil, e
+	}
+	dict, ok := ben.(bencode.Dict)
+	if !ok {
+		return nil, &Error{msg: "message is not a dictionary"}
+	}
+
+	m := Msg{}
+	if m.Type, e = dict.GetInt("msg_type"); e != nil {
+		return nil, e
+	}
+	if m.Piece, e = dict.GetInt("piece"); e != nil {
+		return nil, e
+	}
+
+	switch m.Type {
+	case TypeRequest, TypeReject:
+	case TypeData:
+		if m.TotalSize, e = dict.GetInt("total_size"); e != nil {
+			return nil, e
+		}
+		m.Data = make([]byte, len(payload)-n)
+		copy(m.Data, payload[n:])
+	default:
+		return nil, &Error{msg: fmt.Sprintf("unknown msg_type %v", m.Type)}
+	}
+
+	return &m, nil
+}
+
+// PieceData returns the given piece of a bencoded info dictionary, or false if
+// there is no such piece.
+func PieceData(info []byte, piece int64) ([]byte, bool) {
+	start := piece * PieceLen
+	if piece < 0 || start >= int64(len(info)) {
+		return nil, false
+	}
+	end := start + PieceLen
+	if end > int64(len(info)) {
+		end = int64(len(info))
+	}
+	return info[start:end], true
+}
+
+// ============================================================================
+// ASSEMBLER ==================================================================
+
+// Assembler collects metadata pieces until the full info dictionary has been
+// received.
+type Assembler struct {
+	infohash string
+	data     []byte
+	have     []bool
+	nhave    int
+}
+
+// NewAssembler makes an assembler for metadata of the given size, as given
+// by the metadata_size key of a peer's extended handshake.
+func NewAssembler(infohash string, size int64) (*Assembler, error) {
+	if size <= 0 || size > MaxSize {
+		return nil, &Error{msg: fmt.Sprintf("bad metadata size %v", size)}
+	}
+	npieces := (size + PieceLen - 1) / PieceLen
+	return &Assembler{
+		infohash: infohash,
+		data:     make([]byte, size),
+		have:     make([]bool, npieces),
+	}, nil
+}
+
+func (a *Assembler) Size() int64 {
+	return int64(len(a.data))
+}
+
+func (a *Assembler) NumPieces() int64 {
+	return int64(len(a.have))
+}
+
+// Missing returns the indices of the pieces that haven't been received.
+func (a *Assembler) Missing() []int64 {
+	missing := make([]int64, 0, len(a.have)-a.nhave)
+	for i, ok := range a.have {
+		if !ok {
+			missing = append(missing, int64(i))
+		}
+	}
+	return missing
+}
+
+// Put stores a received piece. Pieces must be PieceLen long, except for the
+// last which holds whatever is left.
+func (a *Assembler) Put(piece int64, data []byte) error {
+	if piece < 0 || piece >= a.NumPieces() {
+		return &Error{msg: fmt.Sprintf("piece %v out of range", piece)}
+	}
+
+	start := piece * PieceLen
+	want := a.Size() - start
+	if want > PieceLen {
+		want = PieceLen
+	}
+	if int64(len(data)) != want {
+		return &Error{msg: fmt.Sprintf("piece %v has length %v, expected %v", piece, len(data), want)}
+	}
+
+	copy(a.data[start:], data)
+	if !a.have[piece] {
+		a.have[piece] = true
+		a.nhave++
+	}
+	return nil
+}
+
+// Done returns true once every piece has been received.
+func (a *Assembler) Done() bool {
+	return a.nhave == len(a.have)
+}
+
+// Verify checks the SHA1 of the assembled metadata against the infohash and
+// returns the decoded info dictionary. If the hash doesn't match, every piece
+// is thrown away so that the metadata can be fetched again.
+func (a *Assembler) Verify() (bencode.Dict, error) {
+	if !a.Done() {
+		return nil, &Error{msg: "metadata is incomplete"}
+	}
+
+	if utils.SHA1(a.data) != a.infohash {
+		for i := range a.have {
+			a.have[i] = false
+		}
+		a.nhave = 0
+		return nil, &Error{msg: "metadata does not match infohash"}
+	}
+
+	ben, e := bencode.Decode(a.data)
+	if e != nil {
+		return nil, e
+	}
+	dict, ok := ben.(bencode.Dict)
+	if !ok {
+		return nil, &Error{msg: "metadata is not a dictionary"}
+	}
+	return dict, nil
+}
@@ -0,0 +1,124 @@
+package metadata
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"gotor/bencode"
+	"gotor/utils"
+	"gotor/utils/test"
+)
+
+func TestMsg_Encode(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *Msg
+		raw  string // Expected encoding
+	}{
+		{"request", NewRequest(0), "d8:msg_typei0e5:piecei0ee"},
+		{"data", NewData(1, 20000, []byte("xyz")), "d8:msg_typei1e5:piecei1e10:total_sizei20000eexyz"},
+		{"reject", NewReject(3), "d8:msg_typei2e5:piecei3ee"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc, e := tt.msg.Encode()
+			test.CheckFatal(t, e)
+			if string(enc) != tt.raw {
+				t.Errorf("encoded [%s], want [%s]", enc, tt.raw)
+			}
+
+			got, e := DecodeMsg(enc)
+			test.CheckFatal(t, e)
+			if got.Type != tt.msg.Type || got.Piece != tt.msg.Piece || got.TotalSize != tt.msg.TotalSize {
+				t.Errorf("decoded %+v, want %+v", got, tt.msg)
+			}
+			if !bytes.Equal(got.Data, tt.msg.Data) {
+				t.Errorf("decoded data [%s], want [%s]", got.Data, tt.msg.Data)
+			}
+		})
+	}
+}
+
+func TestAssembler(t *testing.T) {
+	// Info dict that needs 3 pieces
+	info := bencode.Dict{
+		"name":   "file",
+		"pieces": string(make([]byte, 2*PieceLen+100)),
+	}
+	raw, e := bencode.Encode(info)
+	test.CheckFatal(t, e)
+	infohash := utils.SHA1(raw)
+
+	a, e := NewAssembler(infohash, int64(len(raw)))
+	test.CheckFatal(t, e)
+	if a.NumPieces() != 3 {
+		t.Fatalf("assembler has %v pieces, want 3", a.NumPieces())
+	}
+
+	// Wrong length for the last piece
+	if e = a.Put(2, raw[:PieceLen]); e == nil {
+		t.Error("expected error for bad piece length")
+	}
+
+	for _, i := range []int64{2, 0} {
+		end := (i + 1) * PieceLen
+		if end > int64(len(raw)) {
+			end = int64(len(raw))
+		}
+		test.CheckFatal(t, a.Put(i, raw[i*PieceLen:end]))
+	}
+	if a.Done() || !reflect.DeepEqual(a.Missing(), []int64{1}) {
+		t.Fatalf("missing %v, want [1]", a.Missing())
+	}
+
+	// Corrupt piece, should fail verification and start over
+	test.CheckFatal(t, a.Put(1, bytes.Repeat([]byte{0xFF}, PieceLen)))
+	if _, e = a.Verify(); e == nil {
+		t.Fatal("expected verification error")
+	}
+	if len(a.Missing()) != 3 {
+		t.Fatalf("missing %v pieces after failed verify, want 3", len(a.Missing()))
+	}
+
+	for i := int64(0); i < 3; i++ {
+		end := (i + 1) * PieceLen
+		if end > int64(len(raw)) {
+			end = int64(len(raw))
+		}
+		test.CheckFatal(t, a.Put(i, raw[i*PieceLen:end]))
+	}
+	got, e := a.Verify()
+	test.CheckFatal(t, e)
+	if name, _ := got.GetString("name"); name != "file" {
+		t.Errorf("bad info dict %v", got)
+	}
+}
+
+func TestPieceData(t *testing.T) {
+	info := make([]byte, PieceLen+10)
+	tests := []struct {
+		piece int64
+		len   int
+		ok    bool
+	}{
+		{piece: 0, len: PieceLen, ok: true},
+		{piece: 1, len: 10, ok: true},
+		{piece: 2},
+		{piece: -1},
+	}
+	for _, tt := range tests {
+		data, ok := PieceData(info, tt.piece)
+		if ok != tt.ok || len(data) != tt.len {
+			t.Errorf("piece %v: got (%v bytes, %v), want (%v bytes, %v)", tt.piece, len(data), ok, tt.len, tt.ok)
+		}
+	}
+}
+
+func TestNewAssembler_BadSize(t *testing.T) {
+	for _, size := range []int64{0, -1, MaxSize + 1} {
+		if _, e := NewAssembler("", size); e == nil {
+			t.Errorf("expected error for size %v", size)
+		}
+	}
+}
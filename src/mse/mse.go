@@ -0,0 +1,423 @@
+/* mse.go =====================================================================
+Message Stream Encryption, also known as protocol encryption. Peers agree on
+a shared secret with a Diffie-Hellman key exchange, prove that they know the
+infohash of the torrent without sending it in the clear, and then encrypt
+the rest of the connection with RC4. It is meant to hide BitTorrent traffic
+from throttling, not to keep it secret from a determined observer.
+
+The handshake, with A the initiating side and B the receiving side:
+
+	1 A->B: Ya, PadA
+	2 B->A: Yb, PadB
+	3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	        ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD), ENCRYPT2(payload)
+	5 A->B: ENCRYPT2(payload)
+
+S is the shared secret, SKEY is the infohash, and VC is 8 zero bytes. The
+pads are random garbage of up to 512 bytes, so each side finds the start of
+the next step by searching for a value only it can compute.
+============================================================================ */
+
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+)
+
+// Policy decides whether connections are encrypted.
+type Policy int
+
+const (
+	Disabled Policy = iota // Plaintext connections only
+	Prefer                 // Encrypt when the peer can, fall back to plaintext
+	Require                // Encrypted connections only
+)
+
+// Crypto methods for crypto_provide and crypto_select
+const (
+	CryptoPlaintext = uint32(0x01)
+	CryptoRC4       = uint32(0x02)
+)
+
+const (
+	keyLen    = 96  // Length of the public keys and the shared secret
+	maxPadLen = 512 // Longest pad allowed
+	vcLen     = 8   // Length of the verification constant
+
+	// btPrefix is how plaintext BitTorrent connections start
+	btPrefix = "\x13BitTorrent protocol"
+)
+
+var (
+	// dhPrime is the 768 bit safe prime used for the key exchange
+	dhPrime, _ = new(big.Int).SetString(
+		"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74"+
+			"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+			"4FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	dhGenerator = big.NewInt(2)
+)
+
+// ============================================================================
+// ERRORS =====================================================================
+
+type Error struct{ msg string }
+
+func (e *Error) Error() string {
+	return "mse error: " + e.msg
+}
+
+// ============================================================================
+// CONN =======================================================================
+
+// Conn is a connection that has finished the handshake. Reads and writes are
+// decrypted and encrypted if RC4 was selected, and passed through otherwise.
+type Conn struct {
+	net.Conn
+	r      io.Reader // Holds on to data read past the handshake
+	enc    *rc4.Cipher
+	dec    *rc4.Cipher
+	method uint32
+	wmutex sync.Mutex // Keeps the encrypt stream in the same order as writes
+}
+
+// Method returns the selected crypto method, CryptoRC4 or CryptoPlaintext.
+func (c *Conn) Method() uint32 {
+	return c.method
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	n, e := c.r.Read(b)
+	if c.dec != nil {
+		c.dec.XORKeyStream(b[:n], b[:n])
+	}
+	return n, e
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+
+	buf := make([]byte, len(b))
+	c.enc.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+// ============================================================================
+// HANDSHAKE ==================================================================
+
+// Initiate runs the handshake as the connecting side. Require only offers
+// RC4, Prefer offers RC4 and plaintext and lets the peer pick. Disabled skips
+// the handshake altogether. Callers should set a deadline on conn.
+func Initiate(conn net.Conn, infohash string, policy Policy) (*Conn, error) {
+	switch policy {
+	case Disabled:
+		return &Conn{Conn: conn, r: conn, method: CryptoPlaintext}, nil
+	case Require:
+		return initiate(conn, infohash, CryptoRC4)
+	default:
+		return initiate(conn, infohash, CryptoRC4|CryptoPlaintext)
+	}
+}
+
+func initiate(conn net.Conn, infohash string, provide uint32) (*Conn, error) {
+	br := bufio.NewReader(conn)
+
+	// 1. Ya, PadA
+	priv, pub, e := newKeyPair()
+	if e != nil {
+		return nil, e
+	}
+	if e = writeWithPad(conn, pub); e != nil {
+		return nil, e
+	}
+
+	// 2. Yb, PadB
+	yb := make([]byte, keyLen)
+	if _, e = io.ReadFull(br, yb); e != nil {
+		return nil, e
+	}
+	s := sharedSecret(priv, yb)
+	enc, dec := ciphers(s, infohash, true)
+
+	// 3. Everything is sent in one go, with no PadC and no IA
+	buf := bytes.Buffer{}
+	buf.Write(hash("req1", s))
+	buf.Write(xor(hash("req2", []byte(infohash)), hash("req3", s)))
+	plain := make([]byte, vcLen+4+2+2)
+	binary.BigEndian.PutUint32(plain[vcLen:], provide)
+	enc.XORKeyStream(plain, plain)
+	buf.Write(plain)
+	if _, e = conn.Write(buf.Bytes()); e != nil {
+		return nil, e
+	}
+
+	// 4. Find ENCRYPT(VC) after PadB. VC is all zeros, so it encrypts to
+	// the start of the key stream.
+	vc := make([]byte, vcLen)
+	dec.XORKeyStream(vc, vc)
+	if e = syncTo(br, vc, maxPadLen+vcLen); e != nil {
+		return nil, e
+	}
+
+	hdr := make([]byte, 4+2)
+	if _, e = io.ReadFull(br, hdr); e != nil {
+		return nil, e
+	}
+	dec.XORKeyStream(hdr, hdr)
+	selected := binary.BigEndian.Uint32(hdr)
+	padLen := binary.BigEndian.Uint16(hdr[4:])
+	if padLen > maxPadLen {
+		return nil, &Error{msg: fmt.Sprintf("padD too long [%v]", padLen)}
+	}
+	pad := make([]byte, padLen)
+	if _, e = io.ReadFull(br, pad); e != nil {
+		return nil, e
+	}
+	dec.XORKeyStream(pad, pad)
+
+	c := Conn{Conn: conn, r: br, method: selected}
+	switch selected {
+	case CryptoRC4:
+		c.enc, c.dec = enc, dec
+	case CryptoPlaintext:
+	default:
+		return nil, &Error{msg: fmt.Sprintf("peer selected unknown crypto method %#x", selected)}
+	}
+	if selected&provide == 0 {
+		return nil, &Error{msg: fmt.Sprintf("peer selected crypto method %#x we didn't offer", selected)}
+	}
+	return &c, nil
+}
+
+// Accept runs the handshake as the receiving side. Plaintext BitTorrent
+// connections are told apart by their first bytes, and are let through
+// unless the policy is Require. Encrypted connections must be for one of
+// the infohashes, which is returned ("" for plaintext connections).
+// Callers should set a deadline on conn.
+func Accept(conn net.Conn, infohashes []string, policy Policy) (*Conn, string, error) {
+	br := bufio.NewReader(conn)
+
+	// The BitTorrent handshake can't be mistaken for Ya, which is 96 bytes
+	// long and has no such prefix in practice
+	prefix, e := br.Peek(len(btPrefix))
+	if e != nil {
+		return nil, "", e
+	}
+	if string(prefix) == btPrefix {
+		if policy == Require {
+			return nil, "", &Error{msg: "plaintext connection, but encryption is required"}
+		}
+		return &Conn{Conn: conn, r: br, method: CryptoPlaintext}, "", nil
+	}
+	if policy == Disabled {
+		return nil, "", &Error{msg: "encrypted connection, but encryption is disabled"}
+	}
+
+	// 1. Ya, PadA
+	ya := make([]byte, keyLen)
+	if _, e = io.ReadFull(br, ya); e != nil {
+		return nil, "", e
+	}
+
+	// 2. Yb, PadB
+	priv, pub, e := newKeyPair()
+	if e != nil {
+		return nil, "", e
+	}
+	if e = writeWithPad(conn, pub); e != nil {
+		return nil, "", e
+	}
+	s := sharedSecret(priv, ya)
+
+	// 3. Find HASH('req1', S) after PadA, then work out the infohash
+	if e = syncTo(br, hash("req1", s), maxPadLen+sha1.Size); e != nil {
+		return nil, "", e
+	}
+	skeyHash := make([]byte, sha1.Size)
+	if _, e = io.ReadFull(br, skeyHash); e != nil {
+		return nil, "", e
+	}
+	skeyHash = xor(skeyHash, hash("req3", s))
+
+	infohash := ""
+	for _, ih := range infohashes {
+		if bytes.Equal(skeyHash, hash("req2", []byte(ih))) {
+			infohash = ih
+			break
+		}
+	}
+	if infohash == "" {
+		return nil, "", &Error{msg: "peer wants a torrent we don't have"}
+	}
+	enc, dec := ciphers(s, infohash, false)
+
+	hdr := make([]byte, vcLen+4+2)
+	if _, e = io.ReadFull(br, hdr); e != nil {
+		return nil, "", e
+	}
+	dec.XORKeyStream(hdr, hdr)
+	if !bytes.Equal(hdr[:vcLen], make([]byte, vcLen)) {
+		return nil, "", &Error{msg: "bad verification constant"}
+	}
+	provide := binary.BigEndian.Uint32(hdr[vcLen:])
+	padLen := binary.BigEndian.Uint16(hdr[vcLen+4:])
+	if padLen > maxPadLen {
+		return nil, "", &Error{msg: fmt.Sprintf("padC too long [%v]", padLen)}
+	}
+
+	// PadC is thrown away, IA is the start of the payload stream
+	rest := make([]byte, int(padLen)+2)
+	if _, e = io.ReadFull(br, rest); e != nil {
+		return nil, "", e
+	}
+	dec.XORKeyStream(rest, rest)
+	ia := make([]byte, binary.BigEndian.Uint16(rest[padLen:]))
+	if _, e = io.ReadFull(br, ia); e != nil {
+		return nil, "", e
+	}
+	dec.XORKeyStream(ia, ia)
+
+	selected := CryptoRC4
+	if provide&CryptoRC4 == 0 {
+		if provide&CryptoPlaintext == 0 || policy == Require {
+			return nil, "", &Error{msg: fmt.Sprintf("no acceptable crypto method in %#x", provide)}
+		}
+		selected = CryptoPlaintext
+	}
+
+	// 4. VC, crypto_select, no padD
+	reply := make([]byte, vcLen+4+2)
+	binary.BigEndian.PutUint32(reply[vcLen:], selected)
+	enc.XORKeyStream(reply, reply)
+	if _, e = conn.Write(reply); e != nil {
+		return nil, "", e
+	}
+
+	c := Conn{Conn: conn, r: io.MultiReader(bytes.NewReader(ia), br), method: selected}
+	if selected == CryptoRC4 {
+		c.enc, c.dec = enc, dec
+	}
+	return &c, infohash, nil
+}
+
+// ============================================================================
+// HELPERS ====================================================================
+
+// newKeyPair makes a random 160 bit private key and its public key.
+func newKeyPair() (*big.Int, []byte, error) {
+	buf := make([]byte, 20)
+	if _, e := rand.Read(buf); e != nil {
+		return nil, nil, e
+	}
+	priv := new(big.Int).SetBytes(buf)
+	pub := new(big.Int).Exp(dhGenerator, priv, dhPrime)
+	return priv, padKey(pub), nil
+}
+
+// sharedSecret computes S from our private key and the peer's public key.
+func sharedSecret(priv *big.Int, peerPub []byte) []byte {
+	y := new(big.Int).SetBytes(peerPub)
+	return padKey(new(big.Int).Exp(y, priv, dhPrime))
+}
+
+// padKey encodes a key as exactly keyLen big endian bytes.
+func padKey(n *big.Int) []byte {
+	buf := make([]byte, keyLen)
+	n.FillBytes(buf)
+	return buf
+}
+
+// ciphers returns the encrypt and decrypt streams of one side. A encrypts
+// with keyA and B with keyB, and both drop the first 1024 bytes of the key
+// stream.
+func ciphers(s []byte, infohash string, initiator bool) (*rc4.Cipher, *rc4.Cipher) {
+	keyA := hash("keyA", s, []byte(infohash))
+	keyB := hash("keyB", s, []byte(infohash))
+	if !initiator {
+		keyA, keyB = keyB, keyA
+	}
+	enc, _ := rc4.NewCipher(keyA)
+	dec, _ := rc4.NewCipher(keyB)
+
+	discard := make([]byte, 1024)
+	enc.XORKeyStream(discard, discard)
+	dec.XORKeyStream(discard, discard)
+	return enc, dec
+}
+
+// hash returns the SHA1 of the prefix followed by the parts.
+func hash(prefix string, parts ...[]byte) []byte {
+	h := sha1.New()
+	h.Write([]byte(prefix))
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func xor(a []byte, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// writeWithPad writes the key followed by a random pad.
+func writeWithPad(w io.Writer, key []byte) error {
+	n := make([]byte, 2)
+	if _, e := rand.Read(n); e != nil {
+		return e
+	}
+	pad := make([]byte, int(binary.BigEndian.Uint16(n))%(maxPadLen+1))
+	if _, e := rand.Read(pad); e != nil {
+		return e
+	}
+	_, e := w.Write(append(append([]byte{}, key...), pad...))
+	return e
+}
+
+// syncTo reads from r until just after the pattern, which must show up
+// within the first limit bytes.
+func syncTo(r *bufio.Reader, pattern []byte, limit int) error {
+	window := make([]byte, 0, limit)
+	for len(window) < limit {
+		b, e := r.ReadByte()
+		if e != nil {
+			return e
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return &Error{msg: "could not find the start of the handshake"}
+}
+
+// ParsePolicy parses "disabled", "prefer" or "require".
+func ParsePolicy(s string) (Policy, error) {
+	switch s {
+	case "disabled":
+		return Disabled, nil
+	case "prefer":
+		return Prefer, nil
+	case "require":
+		return Require, nil
+	}
+	return Disabled, fmt.Errorf("invalid encryption policy [%v]", s)
+}
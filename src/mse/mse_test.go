@@ -0,0 +1,170 @@
+package mse
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"gotor/utils/test"
+)
+
+// connPair returns the two ends of a loopback TCP connection.
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	test.CheckFatal(t, e)
+	defer l.Close()
+
+	chConn := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		chConn <- c
+	}()
+	a, e := net.Dial("tcp", l.Addr().String())
+	test.CheckFatal(t, e)
+	b := <-chConn
+	if b == nil {
+		t.Fatal("accept failed")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	a.SetDeadline(deadline)
+	b.SetDeadline(deadline)
+	return a, b
+}
+
+type acceptResult struct {
+	conn     *Conn
+	infohash string
+	err      error
+}
+
+func TestHandshake(t *testing.T) {
+	ih := string(hash("torrent"))
+	other := string(hash("other"))
+	tests := []struct {
+		name    string
+		provide uint32
+		policy  Policy
+		known   []string
+		method  uint32
+		err     bool
+	}{
+		{name: "RC4", provide: CryptoRC4 | CryptoPlaintext, policy: Prefer, known: []string{other, ih}, method: CryptoRC4},
+		{name: "RC4 only", provide: CryptoRC4, policy: Require, known: []string{ih}, method: CryptoRC4},
+		{name: "Plaintext selected", provide: CryptoPlaintext, policy: Prefer, known: []string{ih}, method: CryptoPlaintext},
+		{name: "Plaintext refused", provide: CryptoPlaintext, policy: Require, known: []string{ih}, err: true},
+		{name: "Unknown infohash", provide: CryptoRC4, policy: Prefer, known: []string{other}, err: true},
+		{name: "Encryption disabled", provide: CryptoRC4, policy: Disabled, known: []string{ih}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := connPair(t)
+			defer a.Close()
+			defer b.Close()
+
+			chRes := make(chan acceptResult, 1)
+			go func() {
+				c, got, e := Accept(b, tt.known, tt.policy)
+				if e != nil {
+					b.Close()
+				}
+				chRes <- acceptResult{c, got, e}
+			}()
+
+			ca, ea := initiate(a, ih, tt.provide)
+			res := <-chRes
+			if tt.err {
+				if ea == nil || res.err == nil {
+					t.Fatalf("expected both sides to fail, got %v and %v", ea, res.err)
+				}
+				return
+			}
+			test.CheckFatal(t, ea)
+			test.CheckFatal(t, res.err)
+
+			if res.infohash != ih {
+				t.Errorf("accepted wrong infohash %x", res.infohash)
+			}
+			if ca.Method() != tt.method || res.conn.Method() != tt.method {
+				t.Errorf("expected method %v, got %v and %v", tt.method, ca.Method(), res.conn.Method())
+			}
+			exchange(t, ca, res.conn)
+		})
+	}
+}
+
+func TestAcceptPlaintext(t *testing.T) {
+	ih := string(hash("torrent"))
+	tests := []struct {
+		name   string
+		policy Policy
+		err    bool
+	}{
+		{name: "Disabled", policy: Disabled},
+		{name: "Prefer", policy: Prefer},
+		{name: "Require", policy: Require, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := connPair(t)
+			defer a.Close()
+			defer b.Close()
+
+			ca, e := Initiate(a, ih, Disabled)
+			test.CheckFatal(t, e)
+			hs := btPrefix + "rest of the handshake"
+			go ca.Write([]byte(hs))
+
+			cb, got, e := Accept(b, []string{ih}, tt.policy)
+			if tt.err {
+				if e == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			test.CheckFatal(t, e)
+			if got != "" || cb.Method() != CryptoPlaintext {
+				t.Fatalf("expected plaintext without infohash, got %v and %x", cb.Method(), got)
+			}
+
+			// The peeked bytes must not be lost
+			buf := make([]byte, len(hs))
+			_, e = io.ReadFull(cb, buf)
+			test.CheckFatal(t, e)
+			if string(buf) != hs {
+				t.Errorf("expected %q, got %q", hs, buf)
+			}
+		})
+	}
+}
+
+// exchange checks that data makes it across in both directions.
+func exchange(t *testing.T, a *Conn, b *Conn) {
+	t.Helper()
+	for _, pair := range [][2]*Conn{{a, b}, {b, a}} {
+		msg := []byte("hello over the wire, twice over")
+		for i := 0; i < 2; i++ {
+			go pair[0].Write(msg)
+			buf := make([]byte, len(msg))
+			_, e := io.ReadFull(pair[1], buf)
+			test.CheckFatal(t, e)
+			if string(buf) != string(msg) {
+				t.Fatalf("expected %q, got %q", msg, buf)
+			}
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for s, p := range map[string]Policy{"disabled": Disabled, "prefer": Prefer, "require": Require} {
+		got, e := ParsePolicy(s)
+		test.CheckFatal(t, e)
+		if got != p {
+			t.Errorf("%v: expected %v, got %v", s, p, got)
+		}
+	}
+	if _, e := ParsePolicy("always"); e == nil {
+		t.Error("expected error for bad policy")
+	}
+}
@@ -0,0 +1,97 @@
+/* cancel.go ==================================================================
+Implements the cancel protocol message. The payload is identical to that of
+a request message, since it cancels a previously sent request.
+============================================================================ */
+
+package p2p
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	// MsgCancelTotalLen is the total length of a cancel message (len 4 + id 1 + payload 12)
+	MsgCancelTotalLen = uint8(17)
+
+	// MsgCancelSpecLen is the length of the message as defined in BEP_0003
+	MsgCancelSpecLen = uint32(13)
+
+	// MsgCancelPayloadLen is the payload size in bytes
+	MsgCancelPayloadLen = uint32(12)
+)
+
+// ============================================================================
+// TYPES ======================================================================
+
+type MsgCancel struct {
+	msgBase
+	index  uint32
+	begin  uint32
+	reqlen uint32 // Length of the cancelled request, not message
+}
+
+// ============================================================================
+// CONSTRUCTORS ===============================================================
+
+func NewMsgCancel(index uint32, begin uint32, reqlen uint32) *MsgCancel {
+	return &MsgCancel{
+		msgBase: msgBase{
+			length: MsgCancelSpecLen,
+			mtype:  TypeCancel,
+		},
+		index:  index,
+		begin:  begin,
+		reqlen: reqlen,
+	}
+}
+
+// ============================================================================
+// GETTER =====================================================================
+
+func (mc *MsgCancel) Index() uint32 {
+	return mc.index
+}
+
+func (mc *MsgCancel) Begin() uint32 {
+	return mc.begin
+}
+
+func (mc *MsgCancel) ReqLen() uint32 {
+	return mc.reqlen
+}
+
+// ============================================================================
+// IMPL =======================================================================
+
+func (mc *MsgCancel) Encode() []byte {
+	pl := make([]byte, MsgCancelTotalLen, MsgCancelTotalLen)
+	mc.msgBase.fillBase(pl)
+	binary.BigEndian.PutUint32(pl[PayloadStart:], mc.index)
+	binary.BigEndian.PutUint32(pl[PayloadStart+4:], mc.begin)
+	binary.BigEndian.PutUint32(pl[PayloadStart+8:], mc.reqlen)
+	return pl
+}
+
+func (mc *MsgCancel) String() string {
+	strb := strings.Builder{}
+	strb.WriteString("Message: Cancel\n")
+	strb.WriteString(fmt.Sprintf("Index: %v\n", mc.index))
+	strb.WriteString(fmt.Sprintf("Begin: %v\n", mc.begin))
+	strb.WriteString(fmt.Sprintf("Req Len: %v", mc.reqlen))
+	return strb.String()
+}
+
+// ============================================================================
+// FUNC =======================================================================
+
+func DecodeMsgCancel(payload []byte) (*MsgCancel, error) {
+	if uint32(len(payload)) != MsgCancelPayloadLen {
+		return nil, fmt.Errorf("cancel message must have %v byte payload, got %v", MsgCancelPayloadLen, len(payload))
+	}
+	index := binary.BigEndian.Uint32(payload[0:4])
+	begin := binary.BigEndian.Uint32(payload[4:8])
+	reqlen := binary.BigEndian.Uint32(payload[8:12])
+	return NewMsgCancel(index, begin, reqlen), nil
+}
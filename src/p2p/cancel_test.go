@@ -0,0 +1,91 @@
+package p2p
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCancelDecode(t *testing.T) {
+	tests := []struct {
+		name   string
+		index  uint32
+		begin  uint32
+		reqlen uint32
+		data   []byte
+		err    bool
+	}{
+		{
+			name:   "Cancel",
+			index:  12,
+			begin:  16384,
+			reqlen: 16384,
+			data:   []byte{0, 0, 0, 13, 8, 0, 0, 0, 12, 0, 0, 0x40, 0, 0, 0, 0x40, 0},
+			err:    false,
+		},
+		{
+			name:   "Cancel 4 byte index",
+			index:  666420666,
+			begin:  0,
+			reqlen: 1337,
+			data:   []byte{0, 0, 0, 13, 8, 0x27, 0xB8, 0xC5, 0xBA, 0, 0, 0, 0, 0, 0, 0x05, 0x39},
+			err:    false,
+		},
+		{
+			name: "Bad Cancel",
+			data: []byte{0, 0, 0, 9, 8, 0, 0, 0, 12, 0, 0, 0x40, 0},
+			err:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dr, err := Decode(tt.data)
+			if tt.err {
+				if err == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmsg, ok := dr.Msg.(*MsgCancel)
+			if !ok {
+				t.Fatal("couldn't convert message to MsgCancel")
+			}
+			if cmsg.Index() != tt.index || cmsg.Begin() != tt.begin || cmsg.ReqLen() != tt.reqlen {
+				t.Errorf("decoded (%v, %v, %v), want (%v, %v, %v)",
+					cmsg.Index(), cmsg.Begin(), cmsg.ReqLen(), tt.index, tt.begin, tt.reqlen)
+			}
+			if dr.Read != uint64(MsgCancelTotalLen) {
+				t.Errorf("read %v bytes, want %v", dr.Read, MsgCancelTotalLen)
+			}
+		})
+	}
+}
+
+func TestCancelEncode(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *MsgCancel
+		want []byte
+	}{
+		{
+			name: "Cancel",
+			msg:  NewMsgCancel(12, 16384, 16384),
+			want: []byte{0, 0, 0, 13, 8, 0, 0, 0, 12, 0, 0, 0x40, 0, 0, 0, 0x40, 0},
+		},
+		{
+			name: "Cancel 4 byte index",
+			msg:  NewMsgCancel(666420666, 0, 1337),
+			want: []byte{0, 0, 0, 13, 8, 0x27, 0xB8, 0xC5, 0xBA, 0, 0, 0, 0, 0, 0, 0x05, 0x39},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc := tt.msg.Encode()
+			if !bytes.Equal(tt.want, enc) {
+				t.Errorf("\nwant %v\n got %v", tt.want, enc)
+			}
+		})
+	}
+}
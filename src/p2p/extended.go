@@ -0,0 +1,91 @@
+/* extended.go ================================================================
+Implements the extended message from the extension protocol (BEP_0010). The
+first payload byte is the extended message ID, 0 being the extended handshake,
+and the rest is up to the extension.
+============================================================================ */
+
+package p2p
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// TypeExtended is the message ID reserved by BEP_0010
+	TypeExtended = uint8(20)
+
+	// ExtHandshakeId is the extended message ID of the extended handshake
+	ExtHandshakeId = uint8(0)
+
+	// MsgExtendedMinTotalLen is the minimum total length, which includes
+	// <LEN 4><ID 1><EXT ID 1>
+	MsgExtendedMinTotalLen = uint32(6)
+)
+
+// ============================================================================
+// TYPES ======================================================================
+
+type MsgExtended struct {
+	msgBase
+	extId   uint8
+	payload []byte
+}
+
+// ============================================================================
+// CONSTRUCTORS ===============================================================
+
+func NewMsgExtended(extId uint8, payload []byte) *MsgExtended {
+	return &MsgExtended{
+		msgBase: msgBase{
+			length: uint32(2 + len(payload)),
+			mtype:  TypeExtended,
+		},
+		extId:   extId,
+		payload: payload,
+	}
+}
+
+// ============================================================================
+// GETTERS ====================================================================
+
+func (m *MsgExtended) ExtId() uint8 {
+	return m.extId
+}
+
+func (m *MsgExtended) Payload() []byte {
+	return m.payload
+}
+
+// ============================================================================
+// IMPL =======================================================================
+
+func (m *MsgExtended) Encode() []byte {
+	buf := make([]byte, 4+m.length)
+	m.fillBase(buf)
+	buf[PayloadStart] = m.extId
+	copy(buf[PayloadStart+1:], m.payload)
+	return buf
+}
+
+func (m *MsgExtended) String() string {
+	strb := strings.Builder{}
+	strb.WriteString("Message: Extended\n")
+	strb.WriteString(fmt.Sprintf(" Ext ID: %v\n", m.extId))
+	strb.WriteString(fmt.Sprintf("Payload: %v bytes", len(m.payload)))
+	return strb.String()
+}
+
+// ============================================================================
+// FUNC =======================================================================
+
+// DecodeMsgExtended decodes the payload of an extended message. The payload
+// is copied, as it usually points into a receive buffer.
+func DecodeMsgExtended(payload []byte) (*MsgExtended, error) {
+	if len(payload) < 1 {
+		return nil, fmt.Errorf("extended message must have at least a 1 byte payload, got %v", len(payload))
+	}
+	data := make([]byte, len(payload)-1)
+	copy(data, payload[1:])
+	return NewMsgExtended(payload[0], data), nil
+}
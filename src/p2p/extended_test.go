@@ -0,0 +1,130 @@
+package p2p
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestExtendedDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		extId   uint8
+		payload []byte
+		data    []byte
+		err     bool
+	}{
+		{
+			name:    "Handshake",
+			extId:   ExtHandshakeId,
+			payload: []byte("de"),
+			data:    []byte{0, 0, 0, 4, 20, 0, 'd', 'e'},
+		},
+		{
+			name:    "Empty payload",
+			extId:   3,
+			payload: []byte{},
+			data:    []byte{0, 0, 0, 2, 20, 3},
+		},
+		{
+			name: "No ext id",
+			data: []byte{0, 0, 0, 1, 20},
+			err:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dr, err := Decode(tt.data)
+			if tt.err {
+				if err == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			emsg, ok := dr.Msg.(*MsgExtended)
+			if !ok {
+				t.Fatal("couldn't convert message to MsgExtended")
+			}
+			if emsg.ExtId() != tt.extId || !bytes.Equal(emsg.Payload(), tt.payload) {
+				t.Errorf("decoded (%v, %v), want (%v, %v)", emsg.ExtId(), emsg.Payload(), tt.extId, tt.payload)
+			}
+			if dr.Read != uint64(len(tt.data)) {
+				t.Errorf("read %v bytes, want %v", dr.Read, len(tt.data))
+			}
+			if !bytes.Equal(emsg.Encode(), tt.data) {
+				t.Errorf("encoded %v, want %v", emsg.Encode(), tt.data)
+			}
+		})
+	}
+}
+
+func TestExtHandshake(t *testing.T) {
+	hs := NewExtHandshake()
+	hs.M["ut_metadata"] = 1
+	hs.M["ut_pex"] = 2
+	hs.V = "gotor"
+	hs.P = 6881
+	hs.Reqq = 250
+	hs.YourIP = net.IPv4(10, 0, 0, 1)
+	hs.MetadataSize = 31235
+
+	payload, err := hs.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeExtHandshake(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got.M) != 2 || got.M["ut_metadata"] != 1 || got.M["ut_pex"] != 2 {
+		t.Errorf("got m %v, want %v", got.M, hs.M)
+	}
+	if got.V != hs.V || got.P != hs.P || got.Reqq != hs.Reqq || got.MetadataSize != hs.MetadataSize {
+		t.Errorf("got %+v, want %+v", got, hs)
+	}
+	if !got.YourIP.Equal(hs.YourIP) || len(got.YourIP) != net.IPv4len {
+		t.Errorf("got yourip %v, want %v as 4 bytes", got.YourIP, hs.YourIP)
+	}
+}
+
+func TestDecodeExtHandshake(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		m       map[string]uint8
+		err     bool
+	}{
+		{name: "Empty m", payload: "d1:mdee", m: map[string]uint8{}},
+		{name: "Disabled extension", payload: "d1:md6:ut_pexi0e11:ut_metadatai3eee", m: map[string]uint8{"ut_metadata": 3, "ut_pex": 0}},
+		{name: "Bad yourip ignored", payload: "d1:mde6:youripi5ee", m: map[string]uint8{}},
+		{name: "No m", payload: "d1:v5:gotore", err: true},
+		{name: "ID too big", payload: "d1:md6:ut_pexi256eee", err: true},
+		{name: "Not a dict", payload: "li1ee", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hs, err := DecodeExtHandshake([]byte(tt.payload))
+			if tt.err {
+				if err == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hs.M) != len(tt.m) {
+				t.Fatalf("got m %v, want %v", hs.M, tt.m)
+			}
+			for name, id := range tt.m {
+				if hs.M[name] != id {
+					t.Errorf("got m %v, want %v", hs.M, tt.m)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+/* exthandshake.go ============================================================
+The extended handshake (BEP_0010), sent as extended message 0 right after the
+BitTorrent handshake by both peers that set the extension protocol bit. Its
+main job is the "m" dictionary, which maps the name of each extension the
+sender supports to the extended message ID the sender wants to receive it
+under. IDs are chosen by the receiving side, so each peer has its own map.
+============================================================================ */
+
+package p2p
+
+import (
+	"fmt"
+	"net"
+
+	"gotor/bencode"
+)
+
+// ============================================================================
+// TYPES ======================================================================
+
+// ExtHandshake holds the fields of an extended handshake that we know about.
+// Zero values are left out when encoding, and mean the field was absent when
+// decoding.
+type ExtHandshake struct {
+	M            map[string]uint8 // Extension name -> extended message ID
+	V            string           // Client name and version
+	P            uint16           // Listen port of the sender
+	Reqq         int64            // Number of outstanding requests the sender allows
+	YourIP       net.IP           // Our IP as seen by the sender
+	MetadataSize int64            // Size of the info dictionary (BEP_0009)
+}
+
+// ============================================================================
+// FUNC =======================================================================
+
+// NewExtHandshake returns an empty extended handshake.
+func NewExtHandshake() *ExtHandshake {
+	return &ExtHandshake{M: make(map[string]uint8)}
+}
+
+// Encode bencodes the handshake into an extended message payload.
+func (hs *ExtHandshake) Encode() ([]byte, error) {
+	m := bencode.Dict{}
+	for name, id := range hs.M {
+		m[name] = int64(id)
+	}
+
+	dict := bencode.Dict{"m": m}
+	if hs.V != "" {
+		dict["v"] = hs.V
+	}
+	if hs.P != 0 {
+		dict["p"] = int64(hs.P)
+	}
+	if hs.Reqq > 0 {
+		dict["reqq"] = hs.Reqq
+	}
+	if ip4 := hs.YourIP.To4(); ip4 != nil {
+		dict["yourip"] = string(ip4)
+	} else if len(hs.YourIP) == net.IPv6len {
+		dict["yourip"] = string(hs.YourIP)
+	}
+	if hs.MetadataSize > 0 {
+		dict["metadata_size"] = hs.MetadataSize
+	}
+
+	return bencode.Encode(dict)
+}
+
+// DecodeExtHandshake decodes the payload of an extended handshake. Only "m"
+// is required. Extensions mapped to ID 0 in M have been disabled by the
+// sender. Optional fields that are malformed are ignored.
+func DecodeExtHandshake(payload []byte) (*ExtHandshake, error) {
+	ben, e := bencode.Decode(payload)
+	if e != nil {
+		return nil, e
+	}
+	dict, ok := ben.(bencode.Dict)
+	if !ok {
+		return nil, fmt.Errorf("extended handshake is not a dictionary")
+	}
+
+	m, e := dict.GetDict("m")
+	if e != nil {
+		return nil, e
+	}
+
+	hs := NewExtHandshake()
+	for name := range m {
+		id, e := m.GetInt(name)
+		if e != nil || id < 0 || id > 255 {
+			return nil, fmt.Errorf("bad extended message ID for %v", name)
+		}
+		hs.M[name] = uint8(id)
+	}
+
+	hs.V, _ = dict.GetString("v")
+	if p, e := dict.GetInt("p"); e == nil && p > 0 && p <= 65535 {
+		hs.P = uint16(p)
+	}
+	if reqq, e := dict.GetInt("reqq"); e == nil && reqq > 0 {
+		hs.Reqq = reqq
+	}
+	if ip, e := dict.GetString("yourip"); e == nil && (len(ip) == net.IPv4len || len(ip) == net.IPv6len) {
+		hs.YourIP = net.IP(ip)
+	}
+	if size, e := dict.GetInt("metadata_size"); e == nil && size > 0 {
+		hs.MetadataSize = size
+	}
+
+	return hs, nil
+}
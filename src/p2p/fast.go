@@ -0,0 +1,226 @@
+/* fast.go ====================================================================
+Implements the messages of the fast extension (BEP_0006): Suggest Piece,
+Have All, Have None, Reject Request and Allowed Fast (13 - 17 respectively).
+They may only be sent to peers that set the fast extension bit in their
+handshake. Also generates the allowed fast set for a peer.
+============================================================================ */
+
+package p2p
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	TypeSuggest = uint8(iota + 13)
+	TypeHaveAll
+	TypeHaveNone
+	TypeReject
+	TypeAllowedFast
+)
+
+const (
+	// MsgIndexTotalLen is the total length of the suggest and allowed fast
+	// messages (len 4 + id 1 + index 4)
+	MsgIndexTotalLen = uint32(9)
+
+	// MsgIndexPayloadLen is the payload size of the suggest and allowed
+	// fast messages
+	MsgIndexPayloadLen = uint32(4)
+
+	// MsgHaveAllTotalLen is the total length of have all and have none
+	// (4 len + 1 type)
+	MsgHaveAllTotalLen = uint8(5)
+
+	// MsgRejectTotalLen is the total length of a reject message (len 4 + id
+	// 1 + payload 12)
+	MsgRejectTotalLen = uint8(17)
+
+	// MsgRejectPayloadLen is the payload size in bytes
+	MsgRejectPayloadLen = uint32(12)
+)
+
+// ============================================================================
+// TYPES ======================================================================
+
+// MsgSuggest suggests a piece that the peer should download from us
+type MsgSuggest struct{ msgIndex }
+
+// MsgAllowedFast tells the peer it may request the piece even while choked
+type MsgAllowedFast struct{ msgIndex }
+
+type MsgHaveAll struct{ msgBase }
+type MsgHaveNone struct{ msgBase }
+
+// MsgReject tells the peer that we won't serve one of its requests
+type MsgReject struct {
+	msgBase
+	index  uint32
+	begin  uint32
+	reqlen uint32 // Length of the rejected request, not message
+}
+
+// msgIndex is a message whose only payload is a piece index
+type msgIndex struct {
+	msgBase
+	index uint32
+}
+
+// ============================================================================
+// CONSTRUCTORS ===============================================================
+
+func NewMsgSuggest(index uint32) *MsgSuggest {
+	return &MsgSuggest{msgIndex{msgBase{length: 5, mtype: TypeSuggest}, index}}
+}
+
+func NewMsgAllowedFast(index uint32) *MsgAllowedFast {
+	return &MsgAllowedFast{msgIndex{msgBase{length: 5, mtype: TypeAllowedFast}, index}}
+}
+
+func NewMsgHaveAll() *MsgHaveAll {
+	return &MsgHaveAll{msgBase{length: 1, mtype: TypeHaveAll}}
+}
+
+func NewMsgHaveNone() *MsgHaveNone {
+	return &MsgHaveNone{msgBase{length: 1, mtype: TypeHaveNone}}
+}
+
+func NewMsgReject(index uint32, begin uint32, reqlen uint32) *MsgReject {
+	return &MsgReject{
+		msgBase: msgBase{
+			length: 13,
+			mtype:  TypeReject,
+		},
+		index:  index,
+		begin:  begin,
+		reqlen: reqlen,
+	}
+}
+
+// ============================================================================
+// GETTER =====================================================================
+
+func (m *msgIndex) Index() uint32 {
+	return m.index
+}
+
+func (m *MsgReject) Index() uint32 {
+	return m.index
+}
+
+func (m *MsgReject) Begin() uint32 {
+	return m.begin
+}
+
+func (m *MsgReject) ReqLen() uint32 {
+	return m.reqlen
+}
+
+// ============================================================================
+// IMPL =======================================================================
+
+func (m *msgIndex) Encode() []byte {
+	pl := make([]byte, MsgIndexTotalLen)
+	m.msgBase.fillBase(pl)
+	binary.BigEndian.PutUint32(pl[PayloadStart:], m.index)
+	return pl
+}
+
+func (m *MsgReject) Encode() []byte {
+	pl := make([]byte, MsgRejectTotalLen)
+	m.msgBase.fillBase(pl)
+	binary.BigEndian.PutUint32(pl[PayloadStart:], m.index)
+	binary.BigEndian.PutUint32(pl[PayloadStart+4:], m.begin)
+	binary.BigEndian.PutUint32(pl[PayloadStart+8:], m.reqlen)
+	return pl
+}
+
+func (m *MsgSuggest) String() string {
+	return fmt.Sprintf("Message: Suggest Piece\nIndex: %v", m.index)
+}
+
+func (m *MsgAllowedFast) String() string {
+	return fmt.Sprintf("Message: Allowed Fast\nIndex: %v", m.index)
+}
+
+func (m *MsgHaveAll) String() string {
+	return "Message: Have All"
+}
+
+func (m *MsgHaveNone) String() string {
+	return "Message: Have None"
+}
+
+func (m *MsgReject) String() string {
+	strb := strings.Builder{}
+	strb.WriteString("Message: Reject Request\n")
+	strb.WriteString(fmt.Sprintf("Index: %v\n", m.index))
+	strb.WriteString(fmt.Sprintf("Begin: %v\n", m.begin))
+	strb.WriteString(fmt.Sprintf("Req Len: %v", m.reqlen))
+	return strb.String()
+}
+
+// ============================================================================
+// FUNC =======================================================================
+
+func DecodeMsgSuggest(payload []byte) (*MsgSuggest, error) {
+	if uint32(len(payload)) != MsgIndexPayloadLen {
+		return nil, fmt.Errorf("suggest message must have %v byte payload, got %v", MsgIndexPayloadLen, len(payload))
+	}
+	return NewMsgSuggest(binary.BigEndian.Uint32(payload)), nil
+}
+
+func DecodeMsgAllowedFast(payload []byte) (*MsgAllowedFast, error) {
+	if uint32(len(payload)) != MsgIndexPayloadLen {
+		return nil, fmt.Errorf("allowed fast message must have %v byte payload, got %v", MsgIndexPayloadLen, len(payload))
+	}
+	return NewMsgAllowedFast(binary.BigEndian.Uint32(payload)), nil
+}
+
+func DecodeMsgReject(payload []byte) (*MsgReject, error) {
+	if uint32(len(payload)) != MsgRejectPayloadLen {
+		return nil, fmt.Errorf("reject message must have %v byte payload, got %v", MsgRejectPayloadLen, len(payload))
+	}
+	index := binary.BigEndian.Uint32(payload[0:4])
+	begin := binary.BigEndian.Uint32(payload[4:8])
+	reqlen := binary.BigEndian.Uint32(payload[8:12])
+	return NewMsgReject(index, begin, reqlen), nil
+}
+
+// AllowedFastSet generates the k pieces that a peer at the given IPv4 address
+// may request while choked, using the algorithm from BEP_0006. The set only
+// depends on the peer's /24 network, so peers can't get bigger sets by
+// reconnecting from other addresses in it. Returns nil for IPv6 addresses,
+// which BEP_0006 doesn't cover.
+func AllowedFastSet(k int, numPieces uint32, infohash string, ip net.IP) []uint32 {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces == 0 {
+		return nil
+	}
+	if uint32(k) > numPieces {
+		k = int(numPieces)
+	}
+
+	x := make([]byte, 0, 4+len(infohash))
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infohash...)
+
+	set := make([]uint32, 0, k)
+	seen := make(map[uint32]struct{}, k)
+	for len(set) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := binary.BigEndian.Uint32(x[i*4:]) % numPieces
+			if _, ok := seen[index]; !ok {
+				seen[index] = struct{}{}
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
@@ -0,0 +1,108 @@
+package p2p
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFastDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+		data []byte
+		err  bool
+	}{
+		{
+			name: "Suggest",
+			msg:  NewMsgSuggest(12),
+			data: []byte{0, 0, 0, 5, 13, 0, 0, 0, 12},
+		},
+		{
+			name: "Have All",
+			msg:  NewMsgHaveAll(),
+			data: []byte{0, 0, 0, 1, 14},
+		},
+		{
+			name: "Have None",
+			msg:  NewMsgHaveNone(),
+			data: []byte{0, 0, 0, 1, 15},
+		},
+		{
+			name: "Reject",
+			msg:  NewMsgReject(12, 16384, 16384),
+			data: []byte{0, 0, 0, 13, 16, 0, 0, 0, 12, 0, 0, 0x40, 0, 0, 0, 0x40, 0},
+		},
+		{
+			name: "Allowed Fast",
+			msg:  NewMsgAllowedFast(666420666),
+			data: []byte{0, 0, 0, 5, 17, 0x27, 0xB8, 0xC5, 0xBA},
+		},
+		{
+			name: "Have All with payload",
+			data: []byte{0, 0, 0, 2, 14, 0},
+			err:  true,
+		},
+		{
+			name: "Short Reject",
+			data: []byte{0, 0, 0, 9, 16, 0, 0, 0, 12, 0, 0, 0x40, 0},
+			err:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dr, err := Decode(tt.data)
+			if tt.err {
+				if err == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(dr.Msg, tt.msg) {
+				t.Errorf("decoded %v, want %v", dr.Msg, tt.msg)
+			}
+			if dr.Read != uint64(len(tt.data)) {
+				t.Errorf("read %v bytes, want %v", dr.Read, len(tt.data))
+			}
+			if !bytes.Equal(tt.msg.Encode(), tt.data) {
+				t.Errorf("encoded %v, want %v", tt.msg.Encode(), tt.data)
+			}
+		})
+	}
+}
+
+func TestAllowedFastSet(t *testing.T) {
+	// Test vectors from BEP_0006
+	infohash := strings.Repeat("\xaa", 20)
+	ip := net.IPv4(80, 4, 4, 200)
+
+	got := AllowedFastSet(7, 1313, infohash, ip)
+	want := []uint32{1059, 431, 808, 1217, 287, 376, 1188}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	got = AllowedFastSet(9, 1313, infohash, ip)
+	want = append(want, 353, 508)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Only the /24 matters
+	got = AllowedFastSet(7, 1313, infohash, net.IPv4(80, 4, 4, 1))
+	if !reflect.DeepEqual(got, want[:7]) {
+		t.Errorf("got %v for the same /24, want %v", got, want[:7])
+	}
+
+	if got = AllowedFastSet(10, 3, infohash, ip); len(got) != 3 {
+		t.Errorf("got %v pieces out of 3", len(got))
+	}
+	if got = AllowedFastSet(7, 1313, infohash, net.ParseIP("2001:db8::1")); got != nil {
+		t.Errorf("got %v for IPv6, want nil", got)
+	}
+}
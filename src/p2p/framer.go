@@ -0,0 +1,107 @@
+/* framer.go ==================================================================
+Peers send us a continuous stream of length-prefixed messages, and a single
+conn.Read() almost never lines up with message boundaries. A 16KiB piece
+message will usually arrive over several reads, and a single read may end
+half way through a have message. Framer accumulates the raw bytes and hands
+back complete messages one at a time, holding on to any partial tail until
+the rest of it shows up.
+============================================================================ */
+
+package p2p
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// DefaultMaxMsgLen is the default maximum length of a single message
+// (excluding the 4 byte length prefix). This comfortably fits a 16KiB piece
+// message, or even a 128KiB one if a peer is feeling generous.
+const DefaultMaxMsgLen = uint32(131072 + MsgPieceMinTotalLen)
+
+// ============================================================================
+// ERRORS =====================================================================
+
+// FrameError is returned when a peer sends a length prefix that exceeds the
+// maximum message length. The stream can no longer be trusted after this, the
+// connection should be dropped.
+type FrameError struct {
+	msglen uint32
+	maxlen uint32
+}
+
+func (fe *FrameError) Error() string {
+	return fmt.Sprintf("message length %v exceeds maximum of %v", fe.msglen, fe.maxlen)
+}
+
+// ============================================================================
+// TYPES ======================================================================
+
+type Framer struct {
+	buf    []byte // Accumulated bytes, only buf[start:] is unconsumed
+	start  int
+	maxLen uint32
+}
+
+// ============================================================================
+// CONSTRUCTORS ===============================================================
+
+func NewFramer(maxLen uint32) *Framer {
+	return &Framer{
+		buf:    make([]byte, 0, 2*maxLen),
+		start:  0,
+		maxLen: maxLen,
+	}
+}
+
+// ============================================================================
+// IMPL =======================================================================
+
+// Feed appends data to the framer. The data is copied, so the caller is free
+// to reuse the slice once Feed returns.
+func (f *Framer) Feed(data []byte) {
+	// Shift the unconsumed tail to the front of the buffer before appending,
+	// otherwise the buffer would grow forever.
+	if f.start > 0 {
+		n := copy(f.buf, f.buf[f.start:])
+		f.buf = f.buf[:n]
+		f.start = 0
+	}
+	f.buf = append(f.buf, data...)
+}
+
+// Next returns the next complete message in the stream. If there is not yet
+// enough data for a full message, returns (nil, nil) and the partial message
+// is kept until more data is fed. If the message is complete but could not be
+// decoded, the message is still consumed and the decoding error is returned,
+// so the caller may decide whether to keep reading. A *FrameError means the
+// stream is unusable.
+func (f *Framer) Next() (Message, error) {
+	avail := f.buf[f.start:]
+	if len(avail) < int(MsgLengthPrefixLen) {
+		return nil, nil
+	}
+
+	msglen := binary.BigEndian.Uint32(avail[:MsgLengthPrefixLen])
+	if msglen > f.maxLen {
+		return nil, &FrameError{msglen: msglen, maxlen: f.maxLen}
+	}
+
+	total := int(MsgLengthPrefixLen) + int(msglen)
+	if len(avail) < total {
+		return nil, nil
+	}
+
+	f.start += total
+	dr, e := Decode(avail[:total])
+	if e != nil {
+		return nil, e
+	}
+	return dr.Msg, nil
+}
+
+// Buffered returns the number of bytes that have been fed but not yet
+// returned as a message.
+func (f *Framer) Buffered() int {
+	return len(f.buf) - f.start
+}
@@ -0,0 +1,139 @@
+package p2p
+
+import (
+	"bytes"
+	"testing"
+
+	"gotor/utils/test"
+)
+
+// Stream of messages used by the framer tests
+func framerStream() ([]byte, []uint8) {
+	block := make([]byte, 16384)
+	for i := range block {
+		block[i] = byte(i)
+	}
+
+	msgs := []Message{
+		&KeepAliveSingleton,
+		NewMsgUnchoke(),
+		NewMsgHave(666),
+		NewMsgPiece(3, 16384, block),
+		NewMsgInterested(),
+		NewMsgPiece(4, 0, []byte{1, 2, 3}),
+	}
+
+	stream := make([]byte, 0, 2*len(block))
+	types := make([]uint8, 0, len(msgs))
+	for _, msg := range msgs {
+		stream = append(stream, msg.Encode()...)
+		types = append(types, msg.Mtype())
+	}
+	return stream, types
+}
+
+func TestFramer_Next(t *testing.T) {
+	stream, types := framerStream()
+
+	tests := []struct {
+		name  string
+		chunk int // Size of each simulated conn.Read()
+	}{
+		{"one read", len(stream)},
+		{"byte at a time", 1},
+		{"odd chunks", 7},
+		{"recv buffer", 8572},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			framer := NewFramer(DefaultMaxMsgLen)
+			buf := make([]byte, tt.chunk)
+			got := make([]Message, 0, len(types))
+
+			for off := 0; off < len(stream); off += tt.chunk {
+				end := off + tt.chunk
+				if end > len(stream) {
+					end = len(stream)
+				}
+				// Reuse the same buffer, just like the read loop does
+				n := copy(buf, stream[off:end])
+				framer.Feed(buf[:n])
+
+				for {
+					msg, e := framer.Next()
+					test.CheckFatal(t, e)
+					if msg == nil {
+						break
+					}
+					got = append(got, msg)
+				}
+			}
+
+			if len(got) != len(types) {
+				t.Fatalf("got %v messages, want %v", len(got), len(types))
+			}
+			for i, msg := range got {
+				if msg.Mtype() != types[i] {
+					t.Errorf("message %v has type %v, want %v", i, msg.Mtype(), types[i])
+				}
+			}
+
+			// Make sure the big piece survived the buffer being reused
+			reenc := make([]byte, 0, len(stream))
+			for _, msg := range got {
+				reenc = append(reenc, msg.Encode()...)
+			}
+			if !bytes.Equal(reenc, stream) {
+				t.Errorf("re-encoded messages do not match original stream")
+			}
+
+			if framer.Buffered() != 0 {
+				t.Errorf("framer has %v bytes buffered, want 0", framer.Buffered())
+			}
+		})
+	}
+}
+
+func TestFramer_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		fatal   bool // Should be a *FrameError
+		unknown bool // Should be an *UnknownTypeError
+	}{
+		{"too large", []byte{0, 0, 0xFF, 0xFF, TypePiece}, true, false},
+		{"unknown type", []byte{0, 0, 0, 2, 0xDD, 0}, false, true},
+		{"bad have", []byte{0, 0, 0, 3, TypeHave, 0, 0}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			framer := NewFramer(1024)
+			framer.Feed(tt.data)
+			// A valid message afterwards should still come through unless
+			// the error was fatal
+			framer.Feed(NewMsgChoke().Encode())
+
+			_, e := framer.Next()
+			if e == nil {
+				t.Fatal("expected error")
+			}
+
+			_, isFrame := e.(*FrameError)
+			_, isUnknown := e.(*UnknownTypeError)
+			if isFrame != tt.fatal {
+				t.Errorf("FrameError = %v, want %v", isFrame, tt.fatal)
+			}
+			if isUnknown != tt.unknown {
+				t.Errorf("UnknownTypeError = %v, want %v", isUnknown, tt.unknown)
+			}
+
+			if !tt.fatal {
+				msg, e := framer.Next()
+				test.CheckFatal(t, e)
+				if msg == nil || msg.Mtype() != TypeChoke {
+					t.Errorf("expected choke after bad message, got %v", msg)
+				}
+			}
+		})
+	}
+}
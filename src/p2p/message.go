@@ -49,6 +49,13 @@ type DecodeResult struct {
 	Read uint64 // Number of bytes read
 }
 
+// UnknownTypeError is returned by Decode when the message ID is not one that
+// we know about. The message is otherwise well-formed, BEP_0003 says these
+// should just be ignored.
+type UnknownTypeError struct {
+	mtype uint8
+}
+
 type msgBase struct {
 	length uint32
 	mtype  uint8
@@ -57,6 +64,10 @@ type msgBase struct {
 // ============================================================================
 // IMPL =======================================================================
 
+func (e *UnknownTypeError) Error() string {
+	return fmt.Sprintf("unknown message type %v", e.mtype)
+}
+
 func (m *msgBase) Length() uint32 {
 	return m.length
 }
@@ -158,13 +169,15 @@ func Decode(data []byte) (DecodeResult, error) {
 	}
 	mtype := uint8(data[4])
 
-	if mtype <= 3 && msglen != 1 {
+	if (mtype <= 3 || mtype == TypeHaveAll || mtype == TypeHaveNone) && msglen != 1 {
 		// Check invalid message for no-payload messages
 		// Type 0 = Choke
 		// Type 1 = Unchoke
 		// Type 2 = Interested
 		// Type 3 = Not Interested
-		return badResult, fmt.Errorf("invalid message, length for id [0-3] must be 1, got %v", msglen)
+		// Type 14 = Have All
+		// Type 15 = Have None
+		return badResult, fmt.Errorf("invalid message, length for id [0-3, 14, 15] must be 1, got %v", msglen)
 	} else if uint32(len(data)) < 4+msglen {
 		// Messages with payload
 		return badResult, fmt.Errorf("length specified as %v, payload length is %v", msglen, len(data))
@@ -207,11 +220,32 @@ func Decode(data []byte) (DecodeResult, error) {
 		msg, err = DecodeMsgRequest(payload)
 		n = uint64(MsgRequestTotalLen)
 	case TypePiece:
-		msg, err = DecodeMsgPiece(payload, msglen)
-		n = uint64(uint32(MsgLengthPrefixLen) + msg.Length())
+		msg, err = DecodeMsgPiece(payload)
+		n = uint64(uint32(MsgLengthPrefixLen) + msglen)
+	case TypeCancel:
+		msg, err = DecodeMsgCancel(payload)
+		n = uint64(MsgCancelTotalLen)
+	case TypeSuggest:
+		msg, err = DecodeMsgSuggest(payload)
+		n = uint64(MsgIndexTotalLen)
+	case TypeHaveAll:
+		msg = NewMsgHaveAll()
+		n = uint64(MsgHaveAllTotalLen)
+	case TypeHaveNone:
+		msg = NewMsgHaveNone()
+		n = uint64(MsgHaveAllTotalLen)
+	case TypeReject:
+		msg, err = DecodeMsgReject(payload)
+		n = uint64(MsgRejectTotalLen)
+	case TypeAllowedFast:
+		msg, err = DecodeMsgAllowedFast(payload)
+		n = uint64(MsgIndexTotalLen)
+	case TypeExtended:
+		msg, err = DecodeMsgExtended(payload)
+		n = uint64(uint32(MsgLengthPrefixLen) + msglen)
 	default:
 		msg = nil
-		err = fmt.Errorf("unknown message type %v", mtype)
+		err = &UnknownTypeError{mtype: mtype}
 		// Force DecodeResult to be unusable, entire data byte slice should be discarded
 		n = uint64(len(data))
 	}
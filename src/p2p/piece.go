@@ -77,15 +77,16 @@ func (mp *MsgPiece) String() string {
 // ============================================================================
 // FUNC =======================================================================
 
-func DecodeMsgPiece(payload []byte, length uint32) (*MsgPiece, error) {
-	if uint32(len(payload)) != length {
-		return nil, fmt.Errorf("piece message must have %v byte payload, got %v", MsgHavePayloadLen, len(payload))
-	}
+// DecodeMsgPiece decodes the payload of a piece message. The block is copied
+// out of the payload, since the payload will almost always be a slice of some
+// buffer that conn.Read() is going to overwrite.
+func DecodeMsgPiece(payload []byte) (*MsgPiece, error) {
 	if uint32(len(payload)) < MsgPieceMinPayloadLen {
 		return nil, fmt.Errorf("piece message payload must be at least %v bytes, got %v", MsgPieceMinPayloadLen, len(payload))
 	}
 	index := binary.BigEndian.Uint32(payload[0:4])
 	begin := binary.BigEndian.Uint32(payload[4:8])
-	block := payload[8:]
+	block := make([]byte, len(payload)-8)
+	copy(block, payload[8:])
 	return NewMsgPiece(index, begin, block), nil
 }
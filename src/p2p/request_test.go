@@ -0,0 +1,52 @@
+package p2p
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRequestEncodeDecode(t *testing.T) {
+	tests := []struct {
+		name   string
+		index  uint32
+		begin  uint32
+		reqlen uint32
+		want   []byte
+	}{
+		{
+			name:   "Request",
+			index:  1,
+			begin:  16384,
+			reqlen: 16384,
+			want:   []byte{0, 0, 0, 13, 6, 0, 0, 0, 1, 0, 0, 0x40, 0, 0, 0, 0x40, 0},
+		},
+		{
+			name:   "Request large index",
+			index:  666420666,
+			begin:  0,
+			reqlen: 1337,
+			want:   []byte{0, 0, 0, 13, 6, 0x27, 0xB8, 0xC5, 0xBA, 0, 0, 0, 0, 0, 0, 0x05, 0x39},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc := NewMsgRequest(tt.index, tt.begin, tt.reqlen).Encode()
+			if !bytes.Equal(tt.want, enc) {
+				t.Errorf("\nwant %v\n got %v", tt.want, enc)
+			}
+
+			dr, err := Decode(enc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, ok := dr.Msg.(*MsgRequest)
+			if !ok {
+				t.Fatal("couldn't convert message to MsgRequest")
+			}
+			if msg.Index() != tt.index || msg.Begin() != tt.begin || msg.ReqLen() != tt.reqlen {
+				t.Errorf("decoded (%v, %v, %v), want (%v, %v, %v)",
+					msg.Index(), msg.Begin(), msg.ReqLen(), tt.index, tt.begin, tt.reqlen)
+			}
+		})
+	}
+}
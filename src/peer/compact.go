@@ -0,0 +1,74 @@
+package peer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// Lengths of a single peer in the compact formats. IPv4 peers are 4 bytes of
+// address followed by a 2 byte port (BEP_0023), IPv6 peers are 16 bytes of
+// address followed by a 2 byte port (BEP_0007).
+const (
+	CompactLen  = 6
+	Compact6Len = 18
+)
+
+// ============================================================================
+// ERROR ======================================================================
+
+type CompactError struct {
+	length int
+	plen   int
+}
+
+func (e *CompactError) Error() string {
+	return fmt.Sprintf("compact peer list must be divisible by %v, length = [%v]", e.plen, e.length)
+}
+
+// ============================================================================
+// FUNK =======================================================================
+
+// ParseCompact decodes a compact IPv4 peer list.
+func ParseCompact(data []byte) (List, error) {
+	return parseCompact(data, net.IPv4len)
+}
+
+// ParseCompact6 decodes a compact IPv6 peer list.
+func ParseCompact6(data []byte) (List, error) {
+	return parseCompact(data, net.IPv6len)
+}
+
+func parseCompact(data []byte, iplen int) (List, error) {
+	plen := iplen + 2
+	if len(data)%plen != 0 {
+		return nil, &CompactError{length: len(data), plen: plen}
+	}
+
+	npeers := len(data) / plen
+	peerList := make(List, 0, npeers)
+
+	for i := 0; i < npeers; i++ {
+		start := i * plen
+		ip := make(net.IP, iplen)
+		copy(ip, data[start:start+iplen])
+		port := binary.BigEndian.Uint16(data[start+iplen : start+plen])
+		peerList = append(peerList, MakePeer("", ip, port))
+	}
+
+	return peerList, nil
+}
+
+// Compact encodes the peer in the compact format, which is 6 bytes for IPv4
+// peers and 18 bytes for IPv6 peers.
+func (p Info) Compact() []byte {
+	ip := p.ip.To4()
+	if ip == nil {
+		ip = p.ip.To16()
+	}
+
+	buf := make([]byte, len(ip)+2)
+	copy(buf, ip)
+	binary.BigEndian.PutUint16(buf[len(ip):], p.port)
+	return buf
+}
@@ -0,0 +1,73 @@
+package peer
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestParseCompact(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		v6      bool
+		want    []string // Expected Addr() of each peer
+		wantErr bool
+	}{
+		{
+			name: "ipv4",
+			data: []byte{127, 0, 0, 1, 0x1A, 0xE1, 10, 0, 0, 7, 0xEC, 0xDA},
+			want: []string{"127.0.0.1:6881", "10.0.0.7:60634"},
+		},
+		{
+			name: "ipv6",
+			data: append(net.ParseIP("2001:db8::1"), 0x1A, 0xE1),
+			v6:   true,
+			want: []string{"[2001:db8::1]:6881"},
+		},
+		{
+			name:    "bad length",
+			data:    []byte{127, 0, 0, 1, 0x1A},
+			wantErr: true,
+		},
+		{
+			name:    "ipv4 list as ipv6",
+			data:    []byte{127, 0, 0, 1, 0x1A, 0xE1},
+			v6:      true,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got List
+			var err error
+			if tt.v6 {
+				got, err = ParseCompact6(tt.data)
+			} else {
+				got, err = ParseCompact(tt.data)
+			}
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v peers, want %v", len(got), len(tt.want))
+			}
+
+			compact := make([]byte, 0, len(tt.data))
+			for i := range got {
+				if got[i].Addr() != tt.want[i] {
+					t.Errorf("peer %v has address [%v], want [%v]", i, got[i].Addr(), tt.want[i])
+				}
+				if got[i].IsIPv6() != tt.v6 {
+					t.Errorf("peer %v IsIPv6 = %v", i, got[i].IsIPv6())
+				}
+				compact = append(compact, got[i].Compact()...)
+			}
+
+			if !tt.wantErr && !bytes.Equal(compact, tt.data) {
+				t.Errorf("re-encoded [%v], want [%v]", compact, tt.data)
+			}
+		})
+	}
+}
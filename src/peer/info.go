@@ -3,7 +3,7 @@ package peer
 import (
 	"fmt"
 	"net"
-	"strings"
+	"strconv"
 )
 
 type Info struct {
@@ -15,17 +15,15 @@ type Info struct {
 }
 
 func MakePeer(id string, ip net.IP, port uint16) Info {
-	strb := strings.Builder{}
-	strb.WriteString(ip.String())
-	strb.WriteByte(':')
-	strb.WriteString(fmt.Sprintf("%v", port))
+	// JoinHostPort adds the brackets that IPv6 addresses need
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
 
 	return Info{
 		id:   id,
 		ip:   ip,
 		port: port,
-		addr: strb.String(),
-		str:  fmt.Sprintf("%v @ %v:%v", id, ip, port),
+		addr: addr,
+		str:  fmt.Sprintf("%v @ %v", id, addr),
 	}
 }
 
@@ -41,6 +39,11 @@ func (p Info) Port() uint16 {
 	return p.port
 }
 
+// IsIPv6 returns true if the peer has an IPv6 address.
+func (p Info) IsIPv6() bool {
+	return p.ip.To4() == nil
+}
+
 func (p *Info) Addr() string {
 	return p.addr
 }
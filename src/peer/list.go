@@ -20,7 +20,7 @@ func (l List) String() string {
 		if i%5 == 0 {
 			strb.WriteString("\n\t")
 		}
-		strb.WriteString(fmt.Sprintf("(%v:%v) ", v.Ip(), v.Port()))
+		strb.WriteString(fmt.Sprintf("(%v) ", v.Addr()))
 	}
 	return strb.String()
 }
@@ -1,10 +1,17 @@
 package peer
 
+import "sync"
+
+// State is the choke/interest state of a single peer connection. It is read
+// and written by several of a PeerHandler's goroutines, so all access is
+// guarded by a lock.
 type State struct {
 	chokingUs    bool // Peer is choking us
 	weChoking    bool // We are choking peer
 	interestedUs bool // Peer is interested in us
 	weInterested bool // We are interested in peer
+
+	lock sync.RWMutex
 }
 
 func MakeState() State {
@@ -17,33 +24,49 @@ func MakeState() State {
 }
 
 func (s *State) ChokingUs() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	return s.chokingUs
 }
 
 func (s *State) SetChokingUs(chokingUs bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	s.chokingUs = chokingUs
 }
 
 func (s *State) WeChoking() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	return s.weChoking
 }
 
 func (s *State) SetWeChoking(weChoking bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	s.weChoking = weChoking
 }
 
 func (s *State) InterestedUs() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	return s.interestedUs
 }
 
 func (s *State) SetInterestedUs(interestedUs bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	s.interestedUs = interestedUs
 }
 
 func (s *State) WeInterested() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	return s.weInterested
 }
 
 func (s *State) SetWeInterested(weInterested bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	s.weInterested = weInterested
 }
@@ -0,0 +1,215 @@
+/* pex.go =====================================================================
+Peer exchange (BEP_0011), which lets connected peers tell each other about
+the other peers they are connected to. Each message holds the peers added and
+dropped since the last message sent to the same peer, as compact IPv4 and
+IPv6 lists, with a flags byte for every added peer.
+============================================================================ */
+
+package pex
+
+import (
+	"fmt"
+	"time"
+
+	"gotor/bencode"
+	"gotor/peer"
+)
+
+const (
+	// ExtName is the name of the extension in the extended handshake
+	ExtName = "ut_pex"
+
+	// Interval is the minimum time between two messages to the same peer
+	Interval = time.Minute
+
+	// MaxPeers is the largest number of added, and of dropped, peers in a
+	// single message
+	MaxPeers = 50
+)
+
+// Flags describing an added peer
+const (
+	FlagEncryption = byte(0x01) // Prefers encrypted connections
+	FlagSeed       = byte(0x02) // Is a seed, or upload only
+	FlagUTP        = byte(0x04) // Supports uTP
+	FlagHolepunch  = byte(0x08) // Supports ut_holepunch
+	FlagReachable  = byte(0x10) // We connected to it, so it accepts connections
+)
+
+// ============================================================================
+// ERRORS =====================================================================
+
+type Error struct{ msg string }
+
+func (e *Error) Error() string {
+	return "pex error: " + e.msg
+}
+
+// ============================================================================
+// MESSAGE ====================================================================
+
+// Msg is a single ut_pex message. Flags has one entry for every added peer.
+type Msg struct {
+	Added   peer.List
+	Flags   []byte
+	Dropped peer.List
+}
+
+// Empty returns true if the message has no peers in it.
+func (m *Msg) Empty() bool {
+	return len(m.Added) == 0 && len(m.Dropped) == 0
+}
+
+// Encode encodes the message as the payload of an extended message. Empty
+// lists are left out.
+func (m *Msg) Encode() ([]byte, error) {
+	if len(m.Flags) != len(m.Added) {
+		return nil, &Error{msg: fmt.Sprintf("%v flags for %v added peers", len(m.Flags), len(m.Added))}
+	}
+
+	var added, addedf, added6, added6f []byte
+	for i, p := range m.Added {
+		if p.IsIPv6() {
+			added6 = append(added6, p.Compact()...)
+			added6f = append(added6f, m.Flags[i])
+		} else {
+			added = append(added, p.Compact()...)
+			addedf = append(addedf, m.Flags[i])
+		}
+	}
+
+	var dropped, dropped6 []byte
+	for _, p := range m.Dropped {
+		if p.IsIPv6() {
+			dropped6 = append(dropped6, p.Compact()...)
+		} else {
+			dropped = append(dropped, p.Compact()...)
+		}
+	}
+
+	dict := bencode.Dict{}
+	putBytes(dict, "added", added)
+	putBytes(dict, "added.f", addedf)
+	putBytes(dict, "added6", added6)
+	putBytes(dict, "added6.f", added6f)
+	putBytes(dict, "dropped", dropped)
+	putBytes(dict, "dropped6", dropped6)
+	return bencode.Encode(dict)
+}
+
+// DecodeMsg decodes the payload of an extended ut_pex message. Missing or
+// malformed flags are treated as no flags.
+func DecodeMsg(payload []byte) (*Msg, error) {
+	ben, e := bencode.Decode(payload)
+	if e != nil {
+		return nil, e
+	}
+	dict, ok := ben.(bencode.Dict)
+	if !ok {
+		return nil, &Error{msg: "message is not a dictionary"}
+	}
+
+	m := Msg{}
+	for _, v := range []struct {
+		key   string
+		flags string
+		parse func([]byte) (peer.List, error)
+	}{
+		{"added", "added.f", peer.ParseCompact},
+		{"added6", "added6.f", peer.ParseCompact6},
+	} {
+		peers, e := getPeers(dict, v.key, v.parse)
+		if e != nil {
+			return nil, e
+		}
+		flags, _ := dict.GetString(v.flags)
+		if len(flags) != len(peers) {
+			flags = string(make([]byte, len(peers)))
+		}
+		m.Added = append(m.Added, peers...)
+		m.Flags = append(m.Flags, flags...)
+	}
+
+	for _, v := range []struct {
+		key   string
+		parse func([]byte) (peer.List, error)
+	}{
+		{"dropped", peer.ParseCompact},
+		{"dropped6", peer.ParseCompact6},
+	} {
+		peers, e := getPeers(dict, v.key, v.parse)
+		if e != nil {
+			return nil, e
+		}
+		m.Dropped = append(m.Dropped, peers...)
+	}
+
+	return &m, nil
+}
+
+// putBytes adds the value to the dict, unless it is empty.
+func putBytes(dict bencode.Dict, key string, value []byte) {
+	if len(value) > 0 {
+		dict[key] = string(value)
+	}
+}
+
+// getPeers parses the compact peer list under key, which may be missing.
+func getPeers(dict bencode.Dict, key string, parse func([]byte) (peer.List, error)) (peer.List, error) {
+	if _, ok := dict[key]; !ok {
+		return nil, nil
+	}
+	s, e := dict.GetString(key)
+	if e != nil {
+		return nil, e
+	}
+	return parse([]byte(s))
+}
+
+// ============================================================================
+// SENDER =====================================================================
+
+// Sender keeps track of the peers that one remote peer has been told about,
+// so that each message only holds the changes since the last one.
+type Sender struct {
+	sent map[string]peer.Info // By address
+}
+
+func NewSender() *Sender {
+	return &Sender{sent: make(map[string]peer.Info)}
+}
+
+// Next returns the message that brings the remote peer up to date with the
+// current peers, which have the given flags. At most MaxPeers are added and
+// dropped, the rest are left for later messages. Returns nil if there is
+// nothing to send.
+func (s *Sender) Next(current peer.List, flags []byte) *Msg {
+	m := Msg{}
+
+	now := make(map[string]struct{}, len(current))
+	for i, p := range current {
+		addr := p.Addr()
+		now[addr] = struct{}{}
+		if _, ok := s.sent[addr]; ok || len(m.Added) == MaxPeers {
+			continue
+		}
+		s.sent[addr] = p
+		m.Added = append(m.Added, p)
+		m.Flags = append(m.Flags, flags[i])
+	}
+
+	for addr, p := range s.sent {
+		if len(m.Dropped) == MaxPeers {
+			break
+		}
+		if _, ok := now[addr]; !ok {
+			delete(s.sent, addr)
+			m.Dropped = append(m.Dropped, p)
+		}
+	}
+
+	if m.Empty() {
+		return nil
+	}
+	return &m
+}
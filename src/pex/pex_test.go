@@ -0,0 +1,104 @@
+package pex
+
+import (
+	"net"
+	"testing"
+
+	"gotor/peer"
+	"gotor/utils/test"
+)
+
+func TestMsg_Encode(t *testing.T) {
+	m := Msg{
+		Added: peer.List{
+			peer.MakePeer("", net.IPv4(10, 0, 0, 1), 6881),
+			peer.MakePeer("", net.ParseIP("2001:db8::1"), 6882),
+			peer.MakePeer("", net.IPv4(10, 0, 0, 2), 6883),
+		},
+		Flags:   []byte{FlagSeed, FlagReachable, 0},
+		Dropped: peer.List{peer.MakePeer("", net.ParseIP("2001:db8::2"), 51413)},
+	}
+
+	enc, e := m.Encode()
+	test.CheckFatal(t, e)
+	got, e := DecodeMsg(enc)
+	test.CheckFatal(t, e)
+
+	// IPv4 peers come first after decoding
+	wantAdded := []string{"10.0.0.1:6881", "10.0.0.2:6883", "[2001:db8::1]:6882"}
+	wantFlags := []byte{FlagSeed, 0, FlagReachable}
+	if len(got.Added) != len(wantAdded) {
+		t.Fatalf("got %v added peers, want %v", len(got.Added), len(wantAdded))
+	}
+	for i := range wantAdded {
+		if got.Added[i].Addr() != wantAdded[i] || got.Flags[i] != wantFlags[i] {
+			t.Errorf("added %v: got (%v, %v), want (%v, %v)", i, got.Added[i].Addr(), got.Flags[i], wantAdded[i], wantFlags[i])
+		}
+	}
+	if len(got.Dropped) != 1 || got.Dropped[0].Addr() != "[2001:db8::2]:51413" {
+		t.Errorf("got dropped %v", got.Dropped)
+	}
+}
+
+func TestDecodeMsg(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		added   int
+		dropped int
+		err     bool
+	}{
+		{name: "Empty", payload: "de"},
+		{name: "Missing flags", payload: "d5:added6:\x0a\x00\x00\x01\x1a\xe1e", added: 1},
+		{name: "Dropped only", payload: "d7:dropped6:\x0a\x00\x00\x01\x1a\xe1e", dropped: 1},
+		{name: "Bad compact length", payload: "d5:added5:\x0a\x00\x00\x01\x1ae", err: true},
+		{name: "Not a dict", payload: "i1e", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, e := DecodeMsg([]byte(tt.payload))
+			if tt.err {
+				if e == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+			test.CheckFatal(t, e)
+			if len(m.Added) != tt.added || len(m.Flags) != tt.added || len(m.Dropped) != tt.dropped {
+				t.Errorf("got %v added, %v flags, %v dropped", len(m.Added), len(m.Flags), len(m.Dropped))
+			}
+		})
+	}
+}
+
+func TestSender_Next(t *testing.T) {
+	peers := make(peer.List, MaxPeers+10)
+	for i := range peers {
+		peers[i] = peer.MakePeer("", net.IPv4(10, 0, 1, byte(i)), 6881)
+	}
+	flags := make([]byte, len(peers))
+
+	s := NewSender()
+	m := s.Next(peers, flags)
+	if m == nil || len(m.Added) != MaxPeers || len(m.Dropped) != 0 {
+		t.Fatalf("first message %+v, want %v added", m, MaxPeers)
+	}
+	m = s.Next(peers, flags)
+	if m == nil || len(m.Added) != 10 {
+		t.Fatalf("second message %+v, want the 10 left over", m)
+	}
+	if m = s.Next(peers, flags); m != nil {
+		t.Fatalf("expected nothing to send, got %+v", m)
+	}
+
+	m = s.Next(peers[5:], flags[5:])
+	if m == nil || len(m.Added) != 0 || len(m.Dropped) != 5 {
+		t.Fatalf("got %+v, want 5 dropped", m)
+	}
+
+	// Dropped peers are sent again if they come back
+	m = s.Next(peers, flags)
+	if m == nil || len(m.Added) != 5 {
+		t.Fatalf("got %+v, want 5 added", m)
+	}
+}
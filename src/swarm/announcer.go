@@ -0,0 +1,236 @@
+package swarm
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gotor/dht"
+	"gotor/peer"
+	"gotor/tracker"
+)
+
+// ============================================================================
+// ============================================================================
+
+const (
+	// DefaultAnnounceInterval is used when the tracker doesn't give us an
+	// interval.
+	DefaultAnnounceInterval = 30 * time.Minute
+
+	// dhtInterval is how often we look for peers in the DHT and announce
+	// ourselves to it.
+	dhtInterval = 15 * time.Minute
+)
+
+// After every tracker fails, we wait announceRetryMin before trying again,
+// doubling each time up to announceRetryMax. Tests shorten them.
+var (
+	announceRetryMin = 30 * time.Second
+	announceRetryMax = 30 * time.Minute
+)
+
+// ============================================================================
+// ============================================================================
+
+// announceLoop re-announces to the trackers for as long as the swarm runs.
+// Regular announces follow the interval given by the tracker, the completed
+// event is sent as soon as the download finishes, and the stopped event is
+// sent when chStop is closed. An event other than EventNone is sent right
+// away, e.g. started when a paused swarm resumes. Any new peers the trackers
+// return are connected to. done is closed once the loop has stopped.
+func (s *Swarm) announceLoop(event tracker.Event, chStop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	// Nothing to do for trackerless torrents
+	if len(s.Trackers.Tiers()) == 0 {
+		return
+	}
+
+	// Only send completed if the download finishes during this session
+	completeSent := s.Bf.Complete()
+	retry := announceRetryMin
+	next := time.After(announceWait(s.getState()))
+	if event != tracker.EventNone {
+		next = time.After(0)
+	}
+
+	for {
+		select {
+		case <-chStop:
+			_, e := s.announce(context.Background(), tracker.EventStopped)
+			if e != nil {
+				log.Printf("failed to send stopped announce: %v", e)
+			}
+			return
+		case <-s.chCompleted:
+			if completeSent {
+				continue
+			}
+			event = tracker.EventCompleted
+		case <-next:
+		}
+
+		resp, e := s.announce(context.Background(), event)
+		if e != nil {
+			// Keep the event so that it is sent on the next attempt
+			log.Printf("announce failed, retrying in %v: %v", retry, e)
+			next = time.After(retry)
+			retry *= 2
+			if retry > announceRetryMax {
+				retry = announceRetryMax
+			}
+			continue
+		}
+
+		if event == tracker.EventCompleted {
+			completeSent = true
+		}
+		event = tracker.EventNone
+		retry = announceRetryMin
+		next = time.After(announceWait(resp.State))
+
+		s.addPeers(resp.Peers)
+	}
+}
+
+// dhtLoop joins the DHT, then periodically announces the torrent to it and
+// connects to any new peers it returns, until chDone is closed.
+func (s *Swarm) dhtLoop(chDone <-chan struct{}) {
+	// Magnet links may have had us join already
+	if s.DHT.NumNodes() == 0 {
+		s.bootstrapDHT(s.Tor.Nodes())
+	}
+
+	for {
+		peers, e := s.DHT.Announce(s.Tor.Infohash(), s.Port)
+		if e != nil {
+			log.Printf("dht announce failed: %v", e)
+		}
+
+		added := s.addPeers(peers)
+		if len(added) > 0 {
+			log.Printf("got %v new peers from dht", len(added))
+		}
+
+		select {
+		case <-time.After(dhtInterval):
+		case <-chDone:
+			return
+		}
+	}
+}
+
+// bootstrapDHT joins the DHT through the given nodes and the default
+// bootstrap nodes.
+func (s *Swarm) bootstrapDHT(nodes []string) {
+	bootstrap := make([]string, 0, len(nodes)+len(dht.DefaultBootstrap))
+	bootstrap = append(bootstrap, nodes...)
+	bootstrap = append(bootstrap, dht.DefaultBootstrap...)
+
+	e := s.DHT.Bootstrap(bootstrap)
+	if e != nil {
+		log.Printf("dht bootstrap failed: %v", e)
+	} else {
+		log.Printf("joined dht, %v nodes in routing table", s.DHT.NumNodes())
+	}
+}
+
+// DefaultDHTStatePath returns where the DHT routing table is saved between
+// runs by default, or "" if there is nowhere to save it. The directory is
+// only made once the state is saved.
+func DefaultDHTStatePath() string {
+	dir, e := os.UserCacheDir()
+	if e != nil {
+		return ""
+	}
+	return filepath.Join(dir, "gotor", "dht.dat")
+}
+
+// announce sends a single announce with the swarm's current stats, and
+// updates the swarm's tracker state on success. Gives up once ctx is done.
+func (s *Swarm) announce(ctx context.Context, event tracker.Event) (*tracker.Response, error) {
+	resp, announceUrl, e := s.Trackers.Announce(ctx, s.Tor.Infohash(), s.Stats, s.Port, s.Id, event)
+	if e != nil {
+		return nil, e
+	}
+
+	if event != tracker.EventNone {
+		log.Printf("sent %v announce to [%v]", event, announceUrl)
+	}
+	if w := resp.State.Warning(); w != "" {
+		log.Printf("tracker [%v] warning: %v", announceUrl, w)
+	}
+
+	s.pmutex.Lock()
+	s.State = resp.State
+	s.pmutex.Unlock()
+
+	return resp, nil
+}
+
+// announceCompleted tells the announce loop that the download has finished.
+// Never blocks.
+func (s *Swarm) announceCompleted() {
+	select {
+	case s.chCompleted <- struct{}{}:
+	default:
+	}
+}
+
+// mergePeers adds peers we haven't seen before to the swarm's peer list, and
+// returns them.
+func (s *Swarm) mergePeers(peers peer.List) peer.List {
+	s.pmutex.Lock()
+	defer s.pmutex.Unlock()
+
+	known := make(map[string]struct{}, len(s.Peers))
+	for i := range s.Peers {
+		known[s.Peers[i].Addr()] = struct{}{}
+	}
+
+	added := make(peer.List, 0)
+	for _, p := range peers {
+		if _, ok := known[p.Addr()]; ok {
+			continue
+		}
+		known[p.Addr()] = struct{}{}
+		s.Peers = append(s.Peers, p)
+		added = append(added, p)
+	}
+	return added
+}
+
+// addPeers adds new peers to the swarm's peer list, and hands them to the
+// connection manager to dial. Returns the peers that were new.
+func (s *Swarm) addPeers(peers peer.List) peer.List {
+	added := s.mergePeers(peers)
+	if conns := s.conns(); conns != nil {
+		conns.Add(added)
+	}
+	return added
+}
+
+// getState returns the latest tracker state.
+func (s *Swarm) getState() *tracker.State {
+	s.pmutex.Lock()
+	defer s.pmutex.Unlock()
+	return s.State
+}
+
+// announceWait returns how long to wait before the next regular announce.
+// Trackers may give a min interval that is larger than the interval, in
+// which case we respect the min interval.
+func announceWait(state *tracker.State) time.Duration {
+	if state == nil || state.Interval() == 0 {
+		return DefaultAnnounceInterval
+	}
+
+	secs := state.Interval()
+	if state.MinInterval() > secs {
+		secs = state.MinInterval()
+	}
+	return time.Duration(secs) * time.Second
+}
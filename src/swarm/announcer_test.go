@@ -0,0 +1,176 @@
+package swarm
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotor/bf"
+	"gotor/peer"
+	"gotor/torrent"
+	"gotor/torrent/filesd"
+	"gotor/torrent/info"
+	"gotor/tracker"
+	"gotor/utils/test"
+)
+
+func TestSwarm_mergePeers(t *testing.T) {
+	p1 := peer.MakePeer("", net.IPv4(10, 0, 0, 1), 6881)
+	p2 := peer.MakePeer("", net.IPv4(10, 0, 0, 2), 6881)
+	p3 := peer.MakePeer("", net.IPv4(10, 0, 0, 1), 6882)
+
+	s := Swarm{Peers: peer.List{p1}}
+
+	added := s.mergePeers(peer.List{p1, p2, p3, p2})
+	if len(added) != 2 {
+		t.Fatalf("added %v peers, want 2\n%v", len(added), added)
+	}
+	if added[0].Addr() != p2.Addr() || added[1].Addr() != p3.Addr() {
+		t.Errorf("added wrong peers\n%v", added)
+	}
+	if len(s.Peers) != 3 {
+		t.Errorf("swarm has %v peers, want 3", len(s.Peers))
+	}
+
+	added = s.mergePeers(peer.List{p3, p1})
+	if len(added) != 0 {
+		t.Errorf("added %v known peers", len(added))
+	}
+}
+
+// fakeTracker is an HTTP tracker that passes the event of every announce on
+// to events. The first fail announces get an error.
+type fakeTracker struct {
+	events chan tracker.Event
+	fail   int32
+}
+
+func newFakeTracker(t *testing.T, fail int32) (*fakeTracker, string) {
+	ft := &fakeTracker{events: make(chan tracker.Event, 64), fail: fail}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ft.events <- tracker.Event(r.URL.Query().Get("event"))
+		if atomic.AddInt32(&ft.fail, -1) >= 0 {
+			_, _ = fmt.Fprint(w, "d14:failure reason4:busye")
+			return
+		}
+		_, _ = fmt.Fprint(w, "d8:completei1e10:incompletei2e8:intervali1e5:peers0:e")
+	}))
+	t.Cleanup(srv.Close)
+	return ft, srv.URL + "/announce"
+}
+
+// next returns the event of the next announce, failing the test if there is
+// none within wait.
+func (ft *fakeTracker) next(t *testing.T, wait time.Duration) tracker.Event {
+	t.Helper()
+	select {
+	case event := <-ft.events:
+		return event
+	case <-time.After(wait):
+		t.Fatalf("no announce within %v", wait)
+		return ""
+	}
+}
+
+// newAnnounceSwarm makes a swarm for a single piece torrent with the given
+// tracker, ready to run its announce loop.
+func newAnnounceSwarm(t *testing.T, announceUrl string) *Swarm {
+	files := []filesd.EntryBase{filesd.MakeFileEntry("a", requestLength)}
+	torInfo, e := info.NewTorInfo("a", requestLength, test.DummyHashes(1), files)
+	test.CheckFatal(t, e)
+	tor, e := torrent.NewTorrent(torInfo, announceUrl)
+	test.CheckFatal(t, e)
+
+	return &Swarm{
+		Id:          "-GT0000-000000000000",
+		Tor:         tor,
+		Trackers:    tracker.FromTorrent(tor),
+		Bf:          bf.NewBitfield(1),
+		Stats:       tracker.NewStats(0, 0, requestLength),
+		chCompleted: make(chan struct{}, 1),
+	}
+}
+
+// runAnnounceLoop runs the swarm's announce loop until stop is called, or
+// until the test ends. done is closed once the loop has stopped.
+func runAnnounceLoop(t *testing.T, s *Swarm, event tracker.Event) (stop func(), done <-chan struct{}) {
+	chStop, chDone := make(chan struct{}), make(chan struct{})
+	once := sync.Once{}
+	stop = func() { once.Do(func() { close(chStop) }) }
+	t.Cleanup(func() {
+		stop()
+		<-chDone
+	})
+
+	go s.announceLoop(event, chStop, chDone)
+	return stop, chDone
+}
+
+func TestSwarm_announceLoop(t *testing.T) {
+	ft, announceUrl := newFakeTracker(t, 0)
+	s := newAnnounceSwarm(t, announceUrl)
+
+	stop, done := runAnnounceLoop(t, s, tracker.EventStarted)
+
+	if event := ft.next(t, time.Second); event != tracker.EventStarted {
+		t.Fatalf("got %q announce, want %q", event, tracker.EventStarted)
+	}
+
+	// The tracker asks for an announce every second
+	start := time.Now()
+	if event := ft.next(t, 3*time.Second); event != tracker.EventNone {
+		t.Fatalf("got %q announce, want a regular one", event)
+	}
+	if waited := time.Since(start); waited < 900*time.Millisecond {
+		t.Errorf("announced again after %v, want the 1s interval", waited)
+	}
+
+	// Completed is sent right away, and only once
+	s.announceCompleted()
+	if event := ft.next(t, time.Second); event != tracker.EventCompleted {
+		t.Fatalf("got %q announce, want %q", event, tracker.EventCompleted)
+	}
+	s.announceCompleted()
+	if event := ft.next(t, 3*time.Second); event != tracker.EventNone {
+		t.Fatalf("got %q announce, want a regular one", event)
+	}
+
+	stop()
+	if event := ft.next(t, time.Second); event != tracker.EventStopped {
+		t.Fatalf("got %q announce, want %q", event, tracker.EventStopped)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("announce loop did not stop")
+	}
+}
+
+func TestSwarm_announceLoopRetry(t *testing.T) {
+	oldMin, oldMax := announceRetryMin, announceRetryMax
+	announceRetryMin, announceRetryMax = 100*time.Millisecond, 200*time.Millisecond
+	t.Cleanup(func() { announceRetryMin, announceRetryMax = oldMin, oldMax })
+
+	// The first three announces fail
+	ft, announceUrl := newFakeTracker(t, 3)
+	s := newAnnounceSwarm(t, announceUrl)
+
+	runAnnounceLoop(t, s, tracker.EventStarted)
+
+	// Started is sent again until it gets through, backing off up to the max
+	waits := []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond, 200 * time.Millisecond}
+	for i, want := range waits {
+		start := time.Now()
+		if event := ft.next(t, time.Second); event != tracker.EventStarted {
+			t.Fatalf("attempt %v: got %q announce, want %q", i, event, tracker.EventStarted)
+		}
+		if waited := time.Since(start); waited < want*9/10 {
+			t.Errorf("attempt %v: retried after %v, want %v", i, waited, want)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package swarm
+
+import (
+	"sync"
+
+	"gotor/bf"
+	"gotor/torrent/info"
+)
+
+// ============================================================================
+// ============================================================================
+
+const (
+	blockMissing   = uint8(iota) // Nobody has requested the block yet
+	blockRequested               // Block has been requested from a peer
+	blockReceived                // Block data has been received
+)
+
+// ============================================================================
+// ============================================================================
+
+// PieceAssembler collects the blocks of pieces that are being downloaded.
+// Each piece is split into blocks of requestLength bytes (the last block of
+// the last piece may be shorter), which are requested from peers one at a
+// time. Once every block of a piece has been received, the full piece is
+// handed back so it can be verified and written to disk.
+type PieceAssembler struct {
+	torInfo *info.TorInfo
+	pieces  map[uint32]*partialPiece // Pieces currently being downloaded
+	mutex   sync.Mutex
+}
+
+// receivedPiece is a copy of a partly downloaded piece.
+type receivedPiece struct {
+	data   []byte
+	blocks *bf.Bitfield // Blocks received
+}
+
+type partialPiece struct {
+	data   []byte
+	blocks []uint8 // State of each block in the piece
+	nrecv  int     // Number of blocks received
+}
+
+// ============================================================================
+// ============================================================================
+
+func NewPieceAssembler(torInfo *info.TorInfo) *PieceAssembler {
+	return &PieceAssembler{
+		torInfo: torInfo,
+		pieces:  make(map[uint32]*partialPiece),
+	}
+}
+
+// Begin starts assembling the piece at the given index. Calling Begin on a
+// piece that is already being assembled does nothing.
+func (pa *PieceAssembler) Begin(index uint32) {
+	pa.mutex.Lock()
+	defer pa.mutex.Unlock()
+
+	if _, ok := pa.pieces[index]; ok {
+		return
+	}
+
+	plen := pa.torInfo.PieceLenAt(int64(index))
+	nblocks := plen / requestLength
+	if plen%requestLength != 0 {
+		nblocks++
+	}
+
+	pa.pieces[index] = &partialPiece{
+		data:   make([]byte, plen, plen),
+		blocks: make([]uint8, nblocks, nblocks),
+		nrecv:  0,
+	}
+}
+
+// Has returns true if the piece at the given index is being assembled.
+func (pa *PieceAssembler) Has(index uint32) bool {
+	pa.mutex.Lock()
+	defer pa.mutex.Unlock()
+
+	_, ok := pa.pieces[index]
+	return ok
+}
+
+// NextBlock returns the first block of the piece that nobody has requested
+// yet, and marks it as requested. Returns false if there are no such blocks,
+// or if the piece is not being assembled.
+func (pa *PieceAssembler) NextBlock(index uint32) (blockReq, bool) {
+	pa.mutex.Lock()
+	defer pa.mutex.Unlock()
+
+	pp, ok := pa.pieces[index]
+	if !ok {
+		return blockReq{}, false
+	}
+
+	for i, state := range pp.blocks {
+		if state == blockMissing {
+			pp.blocks[i] = blockRequested
+			return pa.blockAt(index, pp, i), true
+		}
+	}
+
+	return blockReq{}, false
+}
+
+// NextDuplicate is used in endgame mode. It returns the first block of the
+// piece that has been requested but not yet received, skipping any blocks in
+// the skip set (i.e. blocks the peer has already been asked for).
+func (pa *PieceAssembler) NextDuplicate(index uint32, skip map[blockReq]struct{}) (blockReq, bool) {
+	pa.mutex.Lock()
+	defer pa.mutex.Unlock()
+
+	pp, ok := pa.pieces[index]
+	if !ok {
+		return blockReq{}, false
+	}
+
+	for i, state := range pp.blocks {
+		if state != blockRequested {
+			continue
+		}
+		req := pa.blockAt(index, pp, i)
+		if _, skipped := skip[req]; !skipped {
+			return req, true
+		}
+	}
+
+	return blockReq{}, false
+}
+
+// Unrequest marks a previously requested block as missing again, so that it
+// may be requested from another peer. Blocks that have already been
+// received are left alone.
+func (pa *PieceAssembler) Unrequest(req blockReq) {
+	pa.mutex.Lock()
+	defer pa.mutex.Unlock()
+
+	pp, ok := pa.pieces[req.index]
+	if !ok {
+		return
+	}
+
+	i := int(req.begin / requestLength)
+	if i < len(pp.blocks) && pp.blocks[i] == blockRequested {
+		pp.blocks[i] = blockMissing
+	}
+}
+
+// Put stores a received block. If this was the last missing block of the
+// piece, the piece is removed from the assembler and its data is returned
+// along with true. Blocks that don't line up with our block boundaries, or
+// that have already been received, are ignored.
+func (pa *PieceAssembler) Put(index uint32, begin uint32, block []byte) ([]byte, bool) {
+	pa.mutex.Lock()
+	defer pa.mutex.Unlock()
+
+	pp, ok := pa.pieces[index]
+	if !ok || begin%requestLength != 0 {
+		return nil, false
+	}
+
+	i := int(begin / requestLength)
+	if i >= len(pp.blocks) || pp.blocks[i] == blockReceived {
+		return nil, false
+	}
+	if uint32(len(block)) != pa.blockAt(index, pp, i).length {
+		return nil, false
+	}
+
+	copy(pp.data[begin:], block)
+	pp.blocks[i] = blockReceived
+	pp.nrecv++
+
+	if pp.nrecv < len(pp.blocks) {
+		return nil, false
+	}
+
+	delete(pa.pieces, index)
+	return pp.data, true
+}
+
+// Received returns a copy of every piece being assembled that has received
+// at least one block, with the blocks received set in its bitfield.
+func (pa *PieceAssembler) Received() map[uint32]receivedPiece {
+	pa.mutex.Lock()
+	defer pa.mutex.Unlock()
+
+	received := make(map[uint32]receivedPiece)
+	for index, pp := range pa.pieces {
+		if pp.nrecv == 0 {
+			continue
+		}
+		blocks := bf.NewBitfield(int64(len(pp.blocks)))
+		for i, state := range pp.blocks {
+			blocks.Set(int64(i), state == blockReceived)
+		}
+		data := make([]byte, len(pp.data))
+		copy(data, pp.data)
+		received[index] = receivedPiece{data: data, blocks: blocks}
+	}
+	return received
+}
+
+// Restore starts assembling the piece with some of its blocks already
+// received, e.g. from before a restart. data holds the whole piece, only the
+// blocks set in blocks are used. Does nothing if the piece is already being
+// assembled, or if blocks doesn't match the piece.
+func (pa *PieceAssembler) Restore(index uint32, blocks *bf.Bitfield, data []byte) {
+	pa.Begin(index)
+
+	pa.mutex.Lock()
+	defer pa.mutex.Unlock()
+
+	pp := pa.pieces[index]
+	if pp.nrecv > 0 || blocks.Nbits() != int64(len(pp.blocks)) || len(data) < len(pp.data) {
+		return
+	}
+	for i := range pp.blocks {
+		if !blocks.Get(int64(i)) || pp.blocks[i] != blockMissing {
+			continue
+		}
+		req := pa.blockAt(index, pp, i)
+		copy(pp.data[req.begin:req.begin+req.length], data[req.begin:])
+		pp.blocks[i] = blockReceived
+		pp.nrecv++
+	}
+
+	// Nothing left to download, so let it be downloaded again in full
+	if pp.nrecv == len(pp.blocks) {
+		delete(pa.pieces, index)
+	}
+}
+
+// blockAt returns the request for the i'th block of a piece. Must be called
+// with the lock held.
+func (pa *PieceAssembler) blockAt(index uint32, pp *partialPiece, i int) blockReq {
+	begin := uint32(i) * requestLength
+	length := uint32(len(pp.data)) - begin
+	if length > requestLength {
+		length = requestLength
+	}
+	return blockReq{
+		index:  index,
+		begin:  begin,
+		length: length,
+	}
+}
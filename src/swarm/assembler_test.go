@@ -0,0 +1,120 @@
+package swarm
+
+import (
+	"bytes"
+	"testing"
+
+	"gotor/torrent/filesd"
+	"gotor/torrent/info"
+	"gotor/utils/test"
+)
+
+func TestPieceAssembler(t *testing.T) {
+	tests := []struct {
+		name     string
+		pieceLen int64
+		length   int64
+		index    uint32
+		nblocks  int
+	}{
+		{"exact blocks", 4 * requestLength, 8 * requestLength, 0, 4},
+		{"short last piece", 4 * requestLength, 5*requestLength + 100, 1, 2},
+		{"piece smaller than block", 1000, 2500, 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			npieces := tt.length / tt.pieceLen
+			if tt.length%tt.pieceLen != 0 {
+				npieces++
+			}
+			files := []filesd.EntryBase{filesd.MakeFileEntry("f", tt.length)}
+			torInfo, e := info.NewTorInfo("f", tt.pieceLen, test.DummyHashes(npieces), files)
+			test.CheckFatal(t, e)
+
+			plen := torInfo.PieceLenAt(int64(tt.index))
+			want := make([]byte, plen)
+			for i := range want {
+				want[i] = byte(i * 7)
+			}
+
+			pa := NewPieceAssembler(torInfo)
+			pa.Begin(tt.index)
+			if !pa.Has(tt.index) {
+				t.Fatal("piece not being assembled after Begin")
+			}
+
+			// Request every block
+			reqs := make([]blockReq, 0, tt.nblocks)
+			for {
+				req, ok := pa.NextBlock(tt.index)
+				if !ok {
+					break
+				}
+				reqs = append(reqs, req)
+			}
+			if len(reqs) != tt.nblocks {
+				t.Fatalf("got %v blocks, want %v", len(reqs), tt.nblocks)
+			}
+
+			// Give the first one back, it should be handed out again
+			pa.Unrequest(reqs[0])
+			req, ok := pa.NextBlock(tt.index)
+			if !ok || req != reqs[0] {
+				t.Errorf("expected %v after Unrequest, got %v", reqs[0], req)
+			}
+
+			// Deliver blocks in reverse, plus a duplicate of the last one
+			for i := len(reqs) - 1; i >= 0; i-- {
+				r := reqs[i]
+				data, done := pa.Put(r.index, r.begin, want[r.begin:r.begin+r.length])
+				if i > 0 && done {
+					t.Fatalf("piece completed after %v blocks", len(reqs)-i)
+				}
+				if i == 0 {
+					if !done {
+						t.Fatal("piece not complete after all blocks")
+					}
+					if !bytes.Equal(data, want) {
+						t.Error("assembled piece does not match")
+					}
+				}
+			}
+
+			if pa.Has(tt.index) {
+				t.Error("completed piece still being assembled")
+			}
+			if _, done := pa.Put(reqs[0].index, reqs[0].begin, want[:reqs[0].length]); done {
+				t.Error("block accepted for completed piece")
+			}
+		})
+	}
+}
+
+func TestPieceAssembler_NextDuplicate(t *testing.T) {
+	files := []filesd.EntryBase{filesd.MakeFileEntry("f", 3*requestLength)}
+	torInfo, e := info.NewTorInfo("f", 3*requestLength, test.DummyHashes(1), files)
+	test.CheckFatal(t, e)
+
+	pa := NewPieceAssembler(torInfo)
+	pa.Begin(0)
+
+	// Nothing requested yet, so nothing to duplicate
+	if _, ok := pa.NextDuplicate(0, nil); ok {
+		t.Fatal("got duplicate before any requests")
+	}
+
+	req0, _ := pa.NextBlock(0)
+	req1, _ := pa.NextBlock(0)
+
+	// Skip the first, should get the second
+	got, ok := pa.NextDuplicate(0, map[blockReq]struct{}{req0: {}})
+	if !ok || got != req1 {
+		t.Errorf("got (%v, %v), want (%v, true)", got, ok, req1)
+	}
+
+	// Received blocks are never duplicated
+	pa.Put(req1.index, req1.begin, make([]byte, req1.length))
+	if _, ok = pa.NextDuplicate(0, map[blockReq]struct{}{req0: {}}); ok {
+		t.Errorf("got duplicate of received block")
+	}
+}
@@ -0,0 +1,207 @@
+package swarm
+
+import (
+	"log"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// ============================================================================
+// ============================================================================
+
+const (
+	// ChokeInterval is how often the choker re-evaluates which peers are
+	// unchoked, as suggested by BEP_0003.
+	ChokeInterval = 10 * time.Second
+
+	// OptimisticInterval is how often the optimistic unchoke is rotated.
+	OptimisticInterval = 30 * time.Second
+
+	// DefaultUploadSlots is the number of peers we upload to at once,
+	// including the optimistic unchoke.
+	DefaultUploadSlots = 4
+)
+
+// ============================================================================
+// ============================================================================
+
+// ChokeCandidate is a snapshot of a peer's state at the start of a choking
+// round.
+type ChokeCandidate struct {
+	Peer       *PeerHandler
+	DnRate     float64 // Bytes/sec we downloaded from the peer last round
+	UpRate     float64 // Bytes/sec we uploaded to the peer last round
+	Interested bool    // Peer is interested in us
+	Choked     bool    // We are currently choking the peer
+}
+
+// ChokeStrategy decides which peers should be unchoked. Unchoke is only ever
+// called from the swarm's choke loop, so implementations may keep state
+// between rounds without locking. Every peer not in the returned slice will
+// be choked.
+type ChokeStrategy interface {
+	Unchoke(cands []ChokeCandidate, seeding bool) []*PeerHandler
+}
+
+// TitForTat is the choking algorithm described in BEP_0003. The peers that
+// give us the best download rate (or that we upload to the fastest, when
+// seeding) are unchoked, plus one optimistic unchoke that is rotated every
+// OptimisticInterval so that we can discover better peers.
+type TitForTat struct {
+	slots          int
+	optimistic     *PeerHandler
+	lastOptimistic time.Time
+	rng            *rand.Rand
+}
+
+// ============================================================================
+// ============================================================================
+
+func NewTitForTat(slots int) *TitForTat {
+	if slots < 1 {
+		slots = 1
+	}
+	return &TitForTat{
+		slots: slots,
+		rng:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (tft *TitForTat) Unchoke(cands []ChokeCandidate, seeding bool) []*PeerHandler {
+	rate := func(c ChokeCandidate) float64 {
+		if seeding {
+			return c.UpRate
+		}
+		return c.DnRate
+	}
+
+	sorted := make([]ChokeCandidate, len(cands))
+	copy(sorted, cands)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return rate(sorted[i]) > rate(sorted[j])
+	})
+
+	unchoked := make([]*PeerHandler, 0, tft.slots)
+	isUnchoked := make(map[*PeerHandler]bool)
+
+	// Regular unchokes. Peers that are faster than the slowest unchoked
+	// downloader but aren't interested also get unchoked, so that they can
+	// take a slot as soon as they become interested. They don't count
+	// towards the slot limit.
+	regular := tft.slots - 1
+	ndownloaders := 0
+	for _, c := range sorted {
+		if ndownloaders >= regular {
+			break
+		}
+		if c.Interested {
+			ndownloaders++
+		}
+		unchoked = append(unchoked, c.Peer)
+		isUnchoked[c.Peer] = true
+	}
+
+	// Optimistic unchoke. Keep the current one until its time is up, unless
+	// it has left, lost interest, or earned a regular slot.
+	keep := false
+	if tft.optimistic != nil && time.Since(tft.lastOptimistic) < OptimisticInterval {
+		for _, c := range cands {
+			if c.Peer == tft.optimistic && c.Interested && !isUnchoked[c.Peer] {
+				keep = true
+				break
+			}
+		}
+	}
+
+	if !keep {
+		tft.optimistic = nil
+		pool := make([]*PeerHandler, 0, len(cands))
+		for _, c := range cands {
+			if c.Interested && !isUnchoked[c.Peer] {
+				pool = append(pool, c.Peer)
+			}
+		}
+		if len(pool) > 0 {
+			tft.optimistic = pool[tft.rng.Intn(len(pool))]
+			tft.lastOptimistic = time.Now()
+		}
+	}
+
+	if tft.optimistic != nil {
+		unchoked = append(unchoked, tft.optimistic)
+	}
+
+	return unchoked
+}
+
+// ============================================================================
+// ============================================================================
+
+// chokeLoop periodically re-evaluates which peers are unchoked using the
+// swarm's ChokeStrategy, until chDone is closed. A round can also be
+// triggered early with rechoke.
+func (s *Swarm) chokeLoop(chDone <-chan struct{}) {
+	ticker := time.NewTicker(ChokeInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			elapsed := now.Sub(last)
+			last = now
+			for _, ph := range s.Handlers() {
+				ph.updateRates(elapsed)
+			}
+		case <-s.chRechoke:
+		case <-chDone:
+			return
+		}
+
+		s.runChokeRound()
+	}
+}
+
+// rechoke asks the choke loop to run a round as soon as possible, e.g. when
+// a peer becomes interested. Never blocks.
+func (s *Swarm) rechoke() {
+	select {
+	case s.chRechoke <- struct{}{}:
+	default:
+	}
+}
+
+// runChokeRound asks the ChokeStrategy who should be unchoked, and sends
+// choke and unchoke messages accordingly.
+func (s *Swarm) runChokeRound() {
+	handlers := s.Handlers()
+	cands := make([]ChokeCandidate, 0, len(handlers))
+	for _, ph := range handlers {
+		dn, up := ph.Rates()
+		cands = append(cands, ChokeCandidate{
+			Peer:       ph,
+			DnRate:     dn,
+			UpRate:     up,
+			Interested: ph.peerState.InterestedUs(),
+			Choked:     ph.peerState.WeChoking(),
+		})
+	}
+
+	unchoke := make(map[*PeerHandler]bool)
+	for _, ph := range s.Choker.Unchoke(cands, s.Bf.Complete()) {
+		unchoke[ph] = true
+	}
+
+	for _, c := range cands {
+		var e error
+		if unchoke[c.Peer] && c.Choked {
+			e = c.Peer.Unchoke()
+		} else if !unchoke[c.Peer] && !c.Choked {
+			e = c.Peer.Choke()
+		}
+		if e != nil {
+			log.Printf("error updating choke state for %v: %v", c.Peer.peerInfo.Addr(), e)
+		}
+	}
+}
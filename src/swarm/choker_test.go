@@ -0,0 +1,102 @@
+package swarm
+
+import (
+	"testing"
+)
+
+func TestTitForTat_Unchoke(t *testing.T) {
+	// Candidate shorthand
+	type cand struct {
+		id         string
+		dn         float64
+		up         float64
+		interested bool
+	}
+
+	tests := []struct {
+		name    string
+		slots   int
+		seeding bool
+		cands   []cand
+		regular []string // Peers that must be unchoked, excluding optimistic
+		never   []string // Peers that must never be unchoked
+	}{
+		{"fastest downloaders", 3, false, []cand{
+			{"slow", 10, 0, true},
+			{"fast", 500, 0, true},
+			{"mid", 100, 0, true},
+			{"zero", 0, 0, true},
+		}, []string{"fast", "mid"}, []string{}},
+
+		{"seeding uses upload rate", 2, true, []cand{
+			{"a", 500, 10, true},
+			{"b", 0, 300, true},
+		}, []string{"b"}, []string{}},
+
+		{"uninterested fast peer", 2, false, []cand{
+			{"uninterested", 900, 0, false},
+			{"fast", 500, 0, true},
+			{"slow", 10, 0, true},
+			{"slower", 5, 0, true},
+		}, []string{"uninterested", "fast"}, []string{}},
+
+		{"uninterested slow peer", 2, false, []cand{
+			{"fast", 500, 0, true},
+			{"uninterested", 10, 0, false},
+		}, []string{"fast"}, []string{"uninterested"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			byId := make(map[string]*PeerHandler)
+			cands := make([]ChokeCandidate, 0, len(tt.cands))
+			for _, c := range tt.cands {
+				ph := PHDummy(c.id)
+				byId[c.id] = ph
+				cands = append(cands, ChokeCandidate{
+					Peer:       ph,
+					DnRate:     c.dn,
+					UpRate:     c.up,
+					Interested: c.interested,
+					Choked:     true,
+				})
+			}
+
+			tft := NewTitForTat(tt.slots)
+			got := make(map[*PeerHandler]bool)
+			for _, ph := range tft.Unchoke(cands, tt.seeding) {
+				got[ph] = true
+			}
+
+			for _, id := range tt.regular {
+				if !got[byId[id]] {
+					t.Errorf("peer %v should be unchoked", id)
+				}
+			}
+			for _, id := range tt.never {
+				if got[byId[id]] {
+					t.Errorf("peer %v should be choked", id)
+				}
+			}
+
+			// Optimistic unchoke must be an interested peer
+			for ph := range got {
+				if ph == tft.optimistic {
+					for _, c := range cands {
+						if c.Peer == ph && !c.Interested {
+							t.Errorf("optimistic unchoke %v is not interested", ph.Key())
+						}
+					}
+				}
+			}
+
+			// Optimistic unchoke should stick around for the next round
+			opt := tft.optimistic
+			if opt != nil {
+				tft.Unchoke(cands, tt.seeding)
+				if tft.optimistic != opt {
+					t.Errorf("optimistic unchoke rotated early")
+				}
+			}
+		})
+	}
+}
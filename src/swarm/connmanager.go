@@ -0,0 +1,413 @@
+package swarm
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"gotor/peer"
+)
+
+const (
+	// DefaultMaxConns is the default limit on connections across every
+	// torrent sharing a ConnLimiter.
+	DefaultMaxConns = 200
+
+	// DefaultMaxPeers is the default limit on connections for one torrent.
+	DefaultMaxPeers = 50
+
+	// maxDialing is how many connection attempts a torrent makes at once
+	maxDialing = 8
+
+	// maxCandidates is how many peers we remember. New peers are dropped
+	// once the pool is full.
+	maxCandidates = 2000
+
+	// After a failed attempt we wait dialBackoffMin before dialing the peer
+	// again, doubling each time up to dialBackoffMax. Peers that fail
+	// maxDialFailures times in a row are forgotten.
+	dialBackoffMin  = 30 * time.Second
+	dialBackoffMax  = 30 * time.Minute
+	maxDialFailures = 8
+
+	// reconnectDelay is how long we wait before dialing a peer whose
+	// connection broke.
+	reconnectDelay = time.Minute
+
+	// connTickInterval is how often we look for peers to dial when nothing
+	// else wakes us up.
+	connTickInterval = 5 * time.Second
+)
+
+// errSelfConnection is returned when a peer turns out to be ourselves.
+var errSelfConnection = errors.New("connected to ourselves")
+
+// ============================================================================
+// STRUCTS ====================================================================
+
+// ConnLimiter caps connections across several swarms.
+type ConnLimiter struct {
+	max   int
+	n     int
+	mutex sync.Mutex
+}
+
+// ConnManager keeps a pool of candidate peers from every peer source, and
+// keeps the swarm connected to as many of them as its limits allow. Failed
+// dials are retried with exponential backoff, and connections that break are
+// replaced.
+type ConnManager struct {
+	swarm    *Swarm
+	limiter  *ConnLimiter
+	maxPeers int
+
+	candidates map[string]*candidate // By address
+	ids        map[string]struct{}   // Peer IDs we are connected to
+	active     int                   // Connections and attempts counted against the limits
+	dialing    int                   // Outgoing attempts in progress
+	closed     bool                  // No new connections once set
+	mutex      sync.Mutex            // Guards everything above
+
+	procs sync.WaitGroup // Running dials and connections
+
+	chWake    chan struct{}
+	chDone    chan struct{}
+	closeOnce sync.Once
+}
+
+// candidate is a peer we know the listen address of.
+type candidate struct {
+	info      peer.Info
+	failures  int       // Failed dials in a row
+	nextDial  time.Time // Don't dial before
+	dialing   bool
+	connected bool
+	banned    bool // Never dial, e.g. it's ourselves
+}
+
+// ============================================================================
+// CONSTRUCTORS ===============================================================
+
+func NewConnLimiter(max int) *ConnLimiter {
+	return &ConnLimiter{max: max}
+}
+
+// NewConnManager makes a manager for the swarm that keeps at most maxPeers
+// connections, and shares the limiter's global limit with other swarms.
+func NewConnManager(swarm *Swarm, limiter *ConnLimiter, maxPeers int) *ConnManager {
+	return &ConnManager{
+		swarm:      swarm,
+		limiter:    limiter,
+		maxPeers:   maxPeers,
+		candidates: make(map[string]*candidate),
+		ids:        make(map[string]struct{}),
+		chWake:     make(chan struct{}, 1),
+		chDone:     make(chan struct{}),
+	}
+}
+
+// ============================================================================
+// LIMITER ====================================================================
+
+// acquire takes a connection slot, returning false if none are left.
+func (cl *ConnLimiter) acquire() bool {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	if cl.n >= cl.max {
+		return false
+	}
+	cl.n++
+	return true
+}
+
+func (cl *ConnLimiter) release() {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	cl.n--
+}
+
+// ============================================================================
+// MANAGER ====================================================================
+
+// Add puts peers we haven't seen before in the candidate pool, and dials
+// them if there is room. Returns the peers that were added.
+func (cm *ConnManager) Add(peers peer.List) peer.List {
+	cm.mutex.Lock()
+	added := make(peer.List, 0)
+	for _, p := range peers {
+		if len(cm.candidates) >= maxCandidates {
+			break
+		}
+		if _, ok := cm.candidates[p.Addr()]; ok {
+			continue
+		}
+		cm.candidates[p.Addr()] = &candidate{info: p}
+		added = append(added, p)
+	}
+	cm.mutex.Unlock()
+
+	if len(added) > 0 {
+		cm.wake()
+	}
+	return added
+}
+
+// NumConns returns the number of connections, including attempts in
+// progress.
+func (cm *ConnManager) NumConns() int {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	return cm.active
+}
+
+// Close stops dialing and accepting new peers. Running connections are left
+// alone, they stop along with the swarm.
+func (cm *ConnManager) Close() {
+	cm.mutex.Lock()
+	cm.closed = true
+	cm.mutex.Unlock()
+
+	cm.closeOnce.Do(func() {
+		close(cm.chDone)
+	})
+}
+
+// wait blocks until every dial and connection has stopped, or ctx is done.
+// Only call it after Close, so that no new ones are started.
+func (cm *ConnManager) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		cm.procs.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (cm *ConnManager) wake() {
+	select {
+	case cm.chWake <- struct{}{}:
+	default:
+	}
+}
+
+// loop dials candidates whenever there is room, until Close is called.
+func (cm *ConnManager) loop() {
+	ticker := time.NewTicker(connTickInterval)
+	defer ticker.Stop()
+
+	for {
+		cm.fill()
+		select {
+		case <-cm.chDone:
+			return
+		case <-cm.chWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// fill starts dialing candidates until the limits are reached or no
+// candidate is due.
+func (cm *ConnManager) fill() {
+	for {
+		cm.mutex.Lock()
+		if cm.closed || cm.dialing >= maxDialing {
+			cm.mutex.Unlock()
+			return
+		}
+		c := cm.nextCandidate(time.Now())
+		if c == nil || !cm.reserve() {
+			cm.mutex.Unlock()
+			return
+		}
+		c.dialing = true
+		cm.dialing++
+		cm.procs.Add(1)
+		cm.mutex.Unlock()
+
+		go cm.dial(c)
+	}
+}
+
+// nextCandidate returns the due candidate with the fewest failures, or nil.
+func (cm *ConnManager) nextCandidate(now time.Time) *candidate {
+	var best *candidate
+	for _, c := range cm.candidates {
+		if c.banned || c.dialing || c.connected || now.Before(c.nextDial) {
+			continue
+		}
+		if best == nil || c.failures < best.failures {
+			best = c
+		}
+	}
+	return best
+}
+
+// reserve takes a slot from both the torrent's and the global limit.
+func (cm *ConnManager) reserve() bool {
+	if cm.active >= cm.maxPeers || !cm.limiter.acquire() {
+		return false
+	}
+	cm.active++
+	return true
+}
+
+// release gives back a slot taken by reserve, and wakes up the loop to fill
+// it.
+func (cm *ConnManager) release() {
+	cm.mutex.Lock()
+	cm.active--
+	cm.mutex.Unlock()
+	cm.limiter.release()
+	cm.wake()
+}
+
+// dial connects to the candidate and runs the connection until it breaks.
+func (cm *ConnManager) dial(c *candidate) {
+	defer cm.procs.Done()
+	defer cm.release()
+
+	ctx, cancel := cm.dialContext()
+	ph, e := FromBootstrap(ctx, c.info, cm.swarm)
+	cancel()
+
+	cm.mutex.Lock()
+	cm.dialing--
+	c.dialing = false
+	if e != nil {
+		cm.failed(c, e)
+		cm.mutex.Unlock()
+		log.Printf("failed to connect to %v: %v", c.info.Addr(), e)
+		return
+	}
+	cm.mutex.Unlock()
+
+	cm.run(ph, c)
+}
+
+// dialContext returns a context that is cancelled once the manager is
+// closed, so that Pause and Stop don't wait on peers that never answer.
+func (cm *ConnManager) dialContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-cm.chDone:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// failed backs off from a candidate, and forgets it if it keeps failing or
+// is ourselves.
+func (cm *ConnManager) failed(c *candidate, e error) {
+	if errors.Is(e, errSelfConnection) {
+		c.banned = true
+		return
+	}
+
+	c.failures++
+	if c.failures >= maxDialFailures {
+		delete(cm.candidates, c.info.Addr())
+		return
+	}
+	c.nextDial = time.Now().Add(dialBackoff(c.failures))
+}
+
+// accept answers an incoming connection whose handshake has been read, and
+// runs it in the background, if there is room for it.
+func (cm *ConnManager) accept(conn net.Conn, peerHs Handshake) {
+	cm.mutex.Lock()
+	closed := cm.closed
+	ok := !closed && cm.reserve()
+	if ok {
+		cm.procs.Add(1)
+	}
+	cm.mutex.Unlock()
+	if !ok {
+		if !closed {
+			log.Printf("too many connections, dropping %v", conn.RemoteAddr())
+		}
+		_ = conn.Close()
+		return
+	}
+
+	go cm.incoming(conn, peerHs)
+}
+
+// incoming finishes the handshake for an accepted connection, and runs the
+// connection until it breaks.
+func (cm *ConnManager) incoming(conn net.Conn, peerHs Handshake) {
+	defer cm.procs.Done()
+	defer cm.release()
+
+	ph, e := answerHandshake(conn, peerHs, cm.swarm)
+	if e != nil {
+		log.Printf("incoming connection from %v failed: %v", conn.RemoteAddr(), e)
+		return
+	}
+	cm.run(ph, nil)
+}
+
+// run runs the handler until it stops, unless we are already connected to
+// the same peer or are shutting down. c is nil for incoming connections.
+func (cm *ConnManager) run(ph *PeerHandler, c *candidate) {
+	id := ph.peerInfo.Id()
+
+	cm.mutex.Lock()
+	if cm.closed {
+		cm.mutex.Unlock()
+		_ = ph.conn.Close()
+		return
+	}
+	if _, ok := cm.ids[id]; ok {
+		// Don't dial the same address again while the other connection lives
+		if c != nil {
+			c.nextDial = time.Now().Add(reconnectDelay)
+		}
+		cm.mutex.Unlock()
+		log.Printf("already connected to %v, dropping %v", ph.peerInfo.String(), ph.peerInfo.Addr())
+		_ = ph.conn.Close()
+		return
+	}
+	cm.ids[id] = struct{}{}
+	if c != nil {
+		c.connected = true
+		c.failures = 0
+	}
+	cm.mutex.Unlock()
+
+	ph.chStop = cm.chDone
+	ph.Loop()
+
+	cm.mutex.Lock()
+	delete(cm.ids, id)
+	if c != nil {
+		c.connected = false
+		c.nextDial = time.Now().Add(reconnectDelay)
+	}
+	cm.mutex.Unlock()
+}
+
+// dialBackoff returns how long to wait after the given number of failed
+// dials in a row.
+func dialBackoff(failures int) time.Duration {
+	backoff := dialBackoffMin
+	for i := 1; i < failures && backoff < dialBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > dialBackoffMax {
+		backoff = dialBackoffMax
+	}
+	return backoff
+}
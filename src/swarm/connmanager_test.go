@@ -0,0 +1,229 @@
+package swarm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"gotor/peer"
+)
+
+func TestConnManager_Add(t *testing.T) {
+	cm := NewConnManager(&Swarm{}, NewConnLimiter(10), 10)
+	p1 := peer.MakePeer("", net.IPv4(10, 0, 0, 1), 6881)
+	p2 := peer.MakePeer("", net.IPv4(10, 0, 0, 2), 6881)
+
+	added := cm.Add(peer.List{p1, p2, p1})
+	if len(added) != 2 || len(cm.candidates) != 2 {
+		t.Fatalf("added %v peers, pool has %v, want 2 and 2", len(added), len(cm.candidates))
+	}
+	if added = cm.Add(peer.List{p2}); len(added) != 0 {
+		t.Errorf("added known peer again")
+	}
+}
+
+func TestConnManager_nextCandidate(t *testing.T) {
+	now := time.Now()
+	cm := NewConnManager(&Swarm{}, NewConnLimiter(10), 10)
+	cands := []*candidate{
+		{info: peer.MakePeer("", net.IPv4(10, 0, 0, 1), 1), banned: true},
+		{info: peer.MakePeer("", net.IPv4(10, 0, 0, 2), 1), dialing: true},
+		{info: peer.MakePeer("", net.IPv4(10, 0, 0, 3), 1), connected: true},
+		{info: peer.MakePeer("", net.IPv4(10, 0, 0, 4), 1), nextDial: now.Add(time.Minute)},
+		{info: peer.MakePeer("", net.IPv4(10, 0, 0, 5), 1), failures: 2},
+		{info: peer.MakePeer("", net.IPv4(10, 0, 0, 6), 1), failures: 1, nextDial: now.Add(-time.Second)},
+	}
+	for _, c := range cands {
+		cm.candidates[c.info.Addr()] = c
+	}
+
+	if c := cm.nextCandidate(now); c != cands[5] {
+		t.Fatalf("expected the due candidate with fewest failures, got %v", c)
+	}
+	cands[5].dialing = true
+	if c := cm.nextCandidate(now); c != cands[4] {
+		t.Fatalf("expected the other due candidate, got %v", c)
+	}
+	cands[4].connected = true
+	if c := cm.nextCandidate(now); c != nil {
+		t.Fatalf("expected no candidate, got %v", c)
+	}
+}
+
+func TestConnManager_Limits(t *testing.T) {
+	limiter := NewConnLimiter(3)
+	cm1 := NewConnManager(&Swarm{}, limiter, 2)
+	cm2 := NewConnManager(&Swarm{}, limiter, 2)
+
+	tests := []struct {
+		cm *ConnManager
+		ok bool
+	}{
+		{cm1, true},
+		{cm1, true},
+		{cm1, false}, // Torrent limit
+		{cm2, true},
+		{cm2, false}, // Global limit
+	}
+	for i, tt := range tests {
+		if ok := tt.cm.reserve(); ok != tt.ok {
+			t.Fatalf("reserve %v: got %v, want %v", i, ok, tt.ok)
+		}
+	}
+
+	cm1.release()
+	if !cm2.reserve() {
+		t.Fatal("released slot should be free for the other torrent")
+	}
+	if cm1.NumConns() != 1 || cm2.NumConns() != 2 {
+		t.Errorf("got %v and %v connections, want 1 and 2", cm1.NumConns(), cm2.NumConns())
+	}
+}
+
+func TestConnManager_failed(t *testing.T) {
+	cm := NewConnManager(&Swarm{}, NewConnLimiter(10), 10)
+	self := &candidate{info: peer.MakePeer("", net.IPv4(10, 0, 0, 1), 1)}
+	other := &candidate{info: peer.MakePeer("", net.IPv4(10, 0, 0, 2), 1)}
+	cm.candidates[self.info.Addr()] = self
+	cm.candidates[other.info.Addr()] = other
+
+	cm.failed(self, errSelfConnection)
+	if !self.banned {
+		t.Error("self connection should be banned")
+	}
+
+	before := time.Now()
+	for i := 1; i < maxDialFailures; i++ {
+		cm.failed(other, errors.New("refused"))
+		if other.failures != i || other.nextDial.Before(before.Add(dialBackoff(i))) {
+			t.Fatalf("failure %v: got %v failures, next dial %v", i, other.failures, other.nextDial)
+		}
+	}
+	cm.failed(other, errors.New("refused"))
+	if _, ok := cm.candidates[other.info.Addr()]; ok {
+		t.Error("candidate should be forgotten after too many failures")
+	}
+}
+
+func TestDialBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		backoff  time.Duration
+	}{
+		{1, dialBackoffMin},
+		{2, 2 * dialBackoffMin},
+		{3, 4 * dialBackoffMin},
+		{100, dialBackoffMax},
+	}
+	for _, tt := range tests {
+		if got := dialBackoff(tt.failures); got != tt.backoff {
+			t.Errorf("%v failures: got %v, want %v", tt.failures, got, tt.backoff)
+		}
+	}
+}
+
+func TestConnManager_runDuplicate(t *testing.T) {
+	cm := NewConnManager(&Swarm{}, NewConnLimiter(10), 10)
+	cm.ids["peer"] = struct{}{}
+
+	local, remote := net.Pipe()
+	ph := PHDummy("peer")
+	ph.conn = local
+
+	// A second connection to the same peer is closed right away
+	cm.run(ph, nil)
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	if _, e := remote.Read(make([]byte, 1)); e != io.EOF {
+		t.Fatalf("expected duplicate connection to be closed, got %v", e)
+	}
+
+	// A dialed candidate that turns out to be a peer we are connected to
+	// isn't dialed again until the reconnect delay has passed
+	c := &candidate{info: peer.MakePeer("", net.IPv4(10, 0, 0, 1), 6881)}
+	cm.candidates[c.info.Addr()] = c
+	local, remote = net.Pipe()
+	ph = PHDummy("peer")
+	ph.conn = local
+	cm.run(ph, c)
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	if _, e := remote.Read(make([]byte, 1)); e != io.EOF {
+		t.Fatalf("expected duplicate connection to be closed, got %v", e)
+	}
+	if next := cm.nextCandidate(time.Now()); next != nil {
+		t.Errorf("candidate is due again right after a duplicate connection")
+	}
+	if next := cm.nextCandidate(time.Now().Add(reconnectDelay + time.Second)); next != c {
+		t.Errorf("candidate should be due after the reconnect delay, got %v", next)
+	}
+}
+
+func TestConnManager_acceptFull(t *testing.T) {
+	cm := NewConnManager(&Swarm{}, NewConnLimiter(10), 0)
+
+	local, remote := net.Pipe()
+	cm.accept(local, nil)
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	if _, e := remote.Read(make([]byte, 1)); e != io.EOF {
+		t.Fatalf("expected connection over the limit to be closed, got %v", e)
+	}
+}
+
+func TestConnManager_Close(t *testing.T) {
+	cm := NewConnManager(&Swarm{}, NewConnLimiter(10), 10)
+	cm.Close()
+
+	// Nothing new is accepted or run once closed
+	local, remote := net.Pipe()
+	cm.accept(local, nil)
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	if _, e := remote.Read(make([]byte, 1)); e != io.EOF {
+		t.Fatalf("expected connection after close to be dropped, got %v", e)
+	}
+	if cm.NumConns() != 0 {
+		t.Errorf("closed manager took a slot")
+	}
+
+	local, remote = net.Pipe()
+	ph := PHDummy("peer")
+	ph.conn = local
+	cm.run(ph, nil)
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	if _, e := remote.Read(make([]byte, 1)); e != io.EOF {
+		t.Fatalf("expected handler after close to be dropped, got %v", e)
+	}
+
+	checkWait := func(want error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if e := cm.wait(ctx); e != want {
+			t.Fatalf("wait: got %v, want %v", e, want)
+		}
+	}
+	checkWait(nil)
+
+	// A connection that doesn't stop makes wait give up
+	cm.procs.Add(1)
+	checkWait(context.DeadlineExceeded)
+	cm.procs.Done()
+	checkWait(nil)
+}
+
+func TestConnManager_dialContext(t *testing.T) {
+	cm := NewConnManager(&Swarm{}, NewConnLimiter(10), 10)
+	ctx, cancel := cm.dialContext()
+	defer cancel()
+
+	// Closing the manager gives up on dials in progress
+	cm.Close()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("dial context not cancelled by Close")
+	}
+	if _, e := dial(ctx, "127.0.0.1:1", cm.swarm); e == nil {
+		t.Error("expected dial with a cancelled context to fail")
+	}
+}
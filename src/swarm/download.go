@@ -0,0 +1,84 @@
+package swarm
+
+import (
+	"log"
+
+	"gotor/p2p"
+	"gotor/utils"
+)
+
+// receiveBlock hands a received block to the PieceAssembler. If the block
+// completes its piece, the piece is verified and written.
+func (s *Swarm) receiveBlock(index uint32, begin uint32, block []byte) error {
+	data, done := s.PA.Put(index, begin, block)
+	if !done {
+		return nil
+	}
+	return s.completePiece(index, data)
+}
+
+// completePiece verifies and writes a fully assembled piece. Pieces that
+// fail verification are released back to the PeerPieceTracker so they will
+// be downloaded again.
+func (s *Swarm) completePiece(index uint32, data []byte) error {
+	if utils.SHA1(data) != s.Tor.Info().PieceHash(int64(index)) {
+		log.Printf("piece %v failed verification, re-queueing", index)
+		s.PPT.Release(index)
+		return nil
+	}
+
+	e := s.Storage.WriteAt(int64(index), 0, data)
+	if e != nil {
+		return e
+	}
+	e = s.Storage.MarkComplete(int64(index))
+	if e != nil {
+		return e
+	}
+
+	s.Bf.Set(int64(index), true)
+
+	s.PPT.Release(index)
+	s.Stats.DecLeft(uint64(len(data)))
+
+	nset, nbits := s.Pieces()
+	log.Printf("got piece %v (%v/%v)", index, nset, nbits)
+	if nset == nbits {
+		log.Printf("download complete")
+		s.announceCompleted()
+	}
+
+	s.broadcastHave(index)
+	return nil
+}
+
+// broadcastHave tells every connected peer that we now have the piece at the
+// given index, and updates our interest in peers that had it.
+func (s *Swarm) broadcastHave(index uint32) {
+	msg := p2p.NewMsgHave(index)
+	for _, ph := range s.Handlers() {
+		// Errors will be picked up by the handler's own loops
+		_ = ph.send(msg)
+
+		ph.mutex.Lock()
+		had := ph.bf.Get(int64(index))
+		ph.mutex.Unlock()
+
+		if had && ph.peerState.WeInterested() {
+			_ = ph.updateInterest()
+		}
+	}
+}
+
+// cancelBlock sends a cancel to every peer other than from that has an
+// outstanding request for the block. Only needed in endgame mode, when the
+// same block is requested from several peers.
+func (s *Swarm) cancelBlock(from *PeerHandler, req blockReq) {
+	for _, ph := range s.Handlers() {
+		if ph == from {
+			continue
+		}
+		// Errors will be picked up by the handler's own loops
+		_ = ph.cancel(req)
+	}
+}
@@ -0,0 +1,54 @@
+package swarm
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+
+	"gotor/mse"
+)
+
+// EncryptTimeout is how long the encryption handshake may take. It needs a
+// few more round trips than the BitTorrent handshake.
+const EncryptTimeout = 10 * time.Second
+
+// dialPeer connects to the peer, encrypting the connection as the swarm's
+// policy asks. With Prefer, peers that fail the encryption handshake are
+// dialed again in plaintext, as many clients don't support it. The infohash
+// is passed on its own, as magnet links don't have a torrent yet. Gives up
+// on dialing once ctx is done.
+func dialPeer(ctx context.Context, addr string, infohash string, swarm *Swarm) (net.Conn, error) {
+	conn, e := dial(ctx, addr, swarm)
+	if e != nil || swarm.Encryption == mse.Disabled {
+		return conn, e
+	}
+
+	mconn, e := withDeadline(conn, func() (net.Conn, error) {
+		return mse.Initiate(conn, infohash, swarm.Encryption)
+	})
+	if e == nil {
+		return mconn, nil
+	}
+	_ = conn.Close()
+
+	if swarm.Encryption == mse.Require {
+		return nil, e
+	}
+	log.Printf("encryption handshake with %v failed, retrying in plaintext: %v", addr, e)
+	return dial(ctx, addr, swarm)
+}
+
+// withDeadline runs the handshake with EncryptTimeout set on the connection,
+// and clears the deadline afterwards.
+func withDeadline(conn net.Conn, handshake func() (net.Conn, error)) (net.Conn, error) {
+	e := conn.SetDeadline(time.Now().Add(EncryptTimeout))
+	if e != nil {
+		return nil, e
+	}
+	mconn, e := handshake()
+	if e != nil {
+		return nil, e
+	}
+	return mconn, conn.SetDeadline(time.Time{})
+}
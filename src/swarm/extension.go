@@ -0,0 +1,217 @@
+/* extension.go ===============================================================
+The extension protocol (BEP_0010). Extensions are registered with the swarm
+and get our extended message IDs in order of registration. Every peer that
+sets the extension bit in its handshake is sent our extended handshake, and
+has its own map of extension names to the IDs it wants to receive them under.
+Extended messages are routed to the extension by our ID, so new extensions
+never need changes to p2p.Decode.
+============================================================================ */
+
+package swarm
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"gotor/p2p"
+	"gotor/utils"
+)
+
+const (
+	// maxUploadQueue is the number of requests we queue per peer, sent as
+	// reqq in the extended handshake. Requests beyond this are dropped.
+	maxUploadQueue = 250
+)
+
+// ============================================================================
+// STRUCTS ====================================================================
+
+// Extension is a protocol extension carried over extended messages.
+type Extension interface {
+	// Name is the extension's key in the "m" dictionary, e.g. ut_metadata
+	Name() string
+
+	// FillHandshake adds any fields the extension needs to our extended
+	// handshake.
+	FillHandshake(hs *p2p.ExtHandshake)
+
+	// PeerHandshake is called when a peer that supports the extension sends
+	// its extended handshake.
+	PeerHandshake(ph *PeerHandler, hs *p2p.ExtHandshake) error
+
+	// Handle handles an extended message that the peer sent under our ID for
+	// the extension.
+	Handle(ph *PeerHandler, payload []byte) error
+}
+
+// extRegistry holds the registered extensions by our extended message ID.
+type extRegistry struct {
+	byId   map[uint8]Extension
+	byName map[string]uint8
+	mutex  sync.RWMutex
+}
+
+// ============================================================================
+// SWARM ======================================================================
+
+// RegisterExtension adds an extension to the swarm, and returns the extended
+// message ID that peers will send its messages under. Extensions should be
+// registered before calling Start, peers that connect earlier won't know
+// about them.
+func (s *Swarm) RegisterExtension(ext Extension) (uint8, error) {
+	r := &s.exts
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.byId == nil {
+		r.byId = make(map[uint8]Extension)
+		r.byName = make(map[string]uint8)
+	}
+	if _, ok := r.byName[ext.Name()]; ok {
+		return 0, fmt.Errorf("extension %v is already registered", ext.Name())
+	}
+	if len(r.byId) == 255 {
+		return 0, fmt.Errorf("too many extensions")
+	}
+
+	id := uint8(len(r.byId) + 1)
+	r.byId[id] = ext
+	r.byName[ext.Name()] = id
+	return id, nil
+}
+
+// extension returns the extension registered under our extended message ID.
+func (s *Swarm) extension(id uint8) (Extension, bool) {
+	s.exts.mutex.RLock()
+	defer s.exts.mutex.RUnlock()
+	ext, ok := s.exts.byId[id]
+	return ext, ok
+}
+
+// extHandshake builds our extended handshake for the peer.
+func (s *Swarm) extHandshake(ph *PeerHandler) *p2p.ExtHandshake {
+	hs := p2p.NewExtHandshake()
+	hs.V = utils.GotorVersion
+	hs.P = s.Port
+	hs.Reqq = maxUploadQueue
+	hs.YourIP = ph.peerInfo.Ip()
+
+	s.exts.mutex.RLock()
+	defer s.exts.mutex.RUnlock()
+	for id, ext := range s.exts.byId {
+		hs.M[ext.Name()] = id
+		ext.FillHandshake(hs)
+	}
+	return hs
+}
+
+// ============================================================================
+// PEER =======================================================================
+
+// sendExtHandshake sends our extended handshake to the peer.
+func (ph *PeerHandler) sendExtHandshake() error {
+	payload, e := ph.swarm.extHandshake(ph).Encode()
+	if e != nil {
+		return e
+	}
+	return ph.send(p2p.NewMsgExtended(p2p.ExtHandshakeId, payload))
+}
+
+// SupportsExtension returns true if the peer told us it supports the named
+// extension in its extended handshake.
+func (ph *PeerHandler) SupportsExtension(name string) bool {
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+	_, ok := ph.extIds[name]
+	return ok
+}
+
+// sendExtended sends a message for the named extension to the peer, using
+// the peer's ID for the extension.
+func (ph *PeerHandler) sendExtended(name string, payload []byte) error {
+	ph.mutex.Lock()
+	id, ok := ph.extIds[name]
+	ph.mutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("peer does not support %v", name)
+	}
+	return ph.send(p2p.NewMsgExtended(id, payload))
+}
+
+// handleExtended routes an extended message to the extended handshake or to
+// the registered extension. Messages for extensions we don't know are
+// ignored.
+func (ph *PeerHandler) handleExtended(extMsg *p2p.MsgExtended) error {
+	if !ph.extended {
+		return fmt.Errorf("extended message from peer without the extension protocol")
+	}
+
+	if extMsg.ExtId() == p2p.ExtHandshakeId {
+		return ph.handleExtHandshake(extMsg.Payload())
+	}
+
+	ext, ok := ph.swarm.extension(extMsg.ExtId())
+	if !ok {
+		log.Printf("ignoring unknown extended message %v from %v", extMsg.ExtId(), ph.peerInfo.Addr())
+		return nil
+	}
+	return ext.Handle(ph, extMsg.Payload())
+}
+
+// handleExtHandshake records the peer's extension IDs. Peers may send more
+// than one extended handshake, later ones only change the extensions they
+// mention, and ID 0 disables an extension.
+func (ph *PeerHandler) handleExtHandshake(payload []byte) error {
+	hs, e := p2p.DecodeExtHandshake(payload)
+	if e != nil {
+		return e
+	}
+
+	ph.mutex.Lock()
+	for name, id := range hs.M {
+		if id == 0 {
+			delete(ph.extIds, name)
+		} else {
+			ph.extIds[name] = id
+		}
+	}
+	ph.extHs = hs
+	ph.mutex.Unlock()
+
+	log.Printf("extended handshake from %v [%v] with %v extensions", ph.peerInfo.Addr(), hs.V, len(hs.M))
+
+	s := ph.swarm
+	s.exts.mutex.RLock()
+	exts := make([]Extension, 0, len(s.exts.byId))
+	for _, ext := range s.exts.byId {
+		if id, ok := hs.M[ext.Name()]; ok && id != 0 {
+			exts = append(exts, ext)
+		}
+	}
+	s.exts.mutex.RUnlock()
+
+	for _, ext := range exts {
+		e = ext.PeerHandshake(ph, hs)
+		if e != nil {
+			return e
+		}
+	}
+
+	// The peer may handle fewer outstanding requests than we would send
+	ph.wake()
+	return nil
+}
+
+// requestLimit returns the number of block requests we keep outstanding
+// with the peer, which is maxPending unless the peer asked for fewer.
+func (ph *PeerHandler) requestLimit() int {
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+
+	if ph.extHs != nil && ph.extHs.Reqq > 0 && ph.extHs.Reqq < maxPending {
+		return int(ph.extHs.Reqq)
+	}
+	return maxPending
+}
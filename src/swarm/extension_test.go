@@ -0,0 +1,111 @@
+package swarm
+
+import (
+	"net"
+	"testing"
+
+	"gotor/p2p"
+	"gotor/peer"
+	"gotor/utils/test"
+)
+
+// fakeExtension records what the swarm hands it.
+type fakeExtension struct {
+	name       string
+	handshakes int
+	payloads   [][]byte
+}
+
+func (fe *fakeExtension) Name() string {
+	return fe.name
+}
+
+func (fe *fakeExtension) FillHandshake(hs *p2p.ExtHandshake) {}
+
+func (fe *fakeExtension) PeerHandshake(ph *PeerHandler, hs *p2p.ExtHandshake) error {
+	fe.handshakes++
+	return nil
+}
+
+func (fe *fakeExtension) Handle(ph *PeerHandler, payload []byte) error {
+	fe.payloads = append(fe.payloads, payload)
+	return nil
+}
+
+func TestSwarm_RegisterExtension(t *testing.T) {
+	s := Swarm{}
+
+	id, e := s.RegisterExtension(&fakeExtension{name: "a"})
+	test.CheckFatal(t, e)
+	if id != 1 {
+		t.Errorf("first extension got ID %v, want 1", id)
+	}
+	id, e = s.RegisterExtension(&fakeExtension{name: "b"})
+	test.CheckFatal(t, e)
+	if id != 2 {
+		t.Errorf("second extension got ID %v, want 2", id)
+	}
+
+	if _, e = s.RegisterExtension(&fakeExtension{name: "a"}); e == nil {
+		t.Error("expected error registering a duplicate")
+	}
+	if ext, ok := s.extension(2); !ok || ext.Name() != "b" {
+		t.Errorf("ID 2 is %v, want b", ext)
+	}
+}
+
+func TestPeerHandler_handleExtended(t *testing.T) {
+	s := Swarm{}
+	ours := &fakeExtension{name: "ours"}
+	other := &fakeExtension{name: "other"}
+	oursId, e := s.RegisterExtension(ours)
+	test.CheckFatal(t, e)
+	_, e = s.RegisterExtension(other)
+	test.CheckFatal(t, e)
+
+	ph := &PeerHandler{
+		peerInfo: peer.MakePeer("", net.IPv4(10, 0, 0, 1), 6881),
+		swarm:    &s,
+		extended: true,
+		extIds:   make(map[string]uint8),
+		chWake:   make(chan struct{}, 1),
+	}
+
+	hs := p2p.NewExtHandshake()
+	hs.M["ours"] = 7
+	hs.M["unknown"] = 9
+	hs.Reqq = 4
+	payload, e := hs.Encode()
+	test.CheckFatal(t, e)
+	test.CheckFatal(t, ph.handleExtended(p2p.NewMsgExtended(p2p.ExtHandshakeId, payload)))
+
+	if ours.handshakes != 1 || other.handshakes != 0 {
+		t.Errorf("got %v and %v handshakes, want 1 and 0", ours.handshakes, other.handshakes)
+	}
+	if !ph.SupportsExtension("ours") || ph.SupportsExtension("other") {
+		t.Errorf("wrong supported extensions %v", ph.extIds)
+	}
+	if ph.requestLimit() != 4 {
+		t.Errorf("request limit %v, want peer's reqq 4", ph.requestLimit())
+	}
+
+	// Messages are routed by our ID, unknown IDs are ignored
+	test.CheckFatal(t, ph.handleExtended(p2p.NewMsgExtended(oursId, []byte("hi"))))
+	test.CheckFatal(t, ph.handleExtended(p2p.NewMsgExtended(200, []byte("??"))))
+	if len(ours.payloads) != 1 || string(ours.payloads[0]) != "hi" || len(other.payloads) != 0 {
+		t.Errorf("wrong payloads %q and %q", ours.payloads, other.payloads)
+	}
+
+	// A later handshake can disable an extension
+	payload, e = (&p2p.ExtHandshake{M: map[string]uint8{"ours": 0}}).Encode()
+	test.CheckFatal(t, e)
+	test.CheckFatal(t, ph.handleExtended(p2p.NewMsgExtended(p2p.ExtHandshakeId, payload)))
+	if ph.SupportsExtension("ours") || !ph.SupportsExtension("unknown") {
+		t.Errorf("wrong supported extensions after update %v", ph.extIds)
+	}
+
+	ph.extended = false
+	if e = ph.handleExtended(p2p.NewMsgExtended(oursId, nil)); e == nil {
+		t.Error("expected error for extended message without the extension bit")
+	}
+}
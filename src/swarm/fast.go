@@ -0,0 +1,192 @@
+/* fast.go ====================================================================
+The fast extension (BEP_0006). With it, seeds and empty peers send have all
+or have none instead of a bitfield, requests we won't serve are explicitly
+rejected instead of silently dropped, and each side gets a small set of
+allowed fast pieces that it may request even while choked.
+============================================================================ */
+
+package swarm
+
+import (
+	"fmt"
+	"log"
+
+	"gotor/p2p"
+)
+
+// allowedFastCount is the size of the allowed fast set we give peers.
+const allowedFastCount = 10
+
+// ============================================================================
+// SENDING ====================================================================
+
+// haveMsg returns the message that tells the peer which pieces we have.
+// Fast peers get have all or have none if we are a seed or have nothing.
+func (ph *PeerHandler) haveMsg() p2p.Message {
+	bf := ph.swarm.Bf
+	if ph.fast {
+		if bf.Complete() {
+			return p2p.NewMsgHaveAll()
+		} else if bf.Nset() == 0 {
+			return p2p.NewMsgHaveNone()
+		}
+	}
+	return p2p.NewMsgBitfield(bf.Clone())
+}
+
+// sendAllowedFast generates the peer's allowed fast set and sends it.
+func (ph *PeerHandler) sendAllowedFast() error {
+	torInfo := ph.swarm.Tor.Info()
+	set := p2p.AllowedFastSet(allowedFastCount, uint32(torInfo.NumPieces()), ph.swarm.Tor.Infohash(), ph.peerInfo.Ip())
+
+	ph.allowedOut = make(map[uint32]struct{}, len(set))
+	for _, index := range set {
+		ph.allowedOut[index] = struct{}{}
+		e := ph.send(p2p.NewMsgAllowedFast(index))
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// reject tells a fast peer that we won't serve its request. Other peers
+// just never get an answer.
+func (ph *PeerHandler) reject(req *p2p.MsgRequest) error {
+	if !ph.fast {
+		return nil
+	}
+	return ph.send(p2p.NewMsgReject(req.Index(), req.Begin(), req.ReqLen()))
+}
+
+// isAllowedFast returns true if the peer may request the piece while
+// choked.
+func (ph *PeerHandler) isAllowedFast(index uint32) bool {
+	_, ok := ph.allowedOut[index]
+	return ok
+}
+
+// ============================================================================
+// RECEIVING ==================================================================
+
+// handleFast handles the messages of the fast extension, which only peers
+// that support it may send.
+func (ph *PeerHandler) handleFast(msg p2p.Message) error {
+	if !ph.fast {
+		return fmt.Errorf("fast extension message from peer without the fast extension")
+	}
+
+	switch m := msg.(type) {
+	case *p2p.MsgHaveAll:
+		return ph.handleHaveAll()
+	case *p2p.MsgHaveNone:
+		// Same as an empty bitfield, which is what we start with
+		return nil
+	case *p2p.MsgReject:
+		return ph.handleReject(m)
+	case *p2p.MsgAllowedFast:
+		return ph.handleAllowedFast(m)
+	case *p2p.MsgSuggest:
+		// Suggestions are only hints, we stick to rarest first
+		return nil
+	}
+	return nil
+}
+
+// handleHaveAll marks the peer as a seed.
+func (ph *PeerHandler) handleHaveAll() error {
+	ph.mutex.Lock()
+	ph.bf.Fill()
+	ph.mutex.Unlock()
+
+	ph.swarm.PPT.RegisterAll(ph)
+	return ph.updateInterest()
+}
+
+// handleReject gives the rejected request back to the PieceAssembler, so
+// it can be requested again. Peers must answer every cancel with the block
+// or a reject, so rejects for requests that we cancelled are expected and
+// ignored.
+func (ph *PeerHandler) handleReject(rejectMsg *p2p.MsgReject) error {
+	req := blockReq{
+		index:  rejectMsg.Index(),
+		begin:  rejectMsg.Begin(),
+		length: rejectMsg.ReqLen(),
+	}
+
+	ph.mutex.Lock()
+	_, ok := ph.pending[req]
+	delete(ph.pending, req)
+	ph.mutex.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	ph.swarm.PA.Unrequest(req)
+	ph.wake()
+	return nil
+}
+
+// handleAllowedFast records a piece that we may request while choked.
+func (ph *PeerHandler) handleAllowedFast(afMsg *p2p.MsgAllowedFast) error {
+	idx := afMsg.Index()
+	if int64(idx) >= ph.swarm.Tor.Info().NumPieces() {
+		return fmt.Errorf("allowed fast message for invalid index %v", idx)
+	}
+
+	ph.mutex.Lock()
+	ph.allowedIn[idx] = struct{}{}
+	ph.mutex.Unlock()
+
+	log.Printf("may request piece %v from %v while choked", idx, ph.peerInfo.Addr())
+	ph.wake()
+	return nil
+}
+
+// nextAllowedBlock is nextBlock for when the peer is choking us. Only blocks
+// of pieces in the peer's allowed fast set may be requested. Pieces we are
+// already downloading from the peer come first, then a new allowed fast
+// piece that the peer has and nobody else is downloading is claimed.
+func (ph *PeerHandler) nextAllowedBlock() (blockReq, bool) {
+	swarm := ph.swarm
+
+	ph.mutex.Lock()
+	pieces := make([]uint32, 0, len(ph.pieces))
+	owned := make(map[uint32]struct{}, len(ph.pieces))
+	for _, idx := range ph.pieces {
+		owned[idx] = struct{}{}
+		if _, ok := ph.allowedIn[idx]; ok {
+			pieces = append(pieces, idx)
+		}
+	}
+	candidates := make([]uint32, 0, len(ph.allowedIn))
+	for idx := range ph.allowedIn {
+		if _, ok := owned[idx]; !ok {
+			candidates = append(candidates, idx)
+		}
+	}
+	ph.mutex.Unlock()
+
+	for _, idx := range pieces {
+		if req, ok := swarm.PA.NextBlock(idx); ok {
+			return req, true
+		}
+	}
+
+	for _, idx := range candidates {
+		if !swarm.PPT.Claim(ph, idx) {
+			continue
+		}
+
+		swarm.PA.Begin(idx)
+		ph.mutex.Lock()
+		ph.pieces = append(ph.pieces, idx)
+		ph.mutex.Unlock()
+
+		if req, ok := swarm.PA.NextBlock(idx); ok {
+			return req, true
+		}
+	}
+	return blockReq{}, false
+}
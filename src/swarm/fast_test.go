@@ -0,0 +1,183 @@
+package swarm
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"gotor/bf"
+	"gotor/io"
+	"gotor/p2p"
+	"gotor/peer"
+	"gotor/torrent"
+	"gotor/torrent/filesd"
+	"gotor/torrent/info"
+	"gotor/utils/test"
+)
+
+// newFastPeer makes a fast peer handler for a 4 piece torrent, connected to
+// a pipe. Every message sent to the peer is passed on to the returned
+// channel.
+func newFastPeer(t *testing.T) (*PeerHandler, <-chan p2p.Message) {
+	files := []filesd.EntryBase{filesd.MakeFileEntry("f", 4*requestLength)}
+	torInfo, e := info.NewTorInfo("f", requestLength, test.DummyHashes(4), files)
+	test.CheckFatal(t, e)
+	tor, e := torrent.NewTorrent(torInfo, "")
+	test.CheckFatal(t, e)
+
+	s := &Swarm{Tor: tor, RLIO: io.NewRateLimitIO(), Bf: bf.NewBitfield(4)}
+	s.PPT = NewPeerPieceTracker(4, s.Bf)
+	s.PA = NewPieceAssembler(torInfo)
+
+	ours, theirs := net.Pipe()
+	t.Cleanup(func() {
+		ours.Close()
+		theirs.Close()
+	})
+
+	chMsgs := make(chan p2p.Message, 16)
+	go func() {
+		framer := p2p.NewFramer(p2p.DefaultMaxMsgLen)
+		buf := make([]byte, RecvBufSize)
+		for {
+			n, e := theirs.Read(buf)
+			if e != nil {
+				return
+			}
+			framer.Feed(buf[:n])
+			for msg, e := framer.Next(); msg != nil && e == nil; msg, e = framer.Next() {
+				chMsgs <- msg
+			}
+		}
+	}()
+
+	ph := NewPeerHandler(peer.MakePeer("", net.IPv4(10, 0, 0, 1), 6881), s, ours)
+	ph.fast = true
+	return ph, chMsgs
+}
+
+func TestPeerHandler_haveMsg(t *testing.T) {
+	tests := []struct {
+		name  string
+		fast  bool
+		have  int64
+		mtype uint8
+	}{
+		{name: "Fast empty", fast: true, have: 0, mtype: p2p.TypeHaveNone},
+		{name: "Fast some", fast: true, have: 2, mtype: p2p.TypeBitfield},
+		{name: "Fast seed", fast: true, have: 4, mtype: p2p.TypeHaveAll},
+		{name: "Empty", have: 0, mtype: p2p.TypeBitfield},
+		{name: "Seed", have: 4, mtype: p2p.TypeBitfield},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ph, _ := newFastPeer(t)
+			ph.fast = tt.fast
+			for i := int64(0); i < tt.have; i++ {
+				ph.swarm.Bf.Set(i, true)
+			}
+			if mtype := ph.haveMsg().Mtype(); mtype != tt.mtype {
+				t.Errorf("got message type %v, want %v", mtype, tt.mtype)
+			}
+		})
+	}
+}
+
+func TestPeerHandler_ChokeRejects(t *testing.T) {
+	ph, chMsgs := newFastPeer(t)
+	ph.allowedOut = map[uint32]struct{}{1: {}}
+	allowed := p2p.NewMsgRequest(1, 0, requestLength)
+	other := p2p.NewMsgRequest(2, 0, requestLength)
+	ph.uploads = append(ph.uploads, allowed, other)
+
+	test.CheckFatal(t, ph.Choke())
+
+	if msg := <-chMsgs; msg.Mtype() != p2p.TypeChoke {
+		t.Fatalf("got %v, want choke", msg)
+	}
+	want := p2p.NewMsgReject(2, 0, requestLength)
+	if msg := <-chMsgs; !reflect.DeepEqual(msg, want) {
+		t.Fatalf("got %v, want %v", msg, want)
+	}
+	if len(ph.uploads) != 1 || ph.uploads[0] != allowed {
+		t.Errorf("upload queue %v, want only the allowed fast request", ph.uploads)
+	}
+}
+
+func TestPeerHandler_handleFast(t *testing.T) {
+	ph, _ := newFastPeer(t)
+
+	// A rejected request can be requested again
+	ph.swarm.PA.Begin(0)
+	req, ok := ph.swarm.PA.NextBlock(0)
+	if !ok {
+		t.Fatal("no block to request")
+	}
+	ph.pending[req] = struct{}{}
+	test.CheckFatal(t, ph.handleMessage(p2p.NewMsgReject(req.index, req.begin, req.length)))
+	if len(ph.pending) != 0 {
+		t.Errorf("rejected request still pending")
+	}
+	if again, ok := ph.swarm.PA.NextBlock(0); !ok || again != req {
+		t.Errorf("got (%v, %v), want rejected block %v back", again, ok, req)
+	}
+	ph.swarm.PA.Unrequest(req)
+
+	// Allowed fast pieces are requested while choked
+	ph.peerState.SetChokingUs(true)
+	ph.pieces = append(ph.pieces, 0)
+	if _, ok = ph.nextAllowedBlock(); ok {
+		t.Errorf("got a block while choked without allowed fast")
+	}
+	test.CheckFatal(t, ph.handleMessage(p2p.NewMsgAllowedFast(0)))
+	if got, ok := ph.nextAllowedBlock(); !ok || got != req {
+		t.Errorf("got (%v, %v), want %v", got, ok, req)
+	}
+	if e := ph.handleMessage(p2p.NewMsgAllowedFast(4)); e == nil {
+		t.Errorf("expected error for allowed fast with invalid index")
+	}
+
+	test.CheckFatal(t, ph.handleMessage(p2p.NewMsgHaveAll()))
+	if !ph.bf.Complete() {
+		t.Errorf("peer is not a seed after have all")
+	}
+
+	ph.fast = false
+	if e := ph.handleMessage(p2p.NewMsgHaveNone()); e == nil {
+		t.Errorf("expected error for fast message from a peer without the fast extension")
+	}
+}
+
+func TestPeerHandler_RequestAllowedWhileChoked(t *testing.T) {
+	ph, chMsgs := newFastPeer(t)
+	ph.swarm.Bf.Set(1, true)
+	ph.peerState.SetChokingUs(true)
+
+	// The peer has pieces 1 and 2, both allowed fast, and we only lack 2
+	test.CheckFatal(t, ph.handleMessage(p2p.NewMsgHave(1)))
+	test.CheckFatal(t, ph.handleMessage(p2p.NewMsgHave(2)))
+	test.CheckFatal(t, ph.handleMessage(p2p.NewMsgAllowedFast(1)))
+	test.CheckFatal(t, ph.handleMessage(p2p.NewMsgAllowedFast(2)))
+
+	test.CheckFatal(t, ph.fillRequests(ph.nextAllowedBlock))
+
+	want := p2p.NewMsgRequest(2, 0, requestLength)
+	for {
+		msg := <-chMsgs
+		if msg.Mtype() != p2p.TypeRequest {
+			continue
+		}
+		if !reflect.DeepEqual(msg, want) {
+			t.Fatalf("got %v, want %v", msg, want)
+		}
+		break
+	}
+
+	// The piece is now ours, other peers can't claim it
+	if len(ph.pieces) != 1 || ph.pieces[0] != 2 {
+		t.Errorf("peer pieces %v, want [2]", ph.pieces)
+	}
+	if ph.swarm.PPT.Claim(ph, 2) {
+		t.Errorf("allowed fast piece was claimed twice")
+	}
+}
@@ -1,5 +1,12 @@
 package swarm
 
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
 const HandshakeLen = uint8(68)
 const HandshakePstrLen = uint8(19)
 const HandshakePstr = "BitTorrent protocol"
@@ -27,6 +34,28 @@ func (hs Handshake) Reserved() []byte {
 	return hs[20:28]
 }
 
+// SetExtended sets the reserved bit that advertises support for the
+// extension protocol (BEP_0010).
+func (hs Handshake) SetExtended() {
+	hs[20+5] |= 0x10
+}
+
+// SupportsExtended returns true if the extension protocol bit is set.
+func (hs Handshake) SupportsExtended() bool {
+	return hs[20+5]&0x10 != 0
+}
+
+// SetFast sets the reserved bit that advertises support for the fast
+// extension (BEP_0006).
+func (hs Handshake) SetFast() {
+	hs[20+7] |= 0x04
+}
+
+// SupportsFast returns true if the fast extension bit is set.
+func (hs Handshake) SupportsFast() bool {
+	return hs[20+7]&0x04 != 0
+}
+
 func (hs Handshake) Infohash() []byte {
 	return hs[28:48]
 }
@@ -55,3 +84,36 @@ func ValidHandshake(hs Handshake, infohash string) bool {
 
 	return true
 }
+
+// readHandshake reads the peer's handshake from the connection and checks
+// that it is for our torrent. The read deadline is cleared afterwards.
+func readHandshake(conn net.Conn, infohash string) (Handshake, error) {
+	hs, e := readAnyHandshake(conn)
+	if e != nil {
+		return nil, e
+	}
+	if string(hs.Infohash()) != infohash {
+		return nil, fmt.Errorf("bad peer handshake")
+	}
+	return hs, nil
+}
+
+// readAnyHandshake reads the peer's handshake from the connection, whatever
+// torrent it is for. The read deadline is cleared afterwards.
+func readAnyHandshake(conn net.Conn) (Handshake, error) {
+	e := conn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	if e != nil {
+		return nil, e
+	}
+
+	hs := make(Handshake, HandshakeLen)
+	_, e = io.ReadFull(conn, hs)
+	if e != nil {
+		return nil, e
+	}
+	if !ValidHandshake(hs, string(hs.Infohash())) {
+		return nil, fmt.Errorf("bad peer handshake")
+	}
+
+	return hs, conn.SetReadDeadline(time.Time{})
+}
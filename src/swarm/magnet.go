@@ -0,0 +1,338 @@
+package swarm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"gotor/bencode"
+	"gotor/metadata"
+	"gotor/p2p"
+	"gotor/peer"
+	"gotor/torrent"
+	"gotor/tracker"
+	"gotor/utils"
+)
+
+const (
+	// MetadataTimeout is how long a single peer gets to send us the
+	// metadata.
+	MetadataTimeout = 30 * time.Second
+
+	// metadataDialTimeout is how long we wait to connect to a peer.
+	metadataDialTimeout = 5 * time.Second
+
+	// metadataWorkers is the number of peers asked for the metadata at
+	// once.
+	metadataWorkers = 4
+
+	// utMetadataId is the extended message ID we ask peers to use when
+	// sending us ut_metadata messages.
+	utMetadataId = uint8(1)
+
+	// metadataMaxMsgLen is the largest message accepted while fetching
+	// metadata. We don't know the number of pieces yet, so bitfields of any
+	// reasonable size must fit.
+	metadataMaxMsgLen = 1 << 20
+)
+
+// ============================================================================
+// ============================================================================
+
+// torrentFromMagnet finds peers for the magnet link through its trackers,
+// its x.pe peers and the DHT, then fetches the info dictionary from them.
+// The peers found are added to the swarm.
+func (s *Swarm) torrentFromMagnet(ctx context.Context, uri string, workingDir string) (*torrent.Torrent, error) {
+	mag, e := torrent.ParseMagnet(uri)
+	if e != nil {
+		return nil, e
+	}
+
+	for _, addr := range mag.Peers {
+		p, e := parsePeerAddr(addr)
+		if e != nil {
+			log.Printf("ignoring magnet peer [%v]: %v", addr, e)
+			continue
+		}
+		s.mergePeers(peer.List{p})
+	}
+
+	// We don't know how much is left until we have the metadata, but it
+	// must not be 0 or the tracker will think we are seeding
+	if len(mag.Trackers) > 0 {
+		trackers := tracker.NewMultiTracker(mag.AnnounceList())
+		resp, _, e := trackers.Announce(ctx, mag.Infohash, tracker.NewStats(0, 0, 1), s.Port, s.Id, tracker.EventNone)
+		if e != nil {
+			log.Printf("magnet trackers failed: %v", e)
+		} else {
+			s.mergePeers(resp.Peers)
+		}
+	}
+
+	if s.DHT != nil {
+		s.bootstrapDHT(nil)
+		peers, e := s.DHT.GetPeers(mag.Infohash)
+		if e != nil {
+			log.Printf("dht lookup failed: %v", e)
+		}
+		s.mergePeers(peers)
+	}
+
+	s.pmutex.Lock()
+	peers := make(peer.List, len(s.Peers))
+	copy(peers, s.Peers)
+	s.pmutex.Unlock()
+
+	log.Printf("asking %v peers for metadata", len(peers))
+	info, e := s.FetchMetadata(ctx, mag.Infohash, peers)
+	if e != nil {
+		return nil, e
+	}
+
+	tor, e := torrent.FromInfoDict(info, mag.AnnounceList(), workingDir)
+	if e != nil {
+		return nil, e
+	}
+	if tor.Infohash() != mag.Infohash {
+		return nil, fmt.Errorf("metadata re-encodes to a different infohash")
+	}
+	return tor, nil
+}
+
+// parsePeerAddr parses a host:port peer address. The host must be an IP.
+func parsePeerAddr(addr string) (peer.Info, error) {
+	host, portStr, e := net.SplitHostPort(addr)
+	if e != nil {
+		return peer.Info{}, e
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return peer.Info{}, fmt.Errorf("bad ip [%v]", host)
+	}
+	port, e := strconv.ParseUint(portStr, 10, 16)
+	if e != nil {
+		return peer.Info{}, e
+	}
+	return peer.MakePeer("", ip, uint16(port)), nil
+}
+
+// FetchMetadata downloads the info dictionary of the torrent with the given
+// infohash from the peers, using the metadata extension (BEP_0009). A few
+// peers are tried at a time, and the first verified info dictionary wins.
+// Peers are dialed like any other, over the swarm's transports and with its
+// encryption policy. If ctx is done first, every connection is closed and
+// FetchMetadata returns ctx's error.
+func (s *Swarm) FetchMetadata(ctx context.Context, infohash string, peers peer.List) (bencode.Dict, error) {
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no peers to fetch metadata from")
+	}
+
+	chPeers := make(chan peer.Info, len(peers))
+	for _, p := range peers {
+		chPeers <- p
+	}
+	close(chPeers)
+
+	chResult := make(chan bencode.Dict, 1)
+	chDone := make(chan struct{})
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < metadataWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range chPeers {
+				select {
+				case <-chDone:
+					return
+				case <-ctx.Done():
+					return
+				default:
+				}
+
+				info, e := s.fetchMetadataFrom(ctx, p, infohash)
+				if e != nil {
+					log.Printf("failed to get metadata from %v: %v", p.Addr(), e)
+					continue
+				}
+
+				select {
+				case chResult <- info:
+				default:
+				}
+				return
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(chResult)
+	}()
+
+	defer close(chDone)
+	select {
+	case info, ok := <-chResult:
+		if !ok {
+			return nil, fmt.Errorf("no peer sent the metadata")
+		}
+		return info, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fetchMetadataFrom connects to a single peer and downloads the metadata
+// from it. The connection is closed once ctx is done.
+func (s *Swarm) fetchMetadataFrom(ctx context.Context, p peer.Info, infohash string) (bencode.Dict, error) {
+	dctx, cancel := context.WithTimeout(ctx, metadataDialTimeout)
+	conn, e := dialPeer(dctx, p.Addr(), infohash, s)
+	cancel()
+	if e != nil {
+		return nil, e
+	}
+	defer conn.Close()
+
+	chFetched := make(chan struct{})
+	defer close(chFetched)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-chFetched:
+		}
+	}()
+
+	e = conn.SetDeadline(time.Now().Add(MetadataTimeout))
+	if e != nil {
+		return nil, e
+	}
+
+	// Handshake, advertising the extension protocol
+	hs := MakeHandshake(infohash, s.Id)
+	hs.SetExtended()
+	if _, e = conn.Write(hs); e != nil {
+		return nil, e
+	}
+
+	peerHs := make(Handshake, HandshakeLen)
+	if _, e = io.ReadFull(conn, peerHs); e != nil {
+		return nil, e
+	}
+	if !ValidHandshake(peerHs, infohash) {
+		return nil, fmt.Errorf("bad peer handshake")
+	}
+	if !peerHs.SupportsExtended() {
+		return nil, fmt.Errorf("peer does not support the extension protocol")
+	}
+
+	ourExtHs := p2p.NewExtHandshake()
+	ourExtHs.M[metadata.ExtName] = utMetadataId
+	ourExtHs.V = utils.GotorVersion
+	extHs, e := ourExtHs.Encode()
+	if e != nil {
+		return nil, e
+	}
+	if _, e = conn.Write(p2p.NewMsgExtended(p2p.ExtHandshakeId, extHs).Encode()); e != nil {
+		return nil, e
+	}
+
+	var asm *metadata.Assembler
+	framer := p2p.NewFramer(metadataMaxMsgLen)
+	buf := make([]byte, RecvBufSize)
+
+	for {
+		msg, e := framer.Next()
+		if _, ok := e.(*p2p.UnknownTypeError); ok {
+			continue
+		} else if e != nil {
+			return nil, e
+		}
+
+		if msg == nil {
+			n, e := conn.Read(buf)
+			if n > 0 {
+				framer.Feed(buf[:n])
+			}
+			if e != nil {
+				return nil, e
+			}
+			continue
+		}
+
+		ext, ok := msg.(*p2p.MsgExtended)
+		if !ok {
+			continue
+		}
+
+		switch ext.ExtId() {
+		case p2p.ExtHandshakeId:
+			asm, e = startMetadata(conn, ext.Payload(), infohash)
+			if e != nil {
+				return nil, e
+			}
+
+		case utMetadataId:
+			if asm == nil {
+				return nil, fmt.Errorf("got metadata before extended handshake")
+			}
+			mm, e := metadata.DecodeMsg(ext.Payload())
+			if e != nil {
+				return nil, e
+			}
+
+			switch mm.Type {
+			case metadata.TypeData:
+				if e = asm.Put(mm.Piece, mm.Data); e != nil {
+					return nil, e
+				}
+				if asm.Done() {
+					return asm.Verify()
+				}
+			case metadata.TypeReject:
+				return nil, fmt.Errorf("peer rejected metadata piece %v", mm.Piece)
+			}
+		}
+	}
+}
+
+// startMetadata reads the peer's extended handshake, and requests every
+// metadata piece from it.
+func startMetadata(conn net.Conn, payload []byte, infohash string) (*metadata.Assembler, error) {
+	hs, e := p2p.DecodeExtHandshake(payload)
+	if e != nil {
+		return nil, e
+	}
+
+	remoteId := hs.M[metadata.ExtName]
+	if remoteId == 0 {
+		return nil, fmt.Errorf("peer does not support %v", metadata.ExtName)
+	}
+	if hs.MetadataSize == 0 {
+		return nil, fmt.Errorf("peer did not give metadata_size")
+	}
+
+	asm, e := metadata.NewAssembler(infohash, hs.MetadataSize)
+	if e != nil {
+		return nil, e
+	}
+
+	// The metadata is small, so just ask for all of it at once
+	for _, piece := range asm.Missing() {
+		payload, e := metadata.NewRequest(piece).Encode()
+		if e != nil {
+			return nil, e
+		}
+		_, e = conn.Write(p2p.NewMsgExtended(remoteId, payload).Encode())
+		if e != nil {
+			return nil, e
+		}
+	}
+
+	return asm, nil
+}
@@ -0,0 +1,167 @@
+package swarm
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"gotor/bencode"
+	"gotor/metadata"
+	"gotor/mse"
+	"gotor/p2p"
+	"gotor/peer"
+	"gotor/utils"
+	"gotor/utils/test"
+)
+
+// serveMetadata accepts a single connection, encrypted as the policy asks,
+// and serves the raw info dict to it over ut_metadata.
+func serveMetadata(t *testing.T, l net.Listener, infohash string, raw []byte, policy mse.Policy) {
+	tconn, e := l.Accept()
+	if e != nil {
+		return
+	}
+	defer tconn.Close()
+
+	conn, _, e := mse.Accept(tconn, []string{infohash}, policy)
+	if e != nil {
+		return
+	}
+
+	hs := make(Handshake, HandshakeLen)
+	if _, e = io.ReadFull(conn, hs); e != nil {
+		t.Errorf("reading handshake: %v", e)
+		return
+	}
+	reply := MakeHandshake(infohash, utils.NewPeerId())
+	reply.SetExtended()
+	conn.Write(reply)
+
+	const ourId = 3
+	extHs, _ := bencode.Encode(bencode.Dict{
+		"m":             bencode.Dict{metadata.ExtName: int64(ourId)},
+		"metadata_size": int64(len(raw)),
+	})
+	conn.Write(p2p.NewMsgExtended(p2p.ExtHandshakeId, extHs).Encode())
+
+	framer := p2p.NewFramer(metadataMaxMsgLen)
+	buf := make([]byte, RecvBufSize)
+	for {
+		msg, e := framer.Next()
+		if e != nil {
+			t.Errorf("bad message from client: %v", e)
+			return
+		}
+		if msg == nil {
+			n, e := conn.Read(buf)
+			if e != nil {
+				return
+			}
+			framer.Feed(buf[:n])
+			continue
+		}
+
+		ext, ok := msg.(*p2p.MsgExtended)
+		if !ok || ext.ExtId() != ourId {
+			continue
+		}
+		mm, e := metadata.DecodeMsg(ext.Payload())
+		if e != nil || mm.Type != metadata.TypeRequest {
+			t.Errorf("bad metadata request: %v", e)
+			return
+		}
+
+		data, _ := metadata.PieceData(raw, mm.Piece)
+		payload, _ := metadata.NewData(mm.Piece, int64(len(raw)), data).Encode()
+		conn.Write(p2p.NewMsgExtended(utMetadataId, payload).Encode())
+	}
+}
+
+func TestFetchMetadata(t *testing.T) {
+	// Big enough for a few pieces
+	pieces := make([]byte, 20*2000)
+	info := bencode.Dict{
+		"name":         "file.bin",
+		"length":       int64(1 << 30),
+		"piece length": int64(1 << 18),
+		"pieces":       string(pieces),
+	}
+	raw, e := bencode.Encode(info)
+	test.CheckFatal(t, e)
+	infohash := utils.SHA1(raw)
+
+	tests := []struct {
+		name   string
+		ours   mse.Policy
+		theirs mse.Policy
+		ok     bool
+	}{
+		{name: "Plaintext", ours: mse.Disabled, theirs: mse.Prefer, ok: true},
+		{name: "Encrypted", ours: mse.Require, theirs: mse.Require, ok: true},
+		{name: "Peer requires encryption", ours: mse.Disabled, theirs: mse.Require},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, e := net.Listen("tcp", "127.0.0.1:0")
+			test.CheckFatal(t, e)
+			defer l.Close()
+			go serveMetadata(t, l, infohash, raw, tt.theirs)
+
+			addr := l.Addr().(*net.TCPAddr)
+			p := peer.MakePeer("", addr.IP, uint16(addr.Port))
+
+			s := &Swarm{Id: utils.NewPeerId(), Encryption: tt.ours}
+			got, e := s.FetchMetadata(context.Background(), infohash, peer.List{p})
+			if !tt.ok {
+				if e == nil {
+					t.Errorf("expected error")
+				}
+				return
+			}
+			test.CheckFatal(t, e)
+
+			name, e := got.GetString("name")
+			test.CheckFatal(t, e)
+			if name != "file.bin" {
+				t.Errorf("got name %v, want file.bin", name)
+			}
+		})
+	}
+}
+
+func TestFetchMetadata_NoPeers(t *testing.T) {
+	s := &Swarm{Id: utils.NewPeerId()}
+	_, e := s.FetchMetadata(context.Background(), utils.SHA1([]byte("x")), nil)
+	if e == nil {
+		t.Errorf("expected error with no peers")
+	}
+}
+
+func TestFetchMetadata_Cancel(t *testing.T) {
+	// A peer that accepts the connection but never answers
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	test.CheckFatal(t, e)
+	defer l.Close()
+	go func() {
+		conn, e := l.Accept()
+		if e == nil {
+			defer conn.Close()
+			_, _ = io.Copy(io.Discard, conn)
+		}
+	}()
+	addr := l.Addr().(*net.TCPAddr)
+	p := peer.MakePeer("", addr.IP, uint16(addr.Port))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	s := &Swarm{Id: utils.NewPeerId(), Encryption: mse.Disabled}
+	start := time.Now()
+	if _, e = s.FetchMetadata(ctx, utils.SHA1([]byte("x")), peer.List{p}); e != context.DeadlineExceeded {
+		t.Errorf("got error %v, want %v", e, context.DeadlineExceeded)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("fetch gave up after %v", waited)
+	}
+}
@@ -2,31 +2,88 @@ package swarm
 
 import (
 	"errors"
+	"fmt"
 	"log"
+	"sync/atomic"
 
 	"gotor/p2p"
 )
 
-// handleMessage decodes the data in the buffer and handles the messages appropriately.
-func (ph *PeerHandler) handleMessage(buf []byte) error {
-	var e error
-	dar := p2p.DecodeAll(buf)
-	pcent := 100.0 * float32(dar.Read) / float32(len(buf))
-	log.Printf("Decoded %v/%v (%v%%) bytes from %v\n", dar.Read, len(buf), pcent, ph.peerInfo.Addr())
-
-	for _, msg := range dar.Msgs {
-		switch msg.Mtype() {
-		case p2p.TypeRequest:
-			mreq := msg.(*p2p.MsgRequest)
-			e = ph.handleRequest(mreq)
-		case p2p.TypeBitfield:
-			mbf := msg.(*p2p.MsgBitfield)
-			e = ph.handleBitfield(mbf)
-		}
+// handleMessage handles a single message received from the peer.
+func (ph *PeerHandler) handleMessage(msg p2p.Message) error {
+	switch msg.Mtype() {
+	case p2p.TypeKeepAlive:
+		return nil
+	case p2p.TypeChoke:
+		return ph.handleChoke()
+	case p2p.TypeUnchoke:
+		return ph.handleUnchoke()
+	case p2p.TypeInterested:
+		ph.peerState.SetInterestedUs(true)
+		ph.swarm.rechoke()
+		return nil
+	case p2p.TypeNotInterested:
+		ph.peerState.SetInterestedUs(false)
+		ph.swarm.rechoke()
+		return nil
+	case p2p.TypeHave:
+		mhave := msg.(*p2p.MsgHave)
+		return ph.handleHave(mhave)
+	case p2p.TypeBitfield:
+		mbf := msg.(*p2p.MsgBitfield)
+		return ph.handleBitfield(mbf)
+	case p2p.TypeRequest:
+		mreq := msg.(*p2p.MsgRequest)
+		return ph.handleRequest(mreq)
+	case p2p.TypePiece:
+		mpiece := msg.(*p2p.MsgPiece)
+		return ph.handlePiece(mpiece)
+	case p2p.TypeCancel:
+		mcancel := msg.(*p2p.MsgCancel)
+		return ph.handleCancel(mcancel)
+	case p2p.TypeSuggest, p2p.TypeHaveAll, p2p.TypeHaveNone, p2p.TypeReject, p2p.TypeAllowedFast:
+		return ph.handleFast(msg)
+	case p2p.TypeExtended:
+		mext := msg.(*p2p.MsgExtended)
+		return ph.handleExtended(mext)
+	}
 
-		if e != nil {
-			return e
-		}
+	return nil
+}
+
+// handleChoke handles the peer choking us. BEP_0003 says that all of our
+// pending requests are discarded by the peer once it chokes us. Fast peers
+// reject each request they won't serve instead.
+func (ph *PeerHandler) handleChoke() error {
+	ph.peerState.SetChokingUs(true)
+	if !ph.fast {
+		ph.returnPending()
+	}
+	return nil
+}
+
+func (ph *PeerHandler) handleUnchoke() error {
+	ph.peerState.SetChokingUs(false)
+	ph.wake()
+	return nil
+}
+
+func (ph *PeerHandler) handleHave(haveMsg *p2p.MsgHave) error {
+	swarm := ph.swarm
+	idx := haveMsg.Index()
+	if int64(idx) >= swarm.Tor.Info().NumPieces() {
+		return fmt.Errorf("have message for invalid index %v", idx)
+	}
+
+	ph.mutex.Lock()
+	ph.bf.Set(int64(idx), true)
+	ph.mutex.Unlock()
+
+	swarm.PPT.Register(ph, idx)
+
+	// Only need to check this one piece, not the whole bitfield
+	if !ph.peerState.WeInterested() && !swarm.Bf.Get(int64(idx)) {
+		return ph.setInterested(true)
 	}
 
 	return nil
@@ -46,31 +103,132 @@ func (ph *PeerHandler) handleBitfield(bfMsg *p2p.MsgBitfield) error {
 	bf.SetNbits(swarm.Tor.Info().NumPieces())
 
 	// Replace the bitfield
+	ph.mutex.Lock()
 	ph.bf = bf
+	ph.mutex.Unlock()
 
 	// Register
 	swarm.PPT.RegisterBF(ph, bf)
 	log.Printf("registered bitfield")
 
-	return nil
+	return ph.updateInterest()
 }
 
+// handleRequest validates the request and adds it to the upload queue. The
+// request is actually served by uploadLoop. Requests received while we are
+// choking the peer are ignored, unless they are for an allowed fast piece.
+// Fast peers are sent a reject for every request we ignore.
 func (ph *PeerHandler) handleRequest(reqMsg *p2p.MsgRequest) error {
-	// TODO: Cache pieces
 	s := ph.swarm
+
+	if ph.peerState.WeChoking() && !(ph.fast && ph.isAllowedFast(reqMsg.Index())) {
+		log.Printf("ignoring request from choked peer %v", ph.peerInfo.Addr())
+		return ph.reject(reqMsg)
+	}
+
 	idx := int64(reqMsg.Index())
-	if s.Bf.Complete() || s.Bf.Get(idx) {
-		_, e := s.Fileio.ReadPiece(idx, ph.buf)
-		if e != nil {
-			return e
-		}
-		subdata := ph.buf[reqMsg.Begin() : reqMsg.Begin()+reqMsg.ReqLen()]
-		mPiece := p2p.NewMsgPiece(reqMsg.Index(), reqMsg.Begin(), subdata)
-		e = s.RLIO.Write(ph.conn, mPiece.Encode())
-		if e != nil {
-			return e
+	torInfo := s.Tor.Info()
+	if idx >= torInfo.NumPieces() {
+		return fmt.Errorf("request for invalid index %v", idx)
+	}
+
+	end := int64(reqMsg.Begin()) + int64(reqMsg.ReqLen())
+	if reqMsg.ReqLen() > maxRequestLength || end > torInfo.PieceLenAt(idx) {
+		return fmt.Errorf("invalid request for index %v [%v, %v)", idx, reqMsg.Begin(), end)
+	}
+
+	if !s.Bf.Get(idx) {
+		log.Printf("ignoring request for piece %v we don't have", idx)
+		return ph.reject(reqMsg)
+	}
+
+	ph.mutex.Lock()
+	if len(ph.uploads) >= maxUploadQueue {
+		ph.mutex.Unlock()
+		log.Printf("ignoring request from %v, upload queue is full", ph.peerInfo.Addr())
+		return ph.reject(reqMsg)
+	}
+	ph.uploads = append(ph.uploads, reqMsg)
+	ph.mutex.Unlock()
+
+	select {
+	case ph.chUpload <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// handlePiece handles a block of data sent by the peer. Blocks that we did
+// not request are ignored.
+func (ph *PeerHandler) handlePiece(pieceMsg *p2p.MsgPiece) error {
+	req := blockReq{
+		index:  pieceMsg.Index(),
+		begin:  pieceMsg.Begin(),
+		length: uint32(len(pieceMsg.Block())),
+	}
+
+	ph.mutex.Lock()
+	_, ok := ph.pending[req]
+	delete(ph.pending, req)
+	ph.mutex.Unlock()
+
+	if !ok {
+		log.Printf("ignoring unrequested block %v from %v", req, ph.peerInfo.Addr())
+		return nil
+	}
+
+	ph.swarm.Stats.IncDnloaded(uint64(req.length))
+	atomic.AddUint64(&ph.dnBytes, uint64(req.length))
+
+	// Room for another request
+	ph.wake()
+
+	// Other peers may have been asked for the same block
+	if ph.swarm.PPT.Endgame() {
+		ph.swarm.cancelBlock(ph, req)
+	}
+
+	return ph.swarm.receiveBlock(req.index, req.begin, pieceMsg.Block())
+}
+
+// handleCancel removes a request from the upload queue, if it has not
+// already been served. Fast peers are sent a reject for it.
+func (ph *PeerHandler) handleCancel(cancelMsg *p2p.MsgCancel) error {
+	ph.mutex.Lock()
+	var cancelled *p2p.MsgRequest
+	for i, req := range ph.uploads {
+		if req.Index() == cancelMsg.Index() && req.Begin() == cancelMsg.Begin() && req.ReqLen() == cancelMsg.ReqLen() {
+			cancelled = req
+			ph.uploads = append(ph.uploads[:i], ph.uploads[i+1:]...)
+			break
 		}
 	}
+	ph.mutex.Unlock()
+
+	// Fast peers expect either the block or a reject for every cancel
+	if cancelled != nil {
+		return ph.reject(cancelled)
+	}
+	return nil
+}
+
+// serveRequest reads the requested block and sends it to the peer.
+func (ph *PeerHandler) serveRequest(reqMsg *p2p.MsgRequest) error {
+	// TODO: Cache pieces
+	s := ph.swarm
+	subdata := ph.buf[:reqMsg.ReqLen()]
+	e := s.Storage.ReadAt(int64(reqMsg.Index()), int64(reqMsg.Begin()), subdata)
+	if e != nil {
+		return e
+	}
+	mPiece := p2p.NewMsgPiece(reqMsg.Index(), reqMsg.Begin(), subdata)
+	e = ph.send(mPiece)
+	if e != nil {
+		return e
+	}
+	s.Stats.IncUploaded(uint64(reqMsg.ReqLen()))
+	atomic.AddUint64(&ph.upBytes, uint64(reqMsg.ReqLen()))
 
 	return nil
 }
@@ -1,12 +1,11 @@
 package swarm
 
 import (
-	"errors"
-	"fmt"
+	"context"
 	"log"
-	"math"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"gotor/bf"
@@ -25,6 +24,14 @@ const (
 
 	// requestLength is the same piece request length as qBittorrent
 	requestLength = 16384
+
+	// maxPending is the maximum number of block requests we keep
+	// outstanding with a single peer.
+	maxPending = 16
+
+	// maxRequestLength is the largest request we will serve. Most clients
+	// stick to 16KiB, but some will happily request more.
+	maxRequestLength = 131072
 )
 
 // ============================================================================
@@ -39,101 +46,286 @@ type PeerHandler struct {
 	procs     sync.WaitGroup // How many loops are running for this handler
 	buf       []byte         // Buffer for file io operations
 
-	chErr chan<- error // Report errors
+	pending map[blockReq]struct{} // Requests sent to the peer that haven't been answered
+	pieces  []uint32              // Pieces we are downloading from this peer
+	uploads []*p2p.MsgRequest     // Requests from the peer waiting to be served
+	mutex   sync.Mutex            // Guards bf, pending, pieces, uploads, extIds and extHs
+
+	incoming bool              // The peer connected to us
+	extended bool              // Both sides support the extension protocol
+	fast     bool              // Both sides support the fast extension
+	extIds   map[string]uint8  // The peer's extended message IDs by extension name
+	extHs    *p2p.ExtHandshake // The peer's last extended handshake, nil until received
+
+	allowedOut map[uint32]struct{} // Pieces the peer may request while we choke it
+	allowedIn  map[uint32]struct{} // Pieces we may request while the peer chokes us, guarded by mutex
+
+	dnBytes uint64  // Block bytes received since the last rate update
+	upBytes uint64  // Block bytes sent since the last rate update
+	dnRate  float64 // Download rate (bytes/sec) as of the last update
+	upRate  float64 // Upload rate (bytes/sec) as of the last update
+
+	chWake   chan struct{}   // Wakes up requestLoop
+	chUpload chan struct{}   // Wakes up uploadLoop
+	chErr    chan<- error    // Report errors
+	chStop   <-chan struct{} // Closed to stop the handler
+}
+
+// blockReq identifies a single block request.
+type blockReq struct {
+	index  uint32
+	begin  uint32
+	length uint32
 }
 
 // ============================================================================
 // FUNK =======================================================================
 
-// FromBootstrap creates a TCP connection with the peer, then sends the BitTorrent
-// handshake.
-func FromBootstrap(pInfo peer.Info, swarm *Swarm) (*PeerHandler, error) {
-	conn, e := net.Dial("tcp", pInfo.Addr())
+// FromBootstrap connects to the peer over uTP or TCP, encrypted if the
+// swarm's policy asks for it, sends the BitTorrent handshake and waits for
+// the peer's handshake, then sends our bitfield. Gives up on dialing once
+// ctx is done.
+func FromBootstrap(ctx context.Context, pInfo peer.Info, swarm *Swarm) (*PeerHandler, error) {
+	conn, e := dialPeer(ctx, pInfo.Addr(), swarm.Tor.Infohash(), swarm)
 	if e != nil {
 		return nil, e
 	}
 
 	hs := MakeHandshake(swarm.Tor.Infohash(), swarm.Id)
+	hs.SetExtended()
+	hs.SetFast()
 
 	_, e = conn.Write(hs)
 	if e != nil {
+		_ = conn.Close()
 		return nil, e
 	}
 
-	return NewPeerHandler(pInfo, swarm, conn), nil
-}
-
-// FromIncoming receives a new peer connection. It will first check for the correct
-// BitTorrent handshake, add to the peer list, then send a handshake and bitfield back.
-func FromIncoming(conn net.Conn, swarm *Swarm) (*PeerHandler, error) {
-
-	// Must be using TCP (for now atleast)
-	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
-	if !ok {
-		return nil, errors.New("connection is not TCP")
+	peerHs, e := readHandshake(conn, swarm.Tor.Infohash())
+	if e != nil {
+		_ = conn.Close()
+		return nil, e
+	}
+	if string(peerHs.Id()) == swarm.Id {
+		_ = conn.Close()
+		return nil, errSelfConnection
 	}
 
-	buf := make([]byte, HandshakeLen)
-
-	// Set timeout
-	e := conn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	pInfo = peer.MakePeer(string(peerHs.Id()), pInfo.Ip(), pInfo.Port())
+	ph := NewPeerHandler(pInfo, swarm, conn)
+	e = ph.greet(peerHs)
 	if e != nil {
+		_ = conn.Close()
 		return nil, e
 	}
+	return ph, nil
+}
 
-	// Read the handshake
-	_, e = conn.Read(buf)
+// answerHandshake sends our handshake and bitfield to a peer whose handshake
+// has been read.
+func answerHandshake(conn net.Conn, peerHs Handshake, swarm *Swarm) (*PeerHandler, error) {
+	ip, port, e := remoteAddr(conn)
 	if e != nil {
+		_ = conn.Close()
 		return nil, e
 	}
-	peerHs := Handshake(buf)
-	if !ValidHandshake(peerHs, swarm.Tor.Infohash()) {
-		_ = conn.Close() // TODO: Handle?
-		return nil, fmt.Errorf("bad peer handshake")
+	if string(peerHs.Id()) == swarm.Id {
+		_ = conn.Close()
+		return nil, errSelfConnection
 	}
 	log.Printf("good handshake from %v", conn.RemoteAddr())
 
 	// Send handshake
 	hs := MakeHandshake(swarm.Tor.Infohash(), swarm.Id)
+	hs.SetExtended()
+	hs.SetFast()
 	_, e = conn.Write(hs)
 	if e != nil {
+		_ = conn.Close()
 		return nil, e
 	}
 	log.Printf("Sent %v handshake\n", conn.RemoteAddr())
 
-	// Send bitfield
-	bfmsg := p2p.NewMsgBitfield(swarm.Bf)
-	_, e = conn.Write(bfmsg.Encode())
+	newPeer := peer.MakePeer(string(peerHs.Id()), ip, port)
+	ph := NewPeerHandler(newPeer, swarm, conn)
+	ph.incoming = true
+	e = ph.greet(peerHs)
 	if e != nil {
+		_ = conn.Close()
 		return nil, e
 	}
 	log.Printf("Sent %v bitfield\n", conn.RemoteAddr())
 
-	newPeer := peer.MakePeer(string(peerHs.Id()), tcpAddr.IP, uint16(tcpAddr.Port))
-
-	return NewPeerHandler(newPeer, swarm, conn), nil
+	return ph, nil
 }
 
 func NewPeerHandler(pInfo peer.Info, swarm *Swarm, conn net.Conn) *PeerHandler {
 	torInfo := swarm.Tor.Info()
 	return &PeerHandler{
-		peerInfo: pInfo,
-		swarm:    swarm,
-		conn:     conn,
-		chErr:    swarm.ChErr,
-		procs:    sync.WaitGroup{},
-		buf:      make([]byte, torInfo.PieceLen(), torInfo.PieceLen()),
-		bf:       bf.NewBitfield(torInfo.NumPieces()),
+		peerInfo:  pInfo,
+		peerState: peer.MakeState(),
+		swarm:     swarm,
+		conn:      conn,
+		chErr:     swarm.ChErr,
+		procs:     sync.WaitGroup{},
+		buf:       make([]byte, torInfo.PieceLen(), torInfo.PieceLen()),
+		bf:        bf.NewBitfield(torInfo.NumPieces()),
+		pending:   make(map[blockReq]struct{}),
+		pieces:    make([]uint32, 0, 4),
+		uploads:   make([]*p2p.MsgRequest, 0, 8),
+		extIds:    make(map[string]uint8),
+		allowedIn: make(map[uint32]struct{}),
+		chWake:    make(chan struct{}, 1),
+		chUpload:  make(chan struct{}, 1),
+	}
+}
+
+// greet sends the messages that follow the handshake: our bitfield (or have
+// all/none), the peer's allowed fast set if it supports the fast extension,
+// and our extended handshake if it supports the extension protocol.
+func (ph *PeerHandler) greet(peerHs Handshake) error {
+	ph.fast = peerHs.SupportsFast()
+	e := ph.send(ph.haveMsg())
+	if e != nil {
+		return e
+	}
+
+	if ph.fast {
+		e = ph.sendAllowedFast()
+		if e != nil {
+			return e
+		}
+	}
+
+	if !peerHs.SupportsExtended() {
+		return nil
 	}
+	ph.extended = true
+	return ph.sendExtHandshake()
 }
 
 // ============================================================================
 // ============================================================================
 
+// Choke chokes the peer. Any requests from the peer that haven't been served
+// yet are discarded, as per BEP_0003. Fast peers keep their requests for
+// allowed fast pieces, and are sent a reject for every other one.
 func (ph *PeerHandler) Choke() error {
-	msg := p2p.NewMsgUnchoke()
-	_, e := ph.conn.Write(msg.Encode())
-	return e
+	ph.peerState.SetWeChoking(true)
+
+	ph.mutex.Lock()
+	dropped := make([]*p2p.MsgRequest, 0, len(ph.uploads))
+	kept := make([]*p2p.MsgRequest, 0, len(ph.uploads))
+	for _, req := range ph.uploads {
+		if ph.fast && ph.isAllowedFast(req.Index()) {
+			kept = append(kept, req)
+		} else {
+			dropped = append(dropped, req)
+		}
+	}
+	ph.uploads = kept
+	ph.mutex.Unlock()
+
+	e := ph.send(p2p.NewMsgChoke())
+	if e != nil {
+		return e
+	}
+	for _, req := range dropped {
+		e = ph.reject(req)
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Unchoke unchokes the peer, allowing it to make requests.
+func (ph *PeerHandler) Unchoke() error {
+	ph.peerState.SetWeChoking(false)
+	return ph.send(p2p.NewMsgUnchoke())
+}
+
+// Rates returns the download and upload rates (bytes/sec) of the peer as of
+// the last rate update.
+func (ph *PeerHandler) Rates() (float64, float64) {
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+	return ph.dnRate, ph.upRate
+}
+
+// updateRates recomputes the peer's rates from the bytes transferred over
+// the elapsed period, then resets the byte counters.
+func (ph *PeerHandler) updateRates(elapsed time.Duration) {
+	secs := elapsed.Seconds()
+	if secs <= 0 {
+		return
+	}
+	dn := atomic.SwapUint64(&ph.dnBytes, 0)
+	up := atomic.SwapUint64(&ph.upBytes, 0)
+
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+	ph.dnRate = float64(dn) / secs
+	ph.upRate = float64(up) / secs
+}
+
+// send encodes and writes a message to the peer.
+func (ph *PeerHandler) send(msg p2p.Message) error {
+	return ph.swarm.RLIO.Write(ph.conn, msg.Encode())
+}
+
+// wake tells requestLoop that something has changed and it should try
+// sending more requests. Never blocks.
+func (ph *PeerHandler) wake() {
+	select {
+	case ph.chWake <- struct{}{}:
+	default:
+	}
+}
+
+// setInterested sends an interested or not interested message to the peer.
+func (ph *PeerHandler) setInterested(interested bool) error {
+	var msg p2p.Message
+	if interested {
+		msg = p2p.NewMsgInterested()
+	} else {
+		msg = p2p.NewMsgNotInterested()
+	}
+
+	e := ph.send(msg)
+	if e != nil {
+		return e
+	}
+	ph.peerState.SetWeInterested(interested)
+
+	if interested {
+		ph.wake()
+	}
+	return nil
+}
+
+// updateInterest checks the peer's entire bitfield for pieces that we still
+// need, and tells the peer if our interest has changed.
+func (ph *PeerHandler) updateInterest() error {
+	want := ph.hasWanted()
+	if want == ph.peerState.WeInterested() {
+		return nil
+	}
+	return ph.setInterested(want)
+}
+
+// hasWanted returns true if the peer has any pieces that we don't.
+func (ph *PeerHandler) hasWanted() bool {
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+
+	ours := ph.swarm.Bf
+	for i := int64(0); i < ph.bf.Nbits(); i++ {
+		if ph.bf.Get(i) && !ours.Get(i) {
+			return true
+		}
+	}
+	return false
 }
 
 // ============================================================================
@@ -141,18 +333,17 @@ func (ph *PeerHandler) Choke() error {
 
 func (ph *PeerHandler) Loop() {
 
-	// Any goroutines spawned should report errors on this chan
-	chErr := make(chan error)
+	// Any goroutines spawned should report errors on this chan. Every loop
+	// reports at most once, so sends never block.
+	chErr := make(chan error, 4)
 
 	// Use to stop to all spawned goroutines
 	chDone := make(chan bool)
 
-	// For now, just unchoke everyone
-	msg := p2p.NewMsgUnchoke()
-	_, e := ph.conn.Write(msg.Encode())
-	if e != nil {
-		log.Printf("error unchoking: %v\n", e)
-	}
+	ph.swarm.addHandler(ph)
+
+	// Added before the loops start, so that Wait can't miss any of them
+	ph.procs.Add(4)
 
 	go ph.pingLoop(chErr, chDone)
 
@@ -160,24 +351,29 @@ func (ph *PeerHandler) Loop() {
 
 	go ph.requestLoop(chErr, chDone)
 
-	done := false
-	for {
-		if done {
-			break
-		}
+	go ph.uploadLoop(chErr, chDone)
 
-		select {
-		// For now, just kill ourselves if we receive any error.
-		// We will fine-tune this later
-		case e = <-chErr:
-			done = true
-			log.Printf("error peer [%v] (killing): %v", ph.peerInfo.String(), e)
-			chDone <- true
-			ph.procs.Wait()
-			// We will eventually wrap this in a struct so that we can
-			// tell the main loop which PeerHandler has errored
-			ph.chErr <- e
-		}
+	// For now, just kill ourselves if we receive any error.
+	// We will fine-tune this later
+	var e error
+	select {
+	case e = <-chErr:
+		log.Printf("error peer [%v] (killing): %v", ph.peerInfo.String(), e)
+	case <-ph.chStop:
+		e = errSwarmStopped
+		// Unblocks any loop stuck writing to the peer
+		_ = ph.conn.Close()
+	}
+	close(chDone)
+	ph.procs.Wait()
+	ph.cleanup()
+
+	// We will eventually wrap this in a struct so that we can tell the main
+	// loop which PeerHandler has errored. Nobody may be listening, which
+	// mustn't keep us from exiting.
+	select {
+	case ph.chErr <- e:
+	default:
 	}
 
 	log.Printf("peer %v done", ph.peerInfo.Addr())
@@ -186,24 +382,19 @@ func (ph *PeerHandler) Loop() {
 // recvLoop handles reading in data from the peer and sending
 // replies if needed.
 func (ph *PeerHandler) recvLoop(chErr chan<- error, chKill <-chan bool) {
-	// TODO: Should probably handle split messages
-	// What if we need to recv more than we can handle?
-	// 1. Decode all messages
-	// 2. Any subsections of bytes that were not decoded AND come
-	//    before any successfully decoded messages are discarded
-	// 3. This could leave a tail of non-decoded bytes. These should
-	//    be stored in another buffer. When we go to read again,
-	//    append new data to previous data and try decoding all again.
-	// 4. Rinse repeat.
-
-	ph.procs.Add(1)
 	defer ph.procs.Done()
 
 	defer log.Printf("end recvLoop [%v]", ph.peerInfo.String())
 	log.Printf("start recvLoop [%v]", ph.peerInfo.String())
 
+	// Whatever ends the loop, the read loop must not be left waiting
 	readLoop := io.NewReadLoop(RecvBufSize, ph.conn, GetKeepAlive)
 	go readLoop.Run()
+	defer readLoop.Finish()
+
+	// Reads rarely line up with message boundaries, the framer holds on
+	// to partial messages until the rest arrives.
+	framer := p2p.NewFramer(ph.maxMsgLen())
 
 	var e error
 	done := false
@@ -211,12 +402,12 @@ func (ph *PeerHandler) recvLoop(chErr chan<- error, chKill <-chan bool) {
 
 		select {
 		case buf := <-readLoop.ReadData():
-			e = ph.handleMessage(buf)
+			framer.Feed(buf)
 			readLoop.Ready()
+			e = ph.handleFramed(framer)
 		case e = <-readLoop.ReadError():
 			done = true
 		case <-chKill:
-			readLoop.Finish()
 			done = true
 		}
 
@@ -227,65 +418,253 @@ func (ph *PeerHandler) recvLoop(chErr chan<- error, chKill <-chan bool) {
 	}
 }
 
-// requestLoop sends out piece requests to the peer.
+// handleFramed handles every complete message currently held by the framer.
+// Messages with unknown IDs are ignored, any other error is returned.
+func (ph *PeerHandler) handleFramed(framer *p2p.Framer) error {
+	for {
+		msg, e := framer.Next()
+		if e != nil {
+			if _, ok := e.(*p2p.UnknownTypeError); ok {
+				log.Printf("ignoring message from %v: %v", ph.peerInfo.Addr(), e)
+				continue
+			}
+			return e
+		}
+		if msg == nil {
+			return nil
+		}
+
+		e = ph.handleMessage(msg)
+		if e != nil {
+			return e
+		}
+	}
+}
+
+// maxMsgLen returns the largest message we are willing to accept from the
+// peer. This is normally p2p.DefaultMaxMsgLen, but bitfields for torrents
+// with lots of pieces can be bigger than that.
+func (ph *PeerHandler) maxMsgLen() uint32 {
+	bflen := uint32(1 + ph.swarm.Bf.Nbytes())
+	if bflen > p2p.DefaultMaxMsgLen {
+		return bflen
+	}
+	return p2p.DefaultMaxMsgLen
+}
+
+// requestLoop sends out block requests to the peer. It sleeps until woken
+// by something that might let us send more requests, i.e. the peer unchoking
+// us, a block arriving, or the peer getting a piece we want.
 func (ph *PeerHandler) requestLoop(chErr chan<- error, chDone <-chan bool) {
-	ph.procs.Add(1)
 	defer ph.procs.Done()
 
 	log.Printf("start requestLoop [%v]", ph.peerInfo.String())
 	defer log.Printf("end requestLoop [%v]", ph.peerInfo.String())
 
-	reqs := make([]uint32, 0, 5)
+	for {
+		// Wait until there is something worth doing
+		select {
+		case <-chDone:
+			return
+		case <-ph.chWake:
+		}
 
-	// TODO: Yikes
-	for !ph.swarm.Bf.Complete() {
+		if ph.swarm.Bf.Complete() || !ph.peerState.WeInterested() {
+			continue
+		}
 
-		// Fill up requests
-		for i := len(reqs); i < 5; i++ {
-			next, ok := ph.swarm.PPT.NextPiece(ph)
-			// TODO: Handle this
-			if !ok {
-				break
+		// Peer discards any requests we make until it unchokes us, apart
+		// from those for allowed fast pieces
+		next := ph.nextBlock
+		if ph.peerState.ChokingUs() {
+			if !ph.fast {
+				continue
+			}
+			next = ph.nextAllowedBlock
+		}
+
+		e := ph.fillRequests(next)
+		if e != nil {
+			chErr <- e
+			return
+		}
+	}
+}
+
+// fillRequests sends the block requests picked by next until there are
+// maxPending requests outstanding, or until there is nothing left to request
+// from the peer.
+func (ph *PeerHandler) fillRequests(next func() (blockReq, bool)) error {
+	for {
+		ph.mutex.Lock()
+		npending := len(ph.pending)
+		ph.mutex.Unlock()
+
+		if npending >= ph.requestLimit() {
+			return nil
+		}
+
+		req, ok := next()
+		if !ok {
+			return nil
+		}
+
+		ph.mutex.Lock()
+		ph.pending[req] = struct{}{}
+		ph.mutex.Unlock()
+
+		e := ph.send(p2p.NewMsgRequest(req.index, req.begin, req.length))
+		if e != nil {
+			return e
+		}
+	}
+}
+
+// nextBlock picks the next block to request from the peer. Blocks from the
+// pieces already assigned to this peer come first, otherwise the rarest
+// available piece is fetched from the PeerPieceTracker. In endgame mode,
+// blocks that have already been requested from other peers may be requested
+// again.
+func (ph *PeerHandler) nextBlock() (blockReq, bool) {
+	swarm := ph.swarm
+
+	ph.mutex.Lock()
+	pieces := ph.pieces
+	ph.pieces = ph.pieces[:0]
+	for _, idx := range pieces {
+		// Drop pieces that were completed, or failed and were released
+		if swarm.PA.Has(idx) {
+			ph.pieces = append(ph.pieces, idx)
+		}
+	}
+	pieces = append([]uint32(nil), ph.pieces...)
+	ph.mutex.Unlock()
+
+	for {
+		for _, idx := range pieces {
+			if req, ok := swarm.PA.NextBlock(idx); ok {
+				return req, true
 			}
-			reqs = append(reqs, next)
-
-			// Make the request. qBittorrent uses 16KiB requests
-			msgs := ph.createReqMessages(next)
-			for _, msg := range msgs {
-				// TODO: Handle
-				_ = ph.swarm.RLIO.Write(ph.conn, msg.Encode())
-				fmt.Printf("sent request for %v : %v", msg.Index(), msg.ReqLen())
+		}
+
+		if swarm.PPT.Endgame() {
+			pending := ph.pendingSnapshot()
+			for _, idx := range pieces {
+				if req, ok := swarm.PA.NextDuplicate(idx, pending); ok {
+					return req, true
+				}
 			}
-			fmt.Printf("sent %v msgs", len(msgs))
 		}
 
+		idx, ok := swarm.PPT.NextPiece(ph)
+		if !ok {
+			return blockReq{}, false
+		}
+
+		swarm.PA.Begin(idx)
+		ph.mutex.Lock()
+		ph.pieces = append(ph.pieces, idx)
+		ph.mutex.Unlock()
+		pieces = append(pieces, idx)
 	}
 }
 
-func (ph *PeerHandler) createReqMessages(index uint32) []*p2p.MsgRequest {
-	msgs := make([]*p2p.MsgRequest, 0, 3)
-	ti := ph.swarm.Tor.Info()
+// pendingSnapshot returns a copy of the peer's outstanding requests.
+func (ph *PeerHandler) pendingSnapshot() map[blockReq]struct{} {
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
 
-	length := uint32(ti.PieceLen())
-	if int64(index) == ti.NumPieces()-1 {
-		length = uint32(ti.LastPieceLen())
+	pending := make(map[blockReq]struct{}, len(ph.pending))
+	for req := range ph.pending {
+		pending[req] = struct{}{}
 	}
+	return pending
+}
+
+// cancel cancels an outstanding request, if the peer has one matching req.
+func (ph *PeerHandler) cancel(req blockReq) error {
+	ph.mutex.Lock()
+	_, ok := ph.pending[req]
+	delete(ph.pending, req)
+	ph.mutex.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	ph.wake()
+	return ph.send(p2p.NewMsgCancel(req.index, req.begin, req.length))
+}
+
+// returnPending gives all of our outstanding requests back to the
+// PieceAssembler so they can be requested from other peers.
+func (ph *PeerHandler) returnPending() {
+	ph.mutex.Lock()
+	pending := ph.pending
+	ph.pending = make(map[blockReq]struct{})
+	ph.mutex.Unlock()
+
+	for req := range pending {
+		ph.swarm.PA.Unrequest(req)
+	}
+}
 
-	offset := uint32(0)
+// cleanup removes all traces of the handler from the swarm once all of its
+// loops have stopped.
+func (ph *PeerHandler) cleanup() {
+	_ = ph.conn.Close()
+	ph.swarm.removeHandler(ph)
+	ph.swarm.PPT.Unregister(ph)
+	ph.returnPending()
+}
+
+// uploadLoop serves the requests queued up by handleRequest.
+func (ph *PeerHandler) uploadLoop(chErr chan<- error, chDone <-chan bool) {
+	defer ph.procs.Done()
+
+	log.Printf("start uploadLoop [%v]", ph.peerInfo.String())
+	defer log.Printf("end uploadLoop [%v]", ph.peerInfo.String())
+
+	for {
+		select {
+		case <-chDone:
+			return
+		case <-ph.chUpload:
+		}
 
-	for offset < length {
-		reqlen := uint32(math.Min(requestLength, float64(length-offset)))
-		msgs = append(msgs, p2p.NewMsgRequest(index, offset, reqlen))
+		for {
+			req := ph.popUpload()
+			if req == nil {
+				break
+			}
+
+			e := ph.serveRequest(req)
+			if e != nil {
+				chErr <- e
+				return
+			}
+		}
 	}
+}
 
-	return msgs
+// popUpload removes and returns the oldest request in the upload queue, or
+// nil if the queue is empty.
+func (ph *PeerHandler) popUpload() *p2p.MsgRequest {
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+
+	if len(ph.uploads) == 0 {
+		return nil
+	}
+	req := ph.uploads[0]
+	ph.uploads = ph.uploads[1:]
+	return req
 }
 
 // pingLoop sends a keep alive message to the peer at a set interval
 // defined by SendKeepAlive.
 func (ph *PeerHandler) pingLoop(chErr chan<- error, chDone <-chan bool) {
 
-	ph.procs.Add(1)
 	defer ph.procs.Done()
 	defer log.Printf("end pingLoop [%v]", ph.peerInfo.String())
 
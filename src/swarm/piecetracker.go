@@ -1,8 +1,10 @@
 package swarm
 
 import (
+	"log"
 	"sync"
 
+	"gotor/utils"
 	"gotor/utils/ds"
 
 	"gotor/bf"
@@ -38,6 +40,10 @@ type PeerPieceTracker struct {
 
 	bf *bf.Bitfield // Our bitfield
 
+	// Once every piece we need is being downloaded, we enter endgame mode
+	// and let multiple peers download the same pieces.
+	endgame bool
+
 	mutex sync.Mutex
 }
 
@@ -84,6 +90,17 @@ func (ppt *PeerPieceTracker) RegisterBF(whom *PeerHandler, bf *bf.Bitfield) {
 	}
 }
 
+// RegisterAll registers the given peer as having every piece, e.g. after it
+// sent have all.
+func (ppt *PeerPieceTracker) RegisterAll(whom *PeerHandler) {
+	ppt.mutex.Lock()
+	defer ppt.mutex.Unlock()
+
+	for index := range ppt.nodes {
+		ppt.register(whom, uint32(index))
+	}
+}
+
 // Register registers the given peer as having the given piece indices.
 func (ppt *PeerPieceTracker) Register(whom *PeerHandler, indices ...uint32) {
 	ppt.mutex.Lock()
@@ -104,7 +121,7 @@ func (ppt *PeerPieceTracker) register(whom *PeerHandler, index uint32) {
 	if !node.Data.peerSet.Has(whom) {
 		// Move to next bucket, unless this is the largest bucket
 		oldCount := node.Data.peerSet.Size()
-		if oldCount < numBuckets {
+		if oldCount < numBuckets-1 {
 			ppt.buckets[oldCount].Remove(node)
 			ppt.buckets[oldCount+1].AddNodeFront(node)
 		}
@@ -119,9 +136,12 @@ func (ppt *PeerPieceTracker) Unregister(whom *PeerHandler) {
 	ppt.mutex.Lock()
 	defer ppt.mutex.Unlock()
 
-	// Set the peers active requests to unactive
-	for _, p := range ppt.requests[whom] {
-		p.active = false
+	// Set the peers active requests to unactive, unless another peer is
+	// also downloading them (endgame)
+	reqs := ppt.requests[whom]
+	delete(ppt.requests, whom)
+	for _, p := range reqs {
+		p.active = ppt.requestedByAny(p)
 	}
 
 	// Remove peer from all index peer sets
@@ -129,10 +149,10 @@ func (ppt *PeerPieceTracker) Unregister(whom *PeerHandler) {
 
 		if node.Data.peerSet.Has(whom) {
 			// Move to previous bucket, unless decrementing value by 1
-			// leaves it in the largest bucket. I.e, numBuckets = 50
-			// and oldCount = 52, then the node should remain in bucket 50.
+			// leaves it in the largest bucket. I.e, numBuckets = 64
+			// and oldCount = 66, then the node should remain in bucket 63.
 			oldCount := node.Data.peerSet.Size()
-			if oldCount <= numBuckets {
+			if oldCount < numBuckets {
 				ppt.buckets[oldCount].Remove(node)
 				ppt.buckets[oldCount-1].AddNodeFront(node)
 			}
@@ -147,22 +167,53 @@ func (ppt *PeerPieceTracker) Unregister(whom *PeerHandler) {
 // from given PeerHandler, and that is not being downloaded by any other
 // peer. The returned index will be marked as active, and no other peer
 // may acquire it. If no piece index is available, returns (0, false)
+//
+// Once every needed piece is active, the tracker enters endgame mode, and
+// NextPiece will also hand out active pieces that the peer is not already
+// downloading.
 func (ppt *PeerPieceTracker) NextPiece(whom *PeerHandler) (uint32, bool) {
 	ppt.mutex.Lock()
 	defer ppt.mutex.Unlock()
 
+	index, ok := ppt.nextInactive(whom)
+	if ok {
+		return index, true
+	}
+
+	if !ppt.endgame && ppt.allActive() {
+		ppt.endgame = true
+		log.Printf("entering endgame mode")
+	}
+
+	if ppt.endgame {
+		return ppt.nextShared(whom)
+	}
+
+	return 0, false
+}
+
+// Endgame returns true once the tracker has entered endgame mode.
+func (ppt *PeerPieceTracker) Endgame() bool {
+	ppt.mutex.Lock()
+	defer ppt.mutex.Unlock()
+	return ppt.endgame
+}
+
+// nextInactive finds the rarest needed piece that the peer has and nobody
+// is downloading. Must be called with the lock held.
+func (ppt *PeerPieceTracker) nextInactive(whom *PeerHandler) (uint32, bool) {
 	for i := 1; i < len(ppt.buckets); i++ {
 
 		cur := ppt.buckets[i].Head()
 		for cur != nil {
-			curPiece := cur.Data
+			curPiece := &cur.Data
 			// If the piece is needed
 			if !ppt.bf.Get(int64(curPiece.index)) {
 				// If the piece isn't taken by another peer, and
 				// the peer has the piece
 				if !curPiece.active && curPiece.peerSet.Has(whom) {
 					curPiece.active = true
-					ppt.requests[whom] = append(ppt.requests[whom], &curPiece)
+					ppt.requests[whom] = append(ppt.requests[whom], curPiece)
 					return curPiece.index, true
 				}
 			}
@@ -172,3 +223,100 @@ func (ppt *PeerPieceTracker) NextPiece(whom *PeerHandler) (uint32, bool) {
 
 	return 0, false
 }
+
+// nextShared finds the rarest needed piece that the peer has, which is
+// already being downloaded by other peers but not by this one. Must be
+// called with the lock held.
+func (ppt *PeerPieceTracker) nextShared(whom *PeerHandler) (uint32, bool) {
+	mine := ppt.requests[whom]
+
+	for i := 1; i < len(ppt.buckets); i++ {
+		for cur := ppt.buckets[i].Head(); cur != nil; cur = cur.Next() {
+			curPiece := &cur.Data
+			if ppt.bf.Get(int64(curPiece.index)) || !curPiece.peerSet.Has(whom) {
+				continue
+			}
+
+			taken := false
+			for _, p := range mine {
+				if p == curPiece {
+					taken = true
+					break
+				}
+			}
+			if !taken {
+				curPiece.active = true
+				ppt.requests[whom] = append(mine, curPiece)
+				return curPiece.index, true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+// allActive returns true if every piece we still need is being downloaded.
+// Must be called with the lock held.
+func (ppt *PeerPieceTracker) allActive() bool {
+	if ppt.bf.Complete() {
+		return false
+	}
+	for _, node := range ppt.nodes {
+		if !ppt.bf.Get(int64(node.Data.index)) && !node.Data.active {
+			return false
+		}
+	}
+	return true
+}
+
+// requestedByAny returns true if any peer is downloading the piece. Must be
+// called with the lock held.
+func (ppt *PeerPieceTracker) requestedByAny(p *piece) bool {
+	for _, reqs := range ppt.requests {
+		for _, req := range reqs {
+			if req == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Release marks the piece at the given index as no longer being downloaded.
+// This should be called once a piece has been completed, or if it failed
+// verification and needs to be downloaded again.
+func (ppt *PeerPieceTracker) Release(index uint32) {
+	ppt.mutex.Lock()
+	defer ppt.mutex.Unlock()
+
+	p := &ppt.nodes[index].Data
+	if !p.active {
+		return
+	}
+	p.active = false
+
+	for whom, reqs := range ppt.requests {
+		for i, req := range reqs {
+			if req == p {
+				ppt.requests[whom] = utils.RemoveSwap(reqs, int64(i))
+				break
+			}
+		}
+	}
+}
+
+// Claim marks the piece at the given index as being downloaded by the given
+// peer, if we need it, the peer has it and nobody else is downloading it.
+// Returns false if the piece can't be claimed.
+func (ppt *PeerPieceTracker) Claim(whom *PeerHandler, index uint32) bool {
+	ppt.mutex.Lock()
+	defer ppt.mutex.Unlock()
+
+	p := &ppt.nodes[index].Data
+	if p.active || ppt.bf.Get(int64(index)) || !p.peerSet.Has(whom) {
+		return false
+	}
+	p.active = true
+	ppt.requests[whom] = append(ppt.requests[whom], p)
+	return true
+}
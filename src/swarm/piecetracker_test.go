@@ -1,6 +1,7 @@
 package swarm
 
 import (
+	"fmt"
 	"net"
 	"testing"
 
@@ -126,3 +127,106 @@ func TestPeerPieceTracker_NextPiece(t *testing.T) {
 		})
 	}
 }
+
+func TestPeerPieceTracker_Release(t *testing.T) {
+	ph1 := PHDummy("1")
+	ph2 := PHDummy("2")
+
+	// Piece 1 is needed but nobody has it, which keeps us out of endgame
+	bitfield := bfFromNeed(2, []int64{0, 1})
+	ppt := NewPeerPieceTracker(2, bitfield)
+	ppt.Register(ph1, 0)
+	ppt.Register(ph2, 0)
+
+	next, ok := ppt.NextPiece(ph1)
+	if !ok || next != 0 {
+		t.Fatalf("first peer got (%v, %v), want (0, true)", next, ok)
+	}
+
+	// Piece is active, second peer should get nothing
+	if _, ok = ppt.NextPiece(ph2); ok {
+		t.Errorf("second peer acquired an active piece")
+	}
+
+	// Once released, it is available again
+	ppt.Release(0)
+	next, ok = ppt.NextPiece(ph2)
+	if !ok || next != 0 {
+		t.Errorf("second peer got (%v, %v) after release, want (0, true)", next, ok)
+	}
+
+	// Leaving frees the piece up too
+	ppt.Unregister(ph2)
+	next, ok = ppt.NextPiece(ph1)
+	if !ok || next != 0 {
+		t.Errorf("first peer got (%v, %v) after unregister, want (0, true)", next, ok)
+	}
+}
+
+func TestPeerPieceTracker_Endgame(t *testing.T) {
+	ph1 := PHDummy("1")
+	ph2 := PHDummy("2")
+	ph3 := PHDummy("3")
+
+	// Need pieces 1 and 2, everybody has both
+	bitfield := bfFromNeed(3, []int64{1, 2})
+	ppt := NewPeerPieceTracker(3, bitfield)
+	for _, ph := range []*PeerHandler{ph1, ph2, ph3} {
+		ppt.Register(ph, 1, 2)
+	}
+
+	first, ok1 := ppt.NextPiece(ph1)
+	second, ok2 := ppt.NextPiece(ph2)
+	if !ok1 || !ok2 || first == second {
+		t.Fatalf("expected two distinct pieces, got (%v, %v) and (%v, %v)", first, ok1, second, ok2)
+	}
+	if ppt.Endgame() {
+		t.Fatal("entered endgame before all pieces were active")
+	}
+
+	// Everything is active, ph3 should trigger endgame and get a shared piece
+	shared, ok := ppt.NextPiece(ph3)
+	if !ok {
+		t.Fatal("expected a shared piece in endgame")
+	}
+	if !ppt.Endgame() {
+		t.Fatal("not in endgame after all pieces active")
+	}
+
+	// ph1 can get the other piece, but nothing after that
+	other, ok := ppt.NextPiece(ph1)
+	if !ok || other != second {
+		t.Errorf("ph1 got (%v, %v), want (%v, true)", other, ok, second)
+	}
+	if _, ok = ppt.NextPiece(ph1); ok {
+		t.Errorf("ph1 acquired a piece it is already downloading")
+	}
+
+	// ph3 leaving should not free a piece ph1 is still downloading
+	ppt.Unregister(ph3)
+	ppt.Unregister(ph2)
+	if p := &ppt.nodes[shared].Data; !p.active {
+		t.Errorf("piece %v inactive while still being downloaded", shared)
+	}
+}
+
+func TestPeerPieceTracker_ManyPeers(t *testing.T) {
+	ppt := NewPeerPieceTracker(2, bf.NewBitfield(2))
+
+	// More peers than buckets stay in the largest bucket
+	peers := make([]*PeerHandler, numBuckets+10)
+	for i := range peers {
+		peers[i] = PHDummy(fmt.Sprint(i))
+		ppt.Register(peers[i], 0)
+	}
+	if ppt.buckets[numBuckets-1].Head() == nil {
+		t.Fatal("expected the piece in the largest bucket")
+	}
+
+	for _, ph := range peers {
+		ppt.Unregister(ph)
+	}
+	if ppt.buckets[0].Head() == nil || ppt.buckets[0].Head().Next() == nil {
+		t.Error("expected both pieces back in the first bucket")
+	}
+}
@@ -0,0 +1,397 @@
+/* resume.go ===================================================================
+Fast resume. Checking every piece of a large torrent on start takes a long
+time, so what we know about a torrent is saved to a bencoded resume file when
+it stops, and every resumeInterval while it runs:
+
+	infohash    The torrent's infohash
+	bitfield    The pieces we have
+	files       The path, size and modification time of every file
+	uploaded    Bytes uploaded so far
+	downloaded  Bytes downloaded so far
+	peers       Known peers, compact format
+	peers6      Known IPv6 peers, compact format
+	partial     Unfinished pieces, with a bitfield of the blocks received
+
+On start the resume file is trusted if every file still has the size and
+modification time it had when the file was saved. Otherwise, e.g. after a
+crash or if the files were edited, every piece is checked again. The blocks
+of unfinished pieces are written to their place in the files when the swarm
+stops, and read back from there.
+============================================================================ */
+
+package swarm
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gotor/bencode"
+	"gotor/bf"
+	"gotor/peer"
+	"gotor/torrent/filesd"
+)
+
+// resumeInterval is how often the resume file is saved while the swarm runs.
+const resumeInterval = 5 * time.Minute
+
+// ============================================================================
+// STRUCTS ====================================================================
+
+// resumeData is everything saved in a resume file.
+type resumeData struct {
+	infohash   string
+	bitfield   []byte
+	files      []resumeFile
+	uploaded   uint64
+	downloaded uint64
+	peers      peer.List
+	partial    map[uint32]*bf.Bitfield // Blocks received by piece index
+}
+
+// resumeFile is the state of a file when the resume file was saved.
+type resumeFile struct {
+	path  string
+	size  int64
+	mtime int64 // Unix nanoseconds
+}
+
+// ============================================================================
+// SWARM ======================================================================
+
+// DefaultResumeDir returns where resume files are saved by default, or "" if
+// there is nowhere to save them.
+func DefaultResumeDir() string {
+	dir, e := os.UserCacheDir()
+	if e != nil {
+		return ""
+	}
+	return filepath.Join(dir, "gotor", "resume")
+}
+
+// resumePath returns the path of the torrent's resume file, or "" if resume
+// files are disabled. They only work with torrents stored in their files, as
+// that is how we know nothing changed while the torrent wasn't running.
+func (s *Swarm) resumePath() string {
+	if s.session == nil || s.session.ResumeDir == "" || !s.onDisk() {
+		return ""
+	}
+	name := hex.EncodeToString([]byte(s.Tor.Infohash())) + ".resume"
+	return filepath.Join(s.session.ResumeDir, name)
+}
+
+// loadResume reads the torrent's resume file, and returns it if it can be
+// trusted. Returns nil if there is no resume file, or if the files changed
+// since it was saved. Must be called before the files are opened, as that
+// may change them.
+func (s *Swarm) loadResume() *resumeData {
+	path := s.resumePath()
+	if path == "" {
+		return nil
+	}
+
+	rd, e := loadResume(path)
+	if os.IsNotExist(e) {
+		return nil
+	} else if e != nil {
+		log.Printf("ignoring resume file [%v]: %v", path, e)
+		return nil
+	}
+
+	torInfo := s.Tor.Info()
+	if rd.infohash != s.Tor.Infohash() || int64(len(rd.bitfield)) != bf.NewBitfield(torInfo.NumPieces()).Nbytes() {
+		log.Printf("ignoring resume file [%v]: not for this torrent", path)
+		return nil
+	}
+
+	files, e := statFiles(torInfo.Files())
+	if e != nil || !sameFiles(rd.files, files) {
+		log.Printf("files changed since [%v] was saved, checking every piece", path)
+		return nil
+	}
+	return rd
+}
+
+// restore sets the bitfield and unfinished pieces from trusted resume data.
+func (s *Swarm) restore(rd *resumeData) error {
+	nbits := s.Bf.Nbits()
+	have, e := bf.FromBytes(append(make([]byte, 5), rd.bitfield...), nbits)
+	if e != nil {
+		return e
+	}
+	for i := int64(0); i < nbits; i++ {
+		s.Bf.Set(i, have.Get(i))
+	}
+
+	torInfo := s.Tor.Info()
+	buf := make([]byte, torInfo.PieceLen())
+	for index, blocks := range rd.partial {
+		if int64(index) >= nbits || s.Bf.Get(int64(index)) {
+			continue
+		}
+		data := buf[:torInfo.PieceLenAt(int64(index))]
+		e := s.Storage.ReadAt(int64(index), 0, data)
+		if e != nil {
+			return e
+		}
+		s.PA.Restore(index, blocks, data)
+	}
+	return nil
+}
+
+// saveResume writes the torrent's resume file. With partial, the blocks of
+// unfinished pieces are written to the files first, which is only safe once
+// no more blocks can arrive. Saves never overlap, as they all write the same
+// temporary file.
+func (s *Swarm) saveResume(partial bool) error {
+	path := s.resumePath()
+	if path == "" {
+		return nil
+	}
+
+	s.rmutex.Lock()
+	defer s.rmutex.Unlock()
+
+	// The bitfield is copied first, so that pieces written after the files
+	// are looked at can't be in it
+	bitfield := s.Bf.Clone().Data()
+
+	rd := resumeData{
+		infohash:   s.Tor.Infohash(),
+		bitfield:   bitfield,
+		uploaded:   s.Stats.Uploaded(),
+		downloaded: s.Stats.Dnloaded(),
+		partial:    make(map[uint32]*bf.Bitfield),
+	}
+
+	if partial {
+		for index, rp := range s.PA.Received() {
+			e := s.Storage.WriteAt(int64(index), 0, rp.data)
+			if e != nil {
+				return e
+			}
+			rd.partial[index] = rp.blocks
+		}
+	}
+
+	files, e := statFiles(s.Tor.Info().Files())
+	if e != nil {
+		return e
+	}
+	rd.files = files
+
+	s.pmutex.Lock()
+	rd.peers = make(peer.List, len(s.Peers))
+	copy(rd.peers, s.Peers)
+	s.pmutex.Unlock()
+
+	if e = os.MkdirAll(filepath.Dir(path), 0755); e != nil {
+		return e
+	}
+	return rd.save(path)
+}
+
+// resumeLoop saves the resume file every resumeInterval until chDone is
+// closed.
+func (s *Swarm) resumeLoop(chDone <-chan struct{}) {
+	ticker := time.NewTicker(resumeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if e := s.saveResume(false); e != nil {
+				log.Printf("failed to save resume file: %v", e)
+			}
+		case <-chDone:
+			return
+		}
+	}
+}
+
+// ============================================================================
+// FILES ======================================================================
+
+// statFiles returns the current state of the torrent's files.
+func statFiles(files filesd.FileList) ([]resumeFile, error) {
+	states := make([]resumeFile, 0, len(files))
+	for _, fe := range files {
+		fi, e := os.Stat(fe.LocalPath())
+		if e != nil {
+			return nil, e
+		}
+		states = append(states, resumeFile{
+			path:  fe.LocalPath(),
+			size:  fi.Size(),
+			mtime: fi.ModTime().UnixNano(),
+		})
+	}
+	return states, nil
+}
+
+// sameFiles returns true if both lists hold the same files in the same
+// state.
+func sameFiles(a []resumeFile, b []resumeFile) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ============================================================================
+// ENCODING ===================================================================
+
+func (rd *resumeData) save(path string) error {
+	files := make(bencode.List, 0, len(rd.files))
+	for _, f := range rd.files {
+		files = append(files, bencode.Dict{
+			"path":  f.path,
+			"size":  f.size,
+			"mtime": f.mtime,
+		})
+	}
+
+	var peers, peers6 []byte
+	for _, p := range rd.peers {
+		if p.IsIPv6() {
+			peers6 = append(peers6, p.Compact()...)
+		} else {
+			peers = append(peers, p.Compact()...)
+		}
+	}
+
+	partial := make(bencode.List, 0, len(rd.partial))
+	for index, blocks := range rd.partial {
+		partial = append(partial, bencode.Dict{
+			"piece":   int64(index),
+			"nblocks": blocks.Nbits(),
+			"blocks":  string(blocks.Data()),
+		})
+	}
+
+	dict := bencode.Dict{
+		"infohash":   rd.infohash,
+		"bitfield":   string(rd.bitfield),
+		"files":      files,
+		"uploaded":   int64(rd.uploaded),
+		"downloaded": int64(rd.downloaded),
+		"partial":    partial,
+	}
+
+	// Empty strings can't be encoded, and peers are optional anyway
+	if len(peers) > 0 {
+		dict["peers"] = string(peers)
+	}
+	if len(peers6) > 0 {
+		dict["peers6"] = string(peers6)
+	}
+
+	data, e := bencode.Encode(dict)
+	if e != nil {
+		return e
+	}
+
+	// Write to a temporary file first, so a crash can't leave half a resume
+	// file behind
+	tmp := path + ".tmp"
+	if e = os.WriteFile(tmp, data, 0644); e != nil {
+		return e
+	}
+	return os.Rename(tmp, path)
+}
+
+func loadResume(path string) (*resumeData, error) {
+	data, e := os.ReadFile(path)
+	if e != nil {
+		return nil, e
+	}
+
+	ben, e := bencode.Decode(data)
+	if e != nil {
+		return nil, e
+	}
+	dict, ok := ben.(bencode.Dict)
+	if !ok {
+		return nil, fmt.Errorf("resume file is not a dictionary")
+	}
+
+	rd := resumeData{partial: make(map[uint32]*bf.Bitfield)}
+	if rd.infohash, e = dict.GetString("infohash"); e != nil {
+		return nil, e
+	}
+	bitfield, e := dict.GetString("bitfield")
+	if e != nil {
+		return nil, e
+	}
+	rd.bitfield = []byte(bitfield)
+	if rd.uploaded, e = dict.GetUint("uploaded"); e != nil {
+		return nil, e
+	}
+	if rd.downloaded, e = dict.GetUint("downloaded"); e != nil {
+		return nil, e
+	}
+
+	files, e := dict.GetList("files")
+	if e != nil {
+		return nil, e
+	}
+	for _, item := range files {
+		fd, ok := item.(bencode.Dict)
+		if !ok {
+			return nil, fmt.Errorf("resume file entry is not a dictionary")
+		}
+		f := resumeFile{}
+		if f.path, e = fd.GetString("path"); e != nil {
+			return nil, e
+		}
+		if f.size, e = fd.GetInt("size"); e != nil {
+			return nil, e
+		}
+		if f.mtime, e = fd.GetInt("mtime"); e != nil {
+			return nil, e
+		}
+		rd.files = append(rd.files, f)
+	}
+
+	// Peers and unfinished pieces are nice to have, so a bad entry only
+	// loses that entry
+	if compact, e := dict.GetString("peers"); e == nil {
+		if peers, e := peer.ParseCompact([]byte(compact)); e == nil {
+			rd.peers = append(rd.peers, peers...)
+		}
+	}
+	if compact, e := dict.GetString("peers6"); e == nil {
+		if peers, e := peer.ParseCompact6([]byte(compact)); e == nil {
+			rd.peers = append(rd.peers, peers...)
+		}
+	}
+
+	partial, _ := dict.GetList("partial")
+	for _, item := range partial {
+		pd, ok := item.(bencode.Dict)
+		if !ok {
+			continue
+		}
+		index, e1 := pd.GetUint("piece")
+		nblocks, e2 := pd.GetInt("nblocks")
+		data, e3 := pd.GetString("blocks")
+		if e1 != nil || e2 != nil || e3 != nil || index > 0xffffffff {
+			continue
+		}
+		blocks, e := bf.FromBytes(append(make([]byte, 5), data...), nblocks)
+		if e != nil {
+			continue
+		}
+		rd.partial[uint32(index)] = blocks
+	}
+
+	return &rd, nil
+}
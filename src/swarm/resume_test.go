@@ -0,0 +1,142 @@
+package swarm
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotor/bf"
+	"gotor/peer"
+	"gotor/torrent"
+	"gotor/torrent/filesd"
+	"gotor/torrent/info"
+	"gotor/torrent/storage"
+	"gotor/tracker"
+	"gotor/utils/test"
+)
+
+// newResumeSwarm makes a swarm for a 2 piece torrent, with 2 blocks per
+// piece, stored in dir.
+func newResumeSwarm(t *testing.T, dir string) *Swarm {
+	fe := filesd.MakeFileEntry("a", 4*requestLength)
+	fe.SetLocalPath(filepath.Join(dir, "a"))
+	torInfo, e := info.NewTorInfo("a", 2*requestLength, test.DummyHashes(2), []filesd.EntryBase{fe})
+	test.CheckFatal(t, e)
+	tor, e := torrent.NewTorrent(torInfo, "")
+	test.CheckFatal(t, e)
+
+	se := newTestSession()
+	se.ResumeDir = filepath.Join(dir, "resume")
+	return &Swarm{
+		session: se,
+		Tor:     tor,
+		Storage: storage.NewFiles(torInfo),
+		Bf:      bf.NewBitfield(2),
+		PA:      NewPieceAssembler(torInfo),
+		Stats:   tracker.NewStats(0, 0, 0),
+	}
+}
+
+func TestSwarm_Resume(t *testing.T) {
+	dir := t.TempDir()
+	block := bytes.Repeat([]byte{'x'}, requestLength)
+
+	s := newResumeSwarm(t, dir)
+	if s.loadResume() != nil {
+		t.Fatal("expected no resume data before saving")
+	}
+	test.CheckFatal(t, s.Storage.Open())
+	s.Bf.Set(0, true)
+	s.PA.Begin(1)
+	s.PA.Put(1, requestLength, block)
+	s.Stats = tracker.NewStats(100, 50, 0)
+	s.Peers = peer.List{
+		peer.MakePeer("", net.IPv4(10, 0, 0, 1), 6881),
+		peer.MakePeer("", net.ParseIP("2001:db8::1"), 6881),
+	}
+	test.CheckFatal(t, s.saveResume(true))
+	test.CheckFatal(t, s.Storage.Close())
+
+	// A new swarm trusts the resume file
+	s = newResumeSwarm(t, dir)
+	rd := s.loadResume()
+	if rd == nil {
+		t.Fatal("expected the resume file to be trusted")
+	}
+	if rd.downloaded != 100 || rd.uploaded != 50 || len(rd.peers) != 2 {
+		t.Errorf("got %v down, %v up and %v peers, want 100, 50 and 2", rd.downloaded, rd.uploaded, len(rd.peers))
+	}
+	test.CheckFatal(t, s.Storage.Open())
+	test.CheckFatal(t, s.restore(rd))
+	if !s.Bf.Get(0) || s.Bf.Get(1) {
+		t.Errorf("expected only piece 0, got %v", s.Bf.Data())
+	}
+	partial, ok := s.PA.Received()[1]
+	if !ok || partial.blocks.Get(0) || !partial.blocks.Get(1) {
+		t.Fatal("expected the second block of piece 1 to be restored")
+	}
+	if !bytes.Equal(partial.data[requestLength:], block) {
+		t.Error("restored block has the wrong data")
+	}
+	test.CheckFatal(t, s.Storage.Close())
+
+	// Any change to the files means every piece is checked again
+	later := time.Now().Add(time.Hour)
+	test.CheckFatal(t, os.Chtimes(filepath.Join(dir, "a"), later, later))
+	if newResumeSwarm(t, dir).loadResume() != nil {
+		t.Error("expected the resume file to be ignored after the files changed")
+	}
+
+	// So does a broken resume file
+	s = newResumeSwarm(t, dir)
+	test.CheckFatal(t, os.WriteFile(s.resumePath(), []byte("d8:infohash"), 0644))
+	if s.loadResume() != nil {
+		t.Error("expected a broken resume file to be ignored")
+	}
+}
+
+func TestSwarm_ResumeConcurrent(t *testing.T) {
+	s := newResumeSwarm(t, t.TempDir())
+	test.CheckFatal(t, s.Storage.Open())
+	defer s.Storage.Close()
+
+	// The resume loop and Pause may save at the same time
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func(partial bool) {
+			errs <- s.saveResume(partial)
+		}(i%2 == 0)
+	}
+	for i := 0; i < cap(errs); i++ {
+		test.CheckFatal(t, <-errs)
+	}
+	if s.loadResume() == nil {
+		t.Error("expected a valid resume file")
+	}
+}
+
+func TestPieceAssembler_Restore(t *testing.T) {
+	files := []filesd.EntryBase{filesd.MakeFileEntry("f", 4*requestLength)}
+	torInfo, e := info.NewTorInfo("f", 2*requestLength, test.DummyHashes(2), files)
+	test.CheckFatal(t, e)
+	pa := NewPieceAssembler(torInfo)
+	data := make([]byte, 2*requestLength)
+
+	one := bf.NewBitfield(2)
+	one.Set(0, true)
+	pa.Restore(0, one, data)
+	if req, ok := pa.NextBlock(0); !ok || req.begin != requestLength {
+		t.Errorf("expected only the second block to be missing, got %v", req)
+	}
+
+	// A piece with every block received is downloaded again instead
+	all := bf.NewBitfield(2)
+	all.Fill()
+	pa.Restore(1, all, data)
+	if pa.Has(1) {
+		t.Error("expected a fully received piece not to be restored")
+	}
+}
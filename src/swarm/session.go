@@ -0,0 +1,453 @@
+package swarm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"gotor/dht"
+	"gotor/io"
+	"gotor/lsd"
+	"gotor/mse"
+	"gotor/peer"
+	"gotor/torrent"
+	"gotor/torrent/storage"
+	"gotor/utils"
+	"gotor/utp"
+)
+
+// maxHandshakes is how many incoming connections may be handshaking at once,
+// before we know which torrent they are for.
+const maxHandshakes = 64
+
+// errSessionClosed is returned when adding torrents to a closed session.
+var errSessionClosed = errors.New("session closed")
+
+// ============================================================================
+// STRUCTS ====================================================================
+
+// SessionConfig is everything a Session needs to run.
+type SessionConfig struct {
+	Port       uint16     // Listen port for TCP and uTP, 0 picks a free one
+	Encryption mse.Policy // Protocol encryption policy
+	MaxConns   int        // Connection limit across every torrent
+	MaxPeers   int        // Connection limit per torrent
+	UpLimit    int64      // Upload limit in bytes / sec, io.NoLimit for none
+	DnLimit    int64      // Download limit in bytes / sec, io.NoLimit for none
+	UTP        bool       // Connect to peers over uTP, falling back to TCP
+	DHT        bool       // Find peers through the DHT
+	LSD        bool       // Find peers on the local network
+
+	// DHTStatePath is where the DHT routing table is saved between runs, ""
+	// to not save it.
+	DHTStatePath string
+
+	// ResumeDir is where resume files are saved, "" to check every piece on
+	// every start.
+	ResumeDir string
+
+	// VerifyWorkers is how many pieces are hashed at once when checking
+	// files, < 1 for one per CPU.
+	VerifyWorkers int
+
+	// Storage makes the storage of every torrent, nil to store torrents in
+	// their files.
+	Storage storage.Factory
+}
+
+// Session runs any number of swarms on one port. The swarms share the
+// listeners, the rate limiter, the connection limit and the peer ID, as well
+// as the DHT, local service discovery and the uTP socket. Incoming peers are
+// handed to the swarm of the torrent named in their handshake.
+type Session struct {
+	Id         string
+	Port       uint16
+	Encryption mse.Policy
+	MaxPeers   int          // Connection limit per torrent
+	Limiter    *ConnLimiter // Connection limit across every torrent
+	RLIO       *io.RateLimitIO
+	DHT        *dht.DHT    // nil if the DHT is disabled
+	LSD        *lsd.LSD    // nil if local service discovery is disabled
+	UTP        *utp.Socket // nil if uTP is disabled
+	ResumeDir  string      // "" if resume files are disabled
+
+	// VerifyWorkers is how many pieces are hashed at once when checking
+	// files, < 1 for one per CPU.
+	VerifyWorkers int
+
+	// Storage makes the storage of every torrent, nil to store torrents in
+	// their files.
+	Storage storage.Factory
+
+	swarms map[string]*Swarm   // By infohash
+	adding map[string]struct{} // Infohashes of the swarms being added
+	closed bool
+	mutex  sync.Mutex // Guards swarms, adding and closed
+
+	listeners   []net.Listener
+	chHandshake chan struct{} // Holds a slot for every handshake in progress
+	chDone      chan struct{} // Closed by Close
+}
+
+// ============================================================================
+// FUNK =======================================================================
+
+// NewSession listens on the configured port, and starts the DHT, local
+// service discovery and uTP if they are enabled. Torrents are added with Add.
+func NewSession(cfg SessionConfig) (*Session, error) {
+	var err error
+
+	se := &Session{
+		Id:            utils.NewPeerId(),
+		Port:          cfg.Port,
+		Encryption:    cfg.Encryption,
+		MaxPeers:      cfg.MaxPeers,
+		ResumeDir:     cfg.ResumeDir,
+		VerifyWorkers: cfg.VerifyWorkers,
+		Storage:       cfg.Storage,
+		Limiter:       NewConnLimiter(cfg.MaxConns),
+		RLIO:          io.NewRateLimitIO(),
+		swarms:        make(map[string]*Swarm),
+		adding:        make(map[string]struct{}),
+		chHandshake:   make(chan struct{}, maxHandshakes),
+		chDone:        make(chan struct{}),
+	}
+	se.RLIO.SetWriteRate(cfg.UpLimit)
+	se.RLIO.SetReadRate(cfg.DnLimit)
+
+	err = se.listen()
+	if err != nil {
+		return nil, err
+	}
+
+	// uTP listens on the same port as TCP, and the DHT shares its socket
+	if cfg.UTP {
+		se.UTP, err = utp.Listen("udp4", fmt.Sprintf(":%v", se.Port))
+		if err != nil {
+			log.Printf("failed to start utp, continuing with tcp only: %v", err)
+		}
+	}
+
+	if cfg.DHT {
+		if se.UTP != nil {
+			se.DHT, err = dht.NewWithConn(se.UTP.PacketConn(), cfg.DHTStatePath)
+		} else {
+			se.DHT, err = dht.New(fmt.Sprintf(":%v", se.Port), cfg.DHTStatePath)
+		}
+		if err != nil {
+			log.Printf("failed to start dht, continuing without: %v", err)
+		}
+	}
+
+	if cfg.LSD {
+		se.LSD, err = lsd.New(se.Port)
+		if err != nil {
+			log.Printf("failed to start local service discovery, continuing without: %v", err)
+		}
+	}
+
+	go se.RLIO.Run()
+	for _, listener := range se.listeners {
+		go se.acceptLoop(listener)
+	}
+	if se.UTP != nil {
+		log.Printf("Listening on utp port %v\n", se.Port)
+		go se.acceptLoop(se.UTP)
+	}
+	if se.LSD != nil {
+		go se.lsdLoop()
+	}
+
+	return se, nil
+}
+
+// listen listens for incoming peers on both IPv4 and IPv6. Hosts without
+// IPv6 (or without IPv4) only get the listener that works.
+func (se *Session) listen() error {
+	for _, network := range []string{"tcp4", "tcp6"} {
+		listener, err := net.Listen(network, fmt.Sprintf(":%v", se.Port))
+		if err != nil {
+			log.Printf("failed to listen on %v: %v", network, err)
+			continue
+		}
+
+		// Everything else listens on the port picked for the first listener
+		if se.Port == 0 {
+			se.Port = uint16(listener.Addr().(*net.TCPAddr).Port)
+		}
+		log.Printf("Listening on %v port %v\n", network, se.Port)
+		se.listeners = append(se.listeners, listener)
+	}
+
+	if len(se.listeners) == 0 {
+		return fmt.Errorf("could not listen on port %v", se.Port)
+	}
+	return nil
+}
+
+// Add loads a torrent from a .torrent file or magnet link, with its files in
+// workingDir, and starts its swarm. Returns an error if the torrent is
+// already in the session, or ctx's error if ctx is done while the files are
+// checked.
+func (se *Session) Add(ctx context.Context, input string, workingDir string) (*Swarm, error) {
+	// Only the infohash is needed to find duplicates, the metadata of magnet
+	// links is fetched once the torrent is known to be new
+	var tor *torrent.Torrent
+	var infohash string
+	if torrent.IsMagnet(input) {
+		mag, e := torrent.ParseMagnet(input)
+		if e != nil {
+			return nil, e
+		}
+		infohash = mag.Infohash
+	} else {
+		log.Printf("reading torrent file [%v]\n", input)
+		var e error
+		tor, e = torrent.FromTorrentFile(input, workingDir)
+		if e != nil {
+			return nil, e
+		}
+		infohash = tor.Infohash()
+	}
+
+	// Hold the infohash while the swarm is built, so that the same torrent
+	// can't be added twice at once
+	se.mutex.Lock()
+	_, exists := se.swarms[infohash]
+	_, adding := se.adding[infohash]
+	if se.closed {
+		se.mutex.Unlock()
+		return nil, errSessionClosed
+	} else if exists || adding {
+		se.mutex.Unlock()
+		return nil, fmt.Errorf("torrent %x is already added", infohash)
+	}
+	se.adding[infohash] = struct{}{}
+	se.mutex.Unlock()
+
+	sw, e := newSwarm(ctx, se, tor, input, workingDir)
+
+	se.mutex.Lock()
+	delete(se.adding, infohash)
+	if e == nil && se.closed {
+		_ = sw.Storage.Close()
+		sw, e = nil, errSessionClosed
+	}
+	if e == nil {
+		se.swarms[infohash] = sw
+	}
+	se.mutex.Unlock()
+
+	if e != nil {
+		return nil, e
+	}
+	return sw, sw.Start()
+}
+
+// newStorage makes the storage of the torrent.
+func (se *Session) newStorage(tor *torrent.Torrent) storage.Storage {
+	if se.Storage == nil {
+		return storage.NewFiles(tor.Info())
+	}
+	return se.Storage(tor.Infohash(), tor.Info())
+}
+
+// Remove stops the torrent's swarm and removes it from the session.
+func (se *Session) Remove(ctx context.Context, infohash string) error {
+	se.mutex.Lock()
+	sw, ok := se.swarms[infohash]
+	delete(se.swarms, infohash)
+	se.mutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no torrent %x", infohash)
+	}
+	return sw.Stop(ctx)
+}
+
+// Pause disconnects the torrent's swarm from its peers until Resume is
+// called.
+func (se *Session) Pause(ctx context.Context, infohash string) error {
+	sw := se.Swarm(infohash)
+	if sw == nil {
+		return fmt.Errorf("no torrent %x", infohash)
+	}
+	return sw.Pause(ctx)
+}
+
+// Resume starts a paused torrent again.
+func (se *Session) Resume(infohash string) error {
+	sw := se.Swarm(infohash)
+	if sw == nil {
+		return fmt.Errorf("no torrent %x", infohash)
+	}
+	return sw.Start()
+}
+
+// Swarm returns the swarm of the torrent, or nil if it isn't in the session.
+func (se *Session) Swarm(infohash string) *Swarm {
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+	return se.swarms[infohash]
+}
+
+// Swarms returns a snapshot of every swarm in the session.
+func (se *Session) Swarms() []*Swarm {
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+
+	swarms := make([]*Swarm, 0, len(se.swarms))
+	for _, sw := range se.swarms {
+		swarms = append(swarms, sw)
+	}
+	return swarms
+}
+
+// Close stops every swarm, then closes the listeners and everything else
+// the swarms share. If ctx is done before the swarms are, Close stops
+// waiting for them and returns ctx's error, but still closes everything.
+func (se *Session) Close(ctx context.Context) error {
+	se.mutex.Lock()
+	if se.closed {
+		se.mutex.Unlock()
+		return nil
+	}
+	se.closed = true
+	se.mutex.Unlock()
+
+	close(se.chDone)
+	for _, listener := range se.listeners {
+		_ = listener.Close()
+	}
+
+	// Swarms wait for their peers and trackers, so stop them all at once
+	swarms := se.Swarms()
+	errs := make([]error, len(swarms))
+	wg := sync.WaitGroup{}
+	for i, sw := range swarms {
+		wg.Add(1)
+		go func(i int, sw *Swarm) {
+			defer wg.Done()
+			errs[i] = sw.Stop(ctx)
+		}(i, sw)
+	}
+	wg.Wait()
+
+	var err error
+	keep := func(e error) {
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	for _, e := range errs {
+		keep(e)
+	}
+
+	se.RLIO.Stop()
+	if se.LSD != nil {
+		se.LSD.Close()
+	}
+	if se.DHT != nil {
+		keep(se.DHT.Close())
+	}
+	if se.UTP != nil {
+		keep(se.UTP.Close())
+	}
+	return err
+}
+
+// acceptLoop accepts incoming peers on the listener until it is closed.
+func (se *Session) acceptLoop(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-se.chDone:
+			default:
+				log.Printf("stopped accepting peers on %v: %v", listener.Addr(), err)
+			}
+			return
+		}
+		log.Printf("new client @ %v", conn.RemoteAddr())
+
+		select {
+		case se.chHandshake <- struct{}{}:
+			go se.handshake(conn)
+		default:
+			log.Printf("too many handshakes, dropping %v", conn.RemoteAddr())
+			_ = conn.Close()
+		}
+	}
+}
+
+// handshake reads the handshake of an incoming peer, encrypted or not, and
+// hands the connection to the swarm of the torrent it asks for.
+func (se *Session) handshake(conn net.Conn) {
+	defer func() { <-se.chHandshake }()
+
+	sw, mconn, peerHs, e := se.route(conn)
+	if e != nil {
+		log.Printf("incoming connection from %v failed: %v", conn.RemoteAddr(), e)
+		_ = conn.Close()
+		return
+	}
+	sw.accept(mconn, peerHs)
+}
+
+// route runs the encryption handshake if the peer starts one, then reads
+// the BitTorrent handshake and finds the swarm it is for.
+func (se *Session) route(conn net.Conn) (*Swarm, net.Conn, Handshake, error) {
+	var skey string
+	mconn, e := withDeadline(conn, func() (net.Conn, error) {
+		c, infohash, e := mse.Accept(conn, se.infohashes(), se.Encryption)
+		skey = infohash
+		return c, e
+	})
+	if e != nil {
+		return nil, nil, nil, e
+	}
+
+	peerHs, e := readAnyHandshake(mconn)
+	if e != nil {
+		return nil, nil, nil, e
+	}
+	infohash := string(peerHs.Infohash())
+	if skey != "" && skey != infohash {
+		return nil, nil, nil, fmt.Errorf("handshake is for another torrent than the encryption handshake")
+	}
+
+	sw := se.Swarm(infohash)
+	if sw == nil {
+		return nil, nil, nil, fmt.Errorf("unknown torrent %x", infohash)
+	}
+	return sw, mconn, peerHs, nil
+}
+
+// infohashes returns the infohashes of the running swarms.
+func (se *Session) infohashes() []string {
+	swarms := se.Swarms()
+	infohashes := make([]string, 0, len(swarms))
+	for _, sw := range swarms {
+		if sw.Running() {
+			infohashes = append(infohashes, sw.Tor.Infohash())
+		}
+	}
+	return infohashes
+}
+
+// lsdLoop hands the peers found on the local network to the swarms of their
+// torrents.
+func (se *Session) lsdLoop() {
+	for p := range se.LSD.Peers() {
+		sw := se.Swarm(p.Infohash)
+		if sw == nil || !sw.Running() {
+			continue
+		}
+		for _, added := range sw.addPeers(peer.List{p.Peer}) {
+			log.Printf("found local peer %v", added.Addr())
+		}
+	}
+}
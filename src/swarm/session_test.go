@@ -0,0 +1,234 @@
+package swarm
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotor/bf"
+	"gotor/mse"
+	"gotor/torrent"
+	"gotor/torrent/filesd"
+	"gotor/torrent/info"
+	"gotor/torrent/storage"
+	"gotor/tracker"
+	"gotor/utils/test"
+)
+
+// newTestSession makes a session without listeners or peer sources.
+func newTestSession() *Session {
+	return &Session{
+		Id:          "-GT0000-000000000000",
+		Encryption:  mse.Prefer,
+		MaxPeers:    10,
+		Limiter:     NewConnLimiter(10),
+		swarms:      make(map[string]*Swarm),
+		adding:      make(map[string]struct{}),
+		chHandshake: make(chan struct{}, maxHandshakes),
+		chDone:      make(chan struct{}),
+	}
+}
+
+// addTestSwarm adds a swarm for a trackerless single piece torrent to the
+// session, without starting it.
+func addTestSwarm(t *testing.T, se *Session, name string) *Swarm {
+	files := []filesd.EntryBase{filesd.MakeFileEntry(name, requestLength)}
+	torInfo, e := info.NewTorInfo(name, requestLength, test.DummyHashes(1), files)
+	test.CheckFatal(t, e)
+	tor, e := torrent.NewTorrent(torInfo, "")
+	test.CheckFatal(t, e)
+
+	s := &Swarm{
+		session:     se,
+		Id:          se.Id,
+		Encryption:  se.Encryption,
+		Tor:         tor,
+		Trackers:    tracker.FromTorrent(tor),
+		Storage:     storage.NewMemory(torInfo),
+		Bf:          bf.NewBitfield(1),
+		Choker:      NewTitForTat(DefaultUploadSlots),
+		handlers:    make(map[*PeerHandler]struct{}),
+		chRechoke:   make(chan struct{}, 1),
+		chCompleted: make(chan struct{}, 1),
+	}
+	se.swarms[tor.Infohash()] = s
+	return s
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	l, e := net.Listen("tcp4", "127.0.0.1:0")
+	test.CheckFatal(t, e)
+	defer l.Close()
+
+	chConn := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		chConn <- c
+	}()
+	dialed, e := net.Dial("tcp4", l.Addr().String())
+	test.CheckFatal(t, e)
+	accepted := <-chConn
+	t.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+	return dialed, accepted
+}
+
+func TestSession_AddDuplicate(t *testing.T) {
+	se := newTestSession()
+	sw := addTestSwarm(t, se, "dup")
+	magnet := "magnet:?xt=urn:btih:" + hex.EncodeToString([]byte(sw.Tor.Infohash()))
+
+	// Duplicates are turned away before any metadata is fetched
+	if _, e := se.Add(context.Background(), magnet, t.TempDir()); e == nil {
+		t.Errorf("expected error adding a torrent twice")
+	}
+
+	// So are torrents that are still being added
+	delete(se.swarms, sw.Tor.Infohash())
+	se.adding[sw.Tor.Infohash()] = struct{}{}
+	if _, e := se.Add(context.Background(), magnet, t.TempDir()); e == nil {
+		t.Errorf("expected error adding a torrent that is being added")
+	}
+
+	se.closed = true
+	if _, e := se.Add(context.Background(), magnet, t.TempDir()); e != errSessionClosed {
+		t.Errorf("got error %v, want %v", e, errSessionClosed)
+	}
+}
+
+func TestSession_route(t *testing.T) {
+	se := newTestSession()
+	a := addTestSwarm(t, se, "a")
+	b := addTestSwarm(t, se, "b")
+	a.running = true
+	b.running = true
+	unknown := "unknown-infohash-000"
+
+	tests := []struct {
+		name    string
+		encrypt string // Infohash for the encryption handshake, "" for plaintext
+		hs      string // Infohash in the BitTorrent handshake
+		want    *Swarm
+	}{
+		{name: "Plaintext", hs: a.Tor.Infohash(), want: a},
+		{name: "Encrypted", encrypt: b.Tor.Infohash(), hs: b.Tor.Infohash(), want: b},
+		{name: "Unknown", hs: unknown},
+		{name: "Mismatch", encrypt: a.Tor.Infohash(), hs: b.Tor.Infohash()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local, remote := tcpPair(t)
+
+			go func() {
+				var conn net.Conn = local
+				if tt.encrypt != "" {
+					mconn, e := mse.Initiate(local, tt.encrypt, mse.Require)
+					if e != nil {
+						return
+					}
+					conn = mconn
+				}
+				_, _ = conn.Write(MakeHandshake(tt.hs, "-XX0000-000000000000"))
+			}()
+
+			sw, _, peerHs, e := se.route(remote)
+			if tt.want == nil {
+				if e == nil {
+					t.Fatalf("expected an error, got swarm %v", sw.Tor.Info().Name())
+				}
+				return
+			}
+			test.CheckFatal(t, e)
+			if sw != tt.want {
+				t.Errorf("routed to the wrong swarm")
+			}
+			if string(peerHs.Infohash()) != tt.hs {
+				t.Errorf("got handshake for %x, want %x", peerHs.Infohash(), tt.hs)
+			}
+		})
+	}
+}
+
+func TestSwarm_PauseResume(t *testing.T) {
+	se := newTestSession()
+	s := addTestSwarm(t, se, "a")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	test.CheckFatal(t, s.Start())
+	first := s.Conns
+	if !s.Running() || len(se.infohashes()) != 1 {
+		t.Fatal("expected the swarm to run")
+	}
+
+	test.CheckFatal(t, s.Pause(ctx))
+	if s.Running() || len(se.infohashes()) != 0 {
+		t.Fatal("expected the swarm to be paused")
+	}
+
+	// Paused swarms drop incoming peers
+	local, remote := net.Pipe()
+	s.accept(local, nil)
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	if _, e := remote.Read(make([]byte, 1)); e != io.EOF {
+		t.Fatalf("expected connection to a paused swarm to be dropped, got %v", e)
+	}
+
+	test.CheckFatal(t, s.Start())
+	if !s.Running() || s.Conns == first {
+		t.Fatal("expected the swarm to run again with a new connection manager")
+	}
+
+	test.CheckFatal(t, s.Stop(ctx))
+	if e := s.Start(); e != errSwarmStopped {
+		t.Fatalf("expected stopped swarm not to start, got %v", e)
+	}
+}
+
+func TestSwarm_Stop(t *testing.T) {
+	ft, announceUrl := newFakeTracker(t, 0)
+	se := newTestSession()
+	s := addTestSwarm(t, se, "a")
+	s.Trackers = tracker.NewMultiTracker([][]string{{announceUrl}})
+	s.Stats = tracker.NewStats(0, 0, requestLength)
+	s.startEvent = tracker.EventStarted
+	s.Storage = storage.NewBlob(s.Tor.Info(), filepath.Join(t.TempDir(), "a.blob"))
+	test.CheckFatal(t, s.Storage.Open())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	test.CheckFatal(t, s.Start())
+	if event := ft.next(t, time.Second); event != tracker.EventStarted {
+		t.Fatalf("got %q announce, want %q", event, tracker.EventStarted)
+	}
+
+	// Trackers hear that we stopped, and the storage is closed
+	test.CheckFatal(t, s.Stop(ctx))
+	if event := ft.next(t, time.Second); event != tracker.EventStopped {
+		t.Fatalf("got %q announce, want %q", event, tracker.EventStopped)
+	}
+	if s.Running() {
+		t.Error("expected the swarm not to run after Stop")
+	}
+	if e := s.Storage.ReadAt(0, 0, make([]byte, 1)); e == nil {
+		t.Error("expected the storage to be closed after Stop")
+	}
+
+	// A stopped swarm stays stopped, and stopping it again does nothing
+	if e := s.Start(); e != errSwarmStopped {
+		t.Fatalf("expected stopped swarm not to start, got %v", e)
+	}
+	test.CheckFatal(t, s.Stop(ctx))
+	select {
+	case event := <-ft.events:
+		t.Errorf("got %q announce after stopping twice", event)
+	default:
+	}
+}
@@ -1,70 +1,156 @@
 package swarm
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"log"
 	"net"
 	"strings"
+	"sync"
 
 	"gotor/bf"
+	"gotor/dht"
 	"gotor/io"
+	"gotor/lsd"
+	"gotor/mse"
 	"gotor/peer"
 	"gotor/torrent"
-	"gotor/torrent/fileio"
+	"gotor/torrent/storage"
+	"gotor/torrent/verify"
 	"gotor/tracker"
-	"gotor/utils"
+	"gotor/utp"
 )
 
+// errSwarmStopped is reported by peer handlers stopped by Swarm.Stop.
+var errSwarmStopped = errors.New("swarm stopped")
+
 // ============================================================================
 // STRUCTS ====================================================================
 
 type Swarm struct {
-	State  *tracker.State
-	Stats  *tracker.Stats
-	Peers  peer.List
-	Tor    *torrent.Torrent
-	Fileio *fileio.FileIO
-	RLIO   *io.RateLimitIO
-	Bf     *bf.Bitfield
-	PPT    *PeerPieceTracker
-	Id     string
-	Port   uint16
-
-	ChErr chan error
+	State    *tracker.State
+	Stats    *tracker.Stats
+	Trackers *tracker.MultiTracker
+	DHT      *dht.DHT    // nil if the DHT is disabled
+	LSD      *lsd.LSD    // nil if local service discovery is disabled
+	UTP      *utp.Socket // nil if uTP is disabled
+	Peers    peer.List
+	Tor      *torrent.Torrent
+	Storage  storage.Storage
+	RLIO     *io.RateLimitIO
+	Bf       *bf.Bitfield // Pieces we have, read and set by every peer
+	PPT      *PeerPieceTracker
+	PA       *PieceAssembler
+	Id       string
+	Port     uint16
+
+	// Encryption is the protocol encryption policy for peer connections
+	Encryption mse.Policy
+
+	// Choker decides which peers we upload to. Defaults to TitForTat, and
+	// may be replaced before calling Start.
+	Choker ChokeStrategy
+
+	ChErr     chan error
+	chRechoke chan struct{} // Triggers an early choke round
+
+	chCompleted chan struct{} // Tells the announce loop the download finished
+
+	// A swarm can be paused and started again, so everything it needs while
+	// running is replaced by every call to Start.
+	session        *Session
+	running        bool
+	stopped        bool          // Set by Stop, the swarm can't start again
+	startEvent     tracker.Event // Sent by the announce loop when it starts
+	chDone         chan struct{} // Closed when the swarm pauses, to end every loop
+	chStopAnnounce chan struct{} // Closed to stop the announce loop
+	announceDone   chan struct{} // Closed once the announce loop has stopped
+	lmutex         sync.Mutex    // Guards the above and Conns
+
+	// Conns dials peers and limits how many we are connected to. A new one is
+	// made every time the swarm starts.
+	Conns *ConnManager
+
+	exts extRegistry // Extension protocol extensions (BEP_0010)
+	pex  *utPex      // Peer exchange (BEP_0011)
+
+	handlers map[*PeerHandler]struct{} // All running peer handlers
+	hmutex   sync.Mutex                // Guards handlers
+	pmutex   sync.Mutex                // Guards State and Peers
+	rmutex   sync.Mutex                // Serialises saving the resume file
 }
 
 // ============================================================================
 // FUNK =======================================================================
 
-func NewSwarm(opts *utils.Opts) (*Swarm, error) {
-	var err error
-
+// newSwarm makes the swarm of tor and checks its files in workingDir. For
+// magnet links tor is nil, and the torrent is fetched from the peers found
+// through input. The trackers only hear from us once the swarm
+// starts. Peers, listening and rate limits are shared through the session.
+// If ctx is done while the files are checked, newSwarm returns ctx's error.
+func newSwarm(ctx context.Context, session *Session, tor *torrent.Torrent, input string, workingDir string) (_ *Swarm, err error) {
 	swarm := Swarm{}
-	swarm.Id = utils.NewPeerId()
-	swarm.Port = opts.Port()
-
-	// Read torrent file
-	log.Printf("reading torrent file [%v]\n", opts.Input())
-	swarm.Tor, err = torrent.FromTorrentFile(opts.Input(), opts.WorkingDir())
-	if err != nil {
-		return nil, err
+	swarm.handlers = make(map[*PeerHandler]struct{})
+	swarm.Choker = NewTitForTat(DefaultUploadSlots)
+	swarm.chRechoke = make(chan struct{}, 1)
+	swarm.chCompleted = make(chan struct{}, 1)
+	swarm.session = session
+	swarm.Id = session.Id
+	swarm.Port = session.Port
+	swarm.Encryption = session.Encryption
+	swarm.DHT = session.DHT
+	swarm.LSD = session.LSD
+	swarm.UTP = session.UTP
+	swarm.RLIO = session.RLIO
+	swarm.Peers = make(peer.List, 0)
+
+	// Get the info dict from peers for magnet links
+	swarm.Tor = tor
+	if tor == nil {
+		log.Printf("fetching metadata for magnet link [%v]\n", input)
+		swarm.Tor, err = swarm.torrentFromMagnet(ctx, input, workingDir)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	torInfo := swarm.Tor.Info()
 
-	// Make the FileIO handler
-	swarm.Fileio = fileio.NewFileIO(torInfo)
+	// Make the storage, the torrent's files unless the session says otherwise
+	swarm.Storage = session.newStorage(swarm.Tor)
 
-	// OCAT files
-	log.Printf("openning and validating files")
-	e := swarm.Fileio.OCATAll(torInfo.Files())
+	// Files must be checked before they are opened, as opening them creates
+	// the missing ones. Any other storage is checked once it is open.
+	swarm.Bf = bf.NewBitfield(torInfo.NumPieces())
+	swarm.PA = NewPieceAssembler(torInfo)
+	resume := swarm.loadResume()
+	if resume == nil && swarm.onDisk() {
+		log.Printf("validating files")
+		e := swarm.Validate(ctx)
+		if e != nil {
+			return nil, e
+		}
+	}
+
+	log.Printf("openning storage")
+	e := swarm.Storage.Open()
 	if e != nil {
 		return nil, e
 	}
-
-	// Make bitfield
-	swarm.Bf = bf.NewBitfield(torInfo.NumPieces())
-	e = swarm.Validate()
+	defer func() {
+		if err != nil {
+			_ = swarm.Storage.Close()
+		}
+	}()
+
+	// Unfinished pieces are read back from the storage
+	if resume != nil {
+		log.Printf("using resume file, skipping validation")
+		e = swarm.restore(resume)
+	} else if !swarm.onDisk() {
+		log.Printf("validating storage")
+		e = swarm.Validate(ctx)
+	}
 	if e != nil {
 		return nil, e
 	}
@@ -72,105 +158,280 @@ func NewSwarm(opts *utils.Opts) (*Swarm, error) {
 	pcent := 100 * float64(_bf.Nset()) / float64(_bf.Nbits())
 	log.Printf("have %v/%v (%v%%) pieces", _bf.Nset(), _bf.Nbits(), pcent)
 
-	// TODO: Compute remaining bytes left
-	//swarm.Stats = tracker.NewStats(0, 0, swarm.Tor.Length())  // Full leech
-	swarm.Stats = tracker.NewStats(0, 0, 0) // Seed
-
-	// Make first contact with tracker
-	log.Printf("sending get to tracker [%v]\n", swarm.Tor.Announce())
-	resp, err := tracker.Get(swarm.Tor, swarm.Stats, swarm.Port, swarm.Id)
-	if err != nil {
-		return nil, err
+	if resume != nil {
+		swarm.Stats = tracker.NewStats(resume.downloaded, resume.uploaded, swarm.bytesLeft())
+		swarm.mergePeers(resume.peers)
+	} else {
+		swarm.Stats = tracker.NewStats(0, 0, swarm.bytesLeft())
 	}
 
-	swarm.State = resp.State
-	swarm.Peers = resp.Peers
-
-	swarm.RLIO = io.NewRateLimitIO()
-	swarm.RLIO.SetWriteRate(opts.UpLimit())
-	swarm.RLIO.SetReadRate(opts.DnLimit())
+	// The announce loop sends the started announce once the swarm starts,
+	// so that slow or dead trackers don't hold up adding the torrent
+	swarm.Trackers = tracker.FromTorrent(swarm.Tor)
+	swarm.startEvent = tracker.EventStarted
 
 	swarm.PPT = NewPeerPieceTracker(uint32(torInfo.NumPieces()), swarm.Bf)
 
+	_, e = swarm.RegisterExtension(newUtMetadata(&swarm))
+	if e != nil {
+		return nil, e
+	}
+	swarm.pex = newUtPex(&swarm)
+	_, e = swarm.RegisterExtension(swarm.pex)
+	if e != nil {
+		return nil, e
+	}
+
 	return &swarm, nil
 }
 
-func (s *Swarm) Validate() error {
+// Validate checks every piece and sets the bitfield from what it finds.
+// Files are read straight from disk, so they don't need to be open, and files
+// that don't exist yet only mean their pieces are missing. Any other storage
+// must be open.
+func (s *Swarm) Validate(ctx context.Context) error {
+	v := verify.Verifier{OnProgress: logProgress(s.Tor.Info().Name())}
+	if s.session != nil {
+		v.Workers = s.session.VerifyWorkers
+	}
 
-	torInfo := s.Tor.Info()
-	buf := make([]byte, torInfo.PieceLen(), torInfo.PieceLen())
+	var res *verify.Result
+	var e error
+	if s.onDisk() {
+		res, e = v.Verify(ctx, s.Tor.Info())
+	} else {
+		res, e = v.VerifyStorage(ctx, s.Tor.Info(), s.Storage)
+	}
+	if e != nil {
+		return e
+	}
 
-	var i int64
-	for i = 0; i < torInfo.NumPieces(); i++ {
+	for _, fpath := range res.Missing {
+		log.Printf("file [%v] does not exist, its pieces are missing", fpath)
+	}
+	for i := int64(0); i < s.Bf.Nbits(); i++ {
+		s.Bf.Set(i, res.Have.Get(i))
+	}
+	return nil
+}
 
-		n, e := s.Fileio.ReadPiece(i, buf)
-		if e != nil {
-			return e
+// onDisk returns true if the torrent is stored in its files.
+func (s *Swarm) onDisk() bool {
+	_, ok := s.Storage.(storage.Local)
+	return ok
+}
+
+// logProgress returns a progress callback that logs every 10% of the check.
+func logProgress(name string) func(verify.Progress) {
+	logged := int64(0)
+	return func(p verify.Progress) {
+		pcent := 100 * p.Checked / p.Total
+		if pcent/10 > logged/10 {
+			logged = pcent
+			log.Printf("checked %v%% of [%v], have %v/%v pieces", pcent, name, p.Have, p.Total)
 		}
+	}
+}
 
-		knownHash := torInfo.PieceHash(i)
-		gotHash := utils.SHA1(buf[:n])
-		eq := knownHash == gotHash
-		s.Bf.Set(i, eq)
+// bytesLeft computes the number of bytes we still need to download, based
+// on which pieces are missing from the bitfield.
+func (s *Swarm) bytesLeft() uint64 {
+	torInfo := s.Tor.Info()
+	left := uint64(0)
+	for i := int64(0); i < torInfo.NumPieces(); i++ {
+		if !s.Bf.Get(i) {
+			left += uint64(torInfo.PieceLenAt(i))
+		}
+	}
+	return left
+}
+
+// Start connects to peers and starts every loop of the swarm. A paused swarm
+// is started again the same way, but one that has been stopped can't be.
+func (s *Swarm) Start() error {
+	s.lmutex.Lock()
+	defer s.lmutex.Unlock()
+	if s.stopped {
+		return errSwarmStopped
+	}
+	if s.running {
+		return nil
+	}
+	s.running = true
+
+	s.chDone = make(chan struct{})
+	s.chStopAnnounce = make(chan struct{})
+	s.announceDone = make(chan struct{})
+	s.Conns = NewConnManager(s, s.session.Limiter, s.session.MaxPeers)
+
+	go s.chokeLoop(s.chDone)
+	go s.announceLoop(s.startEvent, s.chStopAnnounce, s.announceDone)
+	if s.DHT != nil {
+		go s.dhtLoop(s.chDone)
+	}
+	if s.pex != nil {
+		go s.pex.loop(s.chDone)
+	}
+	go s.resumeLoop(s.chDone)
+	if s.LSD != nil {
+		s.LSD.Add(s.Tor.Infohash())
 	}
 
+	// Connect to the peers we already know about
+	s.pmutex.Lock()
+	peers := make(peer.List, len(s.Peers))
+	copy(peers, s.Peers)
+	s.pmutex.Unlock()
+	s.Conns.Add(peers)
+	go s.Conns.loop()
+
 	return nil
 }
 
-func (s *Swarm) Start() {
+// Pause disconnects from every peer, saves the resume file and sends the
+// stopped announce, but keeps the storage open so that Start can carry on
+// where we left off. If ctx is done before the peers or trackers are, Pause
+// stops waiting for them and returns ctx's error.
+func (s *Swarm) Pause(ctx context.Context) error {
+	s.lmutex.Lock()
+	if !s.running {
+		s.lmutex.Unlock()
+		return nil
+	}
+	s.running = false
+	s.startEvent = tracker.EventStarted
+	chDone, conns := s.chDone, s.Conns
+	chStopAnnounce, announceDone := s.chStopAnnounce, s.announceDone
+	s.lmutex.Unlock()
+
+	var err error
+	close(chDone)
+	conns.Close()
+	if s.LSD != nil {
+		s.LSD.Remove(s.Tor.Infohash())
+	}
+
+	log.Printf("waiting for peers of %v to stop", s.Tor.Info().Name())
+	err = conns.wait(ctx)
+
+	// Blocks of unfinished pieces are only saved if no peer can still be
+	// adding to them
+	if e := s.saveResume(err == nil); e != nil {
+		log.Printf("failed to save resume file: %v", e)
+	}
+
+	close(chStopAnnounce)
+	select {
+	case <-announceDone:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	return err
+}
 
-	go s.runListener()
-	go s.RLIO.Run()
+// Stop pauses the swarm, then flushes and closes the storage. The swarm can't
+// be started again. Returns the first error, but always closes the storage.
+func (s *Swarm) Stop(ctx context.Context) error {
+	err := s.Pause(ctx)
+
+	s.lmutex.Lock()
+	stopped := s.stopped
+	s.stopped = true
+	s.lmutex.Unlock()
+	if stopped {
+		return err
+	}
 
-	// Start peer Goroutines
-	for _, p := range s.Peers {
-		go func(peer peer.Info) {
-			ph, e := FromBootstrap(peer, s)
-			if e != nil {
-				log.Printf("failed to bootstrap %v : %v", peer.Addr(), e)
-			} else {
-				ph.Loop()
-			}
-		}(p)
+	e := s.Storage.Close()
+	if err == nil {
+		err = e
 	}
+	return err
+}
+
+// Running returns true if the swarm is started and not paused.
+func (s *Swarm) Running() bool {
+	s.lmutex.Lock()
+	defer s.lmutex.Unlock()
+	return s.running
 }
 
-func (s *Swarm) runListener() {
-	opts := utils.GetOpts()
+// Stopped returns true once Stop has been called.
+func (s *Swarm) Stopped() bool {
+	s.lmutex.Lock()
+	defer s.lmutex.Unlock()
+	return s.stopped
+}
+
+// Pieces returns how many pieces we have, and how many the torrent has.
+func (s *Swarm) Pieces() (int64, int64) {
+	return s.Bf.Nset(), s.Bf.Nbits()
+}
+
+// accept hands a connection whose handshake has been read to the connection
+// manager, or drops it if the swarm isn't running.
+func (s *Swarm) accept(conn net.Conn, peerHs Handshake) {
+	s.lmutex.Lock()
+	conns := s.Conns
+	if !s.running {
+		conns = nil
+	}
+	s.lmutex.Unlock()
 
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%v", opts.Port()))
-	if err != nil {
-		panic(err)
+	if conns == nil {
+		log.Printf("%v is not running, dropping %v", s.Tor.Info().Name(), conn.RemoteAddr())
+		_ = conn.Close()
+		return
 	}
-	log.Printf("Listening on port %v\n", opts.Port())
+	conns.accept(conn, peerHs)
+}
 
-	phs := make([]*PeerHandler, 0, 4)
+// conns returns the current connection manager, or nil if the swarm has
+// never started.
+func (s *Swarm) conns() *ConnManager {
+	s.lmutex.Lock()
+	defer s.lmutex.Unlock()
+	return s.Conns
+}
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			panic(err)
-		}
-		log.Printf("new client @ %v", conn.RemoteAddr())
+// addHandler registers a running PeerHandler with the swarm.
+func (s *Swarm) addHandler(ph *PeerHandler) {
+	s.hmutex.Lock()
+	defer s.hmutex.Unlock()
+	s.handlers[ph] = struct{}{}
+}
 
-		go func(c net.Conn) {
-			ph, e := FromIncoming(c, s)
-			if e != nil {
-				log.Println(e)
-			} else {
-				phs = append(phs, ph)
-				ph.Loop()
-			}
-		}(conn)
+// removeHandler unregisters a PeerHandler once it has stopped.
+func (s *Swarm) removeHandler(ph *PeerHandler) {
+	s.hmutex.Lock()
+	defer s.hmutex.Unlock()
+	delete(s.handlers, ph)
+}
+
+// Handlers returns a snapshot of all running PeerHandlers.
+func (s *Swarm) Handlers() []*PeerHandler {
+	s.hmutex.Lock()
+	defer s.hmutex.Unlock()
+
+	phs := make([]*PeerHandler, 0, len(s.handlers))
+	for ph := range s.handlers {
+		phs = append(phs, ph)
 	}
+	return phs
 }
 
 func (s *Swarm) String() string {
 	strb := strings.Builder{}
 	strb.WriteString(s.Tor.String())
 	strb.WriteByte('\n')
-	strb.WriteString(s.State.String())
-	strb.WriteByte('\n')
+	s.pmutex.Lock()
+	if s.State != nil {
+		strb.WriteString(s.State.String())
+		strb.WriteByte('\n')
+	}
 	strb.WriteString(s.Peers.String())
+	s.pmutex.Unlock()
 	return strb.String()
 }
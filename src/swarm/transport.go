@@ -0,0 +1,48 @@
+package swarm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// utpDialTimeout is how long a uTP connection attempt may take before we
+// fall back to TCP. Peers without uTP never answer, so this is kept short.
+// This is a variable so that tests can shorten it.
+var utpDialTimeout = 3 * time.Second
+
+// tcpDialTimeout is how long a TCP connection attempt may take, so that
+// peers that never answer don't hold a dial slot for the OS's timeout.
+var tcpDialTimeout = 10 * time.Second
+
+// dial connects to the peer over uTP if we can, and TCP otherwise. Gives up
+// once ctx is done.
+func dial(ctx context.Context, addr string, swarm *Swarm) (net.Conn, error) {
+	if swarm.UTP != nil {
+		uctx, cancel := context.WithTimeout(ctx, utpDialTimeout)
+		conn, e := swarm.UTP.DialContext(uctx, addr)
+		cancel()
+		if e == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		log.Printf("no utp connection to %v, trying tcp: %v", addr, e)
+	}
+	dialer := net.Dialer{Timeout: tcpDialTimeout}
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// remoteAddr returns the address of a TCP or uTP connection's peer.
+func remoteAddr(conn net.Conn) (net.IP, uint16, error) {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP, uint16(addr.Port), nil
+	case *net.UDPAddr:
+		return addr.IP, uint16(addr.Port), nil
+	}
+	return nil, 0, fmt.Errorf("connection from %v is not TCP or uTP", conn.RemoteAddr())
+}
@@ -0,0 +1,72 @@
+package swarm
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"gotor/utils/test"
+	"gotor/utp"
+)
+
+func TestDial(t *testing.T) {
+	utpDialTimeout = 200 * time.Millisecond
+
+	s, e := utp.Listen("udp4", "127.0.0.1:0")
+	test.CheckFatal(t, e)
+	defer s.Close()
+	swarm := &Swarm{UTP: s}
+
+	// A peer with both gets uTP
+	peerUtp, e := utp.Listen("udp4", "127.0.0.1:0")
+	test.CheckFatal(t, e)
+	defer peerUtp.Close()
+	addr := peerUtp.Addr().String()
+	peerTcp, e := net.Listen("tcp4", addr)
+	test.CheckFatal(t, e)
+	defer peerTcp.Close()
+
+	for _, l := range []net.Listener{peerUtp, peerTcp} {
+		go func(l net.Listener) {
+			for {
+				c, e := l.Accept()
+				if e != nil {
+					return
+				}
+				c.Close()
+			}
+		}(l)
+	}
+
+	conn, e := dial(context.Background(), addr, swarm)
+	test.CheckFatal(t, e)
+	if _, ok := conn.RemoteAddr().(*net.UDPAddr); !ok {
+		t.Errorf("expected uTP connection, got %v", conn.RemoteAddr())
+	}
+	conn.Close()
+
+	// Without uTP on the other end, TCP is used
+	peerUtp.Close()
+	conn, e = dial(context.Background(), addr, swarm)
+	test.CheckFatal(t, e)
+	if _, ok := conn.RemoteAddr().(*net.TCPAddr); !ok {
+		t.Errorf("expected TCP connection, got %v", conn.RemoteAddr())
+	}
+	conn.Close()
+}
+
+func TestRemoteAddr(t *testing.T) {
+	ip, port, e := remoteAddr(&utpAddrConn{})
+	test.CheckFatal(t, e)
+	if !ip.Equal(net.IPv4(10, 0, 0, 1)) || port != 6881 {
+		t.Errorf("got %v:%v", ip, port)
+	}
+}
+
+// utpAddrConn is a net.Conn that only has a UDP remote address.
+type utpAddrConn struct{ net.Conn }
+
+func (c *utpAddrConn) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+}
@@ -0,0 +1,58 @@
+package swarm
+
+import (
+	"log"
+
+	"gotor/metadata"
+	"gotor/p2p"
+)
+
+// utMetadata serves the torrent's info dictionary to peers that ask for it
+// (BEP_0009), so that they can join from a magnet link. Fetching metadata for
+// our own magnet links happens before the swarm exists, see FetchMetadata.
+type utMetadata struct {
+	swarm *Swarm
+}
+
+func newUtMetadata(swarm *Swarm) *utMetadata {
+	return &utMetadata{swarm: swarm}
+}
+
+func (um *utMetadata) Name() string {
+	return metadata.ExtName
+}
+
+func (um *utMetadata) FillHandshake(hs *p2p.ExtHandshake) {
+	hs.MetadataSize = int64(len(um.swarm.Tor.InfoBytes()))
+}
+
+func (um *utMetadata) PeerHandshake(ph *PeerHandler, hs *p2p.ExtHandshake) error {
+	return nil
+}
+
+// Handle answers metadata requests. We already have the metadata, so data
+// and reject messages are ignored.
+func (um *utMetadata) Handle(ph *PeerHandler, payload []byte) error {
+	mm, e := metadata.DecodeMsg(payload)
+	if e != nil {
+		return e
+	}
+	if mm.Type != metadata.TypeRequest {
+		return nil
+	}
+
+	info := um.swarm.Tor.InfoBytes()
+	var reply *metadata.Msg
+	if data, ok := metadata.PieceData(info, mm.Piece); ok {
+		reply = metadata.NewData(mm.Piece, int64(len(info)), data)
+	} else {
+		log.Printf("rejecting metadata piece %v for %v", mm.Piece, ph.peerInfo.Addr())
+		reply = metadata.NewReject(mm.Piece)
+	}
+
+	enc, e := reply.Encode()
+	if e != nil {
+		return e
+	}
+	return ph.sendExtended(metadata.ExtName, enc)
+}
@@ -0,0 +1,197 @@
+package swarm
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"gotor/p2p"
+	"gotor/peer"
+	"gotor/pex"
+)
+
+// pexMinRecvInterval is how often a peer may send us ut_pex messages. Peers
+// should wait pex.Interval between messages, this leaves some slack for
+// timers that fire early. Messages that come faster are ignored.
+const pexMinRecvInterval = pex.Interval - 10*time.Second
+
+// utPex exchanges peers with every connected peer that supports ut_pex
+// (BEP_0011). Peers we hear about are added to the swarm's peer list and
+// connected to.
+type utPex struct {
+	swarm *Swarm
+	peers map[*PeerHandler]*pexPeer
+	mutex sync.Mutex // Guards peers
+}
+
+// pexPeer is our ut_pex state for a single connected peer.
+type pexPeer struct {
+	sender   *pex.Sender
+	lastRecv time.Time
+}
+
+func newUtPex(swarm *Swarm) *utPex {
+	return &utPex{
+		swarm: swarm,
+		peers: make(map[*PeerHandler]*pexPeer),
+	}
+}
+
+func (up *utPex) Name() string {
+	return pex.ExtName
+}
+
+func (up *utPex) FillHandshake(hs *p2p.ExtHandshake) {}
+
+func (up *utPex) PeerHandshake(ph *PeerHandler, hs *p2p.ExtHandshake) error {
+	up.get(ph)
+	return nil
+}
+
+// Handle adds the peers in a ut_pex message to the swarm. Dropped peers are
+// kept, as they may just have disconnected from the sender.
+func (up *utPex) Handle(ph *PeerHandler, payload []byte) error {
+	pp := up.get(ph)
+	up.mutex.Lock()
+	if !pp.lastRecv.IsZero() && time.Since(pp.lastRecv) < pexMinRecvInterval {
+		up.mutex.Unlock()
+		log.Printf("ignoring early pex message from %v", ph.peerInfo.Addr())
+		return nil
+	}
+	pp.lastRecv = time.Now()
+	up.mutex.Unlock()
+
+	m, e := pex.DecodeMsg(payload)
+	if e != nil {
+		return e
+	}
+
+	added := m.Added
+	if len(added) > pex.MaxPeers {
+		added = added[:pex.MaxPeers]
+	}
+
+	newPeers := up.swarm.addPeers(added)
+	if len(newPeers) > 0 {
+		log.Printf("got %v new peers from pex with %v", len(newPeers), ph.peerInfo.Addr())
+	}
+	return nil
+}
+
+// get returns the state for the peer, creating it if needed.
+func (up *utPex) get(ph *PeerHandler) *pexPeer {
+	up.mutex.Lock()
+	defer up.mutex.Unlock()
+
+	pp, ok := up.peers[ph]
+	if !ok {
+		pp = &pexPeer{sender: pex.NewSender()}
+		up.peers[ph] = pp
+	}
+	return pp
+}
+
+// loop sends every ut_pex peer the changes to our peer list once per
+// pex.Interval, until chDone is closed.
+func (up *utPex) loop(chDone <-chan struct{}) {
+	ticker := time.NewTicker(pex.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			up.sendAll()
+		case <-chDone:
+			return
+		}
+	}
+}
+
+// sendAll sends a ut_pex message to every peer that supports it, and
+// forgets about peers that have disconnected.
+func (up *utPex) sendAll() {
+	handlers := up.swarm.Handlers()
+
+	running := make(map[*PeerHandler]struct{}, len(handlers))
+	for _, ph := range handlers {
+		running[ph] = struct{}{}
+	}
+	up.mutex.Lock()
+	for ph := range up.peers {
+		if _, ok := running[ph]; !ok {
+			delete(up.peers, ph)
+		}
+	}
+	up.mutex.Unlock()
+
+	// Every peer we could tell others about
+	all := make(peer.List, 0, len(handlers))
+	allFlags := make([]byte, 0, len(handlers))
+	owners := make([]*PeerHandler, 0, len(handlers))
+	for _, ph := range handlers {
+		p, flags, ok := ph.pexInfo()
+		if ok {
+			all = append(all, p)
+			allFlags = append(allFlags, flags)
+			owners = append(owners, ph)
+		}
+	}
+
+	for _, ph := range handlers {
+		if !ph.SupportsExtension(pex.ExtName) {
+			continue
+		}
+
+		// Never tell a peer about itself
+		current := make(peer.List, 0, len(all))
+		flags := make([]byte, 0, len(all))
+		for i := range all {
+			if owners[i] != ph {
+				current = append(current, all[i])
+				flags = append(flags, allFlags[i])
+			}
+		}
+
+		pp := up.get(ph)
+		up.mutex.Lock()
+		m := pp.sender.Next(current, flags)
+		up.mutex.Unlock()
+		if m == nil {
+			continue
+		}
+
+		payload, e := m.Encode()
+		if e != nil {
+			log.Printf("failed to encode pex message: %v", e)
+			continue
+		}
+		e = ph.sendExtended(pex.ExtName, payload)
+		if e != nil {
+			log.Printf("failed to send pex message to %v: %v", ph.peerInfo.Addr(), e)
+		}
+	}
+}
+
+// pexInfo returns the address other peers can reach the peer on, and its
+// ut_pex flags. Returns false if we don't know where the peer listens, i.e.
+// it connected to us and didn't give its port in the extended handshake.
+func (ph *PeerHandler) pexInfo() (peer.Info, byte, bool) {
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+
+	flags := byte(0)
+	if ph.bf.Complete() {
+		flags |= pex.FlagSeed
+	}
+	if !ph.incoming {
+		flags |= pex.FlagReachable
+	}
+
+	p := ph.peerInfo
+	if ph.extHs != nil && ph.extHs.P != 0 {
+		p = peer.MakePeer(p.Id(), p.Ip(), ph.extHs.P)
+	} else if ph.incoming {
+		return peer.Info{}, 0, false
+	}
+	return p, flags, true
+}
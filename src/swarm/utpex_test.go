@@ -0,0 +1,99 @@
+package swarm
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"gotor/bf"
+	"gotor/p2p"
+	"gotor/peer"
+	"gotor/pex"
+	"gotor/utils/test"
+)
+
+func TestUtPex_Handle(t *testing.T) {
+	s := Swarm{}
+	up := newUtPex(&s)
+	ph := &PeerHandler{peerInfo: peer.MakePeer("", net.IPv4(10, 0, 0, 1), 6881)}
+
+	// Nothing listens on these, so connecting fails straight away
+	m := pex.Msg{
+		Added: peer.List{
+			peer.MakePeer("", net.IPv4(127, 0, 0, 1), 1),
+			peer.MakePeer("", net.IPv4(127, 0, 0, 1), 2),
+		},
+		Flags: []byte{0, pex.FlagSeed},
+	}
+	payload, e := m.Encode()
+	test.CheckFatal(t, e)
+
+	test.CheckFatal(t, up.Handle(ph, payload))
+	if len(s.Peers) != 2 {
+		t.Fatalf("swarm has %v peers, want 2", len(s.Peers))
+	}
+
+	// Too soon, ignored
+	m.Added = peer.List{peer.MakePeer("", net.IPv4(127, 0, 0, 1), 3)}
+	m.Flags = []byte{0}
+	payload, e = m.Encode()
+	test.CheckFatal(t, e)
+	test.CheckFatal(t, up.Handle(ph, payload))
+	if len(s.Peers) != 2 {
+		t.Fatalf("early message added peers, swarm has %v", len(s.Peers))
+	}
+
+	up.get(ph).lastRecv = time.Now().Add(-pex.Interval)
+	test.CheckFatal(t, up.Handle(ph, payload))
+	if len(s.Peers) != 3 {
+		t.Fatalf("swarm has %v peers, want 3", len(s.Peers))
+	}
+
+	up.get(ph).lastRecv = time.Time{}
+	if e = up.Handle(ph, []byte("junk")); e == nil {
+		t.Error("expected error for a bad message")
+	}
+}
+
+func TestPeerHandler_pexInfo(t *testing.T) {
+	ip := net.IPv4(10, 0, 0, 1)
+	tests := []struct {
+		name     string
+		incoming bool
+		p        uint16
+		seed     bool
+		addr     string
+		flags    byte
+		ok       bool
+	}{
+		{name: "Outgoing", addr: "10.0.0.1:40000", flags: pex.FlagReachable, ok: true},
+		{name: "Outgoing seed", seed: true, addr: "10.0.0.1:40000", flags: pex.FlagReachable | pex.FlagSeed, ok: true},
+		{name: "Incoming with port", incoming: true, p: 6881, addr: "10.0.0.1:6881", ok: true},
+		{name: "Incoming without port", incoming: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ph := &PeerHandler{
+				peerInfo: peer.MakePeer("", ip, 40000),
+				incoming: tt.incoming,
+				bf:       bf.NewBitfield(3),
+			}
+			if tt.seed {
+				for i := int64(0); i < 3; i++ {
+					ph.bf.Set(i, true)
+				}
+			}
+			if tt.p != 0 {
+				ph.extHs = &p2p.ExtHandshake{P: tt.p}
+			}
+
+			p, flags, ok := ph.pexInfo()
+			if ok != tt.ok {
+				t.Fatalf("got ok %v, want %v", ok, tt.ok)
+			}
+			if ok && (p.Addr() != tt.addr || flags != tt.flags) {
+				t.Errorf("got (%v, %v), want (%v, %v)", p.Addr(), flags, tt.addr, tt.flags)
+			}
+		})
+	}
+}
@@ -1,7 +1,6 @@
 package fileio
 
 import (
-	"errors"
 	"fmt"
 	"os"
 	"sync"
@@ -22,6 +21,20 @@ func (pe *PathError) Error() string {
 	return fmt.Sprintf("path [%v] does not exist", pe.fpath)
 }
 
+// HashError is returned by WritePiece when the data does not match the
+// piece's known hash.
+type HashError struct {
+	index int64
+}
+
+func (he *HashError) Error() string {
+	return fmt.Sprintf("invalid hash for piece %v, refusing write", he.index)
+}
+
+func (he *HashError) Index() int64 {
+	return he.index
+}
+
 // ============================================================================
 // STRUCTS ====================================================================
 
@@ -100,6 +113,7 @@ func (fio *FileIO) Close(fpath string) error {
 	}
 }
 
+// CloseAll flushes every file to disk and closes it.
 func (fio *FileIO) CloseAll() error {
 	var e error
 
@@ -107,7 +121,10 @@ func (fio *FileIO) CloseAll() error {
 		func() {
 			lfp.lock.Lock()
 			defer lfp.lock.Unlock()
-			e = lfp.fp.Close()
+			e = lfp.fp.Sync()
+			if ce := lfp.fp.Close(); e == nil {
+				e = ce
+			}
 		}()
 
 		if e != nil {
@@ -149,17 +166,7 @@ func (fio *FileIO) ReadPiece(index int64, buf []byte) (int64, error) {
 		return 0, e
 	}
 
-	offset := int64(0)
-	for _, ploc := range plocs {
-		subbuf := buf[offset : offset+ploc.Loc.ReadAmnt]
-		n, e := fio.read(ploc.Entry.LocalPath(), ploc.Loc.SeekAmnt, subbuf)
-		if e != nil {
-			return 0, e
-		}
-		offset += n
-	}
-
-	return offset, nil
+	return fio.readPiece(plocs, buf)
 }
 
 func (fio *FileIO) WritePiece(index int64, data []byte) (int64, error) {
@@ -172,9 +179,97 @@ func (fio *FileIO) WritePiece(index int64, data []byte) (int64, error) {
 	knownHash := fio.torInfo.PieceHash(index)
 
 	if utils.SHA1(data) != knownHash {
-		return 0, errors.New("invalid hash, refusing write")
+		return 0, &HashError{index: index}
+	}
+
+	return fio.writePiece(plocs, data)
+}
+
+// ReadAt reads len(buf) bytes of the piece, starting begin bytes into it.
+func (fio *FileIO) ReadAt(index int64, begin int64, buf []byte) (int64, error) {
+	plocs, e := fio.blockLocs(index, begin, int64(len(buf)))
+	if e != nil {
+		return 0, e
+	}
+	return fio.readPiece(plocs, buf)
+}
+
+// WriteAt writes data into the piece, starting begin bytes into it, without
+// verifying anything.
+func (fio *FileIO) WriteAt(index int64, begin int64, data []byte) (int64, error) {
+	plocs, e := fio.blockLocs(index, begin, int64(len(data)))
+	if e != nil {
+		return 0, e
+	}
+	return fio.writePiece(plocs, data)
+}
+
+// Sync flushes every file to disk.
+func (fio *FileIO) Sync() error {
+	for _, lfp := range fio.lfps {
+		lfp.lock.Lock()
+		e := lfp.fp.Sync()
+		lfp.lock.Unlock()
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// blockLocs returns where n bytes of the piece, starting begin bytes into
+// it, are in the files.
+func (fio *FileIO) blockLocs(index int64, begin int64, n int64) ([]info.PieceLocation, error) {
+	plocs, e := fio.torInfo.PieceLookup(index)
+	if e != nil {
+		return nil, e
 	}
+	if begin < 0 || n < 0 || begin+n > fio.torInfo.PieceLenAt(index) {
+		return nil, fmt.Errorf("block [%v, %v) is outside of piece %v", begin, begin+n, index)
+	}
+
+	blocs := make([]info.PieceLocation, 0, len(plocs))
+	for _, ploc := range plocs {
+		if n == 0 {
+			break
+		}
+
+		// Skip the files before the block
+		if begin >= ploc.Loc.ReadAmnt {
+			begin -= ploc.Loc.ReadAmnt
+			continue
+		}
+
+		amnt := ploc.Loc.ReadAmnt - begin
+		if amnt > n {
+			amnt = n
+		}
+		blocs = append(blocs, info.PieceLocation{
+			Entry: ploc.Entry,
+			Loc:   filesd.PieceInfo{SeekAmnt: ploc.Loc.SeekAmnt + begin, ReadAmnt: amnt},
+		})
+		begin = 0
+		n -= amnt
+	}
+
+	return blocs, nil
+}
+
+func (fio *FileIO) readPiece(plocs []info.PieceLocation, buf []byte) (int64, error) {
+	offset := int64(0)
+	for _, ploc := range plocs {
+		subbuf := buf[offset : offset+ploc.Loc.ReadAmnt]
+		n, e := fio.read(ploc.Entry.LocalPath(), ploc.Loc.SeekAmnt, subbuf)
+		if e != nil {
+			return 0, e
+		}
+		offset += n
+	}
+
+	return offset, nil
+}
 
+func (fio *FileIO) writePiece(plocs []info.PieceLocation, data []byte) (int64, error) {
 	offset := int64(0)
 	for _, ploc := range plocs {
 		subbuf := data[offset : offset+ploc.Loc.ReadAmnt]
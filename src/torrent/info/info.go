@@ -254,6 +254,15 @@ func (ti *TorInfo) PieceHash(idx int64) string {
 	return ti.hashes[offset : offset+20]
 }
 
+// PieceLenAt returns the length of the piece at the given index, which will
+// be PieceLen for all but (possibly) the last piece.
+func (ti *TorInfo) PieceLenAt(idx int64) int64 {
+	if idx == ti.numPieces-1 {
+		return ti.lastPieceLen
+	}
+	return ti.pieceLen
+}
+
 func (ti *TorInfo) Bencode() bencode.Dict {
 	d := make(bencode.Dict)
 
@@ -0,0 +1,98 @@
+/* magnet.go ==================================================================
+Magnet links (BEP_0009). Only the infohash is required, everything else is a
+hint: "dn" is a display name, "tr" are trackers and "x.pe" are peers to ask
+for the metadata.
+============================================================================ */
+
+package torrent
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const magnetBtihPrefix = "urn:btih:"
+
+// ============================================================================
+// STRUCTS ====================================================================
+
+type Magnet struct {
+	Infohash string   // Raw 20 byte infohash
+	Name     string   // Display name, may be empty
+	Trackers []string // Tracker URLs
+	Peers    []string // Peer addresses as host:port
+}
+
+// ============================================================================
+// FUNK =======================================================================
+
+// IsMagnet returns true if the string looks like a magnet link.
+func IsMagnet(s string) bool {
+	return strings.HasPrefix(s, "magnet:")
+}
+
+// ParseMagnet parses a magnet link. The infohash may be given either as 40
+// hex characters or 32 base32 characters.
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, e := url.Parse(uri)
+	if e != nil {
+		return nil, e
+	}
+	if u.Scheme != "magnet" {
+		return nil, &TorError{msg: fmt.Sprintf("not a magnet link [%v]", uri)}
+	}
+
+	query := u.Query()
+	mag := Magnet{
+		Name:     query.Get("dn"),
+		Trackers: query["tr"],
+		Peers:    query["x.pe"],
+	}
+
+	for _, xt := range query["xt"] {
+		if !strings.HasPrefix(xt, magnetBtihPrefix) {
+			continue
+		}
+		mag.Infohash, e = decodeBtih(strings.TrimPrefix(xt, magnetBtihPrefix))
+		if e != nil {
+			return nil, e
+		}
+		break
+	}
+	if mag.Infohash == "" {
+		return nil, &TorError{msg: "magnet link has no btih infohash"}
+	}
+
+	return &mag, nil
+}
+
+// AnnounceList returns the magnet's trackers as tiers, one tracker per tier.
+func (mag *Magnet) AnnounceList() [][]string {
+	tiers := make([][]string, 0, len(mag.Trackers))
+	for _, tr := range mag.Trackers {
+		tiers = append(tiers, []string{tr})
+	}
+	return tiers
+}
+
+func decodeBtih(s string) (string, error) {
+	var raw []byte
+	var e error
+
+	switch len(s) {
+	case 40:
+		raw, e = hex.DecodeString(s)
+	case 32:
+		raw, e = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return "", &TorError{msg: fmt.Sprintf("bad btih infohash [%v]", s)}
+	}
+	if e != nil {
+		return "", &TorError{msg: fmt.Sprintf("bad btih infohash [%v]: %v", s, e)}
+	}
+
+	return string(raw), nil
+}
@@ -0,0 +1,69 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestParseMagnet(t *testing.T) {
+	hexHash := "a976fdd2ccce699eab604115408ead8560c2d095"
+	rawHash, _ := hex.DecodeString(hexHash)
+
+	tests := []struct {
+		name    string
+		uri     string
+		want    Magnet
+		wantErr bool
+	}{
+		{
+			name: "hex",
+			uri:  "magnet:?xt=urn:btih:" + hexHash + "&dn=multifile&tr=http%3A%2F%2Ftracker%2Fannounce&tr=udp%3A%2F%2Ftracker%3A80&x.pe=10.0.0.1%3A6881",
+			want: Magnet{
+				Infohash: string(rawHash),
+				Name:     "multifile",
+				Trackers: []string{"http://tracker/announce", "udp://tracker:80"},
+				Peers:    []string{"10.0.0.1:6881"},
+			},
+		},
+		{
+			name: "base32",
+			uri:  "magnet:?xt=urn:btih:VF3P3UWMZZUZ5K3AIEKUBDVNQVQMFUEV",
+			want: Magnet{Infohash: string(rawHash)},
+		},
+		{
+			name: "uppercase hex",
+			uri:  "magnet:?xt=urn:btih:A976FDD2CCCE699EAB604115408EAD8560C2D095",
+			want: Magnet{Infohash: string(rawHash)},
+		},
+		{
+			name:    "no infohash",
+			uri:     "magnet:?dn=nothing",
+			wantErr: true,
+		},
+		{
+			name:    "bad infohash",
+			uri:     "magnet:?xt=urn:btih:abc",
+			wantErr: true,
+		},
+		{
+			name:    "not magnet",
+			uri:     "http://example.com/?xt=urn:btih:" + hexHash,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMagnet(tt.uri)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", *got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"gotor/torrent/info"
+	"gotor/utils"
+)
+
+// Blob stores the whole torrent in a single file, pieces one after the
+// other.
+type Blob struct {
+	torInfo *info.TorInfo
+	path    string
+	fp      *os.File
+	mutex   sync.RWMutex // Guards fp
+}
+
+// NewBlob returns the storage of the torrent in the file at path.
+func NewBlob(torInfo *info.TorInfo, path string) *Blob {
+	return &Blob{torInfo: torInfo, path: path}
+}
+
+// BlobFactory returns a Factory storing every torrent in dir, in a file
+// named after its infohash.
+func BlobFactory(dir string) Factory {
+	return func(infohash string, torInfo *info.TorInfo) Storage {
+		name := hex.EncodeToString([]byte(infohash)) + ".blob"
+		return NewBlob(torInfo, filepath.Join(dir, name))
+	}
+}
+
+// Open creates the file if it is missing, and sets it to the torrent's size.
+// A file that is already open is closed first.
+func (b *Blob) Open() error {
+	fp, e := utils.OCAT(b.path, b.torInfo.Length())
+	if e != nil {
+		return e
+	}
+
+	b.mutex.Lock()
+	old := b.fp
+	b.fp = fp
+	b.mutex.Unlock()
+
+	if old != nil {
+		_ = old.Close()
+	}
+	return nil
+}
+
+func (b *Blob) ReadAt(index int64, begin int64, buf []byte) error {
+	off, e := offset(b.torInfo, index, begin, len(buf))
+	if e != nil {
+		return e
+	}
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if b.fp == nil {
+		return errNotOpen
+	}
+	_, e = b.fp.ReadAt(buf, off)
+	return e
+}
+
+func (b *Blob) WriteAt(index int64, begin int64, data []byte) error {
+	off, e := offset(b.torInfo, index, begin, len(data))
+	if e != nil {
+		return e
+	}
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if b.fp == nil {
+		return errNotOpen
+	}
+	_, e = b.fp.WriteAt(data, off)
+	return e
+}
+
+// MarkComplete does nothing, the piece is already in place.
+func (b *Blob) MarkComplete(index int64) error {
+	return nil
+}
+
+func (b *Blob) Flush() error {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if b.fp == nil {
+		return errNotOpen
+	}
+	return b.fp.Sync()
+}
+
+func (b *Blob) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.fp == nil {
+		return errNotOpen
+	}
+
+	e := b.fp.Sync()
+	if ce := b.fp.Close(); e == nil {
+		e = ce
+	}
+	b.fp = nil
+	return e
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"sync"
+
+	"gotor/torrent/fileio"
+	"gotor/torrent/filesd"
+	"gotor/torrent/info"
+)
+
+// Files stores the torrent in its files, at their local paths.
+type Files struct {
+	torInfo *info.TorInfo
+	fio     *fileio.FileIO
+	mutex   sync.RWMutex // Guards fio
+}
+
+// NewFiles returns the storage of the torrent in its files.
+func NewFiles(torInfo *info.TorInfo) *Files {
+	return &Files{torInfo: torInfo}
+}
+
+// LocalFiles returns the torrent's files.
+func (fs *Files) LocalFiles() filesd.FileList {
+	return fs.torInfo.Files()
+}
+
+// Open creates any missing file, and sets every file to its size. Files that
+// are already open are closed first.
+func (fs *Files) Open() error {
+	fio := fileio.NewFileIO(fs.torInfo)
+	e := fio.OCATAll(fs.torInfo.Files())
+	if e != nil {
+		_ = fio.CloseAll()
+		return e
+	}
+
+	fs.mutex.Lock()
+	old := fs.fio
+	fs.fio = fio
+	fs.mutex.Unlock()
+
+	if old != nil {
+		_ = old.CloseAll()
+	}
+	return nil
+}
+
+func (fs *Files) ReadAt(index int64, begin int64, buf []byte) error {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	if fs.fio == nil {
+		return errNotOpen
+	}
+	_, e := fs.fio.ReadAt(index, begin, buf)
+	return e
+}
+
+func (fs *Files) WriteAt(index int64, begin int64, data []byte) error {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	if fs.fio == nil {
+		return errNotOpen
+	}
+	_, e := fs.fio.WriteAt(index, begin, data)
+	return e
+}
+
+// MarkComplete does nothing, the piece is already in place.
+func (fs *Files) MarkComplete(index int64) error {
+	return nil
+}
+
+func (fs *Files) Flush() error {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	if fs.fio == nil {
+		return errNotOpen
+	}
+	return fs.fio.Sync()
+}
+
+func (fs *Files) Close() error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if fs.fio == nil {
+		return errNotOpen
+	}
+
+	e := fs.fio.CloseAll()
+	fs.fio = nil
+	return e
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"sync"
+
+	"gotor/bf"
+	"gotor/torrent/info"
+)
+
+// Memory stores the torrent in memory. Data is lost once the Memory is
+// dropped, which makes it handy for tests.
+type Memory struct {
+	torInfo  *info.TorInfo
+	data     []byte
+	complete *bf.Bitfield // Pieces marked complete
+	mutex    sync.RWMutex // Guards data and complete
+}
+
+// NewMemory returns an empty in-memory storage of the torrent.
+func NewMemory(torInfo *info.TorInfo) *Memory {
+	return &Memory{torInfo: torInfo}
+}
+
+// MemoryFactory is a Factory keeping every torrent in memory.
+func MemoryFactory(infohash string, torInfo *info.TorInfo) Storage {
+	return NewMemory(torInfo)
+}
+
+// Open allocates the memory the first time it is called.
+func (m *Memory) Open() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.data == nil {
+		m.data = make([]byte, m.torInfo.Length())
+		m.complete = bf.NewBitfield(m.torInfo.NumPieces())
+	}
+	return nil
+}
+
+func (m *Memory) ReadAt(index int64, begin int64, buf []byte) error {
+	off, e := offset(m.torInfo, index, begin, len(buf))
+	if e != nil {
+		return e
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if m.data == nil {
+		return errNotOpen
+	}
+	copy(buf, m.data[off:])
+	return nil
+}
+
+func (m *Memory) WriteAt(index int64, begin int64, data []byte) error {
+	off, e := offset(m.torInfo, index, begin, len(data))
+	if e != nil {
+		return e
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.data == nil {
+		return errNotOpen
+	}
+	copy(m.data[off:], data)
+	return nil
+}
+
+func (m *Memory) MarkComplete(index int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.complete == nil {
+		return errNotOpen
+	}
+	m.complete.Set(index, true)
+	return nil
+}
+
+// Complete returns true if the piece was marked complete.
+func (m *Memory) Complete(index int64) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.complete != nil && m.complete.Get(index)
+}
+
+func (m *Memory) Flush() error {
+	return nil
+}
+
+// Close keeps the data, so the storage can be opened again.
+func (m *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,78 @@
+/* storage.go ==================================================================
+Where the data of a torrent is kept. A swarm only reads and writes blocks of
+pieces through Storage, so the data can live anywhere:
+
+	Files   The torrent's files in the working directory, as other clients
+	        lay them out
+	Blob    The whole torrent in a single file
+	Memory  A byte slice, for tests
+
+Storage never verifies anything: pieces are checked against their hash before
+they are written, and MarkComplete is called once a whole piece is written.
+Blocks of unfinished pieces may be written too, to keep them across restarts.
+============================================================================ */
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"gotor/torrent/filesd"
+	"gotor/torrent/info"
+)
+
+// errNotOpen is returned when using a storage before Open.
+var errNotOpen = errors.New("storage is not open")
+
+// ============================================================================
+// INTERFACES =================================================================
+
+// Storage holds the data of one torrent. Every method must be safe to call
+// from many goroutines at once.
+type Storage interface {
+	// Open prepares the storage before any read or write. Data already
+	// stored is kept.
+	Open() error
+
+	// ReadAt fills buf with the piece's data, starting begin bytes into the
+	// piece. Returns io.EOF or io.ErrUnexpectedEOF if the data isn't there.
+	ReadAt(index int64, begin int64, buf []byte) error
+
+	// WriteAt writes data into the piece, starting begin bytes into it.
+	WriteAt(index int64, begin int64, data []byte) error
+
+	// MarkComplete is called once the whole piece is written and verified.
+	MarkComplete(index int64) error
+
+	// Flush makes sure everything written so far is stored.
+	Flush() error
+
+	// Close flushes and releases the storage. It may be opened again.
+	Close() error
+}
+
+// Local is implemented by storages that keep the torrent in its files, at
+// their local paths. The files can be checked before the storage is opened.
+type Local interface {
+	LocalFiles() filesd.FileList
+}
+
+// Factory makes the storage of the torrent with the given infohash.
+type Factory func(infohash string, torInfo *info.TorInfo) Storage
+
+// ============================================================================
+// FUNK =======================================================================
+
+// offset returns where n bytes of the piece, starting begin bytes into it,
+// are in the torrent, when the torrent is stored as one stream of bytes.
+func offset(torInfo *info.TorInfo, index int64, begin int64, n int) (int64, error) {
+	if index < 0 || index >= torInfo.NumPieces() {
+		return 0, fmt.Errorf("piece %v is out of bounds", index)
+	}
+	end := begin + int64(n)
+	if begin < 0 || end > torInfo.PieceLenAt(index) {
+		return 0, fmt.Errorf("block [%v, %v) is outside of piece %v", begin, end, index)
+	}
+	return index*torInfo.PieceLen() + begin, nil
+}
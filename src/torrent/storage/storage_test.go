@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotor/torrent/filesd"
+	"gotor/torrent/info"
+	"gotor/utils"
+	"gotor/utils/test"
+)
+
+func TestStorage(t *testing.T) {
+	names := []string{"f1", "f2", "f3"}
+	data := [][]byte{
+		[]byte("abcde"),
+		[]byte("fgh"),
+		[]byte("ijklmnopq"),
+	}
+	all := bytes.Join(data, nil)
+	pieces := utils.SegmentData(all, 4)
+
+	tests := []struct {
+		name string
+		make func(dir string, torInfo *info.TorInfo) Storage
+	}{
+		{
+			name: "files",
+			make: func(dir string, torInfo *info.TorInfo) Storage { return NewFiles(torInfo) },
+		},
+		{
+			name: "blob",
+			make: func(dir string, torInfo *info.TorInfo) Storage {
+				return BlobFactory(dir)("infohash", torInfo)
+			},
+		},
+		{
+			name: "memory",
+			make: func(dir string, torInfo *info.TorInfo) Storage { return MemoryFactory("infohash", torInfo) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			files := make([]filesd.EntryBase, 0, len(names))
+			for i, name := range names {
+				fe := filesd.MakeFileEntry(name, int64(len(data[i])))
+				fe.SetLocalPath(filepath.Join(dir, name))
+				files = append(files, fe)
+			}
+			torInfo, e := info.NewTorInfo("tor", 4, utils.HashSlices(pieces), files)
+			test.CheckFatal(t, e)
+
+			st := tt.make(dir, torInfo)
+			if _, local := st.(Local); local != (tt.name == "files") {
+				t.Errorf("implements Local: %v", local)
+			}
+			if e = st.ReadAt(0, 0, make([]byte, 4)); e == nil {
+				t.Error("expected an error reading before Open")
+			}
+			test.CheckFatal(t, st.Open())
+
+			// Write every piece in blocks of 2 bytes
+			for i, piece := range pieces {
+				for begin := 0; begin < len(piece); begin += 2 {
+					end := begin + 2
+					if end > len(piece) {
+						end = len(piece)
+					}
+					test.CheckFatal(t, st.WriteAt(int64(i), int64(begin), piece[begin:end]))
+				}
+				test.CheckFatal(t, st.MarkComplete(int64(i)))
+			}
+			test.CheckFatal(t, st.Flush())
+			test.CheckFatal(t, st.Close())
+
+			// Everything is still there once opened again, even twice
+			test.CheckFatal(t, st.Open())
+			test.CheckFatal(t, st.Open())
+			defer st.Close()
+			for i, piece := range pieces {
+				buf := make([]byte, len(piece))
+				test.CheckFatal(t, st.ReadAt(int64(i), 0, buf))
+				if !bytes.Equal(buf, piece) {
+					t.Errorf("piece %v: got %q, want %q", i, buf, piece)
+				}
+			}
+
+			// A block across files
+			buf := make([]byte, 2)
+			test.CheckFatal(t, st.ReadAt(1, 2, buf))
+			if string(buf) != "gh" {
+				t.Errorf("got block %q, want %q", buf, "gh")
+			}
+
+			// Blocks outside of their piece
+			if e = st.ReadAt(0, 3, buf); e == nil {
+				t.Error("expected an error reading past the end of a piece")
+			}
+			if e = st.WriteAt(4, 0, buf); e == nil {
+				t.Error("expected an error writing past the end of the last piece")
+			}
+			if e = st.ReadAt(5, 0, buf[:1]); e == nil {
+				t.Error("expected an error reading a piece out of bounds")
+			}
+		})
+	}
+}
+
+func TestFiles_Layout(t *testing.T) {
+	dir := t.TempDir()
+	f1 := filesd.MakeFileEntry("f1", 3)
+	f1.SetLocalPath(filepath.Join(dir, "f1"))
+	f2 := filesd.MakeFileEntry("f2", 3)
+	f2.SetLocalPath(filepath.Join(dir, "f2"))
+	torInfo, e := info.NewTorInfo("tor", 4, test.DummyHashes(2), []filesd.EntryBase{f1, f2})
+	test.CheckFatal(t, e)
+
+	st := NewFiles(torInfo)
+	test.CheckFatal(t, st.Open())
+	test.CheckFatal(t, st.WriteAt(0, 0, []byte("abcd")))
+	test.CheckFatal(t, st.WriteAt(1, 0, []byte("ef")))
+	test.CheckFatal(t, st.Close())
+
+	for path, want := range map[string]string{"f1": "abc", "f2": "def"} {
+		got, e := os.ReadFile(filepath.Join(dir, path))
+		test.CheckFatal(t, e)
+		if string(got) != want {
+			t.Errorf("%v: got %q, want %q", path, got, want)
+		}
+	}
+}
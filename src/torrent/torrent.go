@@ -3,7 +3,9 @@ package torrent
 import (
 	"encoding/hex"
 	"fmt"
+	"net"
 	"os"
+	"strconv"
 	"strings"
 
 	"gotor/torrent/info"
@@ -25,9 +27,12 @@ func (te *TorError) Error() string {
 // STRUCTS ====================================================================
 
 type Torrent struct {
-	infohash string
-	announce string
-	info     *info.TorInfo
+	infohash     string
+	announce     string
+	announceList [][]string // Tracker tiers from announce-list (BEP_0012)
+	nodes        []string   // DHT bootstrap nodes as host:port (BEP_0005)
+	infoBytes    []byte     // The bencoded info dictionary
+	info         *info.TorInfo
 }
 
 // ============================================================================
@@ -41,6 +46,30 @@ func (tor *Torrent) Announce() string {
 	return tor.announce
 }
 
+// AnnounceList returns the tracker tiers of the torrent. If the torrent has no
+// announce-list, this is a single tier holding the announce URL, or nothing
+// for trackerless torrents.
+func (tor *Torrent) AnnounceList() [][]string {
+	if len(tor.announceList) == 0 {
+		if tor.announce == "" {
+			return nil
+		}
+		return [][]string{{tor.announce}}
+	}
+	return tor.announceList
+}
+
+// Nodes returns the DHT nodes listed in the torrent, if any.
+func (tor *Torrent) Nodes() []string {
+	return tor.nodes
+}
+
+// InfoBytes returns the bencoded info dictionary, whose SHA1 is the
+// infohash. This is what the metadata extension (BEP_0009) sends to peers.
+func (tor *Torrent) InfoBytes() []byte {
+	return tor.infoBytes
+}
+
 func (tor *Torrent) Info() *info.TorInfo {
 	return tor.info
 }
@@ -59,9 +88,10 @@ func NewTorrent(info *info.TorInfo, announce string) (*Torrent, error) {
 	infohash := utils.SHA1(encoded)
 
 	return &Torrent{
-		infohash: infohash,
-		announce: announce,
-		info:     info,
+		infohash:  infohash,
+		announce:  announce,
+		infoBytes: encoded,
+		info:      info,
 	}, nil
 }
 
@@ -87,11 +117,28 @@ func FromTorrentFile(torpath string, workingDir string) (*Torrent, error) {
 		return nil, &TorError{msg: "decoded bencoding is not a dictionary"}
 	}
 
-	tor.announce, err = dict.GetString("announce")
+	tor.announceList, err = parseAnnounceList(dict)
 	if err != nil {
 		return nil, err
 	}
 
+	tor.nodes, err = parseNodes(dict)
+	if err != nil {
+		return nil, err
+	}
+
+	// The announce key is optional if there is an announce-list, in which
+	// case it should be ignored anyways (BEP_0012). Trackerless torrents
+	// have neither, but must list DHT nodes instead (BEP_0005).
+	tor.announce, err = dict.GetString("announce")
+	if err != nil {
+		if len(tor.announceList) > 0 {
+			tor.announce = tor.announceList[0][0]
+		} else if len(tor.nodes) == 0 {
+			return nil, err
+		}
+	}
+
 	infodict, err := dict.GetDict("info")
 	if err != nil {
 		return nil, err
@@ -99,6 +146,7 @@ func FromTorrentFile(torpath string, workingDir string) (*Torrent, error) {
 
 	enc, _ := bencode.Encode(infodict)
 	tor.infohash = utils.SHA1(enc)
+	tor.infoBytes = enc
 
 	torInfo, err := info.FromDict(infodict, workingDir)
 	if err != nil {
@@ -110,6 +158,95 @@ func FromTorrentFile(torpath string, workingDir string) (*Torrent, error) {
 	return &tor, nil
 }
 
+// parseAnnounceList reads the announce-list tiers from the torrent dict.
+// Returns nil if the key is missing. Empty tiers are dropped.
+func parseAnnounceList(dict bencode.Dict) ([][]string, error) {
+	list, err := dict.GetList("announce-list")
+	if err != nil {
+		if _, ok := err.(*bencode.DictMissingKeyError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	tiers := make([][]string, 0, len(list))
+	for _, v := range list {
+		tierList, ok := v.(bencode.List)
+		if !ok {
+			return nil, &TorError{msg: "announce-list tier is not a list"}
+		}
+
+		tier := make([]string, 0, len(tierList))
+		for _, u := range tierList {
+			s, ok := u.(string)
+			if !ok {
+				return nil, &TorError{msg: "announce-list entry is not a string"}
+			}
+			tier = append(tier, s)
+		}
+
+		if len(tier) > 0 {
+			tiers = append(tiers, tier)
+		}
+	}
+
+	return tiers, nil
+}
+
+// parseNodes reads the DHT nodes from the torrent dict, which are stored as a
+// list of [host, port] pairs. Returns nil if the key is missing.
+func parseNodes(dict bencode.Dict) ([]string, error) {
+	list, err := dict.GetList("nodes")
+	if err != nil {
+		if _, ok := err.(*bencode.DictMissingKeyError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	nodes := make([]string, 0, len(list))
+	for _, v := range list {
+		pair, ok := v.(bencode.List)
+		if !ok || len(pair) != 2 {
+			return nil, &TorError{msg: "nodes entry is not a [host, port] pair"}
+		}
+		host, ok1 := pair[0].(string)
+		port, ok2 := pair[1].(int64)
+		if !ok1 || !ok2 {
+			return nil, &TorError{msg: "nodes entry is not a [host, port] pair"}
+		}
+		nodes = append(nodes, net.JoinHostPort(host, strconv.FormatInt(port, 10)))
+	}
+
+	return nodes, nil
+}
+
+// FromInfoDict creates a Torrent from an info dictionary, e.g. one fetched
+// from peers for a magnet link. The tiers are used as the announce-list.
+func FromInfoDict(infodict bencode.Dict, tiers [][]string, workingDir string) (*Torrent, error) {
+	enc, err := bencode.Encode(infodict)
+	if err != nil {
+		return nil, err
+	}
+
+	torInfo, err := info.FromDict(infodict, workingDir)
+	if err != nil {
+		return nil, err
+	}
+
+	tor := Torrent{
+		infohash:     utils.SHA1(enc),
+		announceList: tiers,
+		infoBytes:    enc,
+		info:         torInfo,
+	}
+	if len(tiers) > 0 {
+		tor.announce = tiers[0][0]
+	}
+
+	return &tor, nil
+}
+
 // ============================================================================
 // MISC =======================================================================
 
@@ -120,6 +257,9 @@ func (tor *Torrent) String() string {
 	strb.WriteString("Torrent Info:\n")
 	strb.WriteString(fmt.Sprintf("     Name: [%s]\n", tor.info.Name()))
 	strb.WriteString(fmt.Sprintf(" Announce: [%s]\n", tor.announce))
+	if len(tor.announceList) > 0 {
+		strb.WriteString(fmt.Sprintf("    Tiers: %v\n", tor.announceList))
+	}
 	strb.WriteString(fmt.Sprintf(" Infohash: [%s]\n", prettyHash))
 	plen, units := utils.Bytes4Humans(tor.info.PieceLen())
 	strb.WriteString(fmt.Sprintf("   Pieces: [%v x %v %s]\n", tor.info.NumPieces(), plen, units))
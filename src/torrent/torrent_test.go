@@ -2,8 +2,10 @@ package torrent
 
 import (
 	"encoding/hex"
+	"reflect"
 	"testing"
 
+	"gotor/bencode"
 	"gotor/utils/test"
 )
 
@@ -44,3 +46,88 @@ func TestFromTorrentFile(t *testing.T) {
 		})
 	}
 }
+
+func TestParseAnnounceList(t *testing.T) {
+	tests := []struct {
+		name    string
+		dict    bencode.Dict
+		want    [][]string
+		wantErr bool
+	}{
+		{
+			name: "missing",
+			dict: bencode.Dict{"announce": "http://a"},
+			want: nil,
+		},
+		{
+			name: "tiers",
+			dict: bencode.Dict{"announce-list": bencode.List{
+				bencode.List{"http://a", "udp://b:80"},
+				bencode.List{},
+				bencode.List{"http://c"},
+			}},
+			want: [][]string{{"http://a", "udp://b:80"}, {"http://c"}},
+		},
+		{
+			name:    "tier not a list",
+			dict:    bencode.Dict{"announce-list": bencode.List{"http://a"}},
+			wantErr: true,
+		},
+		{
+			name:    "url not a string",
+			dict:    bencode.Dict{"announce-list": bencode.List{bencode.List{int64(1)}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAnnounceList(tt.dict)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		dict    bencode.Dict
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "missing",
+			dict: bencode.Dict{},
+			want: nil,
+		},
+		{
+			name: "nodes",
+			dict: bencode.Dict{"nodes": bencode.List{
+				bencode.List{"127.0.0.1", int64(6881)},
+				bencode.List{"router.example.com", int64(6882)},
+				bencode.List{"2001:db8::1", int64(6883)},
+			}},
+			want: []string{"127.0.0.1:6881", "router.example.com:6882", "[2001:db8::1]:6883"},
+		},
+		{
+			name:    "not a pair",
+			dict:    bencode.Dict{"nodes": bencode.List{bencode.List{"127.0.0.1"}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseNodes(tt.dict)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
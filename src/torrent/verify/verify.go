@@ -0,0 +1,233 @@
+/* verify.go ===================================================================
+Checks which pieces of a torrent are on disk. Pieces are read straight from
+the files and hashed by a pool of workers, so large torrents are checked as
+fast as the disk allows. Files that don't exist, and the parts of files that
+are too short, are simply missing: nothing is created or changed on disk, so
+the same check works before a swarm opens its files and from the command line.
+Torrents kept elsewhere are checked through their storage instead.
+============================================================================ */
+
+package verify
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+
+	"gotor/bf"
+	"gotor/torrent/filesd"
+	"gotor/torrent/info"
+	"gotor/utils"
+)
+
+// ============================================================================
+// STRUCTS ====================================================================
+
+// Verifier checks the pieces of torrents.
+type Verifier struct {
+	// Workers is how many pieces are read and hashed at once, < 1 for one per
+	// CPU.
+	Workers int
+
+	// OnProgress is called after every piece, from the goroutine that called
+	// Verify. May be nil.
+	OnProgress func(Progress)
+}
+
+// Progress is how far along a check is.
+type Progress struct {
+	Checked int64 // Pieces checked so far
+	Have    int64 // Pieces checked that match their hash
+	Total   int64 // Pieces in the torrent
+}
+
+// Result is what a check found.
+type Result struct {
+	Have    *bf.Bitfield // Pieces that match their hash
+	Missing []string     // Local paths of the files that don't exist
+}
+
+// PieceReader reads blocks of pieces, as storage.Storage does.
+type PieceReader interface {
+	ReadAt(index int64, begin int64, buf []byte) error
+}
+
+// result is the check of a single piece.
+type result struct {
+	index int64
+	ok    bool
+	e     error
+}
+
+// ============================================================================
+// FUNK =======================================================================
+
+// Verify checks every piece of the torrent. If ctx is done first, Verify
+// stops and returns ctx's error. Other errors, e.g. a file we may not read,
+// stop the check too.
+func (v *Verifier) Verify(ctx context.Context, torInfo *info.TorInfo) (*Result, error) {
+	files, missing, e := openFiles(torInfo.Files())
+	if e != nil {
+		return nil, e
+	}
+	defer closeFiles(files)
+
+	res, e := v.run(ctx, torInfo, func(index int64, buf []byte) (bool, error) {
+		return checkPiece(torInfo, files, index, buf)
+	})
+	if e != nil {
+		return nil, e
+	}
+	res.Missing = missing
+	return res, nil
+}
+
+// VerifyStorage checks every piece of the torrent through its open storage.
+// Pieces the storage has no data for are missing.
+func (v *Verifier) VerifyStorage(ctx context.Context, torInfo *info.TorInfo, r PieceReader) (*Result, error) {
+	return v.run(ctx, torInfo, func(index int64, buf []byte) (bool, error) {
+		buf = buf[:torInfo.PieceLenAt(index)]
+		e := r.ReadAt(index, 0, buf)
+		if errors.Is(e, io.EOF) || errors.Is(e, io.ErrUnexpectedEOF) {
+			return false, nil
+		} else if e != nil {
+			return false, e
+		}
+		return utils.SHA1(buf) == torInfo.PieceHash(index), nil
+	})
+}
+
+// run checks every piece with check, from a pool of workers. buf holds a
+// whole piece, and is only used by one worker.
+func (v *Verifier) run(ctx context.Context, torInfo *info.TorInfo, check func(index int64, buf []byte) (bool, error)) (*Result, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	wg := sync.WaitGroup{}
+	defer func() {
+		// Workers must be done with the files before they are closed
+		cancel()
+		wg.Wait()
+	}()
+
+	npieces := torInfo.NumPieces()
+	chIndex := make(chan int64)
+	chResult := make(chan result)
+
+	go func() {
+		defer close(chIndex)
+		for i := int64(0); i < npieces; i++ {
+			select {
+			case chIndex <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for w := 0; w < v.workers(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, torInfo.PieceLen())
+			for index := range chIndex {
+				ok, e := check(index, buf)
+				select {
+				case chResult <- result{index, ok, e}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	res := &Result{Have: bf.NewBitfield(npieces)}
+	p := Progress{Total: npieces}
+	for p.Checked < npieces {
+		select {
+		case r := <-chResult:
+			if r.e != nil {
+				return nil, r.e
+			}
+			res.Have.Set(r.index, r.ok)
+			p.Checked++
+			if r.ok {
+				p.Have++
+			}
+			if v.OnProgress != nil {
+				v.OnProgress(p)
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return res, nil
+}
+
+func (v *Verifier) workers() int {
+	if v.Workers < 1 {
+		return runtime.NumCPU()
+	}
+	return v.Workers
+}
+
+// checkPiece returns true if the piece is on disk and matches its hash.
+// Files missing from files, or too short, mean the piece is missing.
+func checkPiece(torInfo *info.TorInfo, files map[string]*os.File, index int64, buf []byte) (bool, error) {
+	plocs, e := torInfo.PieceLookup(index)
+	if e != nil {
+		return false, e
+	}
+
+	offset := int64(0)
+	for _, ploc := range plocs {
+		fp := files[ploc.Path()]
+		if fp == nil {
+			return false, nil
+		}
+
+		n, e := fp.ReadAt(buf[offset:offset+ploc.ReadAmnt()], ploc.SeekAmnt())
+		if errors.Is(e, io.EOF) {
+			return false, nil
+		} else if e != nil {
+			return false, e
+		}
+		offset += int64(n)
+	}
+
+	return utils.SHA1(buf[:offset]) == torInfo.PieceHash(index), nil
+}
+
+// openFiles opens every file of the torrent for reading, by local path.
+// Files that don't exist are returned in missing instead.
+func openFiles(fl filesd.FileList) (files map[string]*os.File, missing []string, err error) {
+	files = make(map[string]*os.File)
+	for _, fe := range fl {
+		fpath := fe.LocalPath()
+		if _, ok := files[fpath]; ok {
+			continue
+		}
+
+		fp, e := os.Open(fpath)
+		if os.IsNotExist(e) {
+			files[fpath] = nil
+			missing = append(missing, fpath)
+			continue
+		} else if e != nil {
+			closeFiles(files)
+			return nil, nil, e
+		}
+		files[fpath] = fp
+	}
+	return files, missing, nil
+}
+
+func closeFiles(files map[string]*os.File) {
+	for _, fp := range files {
+		if fp != nil {
+			_ = fp.Close()
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package verify
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"gotor/torrent/filesd"
+	"gotor/torrent/info"
+	"gotor/torrent/storage"
+	"gotor/utils"
+	"gotor/utils/test"
+)
+
+// makeTorrent returns a torrent of the files, with pieces of pieceLen bytes,
+// stored in dir.
+func makeTorrent(t *testing.T, dir string, pieceLen int64, names []string, data [][]byte) *info.TorInfo {
+	all := make([]byte, 0)
+	files := make([]filesd.EntryBase, 0, len(names))
+	for i, name := range names {
+		fe := filesd.MakeFileEntry(name, int64(len(data[i])))
+		fe.SetLocalPath(filepath.Join(dir, name))
+		files = append(files, fe)
+		all = append(all, data[i]...)
+	}
+
+	torInfo, e := info.NewTorInfo("tor", pieceLen, utils.HashSlices(utils.SegmentData(all, pieceLen)), files)
+	test.CheckFatal(t, e)
+	return torInfo
+}
+
+func TestVerifier_Verify(t *testing.T) {
+	names := []string{"f1", "f2", "f3"}
+	data := [][]byte{
+		[]byte("abcde"),
+		[]byte("fgh"),
+		[]byte("ijklmnopq"),
+	}
+
+	tests := []struct {
+		name    string
+		files   [][]byte // What is on disk, nil for a missing file
+		have    []bool   // Pieces of 4 bytes
+		missing int
+	}{
+		{
+			name:  "complete",
+			files: data,
+			have:  []bool{true, true, true, true, true},
+		},
+		{
+			name:    "missing file",
+			files:   [][]byte{data[0], nil, data[2]},
+			have:    []bool{true, false, true, true, true},
+			missing: 1,
+		},
+		{
+			name:  "corrupt piece",
+			files: [][]byte{data[0], []byte("fXh"), data[2]},
+			have:  []bool{true, false, true, true, true},
+		},
+		{
+			name:  "short file",
+			files: [][]byte{data[0], data[1], []byte("ijklmn")},
+			have:  []bool{true, true, true, false, false},
+		},
+		{
+			name:    "nothing",
+			files:   [][]byte{nil, nil, nil},
+			have:    []bool{false, false, false, false, false},
+			missing: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		for _, workers := range []int{1, 3} {
+			t.Run(tt.name, func(t *testing.T) {
+				dir := t.TempDir()
+				torInfo := makeTorrent(t, dir, 4, names, data)
+				for i, fdata := range tt.files {
+					if fdata != nil {
+						test.CheckFatal(t, test.WriteTestFile(filepath.Join(dir, names[i]), fdata))
+					}
+				}
+
+				var last Progress
+				v := Verifier{
+					Workers:    workers,
+					OnProgress: func(p Progress) { last = p },
+				}
+				res, e := v.Verify(context.Background(), torInfo)
+				test.CheckFatal(t, e)
+
+				for i, want := range tt.have {
+					if got := res.Have.Get(int64(i)); got != want {
+						t.Errorf("piece %v: got %v, want %v", i, got, want)
+					}
+				}
+				if len(res.Missing) != tt.missing {
+					t.Errorf("got missing files %v, want %v of them", res.Missing, tt.missing)
+				}
+				if last.Checked != last.Total || last.Total != 5 || last.Have != res.Have.Nset() {
+					t.Errorf("last progress was %+v, have %v pieces", last, res.Have.Nset())
+				}
+			})
+		}
+	}
+}
+
+func TestVerifier_Cancel(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 1000)
+	torInfo := makeTorrent(t, dir, 10, []string{"f"}, [][]byte{data})
+	test.CheckFatal(t, test.WriteTestFile(filepath.Join(dir, "f"), data))
+
+	// Cancel once some pieces are checked
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	checked := int64(0)
+	v := Verifier{
+		Workers: 2,
+		OnProgress: func(p Progress) {
+			checked = p.Checked
+			if p.Checked == 10 {
+				cancel()
+			}
+		},
+	}
+
+	_, e := v.Verify(ctx, torInfo)
+	if !errors.Is(e, context.Canceled) {
+		t.Fatalf("got error %v, want %v", e, context.Canceled)
+	}
+	if checked == torInfo.NumPieces() {
+		t.Error("expected the check to stop early")
+	}
+}
+
+func TestVerifier_VerifyStorage(t *testing.T) {
+	data := []byte("abcdefghij")
+	torInfo := makeTorrent(t, t.TempDir(), 4, []string{"f"}, [][]byte{data})
+
+	st := storage.NewMemory(torInfo)
+	test.CheckFatal(t, st.Open())
+	test.CheckFatal(t, st.WriteAt(0, 0, data[:4]))
+	test.CheckFatal(t, st.WriteAt(2, 0, data[8:]))
+
+	v := Verifier{Workers: 2}
+	res, e := v.VerifyStorage(context.Background(), torInfo, st)
+	test.CheckFatal(t, e)
+	for i, want := range []bool{true, false, true} {
+		if got := res.Have.Get(int64(i)); got != want {
+			t.Errorf("piece %v: got %v, want %v", i, got, want)
+		}
+	}
+}
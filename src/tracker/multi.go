@@ -0,0 +1,149 @@
+/* multi.go ===================================================================
+Implements multitracker announces (BEP_0012). Trackers are grouped into tiers,
+and the URLs within each tier are shuffled once when the MultiTracker is made.
+An announce tries every tracker of the first tier in order, then every tracker
+of the second tier, and so on, stopping at the first one that answers. That
+tracker is then moved to the front of its tier so that it is tried first next
+time around. Each tracker gets at most trackerTimeout, so that a dead tracker
+can't hold up the ones after it. UDP trackers get a few retransmissions.
+============================================================================ */
+
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"gotor/torrent"
+)
+
+// trackerTimeout is how long an announce waits for a single tracker before
+// moving on to the next one. A variable so that tests don't need to wait.
+var trackerTimeout = 20 * time.Second
+
+// udpAttempts is how many transmissions of the BEP_0015 schedule a UDP
+// tracker gets before we move on, so that a lost packet doesn't fail it.
+const udpAttempts = 3
+
+// ============================================================================
+// STRUCT =====================================================================
+
+type MultiTracker struct {
+	tiers [][]string
+	mutex sync.Mutex
+}
+
+// ============================================================================
+// FUNK =======================================================================
+
+// NewMultiTracker copies the given tiers, dropping empty ones, and shuffles
+// the URLs within each tier.
+func NewMultiTracker(tiers [][]string) *MultiTracker {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	mt := MultiTracker{tiers: make([][]string, 0, len(tiers))}
+	for _, tier := range tiers {
+		if len(tier) == 0 {
+			continue
+		}
+		cpy := make([]string, len(tier))
+		copy(cpy, tier)
+		rng.Shuffle(len(cpy), func(i, j int) {
+			cpy[i], cpy[j] = cpy[j], cpy[i]
+		})
+		mt.tiers = append(mt.tiers, cpy)
+	}
+
+	return &mt
+}
+
+// FromTorrent makes a MultiTracker from the announce-list of the torrent.
+func FromTorrent(tor *torrent.Torrent) *MultiTracker {
+	return NewMultiTracker(tor.AnnounceList())
+}
+
+// Tiers returns a copy of the tiers in their current order.
+func (mt *MultiTracker) Tiers() [][]string {
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+
+	tiers := make([][]string, 0, len(mt.tiers))
+	for _, tier := range mt.tiers {
+		cpy := make([]string, len(tier))
+		copy(cpy, tier)
+		tiers = append(tiers, cpy)
+	}
+	return tiers
+}
+
+// Announce tries each tracker in tier order until one responds, and returns
+// its response along with its URL. The tracker that responded is promoted to
+// the front of its tier. If every tracker fails, the returned error lists
+// each failure. Gives up once ctx is done, returning ctx's error.
+func (mt *MultiTracker) Announce(ctx context.Context, infohash string, stats *Stats, port uint16, peerId string, event Event) (*Response, string, error) {
+	errs := make([]string, 0)
+
+	for t, tier := range mt.Tiers() {
+		for _, announceUrl := range tier {
+			if e := ctx.Err(); e != nil {
+				return nil, "", e
+			}
+
+			tctx, cancel := context.WithTimeout(ctx, timeoutFor(announceUrl))
+			resp, e := announce(tctx, announceUrl, infohash, stats, port, peerId, event)
+			cancel()
+			if e != nil {
+				log.Printf("tracker [%v] failed: %v", announceUrl, e)
+				errs = append(errs, fmt.Sprintf("[%v] %v", announceUrl, e))
+				continue
+			}
+
+			mt.promote(t, announceUrl)
+			return resp, announceUrl, nil
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil, "", &Error{msg: "no trackers to announce to"}
+	}
+	return nil, "", &Error{msg: "all trackers failed\n" + strings.Join(errs, "\n")}
+}
+
+// timeoutFor returns how long an announce waits for the tracker. UDP
+// trackers get the first udpAttempts timeouts of their retransmission
+// schedule, or trackerTimeout if that is longer.
+func timeoutFor(announceUrl string) time.Duration {
+	if !strings.HasPrefix(announceUrl, "udp:") {
+		return trackerTimeout
+	}
+
+	timeout := time.Duration(0)
+	for n := 0; n < udpAttempts; n++ {
+		timeout += udpTimeout(n)
+	}
+	if timeout < trackerTimeout {
+		timeout = trackerTimeout
+	}
+	return timeout
+}
+
+// promote moves the URL to the front of the given tier, shifting the
+// trackers before it back by one.
+func (mt *MultiTracker) promote(t int, announceUrl string) {
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+
+	tier := mt.tiers[t]
+	for i, u := range tier {
+		if u == announceUrl {
+			copy(tier[1:i+1], tier[:i])
+			tier[0] = announceUrl
+			return
+		}
+	}
+}
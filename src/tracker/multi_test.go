@@ -0,0 +1,164 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"gotor/utils/test"
+)
+
+// newFakeHttpTracker serves a fixed, empty announce response.
+func newFakeHttpTracker(t *testing.T) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, "d8:completei1e10:incompletei2e8:intervali900e5:peers0:e")
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL + "/announce"
+}
+
+func TestNewMultiTracker(t *testing.T) {
+	tiers := [][]string{
+		{"a", "b", "c", "d"},
+		{},
+		{"e"},
+	}
+	mt := NewMultiTracker(tiers)
+	got := mt.Tiers()
+
+	if len(got) != 2 {
+		t.Fatalf("got %v tiers, want 2", len(got))
+	}
+
+	// Shuffling should keep every tracker in its tier
+	sort.Strings(got[0])
+	if !reflect.DeepEqual(got[0], tiers[0]) || !reflect.DeepEqual(got[1], tiers[2]) {
+		t.Errorf("bad tiers %v", got)
+	}
+
+	// Caller's slices should be left alone
+	if tiers[0][0] != "a" {
+		t.Errorf("input tiers were modified")
+	}
+}
+
+func TestMultiTracker_Announce(t *testing.T) {
+	good := newFakeHttpTracker(t)
+	bad1 := "wss://bad1/announce" // Unsupported scheme, fails immediately
+	bad2 := "wss://bad2/announce"
+
+	tests := []struct {
+		name      string
+		tiers     [][]string
+		wantUrl   string
+		wantTiers [][]string
+	}{
+		{
+			name:      "promote within tier",
+			tiers:     [][]string{{bad1, bad2, good}},
+			wantUrl:   good,
+			wantTiers: [][]string{{good, bad1, bad2}},
+		},
+		{
+			name:      "fall back to next tier",
+			tiers:     [][]string{{bad1}, {bad2, good}},
+			wantUrl:   good,
+			wantTiers: [][]string{{bad1}, {good, bad2}},
+		},
+		{
+			name:      "first tier wins",
+			tiers:     [][]string{{good}, {bad1}},
+			wantUrl:   good,
+			wantTiers: [][]string{{good}, {bad1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Skip the shuffle so that the order is known
+			mt := &MultiTracker{tiers: tt.tiers}
+
+			resp, gotUrl, e := mt.Announce(context.Background(), string(make([]byte, 20)), NewStats(0, 0, 0), 60666, "-GT0000-aaaaaaaaaaaa", EventNone)
+			test.CheckFatal(t, e)
+
+			if gotUrl != tt.wantUrl {
+				t.Errorf("announced to [%v], want [%v]", gotUrl, tt.wantUrl)
+			}
+			if resp.State.Interval() != 900 {
+				t.Errorf("bad response state\n%v", resp.State)
+			}
+			if !reflect.DeepEqual(mt.Tiers(), tt.wantTiers) {
+				t.Errorf("tiers are %v, want %v", mt.Tiers(), tt.wantTiers)
+			}
+		})
+	}
+}
+
+func TestMultiTracker_AllFail(t *testing.T) {
+	mt := NewMultiTracker([][]string{{"wss://a"}, {"wss://b"}})
+	_, _, e := mt.Announce(context.Background(), string(make([]byte, 20)), NewStats(0, 0, 0), 60666, "-GT0000-aaaaaaaaaaaa", EventNone)
+	if _, ok := e.(*Error); !ok {
+		t.Errorf("expected *Error, got %T (%v)", e, e)
+	}
+}
+
+func TestMultiTracker_Timeout(t *testing.T) {
+	old := trackerTimeout
+	trackerTimeout = 100 * time.Millisecond
+	defer func() { trackerTimeout = old }()
+
+	// A tracker that never answers
+	chRelease := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-chRelease:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(hung.Close)
+	defer close(chRelease)
+	good := newFakeHttpTracker(t)
+
+	mt := &MultiTracker{tiers: [][]string{{hung.URL + "/announce"}, {good}}}
+	start := time.Now()
+	_, gotUrl, e := mt.Announce(context.Background(), string(make([]byte, 20)), NewStats(0, 0, 0), 60666, "-GT0000-aaaaaaaaaaaa", EventNone)
+	test.CheckFatal(t, e)
+	if gotUrl != good {
+		t.Errorf("announced to [%v], want [%v]", gotUrl, good)
+	}
+	if waited := time.Since(start); waited > 2*time.Second {
+		t.Errorf("falling back took %v", waited)
+	}
+
+	// A done context stops the announce instead of trying every tracker
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, e = mt.Announce(ctx, string(make([]byte, 20)), NewStats(0, 0, 0), 60666, "-GT0000-aaaaaaaaaaaa", EventNone)
+	if e != context.Canceled {
+		t.Errorf("got error %v, want %v", e, context.Canceled)
+	}
+}
+
+func TestMultiTracker_UdpRetransmit(t *testing.T) {
+	oldTimeout, oldBase := trackerTimeout, udpTimeoutBase
+	trackerTimeout, udpTimeoutBase = 30*time.Millisecond, 50*time.Millisecond
+	defer func() { trackerTimeout, udpTimeoutBase = oldTimeout, oldBase }()
+
+	// The first packet is lost, the tracker answers the retransmission
+	ft := newFakeUdpTracker(t, nil)
+	ft.setDrop(1)
+
+	mt := &MultiTracker{tiers: [][]string{{ft.url()}}}
+	_, gotUrl, e := mt.Announce(context.Background(), string(make([]byte, 20)), NewStats(0, 0, 0), 60666, "-GT0000-aaaaaaaaaaaa", EventNone)
+	test.CheckFatal(t, e)
+	if gotUrl != ft.url() {
+		t.Errorf("announced to [%v], want [%v]", gotUrl, ft.url())
+	}
+	if got := ft.numRecv(); got < 2 {
+		t.Errorf("tracker got %v packets, want a retransmission", got)
+	}
+}
@@ -0,0 +1,129 @@
+/* scrape.go ==================================================================
+Tracker scrapes, which get the swarm statistics of one or more torrents without
+announcing. For HTTP trackers the scrape URL is derived from the announce URL
+by the convention described in BEP_0048, UDP trackers use the scrape action
+from BEP_0015 on the same host.
+============================================================================ */
+
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gotor/bencode"
+)
+
+// ============================================================================
+// FUNK =======================================================================
+
+// ScrapeURL derives the scrape URL from an announce URL. For HTTP trackers,
+// the last path segment must begin with "announce", which is replaced with
+// "scrape". UDP trackers scrape the same URL they announce to.
+func ScrapeURL(announceUrl string) (string, error) {
+	u, e := url.Parse(announceUrl)
+	if e != nil {
+		return "", e
+	}
+
+	switch u.Scheme {
+	case "udp":
+		return announceUrl, nil
+	case "http", "https":
+		slash := strings.LastIndex(u.Path, "/")
+		last := u.Path[slash+1:]
+		if !strings.HasPrefix(last, "announce") {
+			return "", &Error{msg: fmt.Sprintf("tracker [%v] does not support scraping", announceUrl)}
+		}
+		u.Path = u.Path[:slash+1] + "scrape" + strings.TrimPrefix(last, "announce")
+		return u.String(), nil
+	default:
+		return "", &Error{msg: fmt.Sprintf("unsupported tracker scheme [%v]", u.Scheme)}
+	}
+}
+
+// Scrape asks the tracker for the statistics of each of the given infohashes.
+// Results are in the same order as the infohashes. Infohashes that the
+// tracker doesn't know about are returned with all counts set to zero. Gives
+// up once ctx is done.
+func Scrape(ctx context.Context, announceUrl string, infohashes []string) ([]ScrapeResult, error) {
+	scrapeUrl, e := ScrapeURL(announceUrl)
+	if e != nil {
+		return nil, e
+	}
+	if len(infohashes) == 0 {
+		return []ScrapeResult{}, nil
+	}
+
+	if strings.HasPrefix(scrapeUrl, "udp:") {
+		return scrapeUdp(ctx, scrapeUrl, infohashes)
+	}
+	return scrapeHttp(ctx, scrapeUrl, infohashes)
+}
+
+func scrapeHttp(ctx context.Context, scrapeUrl string, infohashes []string) ([]ScrapeResult, error) {
+	req, e := http.NewRequestWithContext(ctx, "GET", scrapeUrl, nil)
+	if e != nil {
+		return nil, e
+	}
+	query := req.URL.Query()
+	for _, ih := range infohashes {
+		query.Add("info_hash", ih)
+	}
+	req.URL.RawQuery = query.Encode()
+
+	resp, e := httpClient.Do(req)
+	if e != nil {
+		return nil, e
+	}
+	defer resp.Body.Close()
+
+	body, e := ioutil.ReadAll(resp.Body)
+	if e != nil {
+		return nil, e
+	}
+
+	ben, e := bencode.Decode(body)
+	if e != nil {
+		return nil, e
+	}
+	dict, ok := ben.(bencode.Dict)
+	if !ok {
+		return nil, fmt.Errorf("scrape response not a bencoded dictionary\n%v", body)
+	}
+
+	return newScrapeResults(dict, infohashes)
+}
+
+func newScrapeResults(dict bencode.Dict, infohashes []string) ([]ScrapeResult, error) {
+	fail, e := dict.GetString("failure reason")
+	if e == nil {
+		return nil, &Error{msg: fail}
+	}
+
+	files, e := dict.GetDict("files")
+	if e != nil {
+		return nil, e
+	}
+
+	results := make([]ScrapeResult, 0, len(infohashes))
+	for _, ih := range infohashes {
+		result := ScrapeResult{Infohash: ih}
+
+		stats, e := files.GetDict(ih)
+		if e == nil {
+			// Trackers should send all three, but don't fail if they don't
+			result.Seeders, _ = stats.GetUint("complete")
+			result.Leechers, _ = stats.GetUint("incomplete")
+			result.Downloaded, _ = stats.GetUint("downloaded")
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
@@ -0,0 +1,72 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gotor/utils/test"
+)
+
+func TestScrapeURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		announce string
+		want     string
+		wantErr  bool
+	}{
+		{"plain", "http://example.com/announce", "http://example.com/scrape", false},
+		{"php", "http://example.com/x/announce.php", "http://example.com/x/scrape.php", false},
+		{"query", "https://example.com/announce?passkey=abc", "https://example.com/scrape?passkey=abc", false},
+		{"udp", "udp://tracker.example.com:80", "udp://tracker.example.com:80", false},
+		{"no announce", "http://example.com/a", "", true},
+		{"announce not last", "http://example.com/announce/x", "", true},
+		{"bad scheme", "wss://example.com/announce", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ScrapeURL(tt.announce)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got [%v], want [%v]", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScrapeHttp(t *testing.T) {
+	known := "aaaaaaaaaaaaaaaaaaaa"
+	unknown := "bbbbbbbbbbbbbbbbbbbb"
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			http.NotFound(w, r)
+			return
+		}
+		if n := len(r.URL.Query()["info_hash"]); n != 2 {
+			t.Errorf("tracker got %v infohashes, want 2", n)
+		}
+		_, _ = fmt.Fprintf(w, "d5:filesd20:%vd8:completei5e10:downloadedi50e10:incompletei3eeee", known)
+	}))
+	defer srv.Close()
+
+	results, e := Scrape(context.Background(), srv.URL+"/announce", []string{known, unknown})
+	test.CheckFatal(t, e)
+
+	if len(results) != 2 {
+		t.Fatalf("got %v results, want 2", len(results))
+	}
+	want := []ScrapeResult{
+		{Infohash: known, Seeders: 5, Leechers: 3, Downloaded: 50},
+		{Infohash: unknown},
+	}
+	for i := range want {
+		if results[i] != want[i] {
+			t.Errorf("result %v = %+v, want %+v", i, results[i], want[i])
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package tracker
 
+import "sync/atomic"
+
 // Stats to be sent in a tracker GET request. Uploaded and Dnloaded
 // should report total bytes up/dnloaded, while Left should report
-// how many bytes until we have 100% downloaded.
+// how many bytes until we have 100% downloaded. Stats are updated by
+// every peer connection, so all access is atomic.
 type Stats struct {
 	uploaded uint64
 	dnloaded uint64
@@ -18,29 +21,34 @@ func NewStats(dn uint64, up uint64, left uint64) *Stats {
 }
 
 func (s *Stats) IncUploaded(amnt uint64) {
-	s.uploaded += amnt
+	atomic.AddUint64(&s.uploaded, amnt)
 }
 
 func (s *Stats) IncDnloaded(amnt uint64) {
-	s.dnloaded += amnt
+	atomic.AddUint64(&s.dnloaded, amnt)
 }
 
 func (s *Stats) DecLeft(amnt uint64) {
-	if amnt >= s.left {
-		s.left = 0
-	} else {
-		s.left -= amnt
+	for {
+		left := atomic.LoadUint64(&s.left)
+		newLeft := uint64(0)
+		if amnt < left {
+			newLeft = left - amnt
+		}
+		if atomic.CompareAndSwapUint64(&s.left, left, newLeft) {
+			return
+		}
 	}
 }
 
-func (s Stats) Uploaded() uint64 {
-	return s.uploaded
+func (s *Stats) Uploaded() uint64 {
+	return atomic.LoadUint64(&s.uploaded)
 }
 
-func (s Stats) Dnloaded() uint64 {
-	return s.dnloaded
+func (s *Stats) Dnloaded() uint64 {
+	return atomic.LoadUint64(&s.dnloaded)
 }
 
-func (s Stats) Left() uint64 {
-	return s.left
+func (s *Stats) Left() uint64 {
+	return atomic.LoadUint64(&s.left)
 }
@@ -1,13 +1,14 @@
 package tracker
 
 import (
-	"encoding/binary"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"gotor/bencode"
 	"gotor/peer"
@@ -23,6 +24,26 @@ func (e *Error) Error() string {
 	return "tracker error: " + e.msg
 }
 
+// httpTimeout bounds every request to an HTTP tracker, in case the caller's
+// context has no deadline.
+const httpTimeout = 30 * time.Second
+
+// httpClient is shared by every request to an HTTP tracker.
+var httpClient = &http.Client{Timeout: httpTimeout}
+
+// ============================================================================
+// EVENTS =====================================================================
+
+// Event is the event key sent with an announce, as defined in BEP_0003.
+type Event string
+
+const (
+	EventNone      Event = ""          // Regular interval announce
+	EventStarted   Event = "started"   // First announce of the session
+	EventCompleted Event = "completed" // Sent once when the download finishes
+	EventStopped   Event = "stopped"   // Sent when shutting down gracefully
+)
+
 // ============================================================================
 // STRUCT =====================================================================
 
@@ -44,6 +65,15 @@ type Response struct {
 	Peers peer.List
 }
 
+// ScrapeResult holds the swarm statistics for a single infohash, as returned
+// by a tracker scrape.
+type ScrapeResult struct {
+	Infohash   string
+	Seeders    uint64 // Peers with the entire file, "complete"
+	Leechers   uint64 // Peers without the entire file, "incomplete"
+	Downloaded uint64 // Number of times the tracker has registered a completion
+}
+
 // ============================================================================
 // GETTERS ====================================================================
 
@@ -74,36 +104,68 @@ func (s State) Leechers() uint64 {
 // ============================================================================
 // FUNK =======================================================================
 
-func Get(tor *torrent.Torrent, stats *Stats, port uint16, peerId string) (*Response, error) {
-	req := newRequest(tor, stats, port, peerId)
-	resp, e := do(req)
+// Get announces to the torrent's trackers, going through the announce-list
+// tiers until one responds. Both HTTP(S) and UDP trackers are supported, the
+// scheme of the announce URL decides which is used. Use a MultiTracker
+// directly to keep the tier order between announces.
+func Get(ctx context.Context, tor *torrent.Torrent, stats *Stats, port uint16, peerId string, event Event) (*Response, error) {
+	resp, _, e := FromTorrent(tor).Announce(ctx, tor.Infohash(), stats, port, peerId, event)
+	return resp, e
+}
+
+// announce sends an announce to the tracker at the given URL, giving up once
+// ctx is done.
+func announce(ctx context.Context, announceUrl string, infohash string, stats *Stats, port uint16, peerId string, event Event) (*Response, error) {
+	u, e := url.Parse(announceUrl)
 	if e != nil {
 		return nil, e
 	}
-	return resp, nil
+
+	switch u.Scheme {
+	case "http", "https":
+		req, e := newRequest(announceUrl, infohash, stats, port, peerId, event)
+		if e != nil {
+			return nil, e
+		}
+		return do(req.WithContext(ctx))
+	case "udp":
+		return announceUdp(ctx, announceUrl, infohash, stats, port, peerId, event)
+	default:
+		return nil, &Error{msg: fmt.Sprintf("unsupported tracker scheme [%v]", u.Scheme)}
+	}
 }
 
-func newRequest(tor *torrent.Torrent, stats *Stats, port uint16, peerId string) *http.Request {
-	req, _ := http.NewRequest("GET", tor.Announce(), nil)
+func newRequest(announceUrl string, infohash string, stats *Stats, port uint16, peerId string, event Event) (*http.Request, error) {
+	req, e := http.NewRequest("GET", announceUrl, nil)
+	if e != nil {
+		return nil, e
+	}
 	query := req.URL.Query()
-	query.Add("info_hash", tor.Infohash())
+	query.Add("info_hash", infohash)
 	query.Add("peer_id", url.QueryEscape(peerId))
 	query.Add("port", fmt.Sprintf("%v", port))
 	query.Add("uploaded", fmt.Sprintf("%v", stats.Uploaded()))
 	query.Add("downloaded", fmt.Sprintf("%v", stats.Dnloaded()))
 	query.Add("left", fmt.Sprintf("%v", stats.Left()))
 	query.Add("compact", "1") // For compact peer list (BEP_0023)
+	if event != EventNone {
+		query.Add("event", string(event))
+	}
+	// Let the tracker know about our IPv6 address, so that IPv6 peers can
+	// find us even though we are announcing over IPv4 (BEP_0007)
+	if ip6 := localIPv6(); ip6 != nil {
+		query.Add("ipv6", ip6.String())
+	}
 	req.URL.RawQuery = query.Encode()
-	return req
+	return req, nil
 }
 
 func do(req *http.Request) (*Response, error) {
-	client := http.Client{}
-
-	resp, err := client.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -163,10 +225,17 @@ func newResponse(dict bencode.Dict) (*Response, error) {
 	// Interface which will be used to extract peers (either a string or list)
 	var src peer.ListSource
 
+	// IPv6 peers come in their own key (BEP_0007). Trackers may leave out
+	// the regular peers key entirely if there are only IPv6 peers.
+	compactPeer6String, err := dict.GetString("peers6")
+	hasPeers6 := err == nil
+
 	// Most trackers should be returning compact peer list, try that first
 	compactPeerString, err := dict.GetString("peers")
 	if err == nil {
 		src = stringSource(compactPeerString)
+	} else if _, missing := err.(*bencode.DictMissingKeyError); missing && hasPeers6 {
+		src = stringSource("")
 	} else {
 		// Else, tracker probably returned non-compact version
 		list, err := dict.GetList("peers")
@@ -181,6 +250,14 @@ func newResponse(dict bencode.Dict) (*Response, error) {
 		return nil, err
 	}
 
+	if hasPeers6 {
+		peers6, err := stringSource6(compactPeer6String).GetPeers()
+		if err != nil {
+			return nil, err
+		}
+		resp.Peers = append(resp.Peers, peers6...)
+	}
+
 	// Optional fields --------------------------------------------------------
 	warn, err := dict.GetString("warning message")
 	if err == nil {
@@ -195,29 +272,51 @@ func newResponse(dict bencode.Dict) (*Response, error) {
 	return &resp, nil
 }
 
+// localIPv6 returns a global unicast IPv6 address of this host, or nil if it
+// doesn't have one.
+func localIPv6() net.IP {
+	addrs, e := net.InterfaceAddrs()
+	if e != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipnet.IP
+		if ip.To4() == nil && ip.IsGlobalUnicast() && !ip.IsPrivate() {
+			return ip
+		}
+	}
+	return nil
+}
+
 // ============================================================================
 // IMPLEMENT INTERFACE ========================================================
 
 // Define 2 new ways to add peers to a peer list using the interface from
 // list.go; using strings and using bencoded lists
 
+// stringSource is a compact IPv4 peer list (BEP_0023)
 type stringSource string
 
 func (s stringSource) GetPeers() (peer.List, error) {
-	if len(s)%6 != 0 {
-		return nil, &Error{msg: fmt.Sprintf("compact peer list must be divisible by 6, length = [%v]", len(s))}
+	peerList, e := peer.ParseCompact([]byte(s))
+	if e != nil {
+		return nil, &Error{msg: e.Error()}
 	}
+	return peerList, nil
+}
 
-	nPeers := uint(len(s) / 6)
-	peerList := make(peer.List, 0, nPeers)
+// stringSource6 is a compact IPv6 peer list (BEP_0007)
+type stringSource6 string
 
-	for i := uint(0); i < nPeers; i++ {
-		start := i * 6
-		ip := net.IPv4(s[start], s[start+1], s[start+2], s[start+3])
-		port := binary.BigEndian.Uint16([]byte(s[start+4 : start+6]))
-		peerList = append(peerList, peer.MakePeer("", ip, port))
+func (s stringSource6) GetPeers() (peer.List, error) {
+	peerList, e := peer.ParseCompact6([]byte(s))
+	if e != nil {
+		return nil, &Error{msg: e.Error()}
 	}
-
 	return peerList, nil
 }
 
@@ -273,7 +372,7 @@ func (r *Response) String() string {
 		if i%5 == 0 {
 			strb.WriteString("\n\t")
 		}
-		strb.WriteString(fmt.Sprintf("(%v:%v) ", v.Ip(), v.Port()))
+		strb.WriteString(fmt.Sprintf("(%v) ", v.Addr()))
 	}
 	return strb.String()
 }
@@ -77,3 +77,73 @@ func TestNewResponseCompact(t *testing.T) {
 	}
 
 }
+
+func TestNewRequest_Event(t *testing.T) {
+	tests := []struct {
+		name  string
+		event Event
+		want  string
+	}{
+		{"none", EventNone, ""},
+		{"started", EventStarted, "started"},
+		{"completed", EventCompleted, "completed"},
+		{"stopped", EventStopped, "stopped"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := newRequest("http://tracker/announce", "infohash", NewStats(1, 2, 3), 60666, "peerid", tt.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			query := req.URL.Query()
+			if got := query.Get("event"); got != tt.want {
+				t.Errorf("event = [%v], want [%v]", got, tt.want)
+			}
+			if _, ok := query["event"]; ok != (tt.event != EventNone) {
+				t.Errorf("event key present = %v", ok)
+			}
+		})
+	}
+}
+
+func TestNewResponsePeers6(t *testing.T) {
+	v4 := string([]byte{10, 0, 0, 7, 0x1A, 0xE1})
+	v6 := string(append(net.ParseIP("2001:db8::7"), 0x1A, 0xE2))
+
+	tests := []struct {
+		name string
+		raw  string
+		want []string
+	}{
+		{
+			name: "both",
+			raw:  fmt.Sprintf("d8:completei1e10:incompletei1e8:intervali900e5:peers6:%v6:peers618:%ve", v4, v6),
+			want: []string{"10.0.0.7:6881", "[2001:db8::7]:6882"},
+		},
+		{
+			name: "only peers6",
+			raw:  fmt.Sprintf("d8:completei1e10:incompletei1e8:intervali900e6:peers618:%ve", v6),
+			want: []string{"[2001:db8::7]:6882"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ben, err := bencode.Decode([]byte(tt.raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := newResponse(ben.(bencode.Dict))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Peers) != len(tt.want) {
+				t.Fatalf("got %v peers, want %v", len(resp.Peers), len(tt.want))
+			}
+			for i := range resp.Peers {
+				if resp.Peers[i].Addr() != tt.want[i] {
+					t.Errorf("peer %v = [%v], want [%v]", i, resp.Peers[i].Addr(), tt.want[i])
+				}
+			}
+		})
+	}
+}
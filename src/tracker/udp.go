@@ -0,0 +1,395 @@
+/* udp.go =====================================================================
+Implements the UDP tracker protocol (BEP_0015). Every request first needs a
+connection ID from the tracker, which is then valid for a minute and is cached
+so that consecutive announces don't need to reconnect. UDP being UDP, requests
+are retransmitted on the 15 * 2^n second schedule that the BEP describes.
+Connecting and the request itself share a single run of that schedule, which
+the caller's context can cut short.
+============================================================================ */
+
+package tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"gotor/peer"
+)
+
+const (
+	udpProtocolId = uint64(0x41727101980)
+
+	udpActionConnect  = uint32(0)
+	udpActionAnnounce = uint32(1)
+	udpActionScrape   = uint32(2)
+	udpActionError    = uint32(3)
+
+	// udpConnIdLife is how long a connection ID may be used for
+	udpConnIdLife = 1 * time.Minute
+
+	// udpMaxPacket is large enough for any response we care about
+	udpMaxPacket = 8192
+
+	// udpMaxScrape is the maximum number of infohashes in a single scrape
+	udpMaxScrape = 74
+)
+
+// udpEvents maps announce events to their UDP tracker encoding
+var udpEvents = map[Event]uint32{
+	EventNone:      0,
+	EventCompleted: 1,
+	EventStarted:   2,
+	EventStopped:   3,
+}
+
+// Retransmission schedule, a request is retried after udpTimeoutBase * 2^n
+// seconds for n = 0..udpMaxRetries. These are variables so that tests don't
+// need to wait around for an hour.
+var (
+	udpTimeoutBase = 15 * time.Second
+	udpMaxRetries  = 8
+)
+
+// ============================================================================
+// STRUCT =====================================================================
+
+// udpTracker holds the cached connection ID for a single UDP tracker.
+type udpTracker struct {
+	host   string
+	connId uint64
+	connAt time.Time
+	sem    chan struct{} // Held for the duration of each request
+}
+
+// udpTrackers caches connection state by tracker host:port
+var udpTrackers = struct {
+	m     map[string]*udpTracker
+	mutex sync.Mutex
+}{m: make(map[string]*udpTracker)}
+
+// udpKey is sent with every announce, so the tracker can identify us if
+// our IP changes.
+var udpKey = rand.New(rand.NewSource(time.Now().UnixNano())).Uint32()
+
+// ============================================================================
+// FUNK =======================================================================
+
+// getUdpTracker returns the cached udpTracker for the announce URL, creating
+// it if needed.
+func getUdpTracker(announce string) (*udpTracker, error) {
+	u, e := url.Parse(announce)
+	if e != nil {
+		return nil, e
+	}
+	if u.Port() == "" {
+		return nil, &Error{msg: fmt.Sprintf("udp tracker [%v] has no port", announce)}
+	}
+
+	udpTrackers.mutex.Lock()
+	defer udpTrackers.mutex.Unlock()
+
+	ut, ok := udpTrackers.m[u.Host]
+	if !ok {
+		ut = &udpTracker{host: u.Host, sem: make(chan struct{}, 1)}
+		udpTrackers.m[u.Host] = ut
+	}
+	return ut, nil
+}
+
+func announceUdp(ctx context.Context, announce string, infohash string, stats *Stats, port uint16, peerId string, event Event) (*Response, error) {
+	ut, e := getUdpTracker(announce)
+	if e != nil {
+		return nil, e
+	}
+	return ut.announce(ctx, infohash, stats, port, peerId, event)
+}
+
+func scrapeUdp(ctx context.Context, announce string, infohashes []string) ([]ScrapeResult, error) {
+	ut, e := getUdpTracker(announce)
+	if e != nil {
+		return nil, e
+	}
+
+	results := make([]ScrapeResult, 0, len(infohashes))
+	for start := 0; start < len(infohashes); start += udpMaxScrape {
+		end := start + udpMaxScrape
+		if end > len(infohashes) {
+			end = len(infohashes)
+		}
+		batch, e := ut.scrape(ctx, infohashes[start:end])
+		if e != nil {
+			return nil, e
+		}
+		results = append(results, batch...)
+	}
+	return results, nil
+}
+
+// ============================================================================
+// REQUESTS ===================================================================
+
+// lock waits for any other request to the tracker to finish, or for ctx to
+// be done.
+func (ut *udpTracker) lock(ctx context.Context) error {
+	select {
+	case ut.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (ut *udpTracker) unlock() {
+	<-ut.sem
+}
+
+func (ut *udpTracker) announce(ctx context.Context, infohash string, stats *Stats, port uint16, peerId string, event Event) (*Response, error) {
+	if e := ut.lock(ctx); e != nil {
+		return nil, e
+	}
+	defer ut.unlock()
+
+	conn, e := net.Dial("udp", ut.host)
+	if e != nil {
+		return nil, e
+	}
+	defer conn.Close()
+
+	// Everything but the connection ID and transaction ID, which are
+	// filled in by request()
+	req := make([]byte, 98)
+	binary.BigEndian.PutUint32(req[8:], udpActionAnnounce)
+	copy(req[16:36], infohash)
+	copy(req[36:56], peerId)
+	binary.BigEndian.PutUint64(req[56:], stats.Dnloaded())
+	binary.BigEndian.PutUint64(req[64:], stats.Left())
+	binary.BigEndian.PutUint64(req[72:], stats.Uploaded())
+	binary.BigEndian.PutUint32(req[80:], udpEvents[event])
+	binary.BigEndian.PutUint32(req[84:], 0) // IP, 0 = use sender's
+	binary.BigEndian.PutUint32(req[88:], udpKey)
+	binary.BigEndian.PutUint32(req[92:], 0xFFFFFFFF) // num_want, -1 = default
+	binary.BigEndian.PutUint16(req[96:], port)
+
+	resp, e := ut.request(ctx, conn, req, 20)
+	if e != nil {
+		return nil, e
+	}
+
+	state := State{
+		interval: uint64(binary.BigEndian.Uint32(resp[8:12])),
+		leechers: uint64(binary.BigEndian.Uint32(resp[12:16])),
+		seeders:  uint64(binary.BigEndian.Uint32(resp[16:20])),
+	}
+
+	// Trackers reached over IPv6 reply with IPv6 peers (BEP_0015)
+	var src peer.ListSource = stringSource(resp[20:])
+	if raddr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && raddr.IP.To4() == nil {
+		src = stringSource6(resp[20:])
+	}
+	peers, e := src.GetPeers()
+	if e != nil {
+		return nil, e
+	}
+
+	return &Response{
+		State: &state,
+		Peers: peers,
+	}, nil
+}
+
+func (ut *udpTracker) scrape(ctx context.Context, infohashes []string) ([]ScrapeResult, error) {
+	if e := ut.lock(ctx); e != nil {
+		return nil, e
+	}
+	defer ut.unlock()
+
+	conn, e := net.Dial("udp", ut.host)
+	if e != nil {
+		return nil, e
+	}
+	defer conn.Close()
+
+	req := make([]byte, 16+20*len(infohashes))
+	binary.BigEndian.PutUint32(req[8:], udpActionScrape)
+	for i, ih := range infohashes {
+		copy(req[16+20*i:], ih)
+	}
+
+	resp, e := ut.request(ctx, conn, req, 8+12*len(infohashes))
+	if e != nil {
+		return nil, e
+	}
+
+	results := make([]ScrapeResult, 0, len(infohashes))
+	for i, ih := range infohashes {
+		off := 8 + 12*i
+		results = append(results, ScrapeResult{
+			Infohash:   ih,
+			Seeders:    uint64(binary.BigEndian.Uint32(resp[off:])),
+			Downloaded: uint64(binary.BigEndian.Uint32(resp[off+4:])),
+			Leechers:   uint64(binary.BigEndian.Uint32(resp[off+8:])),
+		})
+	}
+	return results, nil
+}
+
+// request fills in the connection ID (connecting first if needed) and
+// transaction ID of req, then sends it using the retransmission schedule
+// until a response with at least minLen bytes arrives. Connecting uses up
+// attempts of the same schedule, and ctx being done ends it early. Must be
+// called with the lock held.
+func (ut *udpTracker) request(ctx context.Context, conn net.Conn, req []byte, minLen int) ([]byte, error) {
+	action := binary.BigEndian.Uint32(req[8:12])
+	buf := make([]byte, udpMaxPacket)
+
+	stop := interruptOnDone(ctx, conn)
+	defer stop()
+
+	for n := 0; n <= udpMaxRetries; n++ {
+		if e := expired(ctx); e != nil {
+			return nil, e
+		}
+
+		if time.Since(ut.connAt) >= udpConnIdLife {
+			e := ut.connect(ctx, conn, buf, udpTimeout(n))
+			if isTimeout(e) {
+				continue
+			} else if e != nil {
+				return nil, e
+			}
+		}
+
+		tid := rand.Uint32()
+		binary.BigEndian.PutUint64(req[0:], ut.connId)
+		binary.BigEndian.PutUint32(req[12:], tid)
+
+		resp, e := ut.roundTrip(ctx, conn, req, buf, tid, udpTimeout(n))
+		if isTimeout(e) {
+			continue
+		} else if e != nil {
+			return nil, e
+		}
+
+		if e = checkUdpResponse(resp, action, minLen); e != nil {
+			return nil, e
+		}
+		return resp, nil
+	}
+
+	if e := expired(ctx); e != nil {
+		return nil, e
+	}
+	return nil, &Error{msg: fmt.Sprintf("udp tracker [%v] timed out", ut.host)}
+}
+
+// connect gets a new connection ID from the tracker, waiting up to timeout
+// for the answer. Must be called with the lock held.
+func (ut *udpTracker) connect(ctx context.Context, conn net.Conn, buf []byte, timeout time.Duration) error {
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:], udpProtocolId)
+	binary.BigEndian.PutUint32(req[8:], udpActionConnect)
+	tid := rand.Uint32()
+	binary.BigEndian.PutUint32(req[12:], tid)
+
+	resp, e := ut.roundTrip(ctx, conn, req, buf, tid, timeout)
+	if e != nil {
+		return e
+	}
+	if e = checkUdpResponse(resp, udpActionConnect, 16); e != nil {
+		return e
+	}
+	ut.connId = binary.BigEndian.Uint64(resp[8:16])
+	ut.connAt = time.Now()
+	return nil
+}
+
+// roundTrip sends req and waits for a response with a matching transaction
+// ID, discarding anything else, until the timeout or ctx's deadline expires.
+func (ut *udpTracker) roundTrip(ctx context.Context, conn net.Conn, req []byte, buf []byte, tid uint32, timeout time.Duration) ([]byte, error) {
+	_, e := conn.Write(req)
+	if e != nil {
+		return nil, e
+	}
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	e = conn.SetReadDeadline(deadline)
+	if e != nil {
+		return nil, e
+	}
+
+	// ctx may have been cancelled before the deadline was set, in which case
+	// interruptOnDone's deadline was overwritten
+	if e = ctx.Err(); e != nil {
+		return nil, e
+	}
+
+	for {
+		n, e := conn.Read(buf)
+		if e != nil {
+			return nil, e
+		}
+		if n >= 8 && binary.BigEndian.Uint32(buf[4:8]) == tid {
+			return buf[:n], nil
+		}
+	}
+}
+
+// checkUdpResponse makes sure the response is for the expected action and is
+// long enough, turning error responses into errors.
+func checkUdpResponse(resp []byte, action uint32, minLen int) error {
+	got := binary.BigEndian.Uint32(resp[0:4])
+	if got == udpActionError {
+		return &Error{msg: string(resp[8:])}
+	}
+	if got != action {
+		return &Error{msg: fmt.Sprintf("udp response has action %v, expected %v", got, action)}
+	}
+	if len(resp) < minLen {
+		return &Error{msg: fmt.Sprintf("udp response has length %v, expected at least %v", len(resp), minLen)}
+	}
+	return nil
+}
+
+// interruptOnDone makes reads on conn time out as soon as ctx is done. The
+// returned function stops watching ctx.
+func interruptOnDone(ctx context.Context, conn net.Conn) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetReadDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// expired returns ctx's error, or context.DeadlineExceeded if its deadline
+// has passed but ctx doesn't know yet.
+func expired(ctx context.Context) error {
+	if e := ctx.Err(); e != nil {
+		return e
+	}
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+func udpTimeout(n int) time.Duration {
+	return udpTimeoutBase * time.Duration(1<<n)
+}
+
+func isTimeout(e error) bool {
+	ne, ok := e.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,298 @@
+package tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"gotor/utils/test"
+)
+
+// ============================================================================
+// FAKE TRACKER ===============================================================
+
+// fakeUdpTracker is a tiny BEP_0015 tracker that serves a fixed peer list,
+// used as a local stand-in for real UDP trackers.
+type fakeUdpTracker struct {
+	conn     *net.UDPConn
+	peers    []byte // Compact peer list returned for every announce
+	drop     int    // Number of incoming packets to ignore
+	recv     int    // Number of incoming packets, dropped or not
+	connects int    // Number of connect requests answered
+	fail     string // If set, every announce gets an error response
+	mutex    sync.Mutex
+}
+
+func newFakeUdpTracker(t *testing.T, peers []byte) *fakeUdpTracker {
+	conn, e := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	test.CheckFatal(t, e)
+
+	ft := &fakeUdpTracker{conn: conn, peers: peers}
+	go ft.serve()
+	t.Cleanup(func() { _ = conn.Close() })
+	return ft
+}
+
+func (ft *fakeUdpTracker) setDrop(n int) {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	ft.drop = n
+}
+
+func (ft *fakeUdpTracker) setFail(msg string) {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	ft.fail = msg
+}
+
+func (ft *fakeUdpTracker) numRecv() int {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	return ft.recv
+}
+
+func (ft *fakeUdpTracker) numConnects() int {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	return ft.connects
+}
+
+// expireConnId forgets the cached connection ID for the tracker
+func expireConnId(t *testing.T, announce string) {
+	ut, e := getUdpTracker(announce)
+	test.CheckFatal(t, e)
+	test.CheckFatal(t, ut.lock(context.Background()))
+	ut.connAt = time.Time{}
+	ut.unlock()
+}
+
+func (ft *fakeUdpTracker) url() string {
+	return fmt.Sprintf("udp://%v/announce", ft.conn.LocalAddr())
+}
+
+func (ft *fakeUdpTracker) serve() {
+	buf := make([]byte, 2048)
+	connId := uint64(0xC0FFEE)
+
+	for {
+		n, addr, e := ft.conn.ReadFromUDP(buf)
+		if e != nil {
+			return
+		}
+
+		ft.mutex.Lock()
+		ft.recv++
+		if ft.drop > 0 {
+			ft.drop--
+			ft.mutex.Unlock()
+			continue
+		}
+		fail := ft.fail
+		ft.mutex.Unlock()
+
+		req := buf[:n]
+		action := binary.BigEndian.Uint32(req[8:12])
+		tid := req[12:16]
+		var resp []byte
+
+		switch action {
+		case udpActionConnect:
+			ft.mutex.Lock()
+			ft.connects++
+			ft.mutex.Unlock()
+			resp = make([]byte, 16)
+			binary.BigEndian.PutUint64(resp[8:], connId)
+		case udpActionAnnounce:
+			if binary.BigEndian.Uint64(req[0:8]) != connId {
+				continue
+			}
+			if fail != "" {
+				resp = append(make([]byte, 8), fail...)
+				action = udpActionError
+				break
+			}
+			resp = make([]byte, 20, 20+len(ft.peers))
+			binary.BigEndian.PutUint32(resp[8:], 1800) // interval
+			binary.BigEndian.PutUint32(resp[12:], 3)   // leechers
+			binary.BigEndian.PutUint32(resp[16:], 7)   // seeders
+			resp = append(resp, ft.peers...)
+		case udpActionScrape:
+			nhashes := (n - 16) / 20
+			resp = make([]byte, 8+12*nhashes)
+			for i := 0; i < nhashes; i++ {
+				binary.BigEndian.PutUint32(resp[8+12*i:], uint32(10+i)) // seeders
+				binary.BigEndian.PutUint32(resp[12+12*i:], 100)         // completed
+				binary.BigEndian.PutUint32(resp[16+12*i:], uint32(i))   // leechers
+			}
+		}
+
+		binary.BigEndian.PutUint32(resp[0:], action)
+		copy(resp[4:8], tid)
+		_, _ = ft.conn.WriteToUDP(resp, addr)
+	}
+}
+
+// ============================================================================
+// TESTS ======================================================================
+
+func TestUdpAnnounce(t *testing.T) {
+	peers := []byte{
+		127, 0, 0, 1, 0x1A, 0xE1,
+		10, 0, 0, 7, 0xEC, 0xDA,
+	}
+	ft := newFakeUdpTracker(t, peers)
+	stats := NewStats(0, 0, 1000)
+	infohash := string(make([]byte, 20))
+
+	for i := 0; i < 2; i++ {
+		resp, e := announce(context.Background(), ft.url(), infohash, stats, 60666, "-GT0000-aaaaaaaaaaaa", EventNone)
+		test.CheckFatal(t, e)
+
+		if resp.State.Interval() != 1800 || resp.State.Leechers() != 3 || resp.State.Seeders() != 7 {
+			t.Errorf("bad state\n%v", resp.State)
+		}
+		if len(resp.Peers) != 2 {
+			t.Fatalf("got %v peers, want 2", len(resp.Peers))
+		}
+		if !resp.Peers[1].Ip().Equal(net.IPv4(10, 0, 0, 7)) || resp.Peers[1].Port() != 60634 {
+			t.Errorf("bad peer %v", resp.Peers[1].String())
+		}
+	}
+
+	// Connection ID should have been cached for the second announce
+	if ft.numConnects() != 1 {
+		t.Errorf("tracker got %v connects, want 1", ft.numConnects())
+	}
+
+	// Expire the connection ID, we should connect again
+	expireConnId(t, ft.url())
+	_, e := announce(context.Background(), ft.url(), infohash, stats, 60666, "-GT0000-aaaaaaaaaaaa", EventNone)
+	test.CheckFatal(t, e)
+	if ft.numConnects() != 2 {
+		t.Errorf("tracker got %v connects after expiry, want 2", ft.numConnects())
+	}
+}
+
+func TestUdpRetransmit(t *testing.T) {
+	oldBase, oldRetries := udpTimeoutBase, udpMaxRetries
+	udpTimeoutBase, udpMaxRetries = 20*time.Millisecond, 3
+	defer func() { udpTimeoutBase, udpMaxRetries = oldBase, oldRetries }()
+
+	ft := newFakeUdpTracker(t, nil)
+	stats := NewStats(0, 0, 0)
+	infohash := string(make([]byte, 20))
+
+	// Lose the first connect, and the first announce
+	ft.setDrop(1)
+	_, e := announce(context.Background(), ft.url(), infohash, stats, 60666, "-GT0000-aaaaaaaaaaaa", EventNone)
+	test.CheckError(t, e)
+
+	ft.setDrop(1)
+	_, e = announce(context.Background(), ft.url(), infohash, stats, 60666, "-GT0000-aaaaaaaaaaaa", EventNone)
+	test.CheckError(t, e)
+
+	// Tracker never answers, should give up eventually
+	ft.setDrop(100)
+	expireConnId(t, ft.url())
+	_, e = announce(context.Background(), ft.url(), infohash, stats, 60666, "-GT0000-aaaaaaaaaaaa", EventNone)
+	if e == nil {
+		t.Error("expected timeout error")
+	}
+}
+
+func TestUdpSharedSchedule(t *testing.T) {
+	oldBase, oldRetries := udpTimeoutBase, udpMaxRetries
+	udpTimeoutBase, udpMaxRetries = 20*time.Millisecond, 3
+	defer func() { udpTimeoutBase, udpMaxRetries = oldBase, oldRetries }()
+
+	ft := newFakeUdpTracker(t, nil)
+	ft.setDrop(100)
+
+	// Connecting never succeeds, but must not get a schedule of its own for
+	// every attempt of the announce
+	_, e := announce(context.Background(), ft.url(), string(make([]byte, 20)), NewStats(0, 0, 0), 60666, "-GT0000-aaaaaaaaaaaa", EventNone)
+	if e == nil {
+		t.Fatal("expected timeout error")
+	}
+	if got := ft.numRecv(); got != udpMaxRetries+1 {
+		t.Errorf("tracker got %v packets, want %v", got, udpMaxRetries+1)
+	}
+}
+
+func TestUdpContext(t *testing.T) {
+	ft := newFakeUdpTracker(t, nil)
+	ft.setDrop(1000)
+	infohash := string(make([]byte, 20))
+
+	// The default schedule would wait for hours
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, e := announce(ctx, ft.url(), infohash, NewStats(0, 0, 0), 60666, "-GT0000-aaaaaaaaaaaa", EventNone)
+	if e != context.DeadlineExceeded {
+		t.Errorf("got error %v, want %v", e, context.DeadlineExceeded)
+	}
+	if waited := time.Since(start); waited > 2*time.Second {
+		t.Errorf("announce took %v, expected it to stop at the deadline", waited)
+	}
+
+	// Cancelling works without a deadline too
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	_, e = announce(ctx, ft.url(), infohash, NewStats(0, 0, 0), 60666, "-GT0000-aaaaaaaaaaaa", EventNone)
+	if e != context.Canceled {
+		t.Errorf("got error %v, want %v", e, context.Canceled)
+	}
+
+	// Waiting for another request to the same tracker stops at the deadline
+	ut, e := getUdpTracker(ft.url())
+	test.CheckFatal(t, e)
+	test.CheckFatal(t, ut.lock(context.Background()))
+	defer ut.unlock()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, e = scrapeUdp(ctx, ft.url(), []string{infohash})
+	if e != context.DeadlineExceeded {
+		t.Errorf("got error %v while the tracker was busy, want %v", e, context.DeadlineExceeded)
+	}
+}
+
+func TestUdpError(t *testing.T) {
+	ft := newFakeUdpTracker(t, nil)
+	ft.setFail("torrent not registered")
+
+	_, e := announce(context.Background(), ft.url(), string(make([]byte, 20)), NewStats(0, 0, 0), 60666, "-GT0000-aaaaaaaaaaaa", EventNone)
+	if e == nil {
+		t.Fatal("expected error")
+	}
+	if _, ok := e.(*Error); !ok {
+		t.Errorf("expected *Error, got %T", e)
+	}
+}
+
+func TestUdpScrape(t *testing.T) {
+	ft := newFakeUdpTracker(t, nil)
+
+	hashes := make([]string, 0, 3)
+	for i := 0; i < 3; i++ {
+		h := make([]byte, 20)
+		h[0] = byte(i)
+		hashes = append(hashes, string(h))
+	}
+
+	results, e := scrapeUdp(context.Background(), ft.url(), hashes)
+	test.CheckFatal(t, e)
+
+	if len(results) != len(hashes) {
+		t.Fatalf("got %v results, want %v", len(results), len(hashes))
+	}
+	for i, r := range results {
+		if r.Infohash != hashes[i] || r.Seeders != uint64(10+i) || r.Downloaded != 100 || r.Leechers != uint64(i) {
+			t.Errorf("bad scrape result %v: %+v", i, r)
+		}
+	}
+}
@@ -6,19 +6,34 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+
+	"gotor/mse"
 )
 
 // Valid commands
 const (
-	StartSwarm string = "swarm" // Download/Upload
-	TorInfo           = "info"  // Read and print torrent info
+	StartSwarm string = "swarm"  // Download/Upload
+	TorInfo           = "info"   // Read and print torrent info
+	Scrape            = "scrape" // Scrape the torrent's trackers
+	Verify            = "verify" // Check which pieces are on disk
 )
 
 type Opts struct {
-	input *string // Input torrent path
-	wd    *string // Working directory path
-	port  *uint   // Listen port
-	cmd   *string // What do?
+	input *string  // Input torrent path
+	extra []string // More torrents, given as arguments after the flags
+	wd    *string  // Working directory path
+	port  *uint    // Listen port
+	cmd   *string  // What do?
+	dht   *bool    // Find peers through the DHT
+	lsd   *bool    // Find peers on the local network
+	utp   *bool    // Connect to peers over uTP
+
+	maxConns *uint // Connection limit across all torrents
+	maxPeers *uint // Connection limit per torrent
+	workers  *uint // Pieces hashed at once when checking files
+
+	encStr     *string
+	encryption mse.Policy // Protocol encryption policy
 
 	uplimStr *string
 	dnlimStr *string
@@ -38,15 +53,24 @@ func GetOpts() *Opts {
 
 func initOpts() *Opts {
 	opts = &Opts{}
-	opts.input = flag.String("i", "", "Path to .torrent file")
+	opts.input = flag.String("i", "", "Path to .torrent file, or magnet link")
 	opts.wd = flag.String("w", "", "Working directory")
 	opts.port = flag.Uint("p", 60666, "Port to listen on")
 	opts.cmd = flag.String("cmd", StartSwarm, "Command")
+	opts.dht = flag.Bool("dht", false, "Find peers through the DHT")
+	opts.lsd = flag.Bool("lsd", false, "Find peers on the local network (BEP 14)")
+	opts.utp = flag.Bool("utp", true, "Connect to peers over uTP, falling back to TCP (BEP 29)")
+
+	opts.maxConns = flag.Uint("maxconns", 200, "Most peer connections in total")
+	opts.maxPeers = flag.Uint("maxpeers", 50, "Most peer connections per torrent")
+	opts.workers = flag.Uint("workers", 0, "Pieces hashed at once when checking files, 0 for one per CPU")
+	opts.encStr = flag.String("enc", "prefer", "Protocol encryption: disabled, prefer or require")
 
 	opts.uplimStr = flag.String("u", "-1B", "Upload limit in form X[B|K|M|G]")
 	opts.dnlimStr = flag.String("d", "-1B", "Download limit in form X[B|K|M|G]")
 
 	flag.Parse()
+	opts.extra = flag.Args()
 
 	e := opts.Validate()
 	if e != nil {
@@ -66,12 +90,19 @@ func (o *Opts) Validate() error {
 	}
 
 	switch *o.cmd {
-	case StartSwarm, TorInfo:
+	case StartSwarm, TorInfo, Scrape, Verify:
 		break
 	default:
 		return fmt.Errorf("invalid command given, [%v]", *o.cmd)
 	}
 
+	// Encryption policy
+	p, e := mse.ParsePolicy(*opts.encStr)
+	if e != nil {
+		return e
+	}
+	opts.encryption = p
+
 	// Upload limit
 	v, e := parseSizeUnits(*opts.uplimStr)
 	if e != nil {
@@ -152,6 +183,11 @@ func (o *Opts) Input() string {
 	return *o.input
 }
 
+// Inputs returns every torrent to run, the -i input first.
+func (o *Opts) Inputs() []string {
+	return append([]string{o.Input()}, o.extra...)
+}
+
 func (o *Opts) WorkingDir() string {
 	return *o.wd
 }
@@ -164,6 +200,34 @@ func (o *Opts) Cmd() string {
 	return *o.cmd
 }
 
+func (o *Opts) DHT() bool {
+	return *o.dht
+}
+
+func (o *Opts) LSD() bool {
+	return *o.lsd
+}
+
+func (o *Opts) MaxConns() int {
+	return int(*o.maxConns)
+}
+
+func (o *Opts) MaxPeers() int {
+	return int(*o.maxPeers)
+}
+
+func (o *Opts) Workers() int {
+	return int(*o.workers)
+}
+
+func (o *Opts) UTP() bool {
+	return *o.utp
+}
+
+func (o *Opts) Encryption() mse.Policy {
+	return o.encryption
+}
+
 func (o *Opts) UpLimit() int64 {
 	return o.uplim
 }
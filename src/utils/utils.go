@@ -10,6 +10,9 @@ import (
 
 const GotorPeerString string = "-GT0000-"
 
+// GotorVersion is the client name and version we give other peers.
+const GotorVersion string = "gotor 0.0.0"
+
 func NewPeerId() string {
 	return GotorPeerString + randStringBytesMaskImprSrcSB(12)
 }
@@ -0,0 +1,583 @@
+package utp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPayload keeps packets, with header and selective acks, well under
+	// the usual 1500 byte MTU.
+	maxPayload = 1300
+
+	// recvWindow is the receive buffer we advertise. Data that arrives in
+	// order is never dropped, so this is only a hint to the sender.
+	recvWindow = 1 << 20
+
+	// maxReorder is how far ahead of the last in-order packet we buffer
+	// packets. Anything further is dropped and will be resent.
+	maxReorder = 1024
+
+	initialRTO = time.Second
+	minRTO     = 500 * time.Millisecond
+	maxRTO     = 8 * time.Second
+
+	// maxRetries is how many timeouts in a row we take before giving up on
+	// the connection.
+	maxRetries = 6
+
+	// maxSynRetries is the same for the connection attempt
+	maxSynRetries = 3
+
+	// keepAliveInterval is how long we stay quiet before sending an empty
+	// ack, which keeps NAT mappings open.
+	keepAliveInterval = 29 * time.Second
+
+	// lingerTimeout is how long a closed connection waits for its last
+	// packets to be acked.
+	lingerTimeout = 30 * time.Second
+)
+
+type connState int
+
+const (
+	stateSynSent connState = iota
+	stateConnected
+)
+
+// ============================================================================
+// STRUCTS ====================================================================
+
+// Conn is a uTP connection. It is a net.Conn, so it can be used anywhere a
+// TCP connection is.
+type Conn struct {
+	socket *Socket
+	raddr  *net.UDPAddr
+	recvId uint16 // Connection ID on packets we receive
+	sendId uint16 // Connection ID on packets we send
+
+	mutex sync.Mutex
+	cond  *sync.Cond // Wakes up Read, Write and Dial
+	state connState
+	err   error     // Why the connection broke, nil while it works
+	done  bool      // Removed from the socket
+	close time.Time // When Close was called, zero until then
+
+	// Sending
+	seq      uint16        // Next sequence number
+	outq     []*outPacket  // Sent but not acked, oldest first
+	inflight int           // Payload bytes in outq
+	peerWnd  uint32        // Receive window the peer advertised
+	cc       *ledbat       // Congestion control
+	rtt      time.Duration // Smoothed round trip time, 0 until measured
+	rttVar   time.Duration // Round trip time variance
+	rto      time.Duration // Retransmission timeout
+	rtoAt    time.Time     // When the oldest packet in outq times out
+	retries  int           // Timeouts in a row
+	lastAck  uint16        // Ack number of the last packet received
+	dupAcks  int           // Acks in a row that didn't ack anything
+	lastSend time.Time     // For keep alives
+
+	// Receiving
+	ack        uint16       // Last sequence number received in order
+	rbuf       bytes.Buffer // Data ready to be read
+	reorder    map[uint16]*inPacket
+	eof        bool   // The peer's FIN was received in order
+	replyDelay uint32 // Delay of the peer's last packet, sent back as tsDiff
+
+	rdeadline time.Time
+	wdeadline time.Time
+	rtimer    *time.Timer
+	wtimer    *time.Timer
+}
+
+// outPacket is a data or FIN packet that has been sent but not acked.
+type outPacket struct {
+	typ     uint8
+	seq     uint16
+	payload []byte
+	sentAt  time.Time
+	sends   int
+}
+
+// inPacket is a data or FIN packet that arrived out of order.
+type inPacket struct {
+	typ     uint8
+	payload []byte
+}
+
+// ============================================================================
+// CONSTRUCTORS ===============================================================
+
+func newConn(s *Socket, raddr *net.UDPAddr, recvId uint16, sendId uint16) *Conn {
+	c := Conn{
+		socket:  s,
+		raddr:   raddr,
+		recvId:  recvId,
+		sendId:  sendId,
+		outq:    make([]*outPacket, 0, 16),
+		peerWnd: recvWindow,
+		cc:      newLedbat(),
+		rto:     initialRTO,
+		reorder: make(map[uint16]*inPacket),
+	}
+	c.cond = sync.NewCond(&c.mutex)
+	return &c
+}
+
+// ============================================================================
+// NET.CONN ===================================================================
+
+// Read reads data in order, blocking until there is some. Returns io.EOF
+// once the peer has closed its side and all its data has been read.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for c.rbuf.Len() == 0 {
+		switch {
+		case !c.close.IsZero():
+			return 0, net.ErrClosed
+		case c.eof:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		case expired(c.rdeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+
+	// Let the peer know when a full window opens up again
+	wasFull := c.rbuf.Len() >= recvWindow
+	n, _ := c.rbuf.Read(b)
+	if wasFull && c.rbuf.Len() < recvWindow {
+		c.sendState()
+	}
+	return n, nil
+}
+
+// Write sends the data, blocking while the congestion window or the peer's
+// receive window is full. It returns once all of b has been handed to the
+// network, not when it has been acked.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	written := 0
+	for written < len(b) {
+		n := len(b) - written
+		if n > maxPayload {
+			n = maxPayload
+		}
+
+		for !c.canSend(n) {
+			switch {
+			case !c.close.IsZero():
+				return written, net.ErrClosed
+			case c.err != nil:
+				return written, c.err
+			case expired(c.wdeadline):
+				return written, os.ErrDeadlineExceeded
+			}
+			c.cond.Wait()
+		}
+		if !c.close.IsZero() {
+			return written, net.ErrClosed
+		}
+		if c.err != nil {
+			return written, c.err
+		}
+
+		payload := make([]byte, n)
+		copy(payload, b[written:])
+		c.queue(stData, payload)
+		written += n
+	}
+	return written, nil
+}
+
+// Close sends a FIN after any data already written. The connection stays
+// around until the FIN is acked, or lingerTimeout passes.
+func (c *Conn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.close.IsZero() {
+		return nil
+	}
+	c.close = time.Now()
+	if c.err == nil && c.state == stateConnected {
+		c.queue(stFin, nil)
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.socket.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	e := c.SetReadDeadline(t)
+	if e != nil {
+		return e
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.rdeadline = t
+	c.rtimer = c.resetTimer(c.rtimer, t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.wdeadline = t
+	c.wtimer = c.resetTimer(c.wtimer, t)
+	return nil
+}
+
+// resetTimer wakes up everyone waiting on the connection at t, so Read and
+// Write notice their deadline has passed.
+func (c *Conn) resetTimer(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	c.cond.Broadcast()
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() {
+		c.mutex.Lock()
+		c.cond.Broadcast()
+		c.mutex.Unlock()
+	})
+}
+
+// ============================================================================
+// SENDING ====================================================================
+
+// canSend returns true if n more bytes fit in the congestion window and the
+// peer's receive window. Something can always be sent when nothing is in
+// flight, so a closed window is probed rather than waited on forever.
+func (c *Conn) canSend(n int) bool {
+	if c.inflight == 0 {
+		return true
+	}
+	wnd := c.cc.window()
+	if int(c.peerWnd) < wnd {
+		wnd = int(c.peerWnd)
+	}
+	return c.inflight+n <= wnd
+}
+
+// queue sends a data or FIN packet and keeps it until it's acked.
+func (c *Conn) queue(typ uint8, payload []byte) {
+	p := &outPacket{typ: typ, seq: c.seq, payload: payload}
+	c.seq++
+	c.outq = append(c.outq, p)
+	c.inflight += len(payload)
+	if c.rtoAt.IsZero() {
+		c.rtoAt = time.Now().Add(c.rto)
+	}
+	c.transmit(p)
+}
+
+func (c *Conn) transmit(p *outPacket) {
+	p.sentAt = time.Now()
+	p.sends++
+	c.send(p.typ, p.seq, p.payload)
+}
+
+// sendState acks everything we have received.
+func (c *Conn) sendState() {
+	c.send(stState, c.seq, nil)
+}
+
+func (c *Conn) send(typ uint8, seq uint16, payload []byte) {
+	h := header{
+		typ:    typ,
+		connId: c.sendId,
+		ts:     timestamp(),
+		tsDiff: c.replyDelay,
+		wnd:    c.window(),
+		seq:    seq,
+		ack:    c.ack,
+		sack:   c.sack(),
+	}
+	if typ == stSyn {
+		h.connId = c.recvId
+	}
+	c.lastSend = time.Now()
+	c.socket.writeTo(h.encode(payload), c.raddr)
+}
+
+// window returns the receive window we advertise.
+func (c *Conn) window() uint32 {
+	if c.rbuf.Len() >= recvWindow {
+		return 0
+	}
+	return uint32(recvWindow - c.rbuf.Len())
+}
+
+// sack returns the selective ack bitmask for the packets we have past the
+// first missing one, or nil if nothing is missing.
+func (c *Conn) sack() []byte {
+	if len(c.reorder) == 0 {
+		return nil
+	}
+	mask := make([]byte, sackLen)
+	any := false
+	for seq := range c.reorder {
+		i := int(seq - c.ack - 2)
+		if i >= 0 && i < sackLen*8 {
+			mask[i/8] |= 1 << (i % 8)
+			any = true
+		}
+	}
+	if !any {
+		return nil
+	}
+	return mask
+}
+
+// ============================================================================
+// RECEIVING ==================================================================
+
+// handle processes a packet from the peer. Called by the socket's read loop.
+func (c *Conn) handle(h *header, payload []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.done {
+		return
+	}
+	if h.typ == stReset {
+		c.fail(&Error{msg: "connection reset by peer"})
+		return
+	}
+
+	now := time.Now()
+	c.replyDelay = timestamp() - h.ts
+	c.peerWnd = h.wnd
+
+	if c.state == stateSynSent {
+		if h.typ != stState {
+			return
+		}
+		// The ack of our SYN carries the peer's first sequence number, but
+		// doesn't use it up
+		c.state = stateConnected
+		c.ack = h.seq - 1
+		c.retries = 0
+		c.rtoAt = time.Time{}
+		c.cond.Broadcast()
+	}
+
+	if h.typ == stSyn {
+		// Our ack of the SYN was lost
+		c.sendState()
+		return
+	}
+	c.handleAck(h, now)
+
+	if h.typ == stData || h.typ == stFin {
+		c.receive(h, payload)
+		c.sendState()
+	}
+}
+
+// handleAck drops the packets the peer acked, adjusts the window and
+// retransmits lost packets.
+func (c *Conn) handleAck(h *header, now time.Time) {
+	acked := 0
+	for len(c.outq) > 0 && !seqLess(h.ack, c.outq[0].seq) {
+		acked += c.acked(c.outq[0], now)
+		c.outq = c.outq[1:]
+	}
+	sacked := h.sacked()
+	for _, seq := range sacked {
+		for i, p := range c.outq {
+			if p.seq == seq {
+				acked += c.acked(p, now)
+				c.outq = append(c.outq[:i], c.outq[i+1:]...)
+				break
+			}
+		}
+	}
+
+	if acked > 0 {
+		c.cc.onAck(acked, h.tsDiff, now)
+		c.retries = 0
+		c.dupAcks = 0
+		c.rtoAt = time.Time{}
+		if len(c.outq) > 0 {
+			c.rtoAt = now.Add(c.rto)
+		}
+		c.cond.Broadcast()
+	} else if h.typ == stState && len(c.outq) > 0 && h.ack == c.lastAck {
+		c.dupAcks++
+	}
+	c.lastAck = h.ack
+
+	// Three duplicate acks, or three packets acked past the oldest one,
+	// mean it was lost
+	if len(c.outq) > 0 && (c.dupAcks >= 3 || len(sacked) >= 3) {
+		p := c.outq[0]
+		if p.seq == h.ack+1 && now.Sub(p.sentAt) > c.rtt {
+			c.cc.onLoss(c.rtt, now)
+			c.dupAcks = 0
+			c.transmit(p)
+		}
+	}
+}
+
+// acked updates the round trip time from an acked packet, and returns its
+// payload size. Retransmitted packets are ambiguous and skipped.
+func (c *Conn) acked(p *outPacket, now time.Time) int {
+	c.inflight -= len(p.payload)
+	if p.sends == 1 {
+		sample := now.Sub(p.sentAt)
+		if c.rtt == 0 {
+			c.rtt = sample
+			c.rttVar = sample / 2
+		} else {
+			diff := c.rtt - sample
+			if diff < 0 {
+				diff = -diff
+			}
+			c.rttVar += (diff - c.rttVar) / 4
+			c.rtt += (sample - c.rtt) / 8
+		}
+		c.rto = c.rtt + 4*c.rttVar
+		if c.rto < minRTO {
+			c.rto = minRTO
+		}
+	}
+	return len(p.payload)
+}
+
+// receive puts data in order, buffering packets that arrive early.
+func (c *Conn) receive(h *header, payload []byte) {
+	if c.eof || !seqLess(c.ack, h.seq) {
+		// Duplicate, the ack we send will tell the peer
+		return
+	}
+	if h.seq-c.ack > maxReorder {
+		return
+	}
+	if h.seq != c.ack+1 {
+		buf := make([]byte, len(payload))
+		copy(buf, payload)
+		c.reorder[h.seq] = &inPacket{typ: h.typ, payload: buf}
+		return
+	}
+
+	c.deliver(h.typ, payload)
+	for !c.eof {
+		p, ok := c.reorder[c.ack+1]
+		if !ok {
+			break
+		}
+		delete(c.reorder, c.ack+1)
+		c.deliver(p.typ, p.payload)
+	}
+	c.cond.Broadcast()
+}
+
+func (c *Conn) deliver(typ uint8, payload []byte) {
+	c.ack++
+	if typ == stFin {
+		c.eof = true
+		c.reorder = make(map[uint16]*inPacket)
+		return
+	}
+	c.rbuf.Write(payload)
+}
+
+// ============================================================================
+// TIMERS =====================================================================
+
+// tick retransmits on timeouts and sends keep alives. Returns false once the
+// connection is finished and can be removed from the socket.
+func (c *Conn) tick(now time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	alive := c.tickLocked(now)
+	if !alive {
+		c.done = true
+	}
+	return alive
+}
+
+func (c *Conn) tickLocked(now time.Time) bool {
+	if c.err != nil {
+		return false
+	}
+	if !c.close.IsZero() && (len(c.outq) == 0 || now.Sub(c.close) > lingerTimeout) {
+		return false
+	}
+
+	if c.state == stateSynSent {
+		if now.After(c.rtoAt) {
+			if c.retries >= maxSynRetries {
+				c.fail(&Error{msg: "connection timed out"})
+				return false
+			}
+			c.retries++
+			c.rto *= 2
+			c.rtoAt = now.Add(c.rto)
+			c.send(stSyn, c.seq-1, nil)
+		}
+		return true
+	}
+
+	if len(c.outq) > 0 && now.After(c.rtoAt) {
+		if c.retries >= maxRetries {
+			c.fail(&Error{msg: "connection timed out"})
+			return false
+		}
+		c.retries++
+		c.cc.onTimeout()
+		c.rto *= 2
+		if c.rto > maxRTO {
+			c.rto = maxRTO
+		}
+		c.rtoAt = now.Add(c.rto)
+		c.transmit(c.outq[0])
+	} else if now.Sub(c.lastSend) > keepAliveInterval {
+		c.sendState()
+	}
+	return true
+}
+
+// fail breaks the connection, waking up everyone waiting on it.
+func (c *Conn) fail(e error) {
+	if c.err == nil {
+		c.err = e
+	}
+	c.cond.Broadcast()
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// timestamp returns the current time in microseconds, which wraps around.
+func timestamp() uint32 {
+	return uint32(time.Now().UnixNano() / 1000)
+}
@@ -0,0 +1,111 @@
+package utp
+
+import (
+	"time"
+)
+
+const (
+	// targetDelay is the queuing delay LEDBAT aims for. Below it the window
+	// grows, above it the window shrinks, so uTP backs off before TCP does
+	// and doesn't fill up the queues in home routers.
+	targetDelay = 100 * time.Millisecond
+
+	// maxCwndIncrease is how much the window can grow per round trip, when
+	// there is no queuing delay at all.
+	maxCwndIncrease = 3000
+
+	// minWindow and maxWindow bound the congestion window
+	minWindow = maxPayload
+	maxWindow = 1 << 20
+
+	// baseDelayBucket is how long each base delay bucket lasts. The base
+	// delay is the smallest delay seen over the last two buckets, so it
+	// follows route changes.
+	baseDelayBucket = time.Minute
+)
+
+// ledbat is the LEDBAT congestion controller (RFC 6817). The window is in
+// bytes.
+type ledbat struct {
+	cwnd float64
+
+	base         [2]uint32 // Smallest delay in the previous and current bucket
+	baseStart    time.Time // When the current bucket started
+	haveBase     bool
+	lastDecrease time.Time // Last time the window was cut for a loss
+}
+
+func newLedbat() *ledbat {
+	return &ledbat{cwnd: 2 * minWindow}
+}
+
+// window returns the congestion window in bytes.
+func (l *ledbat) window() int {
+	return int(l.cwnd)
+}
+
+// onAck grows or shrinks the window after acked bytes were acked. delay is
+// the one way delay the peer measured on our last packet, in microseconds,
+// 0 if it doesn't know it yet.
+func (l *ledbat) onAck(acked int, delay uint32, now time.Time) {
+	if delay == 0 {
+		return
+	}
+	l.addDelay(delay, now)
+
+	// The clocks aren't synchronized, so the delay itself means nothing.
+	// What's above the smallest delay seen is the queuing delay.
+	queuing := time.Duration(delay-l.baseDelay()) * time.Microsecond
+	offTarget := float64(targetDelay-queuing) / float64(targetDelay)
+
+	l.cwnd += maxCwndIncrease * offTarget * float64(acked) / l.cwnd
+	l.clamp()
+}
+
+// onLoss halves the window, at most once per round trip, since losses tend
+// to come in bursts.
+func (l *ledbat) onLoss(rtt time.Duration, now time.Time) {
+	if now.Sub(l.lastDecrease) < rtt {
+		return
+	}
+	l.lastDecrease = now
+	l.cwnd /= 2
+	l.clamp()
+}
+
+// onTimeout drops the window to its minimum.
+func (l *ledbat) onTimeout() {
+	l.cwnd = minWindow
+}
+
+func (l *ledbat) clamp() {
+	if l.cwnd < minWindow {
+		l.cwnd = minWindow
+	} else if l.cwnd > maxWindow {
+		l.cwnd = maxWindow
+	}
+}
+
+func (l *ledbat) addDelay(delay uint32, now time.Time) {
+	if !l.haveBase {
+		l.base = [2]uint32{delay, delay}
+		l.baseStart = now
+		l.haveBase = true
+		return
+	}
+	if now.Sub(l.baseStart) >= baseDelayBucket {
+		l.base[0] = l.base[1]
+		l.base[1] = delay
+		l.baseStart = now
+	}
+	if delay < l.base[1] {
+		l.base[1] = delay
+	}
+}
+
+func (l *ledbat) baseDelay() uint32 {
+	if l.base[0] < l.base[1] {
+		return l.base[0]
+	}
+	return l.base[1]
+}
@@ -0,0 +1,71 @@
+package utp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLedbat(t *testing.T) {
+	const base = uint32(50000) // 50ms of clock offset and propagation delay
+	tests := []struct {
+		name    string
+		queuing time.Duration
+		grows   bool
+		shrinks bool
+	}{
+		{name: "Empty queue", queuing: 0, grows: true},
+		{name: "Below target", queuing: targetDelay / 2, grows: true},
+		{name: "Above target", queuing: 2 * targetDelay, shrinks: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			l := newLedbat()
+			l.cwnd = 20 * maxPayload
+			l.onAck(maxPayload, base, now)
+
+			before := l.window()
+			delay := base + uint32(tt.queuing/time.Microsecond)
+			for i := 0; i < 10; i++ {
+				l.onAck(maxPayload, delay, now)
+			}
+			if tt.grows && l.window() <= before {
+				t.Errorf("expected window to grow from %v, got %v", before, l.window())
+			}
+			if tt.shrinks && l.window() >= before {
+				t.Errorf("expected window to shrink from %v, got %v", before, l.window())
+			}
+		})
+	}
+}
+
+func TestLedbat_Loss(t *testing.T) {
+	now := time.Now()
+	l := newLedbat()
+	l.cwnd = 40 * maxPayload
+
+	l.onLoss(100*time.Millisecond, now)
+	if l.window() != 20*maxPayload {
+		t.Fatalf("expected window to halve, got %v", l.window())
+	}
+
+	// Losses within a round trip are the same congestion event
+	l.onLoss(100*time.Millisecond, now.Add(50*time.Millisecond))
+	if l.window() != 20*maxPayload {
+		t.Fatalf("expected window to stay, got %v", l.window())
+	}
+
+	l.onLoss(100*time.Millisecond, now.Add(200*time.Millisecond))
+	if l.window() != 10*maxPayload {
+		t.Fatalf("expected window to halve again, got %v", l.window())
+	}
+
+	l.onTimeout()
+	if l.window() != minWindow {
+		t.Fatalf("expected minimum window after timeout, got %v", l.window())
+	}
+	l.onLoss(100*time.Millisecond, now.Add(time.Second))
+	if l.window() != minWindow {
+		t.Fatalf("window went below minimum: %v", l.window())
+	}
+}
@@ -0,0 +1,126 @@
+package utp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Packet types
+const (
+	stData  = uint8(0)
+	stFin   = uint8(1)
+	stState = uint8(2)
+	stReset = uint8(3)
+	stSyn   = uint8(4)
+)
+
+const (
+	version   = 1
+	headerLen = 20
+
+	// extSack is the selective ack extension
+	extSack = uint8(1)
+
+	// sackLen is the length of the selective ack bitmask we send, which
+	// covers the 32 packets after the first missing one.
+	sackLen = 4
+)
+
+// header is the uTP packet header, with the selective acks from its
+// extensions. Other extensions are skipped.
+type header struct {
+	typ    uint8
+	connId uint16
+	ts     uint32 // Send time in microseconds
+	tsDiff uint32 // Delay measured on the last packet received
+	wnd    uint32 // Bytes the sender is willing to receive
+	seq    uint16
+	ack    uint16
+	sack   []byte // Bit i is set if packet ack+2+i was received
+}
+
+// encode makes the packet from the header and payload.
+func (h *header) encode(payload []byte) []byte {
+	n := headerLen + len(payload)
+	if h.sack != nil {
+		n += 2 + len(h.sack)
+	}
+	buf := make([]byte, headerLen, n)
+
+	buf[0] = h.typ<<4 | version
+	if h.sack != nil {
+		buf[1] = extSack
+	}
+	binary.BigEndian.PutUint16(buf[2:], h.connId)
+	binary.BigEndian.PutUint32(buf[4:], h.ts)
+	binary.BigEndian.PutUint32(buf[8:], h.tsDiff)
+	binary.BigEndian.PutUint32(buf[12:], h.wnd)
+	binary.BigEndian.PutUint16(buf[16:], h.seq)
+	binary.BigEndian.PutUint16(buf[18:], h.ack)
+
+	if h.sack != nil {
+		buf = append(buf, 0, byte(len(h.sack)))
+		buf = append(buf, h.sack...)
+	}
+	return append(buf, payload...)
+}
+
+// isPacket does a quick check for whether data could be a uTP packet, so
+// other protocols can share the socket.
+func isPacket(data []byte) bool {
+	return len(data) >= headerLen && data[0]&0x0f == version && data[0]>>4 <= stSyn
+}
+
+// decodePacket parses a packet into its header and payload.
+func decodePacket(data []byte) (*header, []byte, error) {
+	if !isPacket(data) {
+		return nil, nil, &Error{msg: "not a uTP packet"}
+	}
+
+	h := header{
+		typ:    data[0] >> 4,
+		connId: binary.BigEndian.Uint16(data[2:]),
+		ts:     binary.BigEndian.Uint32(data[4:]),
+		tsDiff: binary.BigEndian.Uint32(data[8:]),
+		wnd:    binary.BigEndian.Uint32(data[12:]),
+		seq:    binary.BigEndian.Uint16(data[16:]),
+		ack:    binary.BigEndian.Uint16(data[18:]),
+	}
+
+	// Extensions are a linked list of (next type, length, data)
+	ext := data[1]
+	rest := data[headerLen:]
+	for ext != 0 {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return nil, nil, &Error{msg: "truncated extension"}
+		}
+		next, extLen := rest[0], int(rest[1])
+		if ext == extSack {
+			if extLen == 0 || extLen%4 != 0 {
+				return nil, nil, &Error{msg: fmt.Sprintf("bad selective ack length [%v]", extLen)}
+			}
+			h.sack = rest[2 : 2+extLen]
+		}
+		ext = next
+		rest = rest[2+extLen:]
+	}
+	return &h, rest, nil
+}
+
+// sacked returns the sequence numbers acked by the selective ack bitmask.
+func (h *header) sacked() []uint16 {
+	seqs := make([]uint16, 0)
+	for i, b := range h.sack {
+		for bit := 0; bit < 8; bit++ {
+			if b&(1<<bit) != 0 {
+				seqs = append(seqs, h.ack+2+uint16(i*8+bit))
+			}
+		}
+	}
+	return seqs
+}
+
+// seqLess compares sequence numbers, which wrap around.
+func seqLess(a uint16, b uint16) bool {
+	return int16(a-b) < 0
+}
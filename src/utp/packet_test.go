@@ -0,0 +1,81 @@
+package utp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"gotor/utils/test"
+)
+
+func TestPacket(t *testing.T) {
+	tests := []struct {
+		name    string
+		h       header
+		payload []byte
+	}{
+		{name: "Syn", h: header{typ: stSyn, connId: 7, ts: 1, wnd: 100, seq: 1}},
+		{name: "Data", h: header{typ: stData, connId: 8, ts: 2, tsDiff: 3, wnd: 4, seq: 5, ack: 6}, payload: []byte("payload")},
+		{name: "Sack", h: header{typ: stState, connId: 9, seq: 65535, ack: 65534, sack: []byte{0x05, 0, 0, 0x80}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, payload, e := decodePacket(tt.h.encode(tt.payload))
+			test.CheckFatal(t, e)
+			if !reflect.DeepEqual(*h, tt.h) {
+				t.Errorf("expected %+v, got %+v", tt.h, *h)
+			}
+			if !bytes.Equal(payload, tt.payload) {
+				t.Errorf("expected payload %q, got %q", tt.payload, payload)
+			}
+		})
+	}
+}
+
+func TestDecodePacket_Extensions(t *testing.T) {
+	h := header{typ: stState, seq: 1, ack: 10}
+	data := h.encode(nil)
+
+	// Unknown extension 2 followed by selective acks
+	data[1] = 2
+	data = append(data, extSack, 3, 'x', 'y', 'z', 0, 4, 0x01, 0, 0, 0x01)
+	data = append(data, "payload"...)
+
+	got, payload, e := decodePacket(data)
+	test.CheckFatal(t, e)
+	if string(payload) != "payload" {
+		t.Errorf("expected payload after extensions, got %q", payload)
+	}
+	if !reflect.DeepEqual(got.sacked(), []uint16{12, 36}) {
+		t.Errorf("expected 12 and 36 sacked, got %v", got.sacked())
+	}
+
+	bad := [][]byte{
+		[]byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"),
+		h.encode(nil)[:headerLen-1],
+		append(append([]byte{}, data[:headerLen]...), 0, 10),
+	}
+	for _, b := range bad {
+		if _, _, e := decodePacket(b); e == nil {
+			t.Errorf("expected error for %q", b)
+		}
+	}
+}
+
+func TestSeqLess(t *testing.T) {
+	tests := []struct {
+		a, b uint16
+		less bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{2, 2, false},
+		{65535, 0, true},
+		{0, 65535, false},
+	}
+	for _, tt := range tests {
+		if seqLess(tt.a, tt.b) != tt.less {
+			t.Errorf("seqLess(%v, %v) should be %v", tt.a, tt.b, tt.less)
+		}
+	}
+}
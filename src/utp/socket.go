@@ -0,0 +1,465 @@
+/* socket.go ==================================================================
+The Micro Transport Protocol (BEP_0029). uTP carries reliable, ordered
+streams over UDP, like TCP, but uses LEDBAT congestion control so that it
+yields to other traffic on the link instead of competing with it.
+
+A Socket owns a UDP socket and multiplexes any number of connections over
+it, both accepted and dialed. Packets that aren't uTP are handed to
+PacketConn, so the DHT can share the port.
+============================================================================ */
+
+package utp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// tickInterval is how often connections check their timers
+	tickInterval = 50 * time.Millisecond
+
+	// acceptBacklog is how many connections can wait for Accept before new
+	// ones are reset.
+	acceptBacklog = 32
+
+	// otherBacklog is how many packets for PacketConn are buffered before
+	// new ones are dropped.
+	otherBacklog = 64
+
+	maxPacketSize = 65535
+)
+
+// ============================================================================
+// ERRORS =====================================================================
+
+type Error struct{ msg string }
+
+func (e *Error) Error() string {
+	return "utp error: " + e.msg
+}
+
+// ============================================================================
+// STRUCTS ====================================================================
+
+// Socket runs uTP over a packet connection. It is a net.Listener, and can
+// dial connections too.
+type Socket struct {
+	pconn net.PacketConn
+
+	conns map[connKey]*Conn
+	mutex sync.Mutex // Guards conns
+
+	chAccept  chan *Conn
+	other     *otherConn
+	chDone    chan struct{}
+	closeOnce sync.Once
+	procs     sync.WaitGroup
+}
+
+// connKey identifies a connection by the peer's address and the ID on the
+// packets we receive from it.
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// ============================================================================
+// FUNK =======================================================================
+
+// Listen opens a UDP socket on the address and runs uTP on it.
+func Listen(network string, addr string) (*Socket, error) {
+	pconn, e := net.ListenPacket(network, addr)
+	if e != nil {
+		return nil, e
+	}
+	return NewSocket(pconn), nil
+}
+
+// NewSocket runs uTP on an existing packet connection, which the Socket
+// takes over.
+func NewSocket(pconn net.PacketConn) *Socket {
+	s := Socket{
+		pconn:    pconn,
+		conns:    make(map[connKey]*Conn),
+		chAccept: make(chan *Conn, acceptBacklog),
+		chDone:   make(chan struct{}),
+	}
+	s.other = newOtherConn(&s)
+
+	s.procs.Add(2)
+	go s.readLoop()
+	go s.tickLoop()
+	return &s
+}
+
+// Accept waits for the next incoming connection.
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.chAccept:
+		return c, nil
+	case <-s.chDone:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.pconn.LocalAddr()
+}
+
+// PacketConn returns a packet connection on the same port, which gets every
+// packet that isn't uTP.
+func (s *Socket) PacketConn() net.PacketConn {
+	return s.other
+}
+
+// Close breaks every connection and closes the UDP socket.
+func (s *Socket) Close() error {
+	var e error
+	s.closeOnce.Do(func() {
+		close(s.chDone)
+		e = s.pconn.Close()
+		s.procs.Wait()
+
+		s.mutex.Lock()
+		for key, c := range s.conns {
+			c.mutex.Lock()
+			c.fail(net.ErrClosed)
+			c.done = true
+			c.mutex.Unlock()
+			delete(s.conns, key)
+		}
+		s.mutex.Unlock()
+	})
+	return e
+}
+
+// Dial connects to the uTP peer at addr.
+func (s *Socket) Dial(addr string) (net.Conn, error) {
+	return s.DialContext(context.Background(), addr)
+}
+
+// DialContext connects to the uTP peer at addr, giving up when the context
+// is done or the connection attempt times out.
+func (s *Socket) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	raddr, e := net.ResolveUDPAddr(s.pconn.LocalAddr().Network(), addr)
+	if e != nil {
+		return nil, e
+	}
+
+	// Pick an ID nobody is using with this peer. Our send ID is one more.
+	s.mutex.Lock()
+	var c *Conn
+	for c == nil {
+		id := randomUint16()
+		key := connKey{addr: raddr.String(), id: id}
+		if _, ok := s.conns[key]; !ok {
+			c = newConn(s, raddr, id, id+1)
+			s.conns[key] = c
+		}
+	}
+	s.mutex.Unlock()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.seq = 1
+	c.send(stSyn, c.seq, nil)
+	c.seq++
+	c.rtoAt = time.Now().Add(c.rto)
+
+	// Wake up when the context is done
+	chConnected := make(chan struct{})
+	defer close(chConnected)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.mutex.Lock()
+			c.cond.Broadcast()
+			c.mutex.Unlock()
+		case <-chConnected:
+		}
+	}()
+
+	for c.state == stateSynSent && c.err == nil && ctx.Err() == nil {
+		c.cond.Wait()
+	}
+	if c.state == stateConnected {
+		return c, nil
+	}
+
+	e = c.err
+	if e == nil {
+		e = ctx.Err()
+		c.fail(e)
+	}
+	return nil, e
+}
+
+// readLoop reads packets and passes them to their connections until the
+// socket is closed.
+func (s *Socket) readLoop() {
+	defer s.procs.Done()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, e := s.pconn.ReadFrom(buf)
+		if e != nil {
+			select {
+			case <-s.chDone:
+				return
+			default:
+				continue
+			}
+		}
+
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok || !isPacket(buf[:n]) {
+			s.other.deliver(buf[:n], addr)
+			continue
+		}
+
+		h, payload, e := decodePacket(buf[:n])
+		if e != nil {
+			log.Printf("utp: bad packet from %v: %v", addr, e)
+			continue
+		}
+		s.handle(h, payload, udpAddr)
+	}
+}
+
+// handle finds the connection a packet is for, accepting new connections
+// and resetting unknown ones.
+func (s *Socket) handle(h *header, payload []byte, addr *net.UDPAddr) {
+	if h.typ == stSyn {
+		s.handleSyn(h, addr)
+		return
+	}
+
+	s.mutex.Lock()
+	c, ok := s.conns[connKey{addr: addr.String(), id: h.connId}]
+	if !ok && h.typ == stReset {
+		// Resets may carry either of the connection's IDs
+		for key, other := range s.conns {
+			if key.addr == addr.String() && other.sendId == h.connId {
+				c, ok = other, true
+				break
+			}
+		}
+	}
+	s.mutex.Unlock()
+
+	if ok {
+		c.handle(h, payload)
+	} else if h.typ != stReset {
+		s.sendReset(h, addr)
+	}
+}
+
+// handleSyn accepts a new connection. The initiator's ID is one less than
+// the ID it expects us to send.
+func (s *Socket) handleSyn(h *header, addr *net.UDPAddr) {
+	key := connKey{addr: addr.String(), id: h.connId + 1}
+
+	s.mutex.Lock()
+	c, ok := s.conns[key]
+	if !ok {
+		c = newConn(s, addr, h.connId+1, h.connId)
+		c.state = stateConnected
+		c.seq = randomUint16()
+		c.ack = h.seq
+
+		select {
+		case s.chAccept <- c:
+			s.conns[key] = c
+		default:
+			s.mutex.Unlock()
+			log.Printf("utp: accept backlog full, resetting %v", addr)
+			s.sendReset(h, addr)
+			return
+		}
+	}
+	s.mutex.Unlock()
+
+	c.handle(h, nil)
+}
+
+func (s *Socket) sendReset(h *header, addr *net.UDPAddr) {
+	rst := header{typ: stReset, connId: h.connId, ts: timestamp(), seq: randomUint16(), ack: h.seq}
+	s.writeTo(rst.encode(nil), addr)
+}
+
+// tickLoop runs the connections' timers, and removes finished connections.
+func (s *Socket) tickLoop() {
+	defer s.procs.Done()
+
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.chDone:
+			return
+		case now := <-ticker.C:
+			s.mutex.Lock()
+			conns := make(map[connKey]*Conn, len(s.conns))
+			for key, c := range s.conns {
+				conns[key] = c
+			}
+			s.mutex.Unlock()
+
+			for key, c := range conns {
+				if !c.tick(now) {
+					s.mutex.Lock()
+					delete(s.conns, key)
+					s.mutex.Unlock()
+				}
+			}
+		}
+	}
+}
+
+func (s *Socket) writeTo(packet []byte, addr net.Addr) {
+	_, e := s.pconn.WriteTo(packet, addr)
+	if e != nil {
+		select {
+		case <-s.chDone:
+		default:
+			log.Printf("utp: failed to send to %v: %v", addr, e)
+		}
+	}
+}
+
+func randomUint16() uint16 {
+	buf := make([]byte, 2)
+	_, e := rand.Read(buf)
+	if e != nil {
+		panic(fmt.Errorf("utp: no randomness: %v", e))
+	}
+	return binary.BigEndian.Uint16(buf)
+}
+
+// ============================================================================
+// OTHER PROTOCOLS ============================================================
+
+// otherConn is the PacketConn for packets that aren't uTP. Closing it
+// doesn't close the socket.
+type otherConn struct {
+	socket   *Socket
+	chPacket chan otherPacket
+	chClosed chan struct{}
+	once     sync.Once
+
+	deadline time.Time
+	chWake   chan struct{} // Signalled when the deadline changes
+	mutex    sync.Mutex    // Guards deadline
+}
+
+type otherPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+func newOtherConn(s *Socket) *otherConn {
+	return &otherConn{
+		socket:   s,
+		chPacket: make(chan otherPacket, otherBacklog),
+		chClosed: make(chan struct{}),
+		chWake:   make(chan struct{}, 1),
+	}
+}
+
+// deliver queues a packet, dropping it if the queue is full.
+func (oc *otherConn) deliver(data []byte, addr net.Addr) {
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	select {
+	case oc.chPacket <- otherPacket{data: buf, addr: addr}:
+	default:
+	}
+}
+
+func (oc *otherConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		oc.mutex.Lock()
+		deadline := oc.deadline
+		oc.mutex.Unlock()
+
+		var chTimeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			chTimeout = timer.C
+		}
+
+		select {
+		case p := <-oc.chPacket:
+			stopTimer(timer)
+			return copy(b, p.data), p.addr, nil
+		case <-oc.chClosed:
+			stopTimer(timer)
+			return 0, nil, net.ErrClosed
+		case <-oc.socket.chDone:
+			stopTimer(timer)
+			return 0, nil, net.ErrClosed
+		case <-chTimeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-oc.chWake:
+			stopTimer(timer)
+		}
+	}
+}
+
+func (oc *otherConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-oc.chClosed:
+		return 0, net.ErrClosed
+	default:
+	}
+	return oc.socket.pconn.WriteTo(b, addr)
+}
+
+func (oc *otherConn) Close() error {
+	oc.once.Do(func() {
+		close(oc.chClosed)
+	})
+	return nil
+}
+
+func (oc *otherConn) LocalAddr() net.Addr {
+	return oc.socket.Addr()
+}
+
+func (oc *otherConn) SetDeadline(t time.Time) error {
+	return oc.SetReadDeadline(t)
+}
+
+func (oc *otherConn) SetReadDeadline(t time.Time) error {
+	oc.mutex.Lock()
+	oc.deadline = t
+	oc.mutex.Unlock()
+
+	select {
+	case oc.chWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SetWriteDeadline does nothing, UDP writes don't block.
+func (oc *otherConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
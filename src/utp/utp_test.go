@@ -0,0 +1,247 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"gotor/utils/test"
+)
+
+// simConn simulates a bad network on the packets written to it: random
+// loss, latency with jitter (which reorders packets), and a bottleneck link
+// with a queue.
+type simConn struct {
+	net.PacketConn
+	netSim
+
+	mutex    sync.Mutex
+	rnd      *rand.Rand
+	free     time.Time     // When the bottleneck is done with its queue
+	maxQueue time.Duration // Longest queuing delay seen
+}
+
+func (sc *simConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	sc.mutex.Lock()
+	if sc.rnd.Float64() < sc.loss {
+		sc.mutex.Unlock()
+		return len(b), nil
+	}
+	delay := sc.latency
+	if sc.jitter > 0 {
+		delay += time.Duration(sc.rnd.Int63n(int64(sc.jitter)))
+	}
+	if sc.rate > 0 {
+		now := time.Now()
+		if sc.free.Before(now) {
+			sc.free = now
+		}
+		sc.free = sc.free.Add(time.Duration(len(b)) * time.Second / time.Duration(sc.rate))
+		queue := sc.free.Sub(now)
+		if queue > sc.maxQueue {
+			sc.maxQueue = queue
+		}
+		delay += queue
+	}
+	sc.mutex.Unlock()
+
+	buf := make([]byte, len(b))
+	copy(buf, b)
+	time.AfterFunc(delay, func() {
+		_, _ = sc.PacketConn.WriteTo(buf, addr)
+	})
+	return len(b), nil
+}
+
+// netSim is how bad the simulated network is.
+type netSim struct {
+	loss    float64       // Fraction of packets dropped
+	latency time.Duration // Fixed one way delay
+	jitter  time.Duration // Random extra delay, up to this much
+	rate    int           // Bottleneck bytes/sec, 0 for none
+}
+
+// newSimSocket makes a socket on loopback whose outgoing packets go
+// through a simConn.
+func newSimSocket(t *testing.T, sim netSim) (*Socket, *simConn) {
+	pconn, e := net.ListenPacket("udp4", "127.0.0.1:0")
+	test.CheckFatal(t, e)
+	sc := &simConn{
+		PacketConn: pconn,
+		netSim:     sim,
+		rnd:        rand.New(rand.NewSource(1)),
+	}
+	s := NewSocket(sc)
+	t.Cleanup(func() { s.Close() })
+	return s, sc
+}
+
+// connect dials from one socket to the other and returns both ends.
+func connect(t *testing.T, from *Socket, to *Socket) (net.Conn, net.Conn) {
+	chConn := make(chan net.Conn, 1)
+	go func() {
+		c, _ := to.Accept()
+		chConn <- c
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	a, e := from.DialContext(ctx, to.Addr().String())
+	test.CheckFatal(t, e)
+	return a, <-chConn
+}
+
+// transfer sends data from a to b and checks it arrives intact.
+func transfer(t *testing.T, a net.Conn, b net.Conn, data []byte) {
+	t.Helper()
+	chErr := make(chan error, 1)
+	go func() {
+		_, e := a.Write(data)
+		chErr <- e
+	}()
+
+	b.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got := make([]byte, len(data))
+	_, e := io.ReadFull(b, got)
+	test.CheckFatal(t, e)
+	test.CheckFatal(t, <-chErr)
+	if !bytes.Equal(got, data) {
+		t.Fatal("data corrupted in transfer")
+	}
+}
+
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(2)).Read(data)
+	return data
+}
+
+func TestConn_Transfer(t *testing.T) {
+	tests := []struct {
+		name string
+		sim  netSim
+	}{
+		{name: "Clean"},
+		{name: "Loss", sim: netSim{loss: 0.05}},
+		{name: "Latency", sim: netSim{latency: 20 * time.Millisecond}},
+		{name: "Reordering", sim: netSim{latency: 5 * time.Millisecond, jitter: 10 * time.Millisecond}},
+		{name: "Loss and latency", sim: netSim{loss: 0.05, latency: 10 * time.Millisecond, jitter: 5 * time.Millisecond}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sa, _ := newSimSocket(t, tt.sim)
+			sb, _ := newSimSocket(t, tt.sim)
+			a, b := connect(t, sa, sb)
+
+			data := randomData(200000)
+			transfer(t, a, b, data)
+			transfer(t, b, a, data[:5000])
+
+			// Closing sends a FIN after the data
+			a.Write([]byte("bye"))
+			a.Close()
+			got, e := io.ReadAll(b)
+			test.CheckFatal(t, e)
+			if string(got) != "bye" {
+				t.Errorf("expected bye then EOF, got %q", got)
+			}
+			b.Close()
+		})
+	}
+}
+
+// TestConn_Congestion pushes data through a slow bottleneck link. LEDBAT
+// should notice the queue growing and back off around targetDelay, while a
+// sender that only reacts to loss would fill the whole window.
+func TestConn_Congestion(t *testing.T) {
+	if testing.Short() {
+		t.Skip("slow")
+	}
+	sa, sim := newSimSocket(t, netSim{latency: 5 * time.Millisecond, rate: 256 * 1024})
+	sb, _ := newSimSocket(t, netSim{latency: 5 * time.Millisecond})
+	a, b := connect(t, sa, sb)
+	defer a.Close()
+	defer b.Close()
+
+	transfer(t, a, b, randomData(512*1024))
+
+	sim.mutex.Lock()
+	maxQueue := sim.maxQueue
+	sim.mutex.Unlock()
+	if maxQueue < 20*time.Millisecond {
+		t.Errorf("the link was never saturated, queue peaked at %v", maxQueue)
+	}
+	if maxQueue > 3*targetDelay {
+		t.Errorf("queuing delay peaked at %v, far over the %v target", maxQueue, targetDelay)
+	}
+}
+
+func TestSocket_DialTimeout(t *testing.T) {
+	s, _ := newSimSocket(t, netSim{})
+
+	// Nobody answers on a plain UDP socket
+	silent, e := net.ListenPacket("udp4", "127.0.0.1:0")
+	test.CheckFatal(t, e)
+	defer silent.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, e = s.DialContext(ctx, silent.LocalAddr().String())
+	if e == nil {
+		t.Fatal("expected dial to time out")
+	}
+}
+
+func TestSocket_Reset(t *testing.T) {
+	sa, _ := newSimSocket(t, netSim{})
+	sb, _ := newSimSocket(t, netSim{})
+	a, b := connect(t, sa, sb)
+
+	// sb forgets the connection, so the next packet from a gets a reset
+	sb.mutex.Lock()
+	sb.conns = make(map[connKey]*Conn)
+	sb.mutex.Unlock()
+
+	a.Write([]byte("anyone there?"))
+	a.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, e := a.Read(make([]byte, 1))
+	if _, ok := e.(*Error); !ok {
+		t.Fatalf("expected reset, got %v", e)
+	}
+	b.Close()
+}
+
+func TestSocket_PacketConn(t *testing.T) {
+	s, _ := newSimSocket(t, netSim{})
+	other, e := net.ListenPacket("udp4", "127.0.0.1:0")
+	test.CheckFatal(t, e)
+	defer other.Close()
+
+	// A DHT message isn't uTP, and goes to PacketConn
+	msg := []byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe")
+	_, e = other.WriteTo(msg, s.Addr())
+	test.CheckFatal(t, e)
+
+	pc := s.PacketConn()
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, from, e := pc.ReadFrom(buf)
+	test.CheckFatal(t, e)
+	if !bytes.Equal(buf[:n], msg) || from.String() != other.LocalAddr().String() {
+		t.Fatalf("got %q from %v", buf[:n], from)
+	}
+
+	_, e = pc.WriteTo([]byte("reply"), from)
+	test.CheckFatal(t, e)
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, e = other.ReadFrom(buf)
+	test.CheckFatal(t, e)
+	if string(buf[:n]) != "reply" {
+		t.Fatalf("expected reply, got %q", buf[:n])
+	}
+}